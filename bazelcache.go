@@ -0,0 +1,184 @@
+package blobstore
+
+import (
+	"crypto"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	bazelCAS = "cas"
+	bazelAC  = "ac"
+)
+
+// errTooLarge fails uploads over the size limit
+var errTooLarge = errors.New("Upload is over the size limit")
+
+// BazelCacheOptions configure a BazelCache
+type BazelCacheOptions struct {
+	// MaxSize is the largest CAS blob or action cache entry accepted, unlimited if 0
+	MaxSize int64
+}
+
+// BazelCache is a http.Handler speaking the Bazel HTTP remote cache protocol:
+//
+//	GET|HEAD|PUT /cas/{sha256}   the content addressed blobs, PUT blobs are verified against their key
+//	GET|HEAD|PUT /ac/{sha256}    the action cache entries, mutable, keyed by the action digest
+//
+// Paths may have a leading instance name, like /instance/cas/{sha256}, which is ignored
+type BazelCache struct {
+	cas     *VFSBlobServer
+	ac      VirtualFS
+	options BazelCacheOptions
+}
+
+// NewBazelCache returns a BazelCache with the CAS on cas, which must be a SHA-256 store, and the action
+// cache on ac, which must not be shared with cas, as its entries are not content addressed
+func NewBazelCache(cas *VFSBlobServer, ac VirtualFS, options BazelCacheOptions) (*BazelCache, error) {
+	if cas.hash != crypto.SHA256 {
+		return nil, fmt.Errorf("The Bazel CAS must be a SHA-256 store")
+	}
+	return &BazelCache{cas, ac, options}, nil
+}
+
+// NewFileBazelCache returns a BazelCache on files, with the CAS and action cache under dir/cas & dir/ac
+func NewFileBazelCache(dir string, options BazelCacheOptions) (*BazelCache, error) {
+	for _, namespace := range []string{bazelCAS, bazelAC} {
+		if err := os.MkdirAll(filepath.Join(dir, namespace), defaultPerms); err != nil {
+			return nil, err
+		}
+	}
+	return NewBazelCache(NewFileBlobServer(filepath.Join(dir, bazelCAS), crypto.SHA256),
+		fileBlobs{filepath.Join(dir, bazelAC)}, options)
+}
+
+// ServeHTTP routes the request by namespace and method
+func (bc *BazelCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+	namespace, hexKey := parts[len(parts)-2], parts[len(parts)-1]
+	key, err := hex.DecodeString(hexKey)
+	if (namespace != bazelCAS && namespace != bazelAC) || err != nil || len(key) != crypto.SHA256.Size() ||
+		Key(key).String() != hexKey {
+		http.NotFound(w, r)
+		return
+	}
+	vfs := bc.ac
+	if namespace == bazelCAS {
+		vfs = bc.cas
+	}
+	keyname := vfs.Keyname(key)
+	switch r.Method {
+	case "GET":
+		bc.get(w, vfs, keyname, Key(key), namespace == bazelCAS)
+	case "HEAD":
+		if !vfs.Exists(keyname) {
+			http.NotFound(w, r)
+		}
+	case "PUT":
+		if bc.options.MaxSize > 0 && r.ContentLength > bc.options.MaxSize {
+			http.Error(w, errTooLarge.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		body := io.Reader(r.Body)
+		if bc.options.MaxSize > 0 {
+			body = &limitedReader{body, bc.options.MaxSize}
+		}
+		if namespace == bazelCAS {
+			err = bc.putCAS(body, Key(key))
+		} else {
+			err = bc.putAC(body, keyname)
+		}
+		switch {
+		case errors.Is(err, errTooLarge):
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		case err != nil && strings.HasPrefix(err.Error(), corruptedBlobErrorPrefix):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case err != nil:
+			httpError(w, err)
+		}
+	default:
+		methodNotAllowed(w, "GET, HEAD, PUT")
+	}
+}
+
+// get streams a CAS blob, verified as it is read, or an action cache entry
+func (bc *BazelCache) get(w http.ResponseWriter, vfs VirtualFS, keyname string, key Key, verify bool) {
+	var reader io.Reader
+	file, err := vfs.Open(keyname)
+	if err == nil {
+		defer file.Close()
+		reader = file
+		if verify {
+			reader = &checkedReader{file, key, bc.cas.hash.New()}
+		}
+	} else if !vfs.Exists(keyname) {
+		err = fmt.Errorf("Key not found: %s", keyname)
+	}
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := io.Copy(w, reader); err != nil {
+		// too late for an error status, make sure the client does not take a truncated or corrupted blob
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// putCAS stores a CAS blob only if it matches its key
+func (bc *BazelCache) putCAS(body io.Reader, expectedKey Key) error {
+	tmpKeyname, key, err := bc.cas.spool(body)
+	if err != nil {
+		return err
+	}
+	if !key.Equals(expectedKey) {
+		bc.cas.Delete(tmpKeyname)
+		return fmt.Errorf("%s uploaded blob hash is %v, not %v", corruptedBlobErrorPrefix, key, expectedKey)
+	}
+	return bc.cas.commit(tmpKeyname, key)
+}
+
+// putAC replaces an action cache entry, written aside first so that readers never see a partial entry
+func (bc *BazelCache) putAC(body io.Reader, keyname string) error {
+	tmpKeyname := bc.ac.TmpKeyname(crypto.SHA256.Size())
+	file, err := bc.ac.Create(tmpKeyname)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = bc.ac.Rename(tmpKeyname, keyname)
+	}
+	if err != nil {
+		bc.ac.Delete(tmpKeyname)
+	}
+	return err
+}
+
+// limitedReader fails with errTooLarge once more than n bytes are read
+type limitedReader struct {
+	io.Reader
+	n int64
+}
+
+// Read up to the limit
+func (r *limitedReader) Read(buf []byte) (int, error) {
+	n, err := r.Reader.Read(buf)
+	if r.n -= int64(n); r.n < 0 {
+		return n, errTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,66 @@
+package blobstore
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestBazelCache checks the CAS and action cache halves of the Bazel HTTP remote cache protocol
+func TestBazelCache(t *testing.T) {
+	// setup
+	dir := fileBlobs{""}.TmpKeyname(10)
+	cache, err := NewFileBazelCache(dir, BazelCacheOptions{MaxSize: 64})
+	assert(err == nil, t, "Error creating the Bazel cache: %v", err)
+	server := httptest.NewServer(cache)
+	defer server.Close()
+	blob := "some build output"
+	casURL := fmt.Sprintf("%s/cas/%x", server.URL, sha256.Sum256([]byte(blob)))
+	acURL := fmt.Sprintf("%s/instance/ac/%x", server.URL, sha256.Sum256([]byte("some action")))
+	// exercise
+	for _, check := range []struct {
+		method, url, body string
+		status            int
+		response          string
+	}{
+		{"GET", casURL, "", http.StatusNotFound, ""},
+		{"HEAD", casURL, "", http.StatusNotFound, ""},
+		{"PUT", casURL, "not the blob", http.StatusBadRequest, ""},
+		{"HEAD", casURL, "", http.StatusNotFound, ""},
+		{"PUT", casURL, blob, http.StatusOK, ""},
+		{"HEAD", casURL, "", http.StatusOK, ""},
+		{"GET", casURL, "", http.StatusOK, blob},
+		{"PUT", casURL, strings.Repeat("x", 65), http.StatusRequestEntityTooLarge, ""},
+		{"GET", acURL, "", http.StatusNotFound, ""},
+		{"PUT", acURL, "first result", http.StatusOK, ""},
+		{"GET", acURL, "", http.StatusOK, "first result"},
+		{"PUT", acURL, "second result", http.StatusOK, ""},
+		{"GET", acURL, "", http.StatusOK, "second result"},
+		{"GET", server.URL + "/cas/abc", "", http.StatusNotFound, ""},
+		{"DELETE", casURL, "", http.StatusMethodNotAllowed, ""},
+	} {
+		response, body := httpDo(t, check.method, check.url, check.body, nil)
+		assert(response.StatusCode == check.status, t, "Expected %s %s to answer %d but got %s",
+			check.method, check.url, check.status, response.Status)
+		if check.response != "" {
+			assert(body == check.response, t, "Expected %s %s to return '%s' but got '%s'",
+				check.method, check.url, check.response, body)
+		}
+	}
+	count := 0
+	for keyOrErr := range cache.cas.List() {
+		assert(keyOrErr.err == nil, t, "Error in List stream: %v", keyOrErr.err)
+		count++
+	}
+	assert(count == 1, t, "Expected just the valid blob in the CAS but got %d", count)
+	_, err = NewBazelCache(NewMemBlobServer(crypto.SHA1), newMemBlobs(), BazelCacheOptions{})
+	assert(err != nil, t, "Expected a SHA-1 CAS to be rejected")
+	// cleanup
+	err = os.RemoveAll(dir)
+	assert(err == nil, t, "Error in cleanup removing %s: %v", dir, err)
+}
@@ -190,12 +190,31 @@ func listChecks(t *testing.T, expectedKeys map[string]bool, blobs BlobStore) {
 	}
 	blobKeys := blobs.List()
 	assert(blobKeys != nil, t, "Error calling List: nil blobKeys returned")
-	i := 0
+	listed := []string{}
 	for blobKey := range blobKeys {
 		assert(blobKey.err == nil, t, "Error in List stream: %s", blobKey.err)
 		key := strings.ToLower(blobKey.key.String())
 		assert(expectedKeys[key], t, "Unexpected key: %s", key)
-		i++
+		listed = append(listed, key)
+	}
+	// stores able to, list the keys after a given one and know the blob sizes
+	if pager, ok := blobs.(BlobPager); ok && len(listed) > 0 {
+		sort.Strings(listed)
+		after := listed[0]
+		count := 0
+		for keyOrErr := range pager.ListAfter(toKeyOrDie(t, after)) {
+			assert(keyOrErr.err == nil, t, "Error in ListAfter stream: %s", keyOrErr.err)
+			assert(keyOrErr.key.String() > after, t, "Unexpected key %s listed after %s", keyOrErr.key, after)
+			count++
+		}
+		assert(count == len(listed)-1, t, "Expected %d keys after %s but got %d", len(listed)-1, after, count)
+	}
+	if sizer, ok := blobs.(BlobSizer); ok {
+		for _, testCase := range testData {
+			size, err := sizer.Size(toKeyOrDie(t, testCase.expectedHash))
+			assert(err == nil && size == int64(len(testCase.input)), t, "Expected %s size %d but got %d: %v",
+				testCase.expectedHash, len(testCase.input), size, err)
+		}
 	}
 }
 
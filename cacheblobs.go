@@ -0,0 +1,199 @@
+package blobstore
+
+import (
+	"container/list"
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrBlobTooLarge is returned, wrapped, when writing a blob bigger than a cache admits
+var ErrBlobTooLarge = errors.New("Blob too large for the cache")
+
+// CacheStats holds the usage statistics of a cache
+type CacheStats struct {
+	Hits, Misses, Evictions, Rejections uint64
+	Blobs                               int
+	Size, Capacity                      int64
+}
+
+// CacheBlobServer is a VFSBlobServer on a size bounded memory cache with LRU eviction
+//
+// Content Addressed Blobs never need invalidation, blobs are only dropped to make room for new ones
+type CacheBlobServer struct {
+	*VFSBlobServer
+	cache *cacheBlobs
+}
+
+// NewCacheBlobServer returns a CacheBlobServer holding up to capacity bytes,
+// blobs bigger than maxBlobSize are not admitted in the cache (0 means capacity), their writes fail with ErrBlobTooLarge
+func NewCacheBlobServer(hash crypto.Hash, capacity, maxBlobSize int64) *CacheBlobServer {
+	if maxBlobSize <= 0 || maxBlobSize > capacity {
+		maxBlobSize = capacity
+	}
+	cache := &cacheBlobs{
+		memBlobs:    newMemBlobs(),
+		lru:         list.New(),
+		entries:     make(map[string]*list.Element),
+		spooled:     make(map[string]int64),
+		capacity:    capacity,
+		maxBlobSize: maxBlobSize,
+	}
+	return &CacheBlobServer{&VFSBlobServer{cache, hash}, cache}
+}
+
+// Stats returns a snapshot of the cache statistics
+func (cbs *CacheBlobServer) Stats() CacheStats {
+	return cbs.cache.stats()
+}
+
+// cacheBlobs is a memBlobs VirtualFS tracking the blob sizes in LRU order.
+// Blobs being written count towards the cache size too
+type cacheBlobs struct {
+	*memBlobs
+	lock        sync.Mutex
+	lru         *list.List // of *cacheEntry, most recently used at the front
+	entries     map[string]*list.Element
+	spooled     map[string]int64 // sizes of the blobs being written
+	size        int64
+	capacity    int64
+	maxBlobSize int64
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+	rejections  uint64
+}
+
+// cacheEntry is a cached blob keyname and its size
+type cacheEntry struct {
+	keyname string
+	size    int64
+}
+
+// Open a cached blob for reading, marking it as recently used
+func (cache *cacheBlobs) Open(keyname string) (io.ReadCloser, error) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	element, ok := cache.entries[keyname]
+	if !ok {
+		cache.misses++
+		return nil, fmt.Errorf("Key not found: %s", keyname)
+	}
+	cache.hits++
+	cache.lru.MoveToFront(element)
+	return cache.memBlobs.Open(keyname)
+}
+
+// Create a key to set its contents, the writer fails with ErrBlobTooLarge as soon as they go over maxBlobSize
+func (cache *cacheBlobs) Create(keyname string) (io.WriteCloser, error) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	writer, err := cache.memBlobs.Create(keyname)
+	if err != nil {
+		return nil, err
+	}
+	cache.unspool(keyname)
+	cache.spooled[keyname] = 0
+	return &cacheWriter{writer, cache, keyname}, nil
+}
+
+// Delete a key & contents from the cache
+func (cache *cacheBlobs) Delete(keyname string) error {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.drop(keyname)
+	cache.unspool(keyname)
+	return cache.memBlobs.Delete(keyname)
+}
+
+// Does the given key exists in the cache
+func (cache *cacheBlobs) Exists(keyname string) bool {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return cache.memBlobs.Exists(keyname)
+}
+
+// Rename admits a finished blob into the cache, evicting the least recently used blobs to make room for it
+func (cache *cacheBlobs) Rename(oldkey, newkey string) error {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	size, ok := cache.spooled[oldkey]
+	if !ok {
+		return fmt.Errorf("Key not found: %s", oldkey)
+	}
+	delete(cache.spooled, oldkey) // its size is now the entry's
+	cache.drop(newkey)
+	cache.evict()
+	cache.entries[newkey] = cache.lru.PushFront(&cacheEntry{newkey, size})
+	return cache.memBlobs.Rename(oldkey, newkey)
+}
+
+// cacheWriter writes a blob into the cache, accounting for its size as it grows
+type cacheWriter struct {
+	io.WriteCloser
+	cache   *cacheBlobs
+	keyname string
+}
+
+// Write appends to the blob, evicting the least recently used blobs to make room, or fails if it gets too large
+func (w *cacheWriter) Write(buf []byte) (int, error) {
+	cache := w.cache
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	size, ok := cache.spooled[w.keyname]
+	if !ok {
+		return 0, fmt.Errorf("Key not found: %s", w.keyname)
+	}
+	if size+int64(len(buf)) > cache.maxBlobSize {
+		cache.rejections++
+		return 0, fmt.Errorf("%w: over %d bytes", ErrBlobTooLarge, cache.maxBlobSize)
+	}
+	cache.spooled[w.keyname] += int64(len(buf))
+	cache.size += int64(len(buf))
+	cache.evict()
+	return w.WriteCloser.Write(buf)
+}
+
+// stats returns a snapshot of the cache statistics
+func (cache *cacheBlobs) stats() CacheStats {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return CacheStats{
+		Hits:       cache.hits,
+		Misses:     cache.misses,
+		Evictions:  cache.evictions,
+		Rejections: cache.rejections,
+		Blobs:      len(cache.entries),
+		Size:       cache.size,
+		Capacity:   cache.capacity,
+	}
+}
+
+// evict drops the least recently used blobs till the cache is within capacity, or holds just blobs being written
+func (cache *cacheBlobs) evict() {
+	for cache.size > cache.capacity && cache.lru.Len() > 0 {
+		oldest := cache.lru.Back().Value.(*cacheEntry)
+		cache.drop(oldest.keyname)
+		cache.memBlobs.Delete(oldest.keyname)
+		cache.evictions++
+	}
+}
+
+// unspool forgets the size of keyname being written, if it was
+func (cache *cacheBlobs) unspool(keyname string) {
+	if size, ok := cache.spooled[keyname]; ok {
+		cache.size -= size
+		delete(cache.spooled, keyname)
+	}
+}
+
+// drop forgets the LRU entry of keyname, if any
+func (cache *cacheBlobs) drop(keyname string) {
+	if element, ok := cache.entries[keyname]; ok {
+		cache.size -= element.Value.(*cacheEntry).size
+		cache.lru.Remove(element)
+		delete(cache.entries, keyname)
+	}
+}
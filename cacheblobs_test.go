@@ -0,0 +1,74 @@
+package blobstore
+
+import (
+	"crypto"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestCacheReadsNWrites test that the cache blobserver does its reads and writes as expected
+func TestCacheReadsNWrites(t *testing.T) {
+	readsNWrites(t, NewCacheBlobServer(crypto.SHA1, 1024, 0))
+}
+
+// TestCacheEviction checks blobs are evicted in LRU order and big blobs are not admitted
+func TestCacheEviction(t *testing.T) {
+	// setup
+	cache := NewCacheBlobServer(crypto.SHA1, 10, 6)
+	// exercise
+	first, err := cache.Write(strings.NewReader("12345"))
+	assert(err == nil, t, "Error writing blob: %v", err)
+	second, err := cache.Write(strings.NewReader("abcde"))
+	assert(err == nil, t, "Error writing blob: %v", err)
+	_, err = cache.Read(first) // first is now the most recently used
+	assert(err == nil, t, "Error reading %v: %v", first, err)
+	third, err := cache.Write(strings.NewReader("ABCDE"))
+	assert(err == nil, t, "Error writing blob: %v", err)
+	_, err = cache.Write(strings.NewReader("too big!"))
+	assert(errors.Is(err, ErrBlobTooLarge), t, "Expected a too large blob error but got %v", err)
+	// check
+	_, err = cache.Read(second)
+	assert(err != nil, t, "Expected %v to be evicted", second)
+	for _, key := range []Key{first, third} {
+		_, err = cache.Read(key)
+		assert(err == nil, t, "Expected %v to be cached, but: %v", key, err)
+	}
+	stats := cache.Stats()
+	expected := CacheStats{Hits: 3, Misses: 1, Evictions: 1, Rejections: 1, Blobs: 2, Size: 10, Capacity: 10}
+	assert(stats == expected, t, "Expected stats %+v but got %+v", expected, stats)
+}
+
+// TestCacheSpooling checks writes fail as soon as they are too large and blobs being written count as cache size
+func TestCacheSpooling(t *testing.T) {
+	// setup
+	cache := NewCacheBlobServer(crypto.SHA1, 10, 0)
+	_, err := cache.Write(strings.NewReader("12345"))
+	assert(err == nil, t, "Error writing blob: %v", err)
+	// exercise an endless blob
+	_, err = cache.Write(endlessReader{})
+	assert(errors.Is(err, ErrBlobTooLarge), t, "Expected a too large blob error but got %v", err)
+	// exercise a blob being written
+	tmpKeyname := cache.TmpKeyname(10)
+	writer, err := cache.Create(tmpKeyname)
+	assert(err == nil, t, "Error creating %s: %v", tmpKeyname, err)
+	_, err = writer.Write([]byte("abcd"))
+	assert(err == nil && cache.Stats().Size == 9, t, "Expected 9 bytes cached but got %d: %v", cache.Stats().Size, err)
+	_, err = writer.Write([]byte("ef"))
+	// check
+	stats := cache.Stats()
+	assert(err == nil && stats.Size == 6 && stats.Evictions == 1, t,
+		"Expected the blob evicted for the one being written but got %+v: %v", stats, err)
+	err = cache.Delete(tmpKeyname)
+	assert(err == nil && cache.Stats().Size == 0, t, "Expected an empty cache but got %d: %v", cache.Stats().Size, err)
+}
+
+// endlessReader reads zeros forever
+type endlessReader struct{}
+
+func (endlessReader) Read(buf []byte) (int, error) {
+	for i := range buf {
+		buf[i] = 0
+	}
+	return len(buf), nil
+}
@@ -0,0 +1,292 @@
+package blobstore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	carV2HeaderSize = 40 // characteristics, data offset, data size & index offset
+	cborUint        = 0
+	cborBytes       = 2
+	cborText        = 3
+	cborArray       = 4
+	cborMap         = 5
+	cborTag         = 6
+	cborCIDTag      = 42
+)
+
+// carV2Pragma is the fixed CARv1 style header, {"version":2}, CARv2 files start with
+var carV2Pragma = []byte{0x0a, 0xa1, 0x67, 'v', 'e', 'r', 's', 'i', 'o', 'n', 0x02}
+
+// ExportCAR writes the blobs with the given keys, or all blobs if keys is nil, to w as a CAR file of
+// the given version, 1 or 2. Each blob is a raw block and a root, so keys must be SHA-256.
+// CARv2 files are written without an index, the CARv1 payload is spooled to a temporary file to learn its size
+func ExportCAR(w io.Writer, blobs BlobStore, keys []Key, version int) error {
+	if version != 1 && version != 2 {
+		return fmt.Errorf("Unsupported CAR version %d", version)
+	}
+	if keys == nil {
+		for keyOrErr := range blobs.List() {
+			if keyOrErr.err != nil {
+				return keyOrErr.err
+			}
+			keys = append(keys, keyOrErr.key)
+		}
+	}
+	for _, key := range keys {
+		if len(key) != sha256.Size {
+			return fmt.Errorf("Only SHA-256 keys can be exported as CIDs, but got %v", key)
+		}
+	}
+	if version == 1 {
+		return writeCARv1(w, blobs, keys)
+	}
+	spool, err := ioutil.TempFile("", "car")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	if err := writeCARv1(spool, blobs, keys); err != nil {
+		return err
+	}
+	size, err := spool.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return err
+	}
+	header := make([]byte, carV2HeaderSize)
+	binary.LittleEndian.PutUint64(header[16:], uint64(len(carV2Pragma)+carV2HeaderSize))
+	binary.LittleEndian.PutUint64(header[24:], uint64(size))
+	if _, err := w.Write(append(append([]byte{}, carV2Pragma...), header...)); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, spool)
+	return err
+}
+
+// writeCARv1 writes the header with keys as roots and then a block per key, streaming the blobs
+func writeCARv1(w io.Writer, blobs BlobStore, keys []Key) error {
+	writer := bufio.NewWriter(w)
+	header := cborHead(nil, cborMap, 2)
+	header = cborHead(append(cborHead(header, cborText, 5), "roots"...), cborArray, uint64(len(keys)))
+	for _, key := range keys {
+		cid := append([]byte{0}, key.cidBytes()...) // dag-cbor CIDs have a leading identity multibase byte
+		header = append(cborHead(cborHead(header, cborTag, cborCIDTag), cborBytes, uint64(len(cid))), cid...)
+	}
+	header = cborHead(append(cborHead(header, cborText, 7), "version"...), cborUint, 1)
+	if _, err := writer.Write(append(appendUvarints(nil, uint64(len(header))), header...)); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		size, err := blobSize(blobs, key)
+		if err != nil {
+			return err
+		}
+		blob, err := blobs.Read(key)
+		if err != nil {
+			return err
+		}
+		cid := key.cidBytes()
+		if _, err := writer.Write(append(appendUvarints(nil, uint64(len(cid))+uint64(size)), cid...)); err != nil {
+			return err
+		}
+		// copied to the end, so the blob is verified, and it must be as long as announced
+		copied, err := io.Copy(writer, blob)
+		if err == nil && copied != size {
+			err = fmt.Errorf("Blob %v changed size from %d to %d bytes while exported", key, size, copied)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// ImportCAR reads a CARv1 or CARv2 file, verifying each block against its CID and writing it to blobs,
+// which must be a SHA-256 store. Blocks of any codec are accepted as long as their multihash is sha2-256.
+// It returns the keys imported, in file order
+func ImportCAR(r io.Reader, blobs BlobStore) ([]Key, error) {
+	reader := bufio.NewReader(r)
+	version, err := readCARHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	if version == 2 {
+		header := make([]byte, carV2HeaderSize)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return nil, fmt.Errorf("Truncated CARv2 header: %v", err)
+		}
+		dataOffset := int64(binary.LittleEndian.Uint64(header[16:]))
+		dataSize := int64(binary.LittleEndian.Uint64(header[24:]))
+		if dataOffset < int64(len(carV2Pragma)+carV2HeaderSize) || dataSize < 0 {
+			return nil, fmt.Errorf("Corrupted CARv2 header, data offset %d and size %d", dataOffset, dataSize)
+		}
+		if _, err := io.CopyN(ioutil.Discard, reader, dataOffset-int64(len(carV2Pragma)+carV2HeaderSize)); err != nil {
+			return nil, fmt.Errorf("Truncated CARv2 file: %v", err)
+		}
+		reader = bufio.NewReader(io.LimitReader(reader, dataSize))
+		if version, err = readCARHeader(reader); err == nil && version != 1 {
+			err = fmt.Errorf("Expected a CARv1 payload in the CARv2 file but got version %d", version)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	keys := []Key{}
+	for {
+		size, err := binary.ReadUvarint(reader)
+		if err == io.EOF {
+			return keys, nil
+		}
+		if err != nil {
+			return keys, fmt.Errorf("Truncated CAR block: %v", err)
+		}
+		block, err := ioutil.ReadAll(io.LimitReader(reader, int64(size)))
+		if err == nil && uint64(len(block)) != size {
+			err = fmt.Errorf("Truncated CAR block, expected %d bytes but got %d", size, len(block))
+		}
+		if err != nil {
+			return keys, err
+		}
+		key, err := importCARBlock(block, blobs)
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, key)
+	}
+}
+
+// importCARBlock verifies and writes a CID prefixed block
+func importCARBlock(block []byte, blobs BlobStore) (Key, error) {
+	blockReader := bytes.NewReader(block)
+	expectedKey, _, err := readCID(blockReader)
+	if err != nil {
+		return nil, err
+	}
+	data := block[len(block)-blockReader.Len():]
+	if digest := sha256.Sum256(data); !expectedKey.Equals(digest[:]) {
+		return nil, fmt.Errorf("%s CAR block %s hashes to %x", corruptedBlobErrorPrefix, expectedKey.CID(), digest)
+	}
+	key, err := blobs.Write(bytes.NewReader(data))
+	if err == nil && !key.Equals(expectedKey) {
+		err = fmt.Errorf("The blob store is not SHA-256, it stored %s as %v", expectedKey.CID(), key)
+	}
+	return key, err
+}
+
+// readCARHeader reads the length prefixed dag-cbor header of a CAR file and returns its version
+func readCARHeader(reader *bufio.Reader) (uint64, error) {
+	size, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return 0, fmt.Errorf("Truncated CAR header: %v", err)
+	}
+	header, err := ioutil.ReadAll(io.LimitReader(reader, int64(size)))
+	if err == nil && uint64(len(header)) != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Truncated CAR header: %v", err)
+	}
+	value, err := readCBOR(bytes.NewReader(header))
+	fields, ok := value.(map[string]interface{})
+	if err != nil || !ok {
+		return 0, fmt.Errorf("Wrong CAR header: %v", err)
+	}
+	version, ok := fields["version"].(uint64)
+	if !ok || (version != 1 && version != 2) {
+		return 0, fmt.Errorf("Unsupported CAR version %v", fields["version"])
+	}
+	return version, nil
+}
+
+// cborHead appends a CBOR item head of the given major type and argument
+func cborHead(buf []byte, major byte, argument uint64) []byte {
+	switch {
+	case argument < 24:
+		return append(buf, major<<5|byte(argument))
+	case argument <= 0xff:
+		return append(buf, major<<5|24, byte(argument))
+	case argument <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(buf, major<<5|25), uint16(argument))
+	case argument <= 0xffffffff:
+		return binary.BigEndian.AppendUint32(append(buf, major<<5|26), uint32(argument))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, major<<5|27), argument)
+}
+
+// readCBOR decodes the CBOR subset found in CAR headers: unsigned integers, byte & text strings,
+// arrays, maps with text keys and tags, the latter returned as their content
+func readCBOR(reader *bytes.Reader) (interface{}, error) {
+	initial, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	major, argument := initial>>5, uint64(initial&0x1f)
+	if argument >= 24 && argument <= 27 {
+		size := 1 << (argument - 24)
+		if reader.Len() < size {
+			return nil, io.ErrUnexpectedEOF
+		}
+		argument = 0
+		for i := 0; i < size; i++ {
+			b, _ := reader.ReadByte()
+			argument = argument<<8 | uint64(b)
+		}
+	} else if argument > 27 {
+		return nil, fmt.Errorf("Unsupported CBOR item 0x%x", initial)
+	}
+	switch major {
+	case cborUint:
+		return argument, nil
+	case cborBytes, cborText:
+		if uint64(reader.Len()) < argument {
+			return nil, io.ErrUnexpectedEOF
+		}
+		data := make([]byte, argument)
+		reader.Read(data)
+		if major == cborText {
+			return string(data), nil
+		}
+		return data, nil
+	case cborArray:
+		if uint64(reader.Len()) < argument {
+			return nil, io.ErrUnexpectedEOF
+		}
+		items := make([]interface{}, argument)
+		for i := range items {
+			if items[i], err = readCBOR(reader); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	case cborMap:
+		fields := make(map[string]interface{})
+		for i := uint64(0); i < argument; i++ {
+			name, err := readCBOR(reader)
+			if err != nil {
+				return nil, err
+			}
+			text, ok := name.(string)
+			if !ok {
+				return nil, fmt.Errorf("Unsupported CBOR map key %v", name)
+			}
+			if fields[text], err = readCBOR(reader); err != nil {
+				return nil, err
+			}
+		}
+		return fields, nil
+	case cborTag:
+		return readCBOR(reader)
+	}
+	return nil, fmt.Errorf("Unsupported CBOR item 0x%x", initial)
+}
@@ -0,0 +1,110 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestCID checks keys render and parse as CIDv1 raw sha2-256
+func TestCID(t *testing.T) {
+	blobs := NewMemBlobServer(crypto.SHA256)
+	key, err := blobs.Write(strings.NewReader("hello world"))
+	assert(err == nil, t, "Error writing blob: %v", err)
+	expectedCID := "bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e"
+	assert(key.CID() == expectedCID, t, "Expected CID %s but got %s", expectedCID, key.CID())
+	parsed, err := ParseCID(expectedCID)
+	assert(err == nil && parsed.Equals(key), t, "Expected %v parsed but got %v: %v", key, parsed, err)
+	for _, wrong := range []string{"", "QmWATWQ7fVPP2EFGu71UkfnqhYXDYH566qy47CnJDgvs8u", expectedCID[:20], expectedCID + "aa",
+		"bafybeifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e"} {
+		_, err := ParseCID(wrong)
+		assert(err != nil, t, "Expected CID %q to be rejected", wrong)
+	}
+	assert(toKeyOrDie(t, "f648cdc2a3a4d39e25bbb9b2c9e8b5c8c02b9d36").CID() == "", t, "Expected no CID for a SHA-1 key")
+}
+
+// TestCAR checks blobs exported to CARv1 & CARv2 files import back verified
+func TestCAR(t *testing.T) {
+	// setup
+	blobs := writeBlobs(t, NewMemBlobAdmin(crypto.SHA256), 5)
+	keys := []Key{}
+	for keyOrErr := range blobs.List() {
+		assert(keyOrErr.err == nil, t, "Error in List stream: %v", keyOrErr.err)
+		keys = append(keys, keyOrErr.key)
+	}
+	// exercise
+	for _, version := range []int{1, 2} {
+		car := &bytes.Buffer{}
+		err := ExportCAR(car, blobs, keys[1:], version)
+		assert(err == nil, t, "Error exporting CARv%d: %v", version, err)
+		imported := NewMemBlobServer(crypto.SHA256)
+		importedKeys, err := ImportCAR(bytes.NewReader(car.Bytes()), imported)
+		assert(err == nil, t, "Error importing CARv%d: %v", version, err)
+		assert(fmt.Sprint(importedKeys) == fmt.Sprint(keys[1:]), t, "Expected keys %v but got %v", keys[1:], importedKeys)
+		for _, key := range importedKeys {
+			blob, err := readBlob(imported, key)
+			expected, _ := readBlob(blobs, key)
+			assert(err == nil && bytes.Equal(blob, expected), t, "Expected '%s' but got '%s': %v", expected, blob, err)
+		}
+		corrupted := car.Bytes()
+		corrupted[len(corrupted)-1] ^= 0xff
+		_, err = ImportCAR(bytes.NewReader(corrupted), NewMemBlobServer(crypto.SHA256))
+		assert(err != nil && strings.HasPrefix(err.Error(), corruptedBlobErrorPrefix), t,
+			"Expected a corrupted block error in CARv%d but got %v", version, err)
+	}
+	car := &bytes.Buffer{}
+	err := ExportCAR(car, blobs, nil, 1)
+	assert(err == nil, t, "Error exporting all blobs: %v", err)
+	importedKeys, err := ImportCAR(car, NewMemBlobServer(crypto.SHA256))
+	assert(err == nil && len(importedKeys) == len(keys), t, "Expected %d keys but got %d: %v",
+		len(keys), len(importedKeys), err)
+	err = ExportCAR(car, writeBlobs(t, NewMemBlobAdmin(crypto.SHA1), 1), nil, 1)
+	assert(err != nil, t, "Expected SHA-1 keys not to be exported")
+	err = ExportCAR(car, blobs, nil, 3)
+	assert(err != nil, t, "Expected CARv3 to be unsupported")
+}
+
+// carV1Reference is a CARv1 file laid out by hand after the spec, with the "hello world" raw block as its root
+const carV1Reference = "3a" + // header length
+	"a2" + "65" + "726f6f7473" + "81" + "d82a" + "5825" + "00" + // {"roots": [42(h'00' ++
+	"01551220b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9" + // CID)],
+	"67" + "76657273696f6e" + "01" + // "version": 1}
+	"2f" + "01551220b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9" + // block length & CID
+	"68656c6c6f20776f726c64" // hello world
+
+// carV2Reference is the CARv2 spec pragma and header, with no index, wrapping carV1Reference
+const carV2Reference = "0aa16776657273696f6e02" + // {"version": 2}
+	"00000000000000000000000000000000" + // characteristics
+	"3300000000000000" + "6b00000000000000" + "0000000000000000" + // data offset, data size & index offset
+	carV1Reference
+
+// TestCARReference checks CAR files as laid out in the spec are imported, and exported byte by byte
+func TestCARReference(t *testing.T) {
+	// setup
+	blobs := NewMemBlobAdmin(crypto.SHA256)
+	key, err := blobs.Write(strings.NewReader("hello world"))
+	assert(err == nil, t, "Error writing blob: %v", err)
+	// exercise
+	for version, reference := range map[int]string{1: carV1Reference, 2: carV2Reference} {
+		expected, err := hex.DecodeString(reference)
+		assert(err == nil, t, "Error decoding the CARv%d reference: %v", version, err)
+		car := &bytes.Buffer{}
+		err = ExportCAR(car, blobs, []Key{key}, version)
+		assert(err == nil && bytes.Equal(car.Bytes(), expected), t, "Expected the CARv%d reference\n%x\nbut got\n%x: %v",
+			version, expected, car.Bytes(), err)
+		imported := NewMemBlobServer(crypto.SHA256)
+		importedKeys, err := ImportCAR(bytes.NewReader(expected), imported)
+		assert(err == nil && len(importedKeys) == 1 && importedKeys[0].CID() == key.CID(), t,
+			"Expected %s imported from the CARv%d reference but got %v: %v", key.CID(), version, importedKeys, err)
+		blob, err := readBlob(imported, key)
+		assert(err == nil && string(blob) == "hello world", t, "Expected 'hello world' but got '%s': %v", blob, err)
+	}
+	// a CARv2 data offset within its header is rejected
+	wrongOffset, _ := hex.DecodeString(carV2Reference)
+	wrongOffset[len(carV2Pragma)+16] = 0x10
+	_, err = ImportCAR(bytes.NewReader(wrongOffset), NewMemBlobServer(crypto.SHA256))
+	assert(err != nil, t, "Expected a CARv2 data offset within the header to be rejected")
+}
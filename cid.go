@@ -0,0 +1,80 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	cidVersion1     = 1
+	cidRawCodec     = 0x55
+	cidSHA256       = 0x12
+	cidBase32Prefix = "b"
+)
+
+// cidBase32 is the multibase base32 alphabet, lower case and without padding
+var cidBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// CID returns the key as an IPFS CIDv1 of a raw block hashed with sha2-256, in base32 like bafkrei...
+// Only SHA-256 keys can be rendered, others return an empty string
+func (k Key) CID() string {
+	if len(k) != sha256.Size {
+		return ""
+	}
+	return cidBase32Prefix + strings.ToLower(cidBase32.EncodeToString(k.cidBytes()))
+}
+
+// cidBytes returns the binary CIDv1 of a SHA-256 key
+func (k Key) cidBytes() []byte {
+	return append(appendUvarints(nil, cidVersion1, cidRawCodec, cidSHA256, uint64(len(k))), k...)
+}
+
+// ParseCID returns the key of a base32 CIDv1 with a sha2-256 multihash, as rendered by Key.CID
+func ParseCID(cid string) (Key, error) {
+	if !strings.HasPrefix(cid, cidBase32Prefix) {
+		return nil, fmt.Errorf("Unsupported CID %q, expected a base32 CIDv1", cid)
+	}
+	binaryCID, err := cidBase32.DecodeString(strings.ToUpper(cid[len(cidBase32Prefix):]))
+	if err != nil {
+		return nil, fmt.Errorf("Wrong CID %q: %v", cid, err)
+	}
+	reader := bytes.NewReader(binaryCID)
+	key, codec, err := readCID(reader)
+	if err == nil && reader.Len() > 0 {
+		err = fmt.Errorf("Wrong CID %q, with %d trailing bytes", cid, reader.Len())
+	}
+	if err == nil && codec != cidRawCodec {
+		err = fmt.Errorf("Unsupported CID codec 0x%x, expected raw", codec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// readCID reads a binary CIDv1 with a sha2-256 multihash, returning its digest as key and its codec
+func readCID(reader *bytes.Reader) (Key, uint64, error) {
+	var header [4]uint64
+	for i := range header {
+		value, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, 0, fmt.Errorf("Truncated CID: %v", err)
+		}
+		header[i] = value
+	}
+	version, codec, hashCode, size := header[0], header[1], header[2], header[3]
+	if version != cidVersion1 || hashCode != cidSHA256 || size != sha256.Size {
+		return nil, 0, fmt.Errorf("Unsupported CID version %d with multihash 0x%x of %d bytes, "+
+			"expected a CIDv1 with a sha2-256 multihash", version, hashCode, size)
+	}
+	key := make(Key, size)
+	if _, err := io.ReadFull(reader, key); err != nil {
+		return nil, 0, fmt.Errorf("Truncated CID: %v", err)
+	}
+	return key, codec, nil
+}
@@ -0,0 +1,563 @@
+/*
+Command blobstore administers file blob stores
+
+Usage:
+
+	blobstore [-dir DIR] [-hash HASH] [-json] COMMAND [ARGS]
+
+The commands are:
+
+	put [FILE...]                              stores files, or stdin, printing their keys
+	get KEY [FILE]                             writes a blob to FILE or stdout
+	cat KEY...                                 writes blobs to stdout
+	ls [PREFIX]                                lists the keys, those starting with PREFIX if given
+	stat KEY...                                prints blobs size & filename
+	rm KEY...                                  removes blobs
+	verify [-repair]                           reads all blobs reporting, or removing, the corrupted ones (alias fsck)
+	copy [-parallelism N] [-cursor FILE] DIR   copies the blobs missing at the store at DIR
+	sync [-parallelism N] [-cursor FILE] DIR   copies the blobs missing at either store
+	export [-format F] [-o FILE] [KEY...]      exports blobs, all if no keys, as tar, car or carv2
+	import [-format F] [FILE]                  imports a tar or car export, from stdin if no FILE
+	gc [-age D] [-keep FILE] [-dry-run]        removes stale temporary files, and the blobs not kept if given
+	serve [-addr ADDR] [-user U -password P]   serves the store over HTTP, removals by the given user only
+
+With -json each result is printed as a JSON object per line
+*/
+package main
+
+import (
+	"bufio"
+	"crypto"
+	_ "crypto/md5"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/josvazg/blobstore"
+)
+
+const (
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+var hashes = map[string]crypto.Hash{
+	"md5":    crypto.MD5,
+	"sha1":   crypto.SHA1,
+	"sha224": crypto.SHA224,
+	"sha256": crypto.SHA256,
+	"sha384": crypto.SHA384,
+	"sha512": crypto.SHA512,
+}
+
+// errUsage tells a command was called wrongly
+var errUsage = errors.New("Wrong usage")
+
+// cli holds the global options & streams of a command run
+type cli struct {
+	dir    string
+	hash   crypto.Hash
+	json   bool
+	store  blobstore.BlobAdmin
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// command runs a command with its arguments
+type command func(c *cli, args []string) error
+
+var commands = map[string]command{
+	"put":    put,
+	"get":    get,
+	"cat":    cat,
+	"ls":     ls,
+	"stat":   stat,
+	"rm":     rm,
+	"verify": verify,
+	"fsck":   verify,
+	"copy":   syncStores(blobstore.SyncOneWay),
+	"sync":   syncStores(blobstore.SyncBothWays),
+	"export": export,
+	"import": importBlobs,
+	"gc":     gc,
+	"serve":  serve,
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run parses the global flags and runs the command, returning the exit code
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("blobstore", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dir := flags.String("dir", envOr("BLOBSTORE_DIR", "."), "store directory, $BLOBSTORE_DIR by default")
+	hashName := flags.String("hash", "sha256", "hash algorithm: md5, sha1, sha224, sha256, sha384 or sha512")
+	jsonOutput := flags.Bool("json", false, "print results as JSON objects, one per line")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	hash, ok := hashes[*hashName]
+	if !ok || flags.NArg() == 0 || commands[flags.Arg(0)] == nil {
+		flags.Usage()
+		return exitUsage
+	}
+	c := &cli{dir: *dir, hash: hash, json: *jsonOutput, store: blobstore.NewFileBlobAdmin(*dir, hash),
+		stdin: stdin, stdout: stdout, stderr: stderr}
+	err := commands[flags.Arg(0)](c, flags.Args()[1:])
+	if err == errUsage || err == flag.ErrHelp {
+		fmt.Fprintf(stderr, "Usage of %s: see 'go doc github.com/josvazg/blobstore/cmd/blobstore'\n", flags.Arg(0))
+		return exitUsage
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "blobstore %s: %v\n", flags.Arg(0), err)
+		return exitFailure
+	}
+	return 0
+}
+
+// envOr returns the environment variable name, or value if not set
+func envOr(name, value string) string {
+	if env := os.Getenv(name); env != "" {
+		return env
+	}
+	return value
+}
+
+// print writes a result, as text or as a JSON object
+func (c *cli) print(text string, object map[string]interface{}) {
+	if c.json {
+		json.NewEncoder(c.stdout).Encode(object)
+		return
+	}
+	fmt.Fprintln(c.stdout, text)
+}
+
+// flags returns a flag set for a command, which prints errors to stderr
+func (c *cli) flags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	return flags
+}
+
+// parseKeys parses hex keys
+func parseKeys(args []string) ([]blobstore.Key, error) {
+	keys := make([]blobstore.Key, 0, len(args))
+	for _, arg := range args {
+		key, err := hex.DecodeString(arg)
+		if err != nil {
+			return nil, fmt.Errorf("Wrong key %q: %v", arg, err)
+		}
+		keys = append(keys, blobstore.Key(key))
+	}
+	return keys, nil
+}
+
+// put stores files, or stdin
+func put(c *cli, args []string) error {
+	if err := os.MkdirAll(c.dir, 0750); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		key, err := c.store.Write(c.stdin)
+		if err != nil {
+			return err
+		}
+		c.print(key.String(), map[string]interface{}{"key": key.String()})
+		return nil
+	}
+	for _, filename := range args {
+		file, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		key, err := c.store.Write(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		c.print(key.String()+"  "+filename, map[string]interface{}{"key": key.String(), "file": filename})
+	}
+	return nil
+}
+
+// get writes a blob to a file or stdout
+func get(c *cli, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+	keys, err := parseKeys(args[:1])
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		return c.copyBlob(c.stdout, keys[0])
+	}
+	file, err := os.Create(args[1])
+	if err != nil {
+		return err
+	}
+	if err := c.copyBlob(file, keys[0]); err != nil {
+		file.Close()
+		os.Remove(args[1])
+		return err
+	}
+	return file.Close()
+}
+
+// cat writes blobs to stdout
+func cat(c *cli, args []string) error {
+	keys, err := parseKeys(args)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := c.copyBlob(c.stdout, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyBlob writes a verified blob to w
+func (c *cli) copyBlob(w io.Writer, key blobstore.Key) error {
+	blob, err := c.store.Read(key)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, blob)
+	return err
+}
+
+// ls lists keys, optionally with a prefix
+func ls(c *cli, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	prefix := ""
+	if len(args) == 1 {
+		prefix = strings.ToLower(args[0])
+	}
+	for keyOrErr := range c.store.List() {
+		if err := keyOrErr.Err(); err != nil {
+			return err
+		}
+		key := keyOrErr.Key()
+		if strings.HasPrefix(key.String(), prefix) {
+			c.print(key.String(), map[string]interface{}{"key": key.String()})
+		}
+	}
+	return nil
+}
+
+// stat prints blobs size & filename
+func stat(c *cli, args []string) error {
+	keys, err := parseKeys(args)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		size, err := blobSize(c.store, key)
+		if err != nil {
+			return err
+		}
+		filename := filepath.Join(c.dir, filepath.FromSlash(blobstore.FileLayout(key)))
+		c.print(fmt.Sprintf("%v  %d  %s", key, size, filename),
+			map[string]interface{}{"key": key.String(), "size": size, "file": filename})
+	}
+	return nil
+}
+
+// blobSize returns the size of a blob, from the store if it tells sizes, or reading it otherwise
+func blobSize(store blobstore.BlobStore, key blobstore.Key) (int64, error) {
+	if sizer, ok := store.(blobstore.BlobSizer); ok {
+		return sizer.Size(key)
+	}
+	blob, err := store.Read(key)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(ioutil.Discard, blob)
+}
+
+// rm removes blobs
+func rm(c *cli, args []string) error {
+	keys, err := parseKeys(args)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := c.store.Remove(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify reads all blobs, reporting or removing the corrupted ones.
+// Blobs failing to be read for other reasons are reported but never removed
+func verify(c *cli, args []string) error {
+	flags := c.flags("verify")
+	repair := flags.Bool("repair", false, "remove the corrupted blobs")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	checked, corrupted, unreadable := 0, 0, 0
+	for keyOrErr := range c.store.List() {
+		if err := keyOrErr.Err(); err != nil {
+			return err
+		}
+		key := keyOrErr.Key()
+		checked++
+		blob, err := c.store.Read(key)
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, blob)
+		}
+		if err == nil {
+			continue
+		}
+		removed := false
+		if blobstore.IsCorrupted(err) {
+			corrupted++
+			if *repair {
+				if err := c.store.Remove(key); err != nil {
+					return err
+				}
+				removed = true
+			}
+		} else {
+			unreadable++
+		}
+		c.print(fmt.Sprintf("%v  %v", key, err),
+			map[string]interface{}{"key": key.String(), "error": err.Error(), "removed": removed})
+	}
+	c.print(fmt.Sprintf("%d blobs checked, %d corrupted, %d unreadable", checked, corrupted, unreadable),
+		map[string]interface{}{"checked": checked, "corrupted": corrupted, "unreadable": unreadable})
+	if unreadable > 0 {
+		return fmt.Errorf("%d unreadable blobs", unreadable)
+	}
+	if corrupted > 0 && !*repair {
+		return fmt.Errorf("%d corrupted blobs", corrupted)
+	}
+	return nil
+}
+
+// syncStores returns the copy or sync command, copying blobs missing at another store one or both ways
+func syncStores(mode blobstore.SyncMode) command {
+	return func(c *cli, args []string) error {
+		flags := c.flags("sync")
+		parallelism := flags.Int("parallelism", 0, "maximum blobs copied at once")
+		cursor := flags.String("cursor", "", "file to persist the progress at, to resume interrupted syncs")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return errUsage
+		}
+		if err := os.MkdirAll(flags.Arg(0), 0750); err != nil {
+			return err
+		}
+		options := blobstore.SyncOptions{Mode: mode, Parallelism: *parallelism}
+		if *cursor != "" {
+			options.Cursor = blobstore.NewFileSyncCursor(*cursor)
+		}
+		copies, err := blobstore.Sync(c.store, blobstore.NewFileBlobAdmin(flags.Arg(0), c.hash), options)
+		if err != nil {
+			return err
+		}
+		c.print(fmt.Sprintf("%d blobs copied", copies), map[string]interface{}{"copied": copies})
+		return nil
+	}
+}
+
+// export writes blobs as a tar or car file
+func export(c *cli, args []string) error {
+	flags := c.flags("export")
+	format := flags.String("format", "tar", "tar, car or carv2")
+	output := flags.String("o", "", "output file, stdout by default")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	keys, err := parseKeys(flags.Args())
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		keys = nil
+	}
+	w := c.stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	switch *format {
+	case "tar":
+		err = blobstore.ExportTar(w, c.store, keys, blobstore.TarOptions{})
+	case "car":
+		err = blobstore.ExportCAR(w, c.store, keys, 1)
+	case "carv2":
+		err = blobstore.ExportCAR(w, c.store, keys, 2)
+	default:
+		return errUsage
+	}
+	return err
+}
+
+// importBlobs reads a tar or car export
+func importBlobs(c *cli, args []string) error {
+	flags := c.flags("import")
+	format := flags.String("format", "tar", "tar or car, for either CAR version")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return errUsage
+	}
+	if err := os.MkdirAll(c.dir, 0750); err != nil {
+		return err
+	}
+	r := c.stdin
+	if flags.NArg() == 1 {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	imported := 0
+	switch *format {
+	case "tar":
+		var err error
+		if imported, err = blobstore.ImportTar(r, c.store, blobstore.TarOptions{}); err != nil {
+			return err
+		}
+	case "car":
+		keys, err := blobstore.ImportCAR(r, c.store)
+		if err != nil {
+			return err
+		}
+		imported = len(keys)
+	default:
+		return errUsage
+	}
+	c.print(fmt.Sprintf("%d blobs imported", imported), map[string]interface{}{"imported": imported})
+	return nil
+}
+
+// gc removes stale temporary files, and the blobs not listed in a keep file if given
+func gc(c *cli, args []string) error {
+	flags := c.flags("gc")
+	age := flags.Duration("age", time.Hour, "minimum age of the temporary files to remove")
+	keepFile := flags.String("keep", "", "file with the keys to keep, one per line, '-' for stdin")
+	dryRun := flags.Bool("dry-run", false, "print the files & blobs that would be removed, without removing them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	var keep map[string]bool
+	if *keepFile != "" {
+		var err error
+		if keep, err = c.readKeep(*keepFile); err != nil {
+			return err
+		}
+	}
+	removeTmps := blobstore.RemoveStaleTmpFiles
+	if *dryRun {
+		removeTmps = blobstore.StaleTmpFiles
+	}
+	tmps, err := removeTmps(c.dir, *age)
+	if err != nil {
+		return err
+	}
+	verb := "removed "
+	if *dryRun {
+		verb = "would remove "
+	}
+	for _, tmp := range tmps {
+		c.print(verb+tmp, map[string]interface{}{"file": tmp, "removed": !*dryRun})
+	}
+	if keep == nil {
+		return nil
+	}
+	for keyOrErr := range c.store.List() {
+		if err := keyOrErr.Err(); err != nil {
+			return err
+		}
+		key := keyOrErr.Key()
+		if keep[key.String()] {
+			continue
+		}
+		if !*dryRun {
+			if err := c.store.Remove(key); err != nil {
+				return err
+			}
+		}
+		c.print(verb+key.String(), map[string]interface{}{"key": key.String(), "removed": !*dryRun})
+	}
+	return nil
+}
+
+// readKeep reads a set of hex keys, one per line, failing on any line that is not a key of the store hash
+func (c *cli) readKeep(filename string) (map[string]bool, error) {
+	r := c.stdin
+	if filename != "-" {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		r = file
+	}
+	keep := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		key, err := hex.DecodeString(line)
+		if err == nil && len(key) != c.hash.Size() {
+			err = fmt.Errorf("Expected %d bytes but got %d", c.hash.Size(), len(key))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Wrong key %q at line %d of the keep file: %v", line, number, err)
+		}
+		keep[blobstore.Key(key).String()] = true
+	}
+	return keep, scanner.Err()
+}
+
+// serve serves the store over HTTP till killed
+func serve(c *cli, args []string) error {
+	flags := c.flags("serve")
+	addr := flags.String("addr", ":8080", "address to listen at")
+	user := flags.String("user", "", "user allowed to remove blobs, removals are disabled if not set")
+	password := flags.String("password", envOr("BLOBSTORE_PASSWORD", ""), "password of the user, "+
+		"$BLOBSTORE_PASSWORD by default")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	options := blobstore.HandlerOptions{}
+	if *user != "" {
+		options.Admin = blobstore.BasicAuthAdmin(*user, *password)
+	}
+	c.print("serving "+c.dir+" at "+*addr, map[string]interface{}{"dir": c.dir, "addr": *addr})
+	return http.ListenAndServe(*addr, blobstore.NewBlobHandler(c.store, options))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runCLI runs the command line with the given stdin, returning the exit code and outputs
+func runCLI(stdin string, args ...string) (int, string, string) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	code := run(args, strings.NewReader(stdin), stdout, stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+// assert fails the test with the given message if the assertion does not hold
+func assert(assertion bool, t *testing.T, format string, args ...interface{}) {
+	if !assertion {
+		t.Helper()
+		t.Fatalf(format, args...)
+	}
+}
+
+// TestCLI checks the commands on file stores
+func TestCLI(t *testing.T) {
+	// setup
+	root, err := ioutil.TempDir("", "blobstore")
+	assert(err == nil, t, "Error creating temp dir: %v", err)
+	defer os.RemoveAll(root)
+	dir, other, imported := filepath.Join(root, "store"), filepath.Join(root, "other"), filepath.Join(root, "imported")
+	filename := filepath.Join(root, "file.txt")
+	err = ioutil.WriteFile(filename, []byte("from a file"), 0640)
+	assert(err == nil, t, "Error writing file: %v", err)
+	// exercise put, ls, stat, get & cat
+	code, stdout, stderr := runCLI("from stdin", "-dir", dir, "put")
+	assert(code == 0, t, "Expected put to succeed but got %d: %s", code, stderr)
+	stdinKey := strings.TrimSpace(stdout)
+	code, stdout, _ = runCLI("", "-dir", dir, "-json", "put", filename)
+	result := map[string]interface{}{}
+	err = json.Unmarshal([]byte(stdout), &result)
+	assert(code == 0 && err == nil && result["file"] == filename, t, "Unexpected put output %s: %v", stdout, err)
+	fileKey := result["key"].(string)
+	code, stdout, _ = runCLI("", "-dir", dir, "ls")
+	assert(code == 0 && len(strings.Fields(stdout)) == 2, t, "Expected 2 keys listed but got %s", stdout)
+	code, stdout, _ = runCLI("", "-dir", dir, "ls", fileKey[:6])
+	assert(code == 0 && strings.TrimSpace(stdout) == fileKey, t, "Expected %s listed but got %s", fileKey, stdout)
+	code, stdout, _ = runCLI("", "-dir", dir, "-json", "stat", fileKey)
+	err = json.Unmarshal([]byte(stdout), &result)
+	assert(code == 0 && err == nil && result["size"] == float64(len("from a file")), t, "Unexpected stat %s: %v",
+		stdout, err)
+	blobFile := result["file"].(string)
+	code, stdout, _ = runCLI("", "-dir", dir, "cat", stdinKey, fileKey)
+	assert(code == 0 && stdout == "from stdinfrom a file", t, "Unexpected cat output %q", stdout)
+	got := filepath.Join(root, "got.txt")
+	code, _, stderr = runCLI("", "-dir", dir, "get", fileKey, got)
+	contents, err := ioutil.ReadFile(got)
+	assert(code == 0 && err == nil && string(contents) == "from a file", t, "Unexpected get %q: %v %s",
+		contents, err, stderr)
+	// copies, exports & imports
+	code, stdout, _ = runCLI("", "-dir", dir, "copy", other)
+	assert(code == 0 && strings.HasPrefix(stdout, "2 blobs copied"), t, "Unexpected copy output %s", stdout)
+	code, stdout, _ = runCLI("only on the other", "-dir", other, "put")
+	otherKey := strings.TrimSpace(stdout)
+	code, stdout, _ = runCLI("", "-dir", dir, "sync", other)
+	assert(code == 0 && strings.HasPrefix(stdout, "1 blobs copied"), t, "Unexpected sync output %s", stdout)
+	for _, format := range []string{"tar", "car", "carv2"} {
+		export := filepath.Join(root, "export."+format)
+		code, _, stderr = runCLI("", "-dir", dir, "export", "-format", format, "-o", export)
+		assert(code == 0, t, "Expected %s export to succeed but got %d: %s", format, code, stderr)
+		importFormat := strings.TrimSuffix(format, "v2")
+		code, stdout, stderr = runCLI("", "-dir", imported+format, "import", "-format", importFormat, export)
+		assert(code == 0 && strings.HasPrefix(stdout, "3 blobs imported"), t, "Unexpected %s import %s: %s",
+			format, stdout, stderr)
+	}
+	// verify, gc & rm
+	code, stdout, _ = runCLI("", "-dir", dir, "verify")
+	assert(code == 0 && strings.HasPrefix(stdout, "3 blobs checked, 0 corrupted"), t, "Unexpected verify %s", stdout)
+	err = ioutil.WriteFile(blobFile, []byte("corrupted"), 0640)
+	assert(err == nil, t, "Error corrupting blob: %v", err)
+	code, stdout, _ = runCLI("", "-dir", dir, "fsck")
+	assert(code == 1 && strings.Contains(stdout, "1 corrupted"), t, "Expected a corrupted blob but got %d: %s",
+		code, stdout)
+	code, _, _ = runCLI("", "-dir", dir, "verify", "-repair")
+	assert(code == 0, t, "Expected the repair to succeed but got %d", code)
+	code, stdout, _ = runCLI(stdinKey[:10]+"\n", "-dir", dir, "gc", "-keep", "-")
+	assert(code == 1 && stdout == "", t, "Expected a short keep key to abort gc but got %d: %s", code, stdout)
+	code, stdout, _ = runCLI(stdinKey+"\n", "-dir", dir, "gc", "-keep", "-", "-dry-run")
+	assert(code == 0 && strings.TrimSpace(stdout) == "would remove "+otherKey, t, "Unexpected gc dry run output %s",
+		stdout)
+	code, stdout, _ = runCLI(stdinKey+"\n", "-dir", dir, "gc", "-keep", "-")
+	assert(code == 0 && strings.TrimSpace(stdout) == "removed "+otherKey, t, "Unexpected gc output %s", stdout)
+	stale := filepath.Join(dir, "interrupted.new")
+	err = ioutil.WriteFile(stale, []byte("interrupted"), 0640)
+	assert(err == nil, t, "Error writing temporary file: %v", err)
+	err = os.Chtimes(stale, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour))
+	assert(err == nil, t, "Error aging temporary file: %v", err)
+	code, stdout, _ = runCLI("", "-dir", dir, "gc", "-dry-run")
+	_, err = os.Stat(stale)
+	assert(code == 0 && strings.TrimSpace(stdout) == "would remove "+stale && err == nil, t,
+		"Expected the stale file reported and kept but got %s: %v", stdout, err)
+	code, _, _ = runCLI("", "-dir", dir, "gc")
+	_, err = os.Stat(stale)
+	assert(code == 0 && os.IsNotExist(err), t, "Expected the stale file removed but got %d: %v", code, err)
+	code, _, _ = runCLI("", "-dir", dir, "rm", stdinKey)
+	code, stdout, _ = runCLI("", "-dir", dir, "ls")
+	assert(code == 0 && stdout == "", t, "Expected an empty store but got %s", stdout)
+	// wrong usages
+	for _, args := range [][]string{{}, {"unknown"}, {"-hash", "crc", "ls"}, {"get"}, {"export", "-format", "zip"}} {
+		code, _, _ = runCLI("", append([]string{"-dir", dir}, args...)...)
+		assert(code == exitUsage, t, "Expected %v to be a wrong usage but got %d", args, code)
+	}
+}
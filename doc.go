@@ -42,6 +42,16 @@ type KeyOrError struct {
 	err error
 }
 
+// Key returns the listed key, nil on errors
+func (ke KeyOrError) Key() Key {
+	return ke.key
+}
+
+// Err returns the listing error, if any
+func (ke KeyOrError) Err() error {
+	return ke.err
+}
+
 // BlobStore saves and retrieves blobs identified by the hash of its content
 type BlobStore interface {
 	// Read returns a reader for the given blob content hash key, or an error (like 'key nor found')
@@ -61,6 +71,20 @@ type BlobAdmin interface {
 	Remove(key Key) error
 }
 
+// BlobSizer is a BlobStore that knows the size of its blobs without reading them through
+type BlobSizer interface {
+	BlobStore
+	// Size returns the size of the given blob, or an error (like 'key not found')
+	Size(key Key) (int64, error)
+}
+
+// BlobPager is a BlobStore that can start listing its keys after a given one, to list them a page at a time
+type BlobPager interface {
+	BlobStore
+	// ListAfter returns the stored keys sorting after the given one via a channel, as List does
+	ListAfter(key Key) <-chan KeyOrError
+}
+
 // NewFileBlobStore returns a files BlobStore
 func NewFileBlobStore(dir string, hash crypto.Hash) BlobStore {
 	return NewFileBlobServer(dir, hash)
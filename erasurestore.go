@@ -0,0 +1,225 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	// shardSizeLen is the length of the blob size header of each shard
+	shardSizeLen = 8
+)
+
+// ErasureStore is a BlobAdmin splitting each blob into data shards plus Reed-Solomon parity shards,
+// each stored on a different VirtualFS, so that blobs survive losing up to parity of them
+//
+// Each shard is stored as the blob size, the hash of the size & shard bytes and the shard bytes,
+// so that corrupted shards can be told apart from good ones and rebuilt as if they were missing
+type ErasureStore struct {
+	shards []*VFSBlobServer
+	code   *reedSolomon
+	hash   crypto.Hash
+}
+
+// NewErasureStore returns an ErasureStore over roots, which must be data+parity VirtualFS
+func NewErasureStore(roots []VirtualFS, data, parity int, hash crypto.Hash) (*ErasureStore, error) {
+	if len(roots) != data+parity {
+		return nil, fmt.Errorf("Expected %d roots for %d data and %d parity shards but got %d",
+			data+parity, data, parity, len(roots))
+	}
+	code, err := newReedSolomon(data, parity)
+	if err != nil {
+		return nil, err
+	}
+	shards := make([]*VFSBlobServer, len(roots))
+	for i, root := range roots {
+		shards[i] = &VFSBlobServer{root, hash}
+	}
+	return &ErasureStore{shards, code, hash}, nil
+}
+
+// NewFileErasureStore returns an ErasureStore with a fileBlobs root on each of dirs
+func NewFileErasureStore(dirs []string, data, parity int, hash crypto.Hash) (*ErasureStore, error) {
+	roots := make([]VirtualFS, len(dirs))
+	for i, dir := range dirs {
+		roots[i] = fileBlobs{dir}
+	}
+	return NewErasureStore(roots, data, parity, hash)
+}
+
+// Read returns the blob, reconstructed from its shards if any of them is missing or corrupted
+func (es *ErasureStore) Read(key Key) (io.Reader, error) {
+	if err := es.checkKey(key); err != nil {
+		return nil, err
+	}
+	shards, size, _, err := es.readShards(key)
+	if err != nil {
+		return nil, err
+	}
+	blob := make([]byte, 0, size)
+	for _, shard := range shards[:es.code.data] {
+		blob = append(blob, shard...)
+	}
+	return &checkedReader{bytes.NewReader(blob[:size]), key, es.hash.New()}, nil
+}
+
+// Write splits the blob into shards and stores each of them on its own root.
+// The blob is fully read into memory before being split
+func (es *ErasureStore) Write(blob io.Reader) (Key, error) {
+	data, err := ioutil.ReadAll(blob)
+	if err != nil {
+		return nil, err
+	}
+	hasher := es.hash.New()
+	hasher.Write(data)
+	key := Key(hasher.Sum(nil))
+	shardSize := (len(data) + es.code.data - 1) / es.code.data
+	shards := make([][]byte, len(es.shards))
+	for i := range shards {
+		shards[i] = make([]byte, shardSize)
+		if i < es.code.data && i*shardSize < len(data) {
+			copy(shards[i], data[i*shardSize:])
+		}
+	}
+	es.code.encode(shards)
+	for i, shard := range shards {
+		if err := es.writeShard(i, key, uint64(len(data)), shard); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// List returns the sorted keys found on any root
+func (es *ErasureStore) List() <-chan KeyOrError {
+	lists := make([]<-chan KeyOrError, 0, len(es.shards))
+	for _, shard := range es.shards {
+		lists = append(lists, shard.List())
+	}
+	return mergeKeys(lists...)
+}
+
+// checkKey fails keys not as long as the store hash
+func (es *ErasureStore) checkKey(key Key) error {
+	return checkKeySize(es.hash, key)
+}
+
+// Remove the given key shards from all roots
+func (es *ErasureStore) Remove(key Key) error {
+	for _, shard := range es.shards {
+		if err := shard.Remove(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Repair regenerates the missing or corrupted shards of all blobs, it returns the number of shards rewritten
+func (es *ErasureStore) Repair() (int, error) {
+	var keys []Key
+	for keyOrErr := range es.List() {
+		if keyOrErr.err != nil {
+			return 0, keyOrErr.err
+		}
+		keys = append(keys, keyOrErr.key)
+	}
+	repaired := 0
+	for _, key := range keys {
+		shards, size, lost, err := es.readShards(key)
+		if err != nil {
+			return repaired, err
+		}
+		for _, i := range lost {
+			if err := es.shards[i].Remove(key); err != nil {
+				return repaired, err
+			}
+			if err := es.writeShard(i, key, size, shards[i]); err != nil {
+				return repaired, err
+			}
+			repaired++
+		}
+	}
+	return repaired, nil
+}
+
+// readShards reads all shards of key reconstructing the lost ones, which indexes are also returned
+func (es *ErasureStore) readShards(key Key) (shards [][]byte, size uint64, lost []int, err error) {
+	shards = make([][]byte, len(es.shards))
+	sizes := make(map[uint64]int)
+	for i := range es.shards {
+		shardSize, shard, err := es.readShard(i, key)
+		if err != nil {
+			lost = append(lost, i)
+			continue
+		}
+		shards[i] = shard
+		sizes[shardSize]++
+		if sizes[shardSize] > sizes[size] {
+			size = shardSize
+		}
+	}
+	if len(lost) == len(es.shards) {
+		return nil, 0, nil, fmt.Errorf("Key not found: %v", key)
+	}
+	if err := es.code.reconstruct(shards); err != nil {
+		return nil, 0, nil, fmt.Errorf("Can't reconstruct %v: %v", key, err)
+	}
+	if size > uint64(es.code.data*len(shards[0])) {
+		return nil, 0, nil, fmt.Errorf("%s %v size %d does not fit its shards", corruptedBlobErrorPrefix, key, size)
+	}
+	return shards, size, lost, nil
+}
+
+// readShard reads and verifies the shard i of key, returning the blob size and the shard bytes
+func (es *ErasureStore) readShard(i int, key Key) (uint64, []byte, error) {
+	file, err := es.shards[i].Open(es.shards[i].Keyname(key))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+	contents, err := ioutil.ReadAll(file)
+	if err != nil {
+		return 0, nil, err
+	}
+	headerLen := shardSizeLen + es.hash.Size()
+	if len(contents) < headerLen {
+		return 0, nil, fmt.Errorf("%s shard %d of %v is truncated", corruptedBlobErrorPrefix, i, key)
+	}
+	shard := contents[headerLen:]
+	hasher := es.hash.New()
+	hasher.Write(contents[:shardSizeLen])
+	hasher.Write(shard)
+	if !Key(hasher.Sum(nil)).Equals(contents[shardSizeLen:headerLen]) {
+		return 0, nil, fmt.Errorf("%s shard %d of %v does not match its hash", corruptedBlobErrorPrefix, i, key)
+	}
+	return binary.BigEndian.Uint64(contents), shard, nil
+}
+
+// writeShard stores the shard i of key, along its header, on its root
+func (es *ErasureStore) writeShard(i int, key Key, size uint64, shard []byte) error {
+	header := make([]byte, shardSizeLen, shardSizeLen+es.hash.Size())
+	binary.BigEndian.PutUint64(header, size)
+	hasher := es.hash.New()
+	hasher.Write(header)
+	hasher.Write(shard)
+	header = hasher.Sum(header)
+	root := es.shards[i]
+	tmpKeyname := root.TmpKeyname(es.hash.Size())
+	file, err := root.Create(tmpKeyname)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(header, shard...))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		root.Delete(tmpKeyname)
+		return err
+	}
+	return root.commit(tmpKeyname, key)
+}
@@ -0,0 +1,104 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestReedSolomon checks any parity lost shards can be reconstructed
+func TestReedSolomon(t *testing.T) {
+	// setup
+	code, err := newReedSolomon(4, 2)
+	assert(err == nil, t, "Error creating the code: %v", err)
+	shards := [][]byte{[]byte("abc"), []byte("def"), []byte("ghi"), []byte("jkl"), make([]byte, 3), make([]byte, 3)}
+	code.encode(shards)
+	// exercise all pairs of lost shards
+	for i := range shards {
+		for j := i + 1; j < len(shards); j++ {
+			damaged := append([][]byte{}, shards...)
+			damaged[i], damaged[j] = nil, nil
+			err := code.reconstruct(damaged)
+			assert(err == nil, t, "Error reconstructing shards %d & %d: %v", i, j, err)
+			for s := range shards {
+				assert(bytes.Equal(shards[s], damaged[s]), t, "Shard %d was %v but reconstructed as %v",
+					s, shards[s], damaged[s])
+			}
+		}
+	}
+	// too many lost shards must fail
+	damaged := [][]byte{nil, nil, nil, shards[3], shards[4], shards[5]}
+	assert(code.reconstruct(damaged) != nil, t, "Reconstructing from 3 out of 6 shards should had failed")
+}
+
+// TestErasureReadsNWrites test that an erasure coded store does its reads and writes as expected
+func TestErasureReadsNWrites(t *testing.T) {
+	// setup
+	dir := fileBlobs{""}.TmpKeyname(10)
+	dirs := []string{}
+	for _, name := range []string{"d0", "d1", "d2", "p0", "p1"} {
+		dirs = append(dirs, filepath.Join(dir, name))
+		os.MkdirAll(dirs[len(dirs)-1], 0700)
+	}
+	es, err := NewFileErasureStore(dirs, 3, 2, crypto.SHA1)
+	assert(err == nil, t, "Error creating the store: %v", err)
+	// exercise
+	readsNWrites(t, es)
+	_, err = es.Read(Key(make([]byte, crypto.SHA1.Size()+1)))
+	assert(errors.Is(err, ErrInvalidKey), t, "Expected an invalid key error for a too long key but got %v", err)
+	// cleanup
+	err = os.RemoveAll(dir)
+	assert(err == nil, t, "Error in cleanup removing %s: %v", dir, err)
+}
+
+// TestErasureRepair checks blobs are read despite lost and corrupted shards, and that they can be repaired
+func TestErasureRepair(t *testing.T) {
+	// setup
+	roots := []VirtualFS{newMemBlobs(), newMemBlobs(), newMemBlobs(), newMemBlobs()}
+	es, err := NewErasureStore(roots, 2, 2, crypto.SHA1)
+	assert(err == nil, t, "Error creating the store: %v", err)
+	input := strings.Repeat(testData[0].input, 5)
+	key, err := es.Write(strings.NewReader(input))
+	assert(err == nil, t, "Error writing blob: %v", err)
+	roots[0].Delete(roots[0].Keyname(key))
+	roots[3].(*memBlobs).blobs[roots[3].Keyname(key)] = bytes.NewBufferString("corrupted shard!!!!!!!!!!!!!!!!!!")
+	// exercise
+	reader, err := es.Read(key)
+	assert(err == nil, t, "Error reading %v: %v", key, err)
+	blob, err := ioutil.ReadAll(reader)
+	assert(err == nil && string(blob) == input, t, "Expected '%s' but got '%s' (%v)", input, blob, err)
+	repaired, err := es.Repair()
+	assert(err == nil, t, "Error repairing: %v", err)
+	assert(repaired == 2, t, "Expected 2 shards repaired but got %d", repaired)
+	for i := range roots {
+		_, _, err := es.readShard(i, key)
+		assert(err == nil, t, "Shard %d was not repaired: %v", i, err)
+	}
+}
+
+// TestErasureCorruptedSize checks a corrupted shard size header is detected instead of trusted
+func TestErasureCorruptedSize(t *testing.T) {
+	// setup
+	roots := []VirtualFS{newMemBlobs(), newMemBlobs(), newMemBlobs(), newMemBlobs()}
+	es, err := NewErasureStore(roots, 2, 2, crypto.SHA1)
+	assert(err == nil, t, "Error creating the store: %v", err)
+	key, err := es.Write(strings.NewReader(testData[0].input))
+	assert(err == nil, t, "Error writing blob: %v", err)
+	for _, i := range []int{0, 1} {
+		shard := roots[i].(*memBlobs).blobs[roots[i].Keyname(key)].Bytes()
+		binary.BigEndian.PutUint64(shard, 1<<62)
+	}
+	// exercise
+	reader, err := es.Read(key)
+	assert(err == nil, t, "Error reading %v: %v", key, err)
+	blob, err := ioutil.ReadAll(reader)
+	// check
+	assert(err == nil && string(blob) == testData[0].input, t, "Expected '%s' but got '%s' (%v)",
+		testData[0].input, blob, err)
+}
@@ -5,15 +5,18 @@ import (
 	"crypto/rand"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 const (
 	defaultPerms = 0750
 	vfsRoot      = ""
-	filesAtOnce  = 10
+	tmpSuffix    = ".new"
 )
 
 // NewFileBlobServer returns a VFSBlobServer using a fileBlobs, that is on top of the os files
@@ -56,59 +59,144 @@ func (vfs fileBlobs) Rename(oldkey, newkey string) error {
 	return err
 }
 
+// Size returns a key contents size, from its file info
+func (vfs fileBlobs) Size(keyname string) (int64, error) {
+	info, err := os.Stat(keyname)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
 // ListTo lists all present keys in sort order to the keys channel
 func (vfs fileBlobs) ListTo(keys chan<- KeyOrError, acceptor func(string) Key) bool {
-	return vfs.listTo(keys, acceptor, vfsRoot)
+	return vfs.listTo(keys, acceptor, vfsRoot, "", "")
+}
+
+// ListAfterTo lists the keys after the given one in sort order, skipping the directories before it
+func (vfs fileBlobs) ListAfterTo(keys chan<- KeyOrError, acceptor func(string) Key, after Key) bool {
+	return vfs.listTo(keys, acceptor, vfsRoot, "", after.String())
 }
 
-// listTo is the internal recursive implementation of ListTo list key names from recursive directories
-func (vfs fileBlobs) listTo(keys chan<- KeyOrError, acceptor func(string) Key, dir string) bool {
+// listTo is the internal recursive implementation of ListTo list key names from recursive directories,
+// the directory names along the way make up the prefix of the keys within, so subtrees before after are skipped
+func (vfs fileBlobs) listTo(keys chan<- KeyOrError, acceptor func(string) Key, dir, prefix, after string) bool {
 	if dir == vfsRoot { // start at the root dir
 		dir = vfs.dir
 	}
-	root, err := os.Open(dir)
+	// ReadDir returns the directory entries sorted by name, so keys are listed in sort order
+	fileInfos, err := ioutil.ReadDir(dir)
 	if err != nil {
 		return failKeyOrError(keys, err)
 	}
-	for {
-		fileInfos, err := root.Readdir(filesAtOnce)
-		if err == io.EOF { // on EOF we are done
-			return true
-		} else if err != nil {
-			return failKeyOrError(keys, err)
-		}
-		for _, fileInfo := range fileInfos {
-			if fileInfo.IsDir() { // If it is a dir...
-				// List tha branch, but fail the pipeline if that returns false (=failure)
-				if !vfs.listTo(keys, acceptor, filepath.Join(dir, fileInfo.Name())) {
-					return false // give up if the subtree failed
-				}
-			} else { // If it is Not a directory but a file...
-				// get the filename
-				filename := fileInfo.Name()
-				// strip the extension, if any
-				if strings.Contains(filename, ".") {
-					filename = strings.Split(filename, ".")[0]
-				}
-				// if filename is accepted by acceptor it will produce a non nil key, then send it through keys
-				key := acceptor(filename)
-				if key != nil {
-					keys <- KeyOrError{key, nil}
-				}
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() { // If it is a dir...
+			subtree := prefix + fileInfo.Name()
+			if len(subtree) < len(after) && subtree < after[:len(subtree)] {
+				continue // all its keys sort before after
+			}
+			// List tha branch, but fail the pipeline if that returns false (=failure)
+			if !vfs.listTo(keys, acceptor, filepath.Join(dir, fileInfo.Name()), subtree, after) {
+				return false // give up if the subtree failed
+			}
+		} else if !strings.HasSuffix(fileInfo.Name(), tmpSuffix) { // If it is Not a directory but a (non temp) file...
+			// get the filename
+			filename := fileInfo.Name()
+			// strip the extension, if any
+			if strings.Contains(filename, ".") {
+				filename = strings.Split(filename, ".")[0]
+			}
+			if filename <= after {
+				continue
+			}
+			// if filename is accepted by acceptor it will produce a non nil key, then send it through keys
+			key := acceptor(filename)
+			if key != nil {
+				keys <- KeyOrError{key, nil}
 			}
 		}
 	}
+	return true
 }
 
 // keyname returns a filename full path of where the key blob should be placed
 func (vfs fileBlobs) Keyname(key Key) string {
+	return filepath.Join(vfs.dir, filepath.FromSlash(FileLayout(key)))
+}
+
+// FileLayout returns the slash separated path of a key blob relative to the fileBlobs root,
+// four directory levels named after the first key bytes and a .blob file named after the whole key
+func FileLayout(key Key) string {
 	hexKey := key.String()
-	return filepath.Join(vfs.dir, hexKey[0:2], hexKey[2:4], hexKey[4:6], hexKey[6:8], fmt.Sprintf("%s.blob", hexKey))
+	return path.Join(hexKey[0:2], hexKey[2:4], hexKey[4:6], hexKey[6:8], fmt.Sprintf("%s.blob", hexKey))
+}
+
+// syncFile flushes a written file to stable storage, when it is an os file
+func syncFile(file io.Writer) error {
+	if syncer, ok := file.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// syncDir flushes the directory of a renamed keyname to stable storage, when vfs is on os files
+func syncDir(vfs VirtualFS, keyname string) error {
+	if syncer, ok := vfs.(interface{ syncDir(keyname string) error }); ok {
+		return syncer.syncDir(keyname)
+	}
+	return nil
+}
+
+// syncDir flushes the directory of a renamed keyname to stable storage
+func (vfs fileBlobs) syncDir(keyname string) error {
+	dir, err := os.Open(filepath.Dir(keyname))
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 // tmpkeyname returns a temporary filename
 func (vfs fileBlobs) TmpKeyname(size int) string {
 	key := make([]byte, size)
 	rand.Reader.Read(key)
-	return filepath.Join(vfs.dir, fmt.Sprintf("%s.new", Key(key).String()))
+	return filepath.Join(vfs.dir, Key(key).String()+tmpSuffix)
+}
+
+// StaleTmpFiles returns the names of the temporary files left at a files store dir by writes interrupted
+// at least age ago
+func StaleTmpFiles(dir string, age time.Duration) ([]string, error) {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	stale := []string{}
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() || !strings.HasSuffix(fileInfo.Name(), tmpSuffix) || time.Since(fileInfo.ModTime()) < age {
+			continue
+		}
+		stale = append(stale, filepath.Join(dir, fileInfo.Name()))
+	}
+	return stale, nil
+}
+
+// RemoveStaleTmpFiles removes the temporary files left at a files store dir by writes interrupted at least
+// age ago, returning their names
+func RemoveStaleTmpFiles(dir string, age time.Duration) ([]string, error) {
+	stale, err := StaleTmpFiles(dir, age)
+	if err != nil {
+		return nil, err
+	}
+	removed := []string{}
+	for _, filename := range stale {
+		if err := os.Remove(filename); err != nil {
+			return removed, err
+		}
+		removed = append(removed, filename)
+	}
+	return removed, nil
 }
@@ -0,0 +1,294 @@
+package blobstore
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// ErrReadOnly is returned when trying to write or remove blobs on a read only BlobStore
+var ErrReadOnly = errors.New("Read only BlobStore, blobs can not be written nor removed")
+
+// NewFSBlobServer returns a read only VFSBlobServer on any fs.FS, like an embed.FS or a zip.Reader,
+// with its blobs placed at the paths returned by layout, or as in fileBlobs if layout is nil
+func NewFSBlobServer(fsys fs.FS, hash crypto.Hash, layout func(Key) string) *VFSBlobServer {
+	if layout == nil {
+		layout = FileLayout
+	}
+	return &VFSBlobServer{fsBlobs{fsys, layout}, hash}
+}
+
+// FlatLayout places each key blob at the root, named after its hex key, as NewBlobFS exposes them
+func FlatLayout(key Key) string {
+	return key.String()
+}
+
+// fsBlobs is a read only VirtualFS on a fs.FS
+type fsBlobs struct {
+	fsys   fs.FS
+	layout func(Key) string
+}
+
+// Open a key contents for reading
+func (vfs fsBlobs) Open(keyname string) (io.ReadCloser, error) {
+	return vfs.fsys.Open(keyname)
+}
+
+// Create always fails, as the fs.FS is read only
+func (vfs fsBlobs) Create(keyname string) (io.WriteCloser, error) {
+	return nil, ErrReadOnly
+}
+
+// Delete always fails, as the fs.FS is read only
+func (vfs fsBlobs) Delete(keyname string) error {
+	return ErrReadOnly
+}
+
+// ReadOnly tells fsBlobs are always read only
+func (vfs fsBlobs) ReadOnly() bool {
+	return true
+}
+
+// Does the given key exists?
+func (vfs fsBlobs) Exists(keyname string) bool {
+	_, err := fs.Stat(vfs.fsys, keyname)
+	return err == nil
+}
+
+// Size returns a key contents size, from its file info
+func (vfs fsBlobs) Size(keyname string) (int64, error) {
+	info, err := fs.Stat(vfs.fsys, keyname)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Rename always fails, as the fs.FS is read only
+func (vfs fsBlobs) Rename(oldkey, newkey string) error {
+	return ErrReadOnly
+}
+
+// ListTo lists all present keys in sort order to the keys channel, WalkDir visits files in lexical order
+func (vfs fsBlobs) ListTo(keys chan<- KeyOrError, acceptor func(string) Key) bool {
+	err := fs.WalkDir(vfs.fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || strings.HasSuffix(name, tmpSuffix) {
+			return err
+		}
+		// strip the extension, if any, as in fileBlobs
+		if key := acceptor(strings.Split(entry.Name(), ".")[0]); key != nil {
+			keys <- KeyOrError{key, nil}
+		}
+		return nil
+	})
+	if err != nil {
+		return failKeyOrError(keys, err)
+	}
+	return true
+}
+
+// Keyname returns the path of the key blob as given by the layout
+func (vfs fsBlobs) Keyname(key Key) string {
+	return vfs.layout(key)
+}
+
+// TmpKeyname returns a temporary keyname, never to be created
+func (vfs fsBlobs) TmpKeyname(size int) string {
+	key := make([]byte, size)
+	rand.Reader.Read(key)
+	return Key(key).String() + tmpSuffix
+}
+
+// NewBlobFS exposes a BlobStore as a read only fs.FS, for http.FileServer (through http.FS) or fs.WalkDir
+//
+// The fs.FS is a single flat directory with a file per blob named after its hex key.
+// Blobs are streamed and verified as they are read, sizing them without reading them if blobs is a BlobSizer,
+// and seeking back reopens them
+func NewBlobFS(blobs BlobStore) fs.FS {
+	return blobFS{blobs}
+}
+
+// blobFS is the fs.FS view of a BlobStore
+type blobFS struct {
+	blobs BlobStore
+}
+
+// Open the root directory or a blob file by name
+func (bfs blobFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return &blobDir{blobs: bfs.blobs}, nil
+	}
+	key, err := hex.DecodeString(name)
+	if err != nil || Key(key).String() != name {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	size, err := blobSize(bfs.blobs, key)
+	if err != nil {
+		if isNotFound(err) {
+			err = fs.ErrNotExist
+		}
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &blobFile{blobs: bfs.blobs, key: key, info: blobInfo{name, size, false}}, nil
+}
+
+// blobFile is an open blob, read from the store at the offset seeked to
+type blobFile struct {
+	blobs  BlobStore
+	key    Key
+	info   blobInfo
+	reader io.Reader // nil till read
+	read   int64     // offset of reader
+	offset int64
+}
+
+// Read reads the blob from the offset, reopening it if it was seeked back
+func (f *blobFile) Read(buf []byte) (int, error) {
+	if f.reader == nil || f.offset < f.read {
+		reader, err := f.blobs.Read(f.key)
+		if err != nil {
+			return 0, err
+		}
+		f.reader, f.read = reader, 0
+	}
+	if f.offset > f.read {
+		skipped, err := io.CopyN(ioutil.Discard, f.reader, f.offset-f.read)
+		if f.read += skipped; err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.reader.Read(buf)
+	f.read += int64(n)
+	f.offset = f.read
+	return n, err
+}
+
+// Seek sets the offset of the next Read
+func (f *blobFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.info.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Stat returns the blob file info
+func (f *blobFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// Close does nothing, as blob readers need no closing
+func (f *blobFile) Close() error {
+	return nil
+}
+
+// blobDir is the open root directory, listing the blobs on demand
+type blobDir struct {
+	blobs BlobStore
+	keys  <-chan KeyOrError
+	done  bool
+}
+
+// Stat returns the root directory info
+func (d *blobDir) Stat() (fs.FileInfo, error) {
+	return blobInfo{".", 0, true}, nil
+}
+
+// Read fails, as directories can not be read
+func (d *blobDir) Read(buf []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: ".", Err: errors.New("is a directory")}
+}
+
+// Close returns right away, any pending listing is drained in the background, as List can not be cancelled
+func (d *blobDir) Close() error {
+	if d.keys != nil && !d.done {
+		go func(keys <-chan KeyOrError) {
+			for range keys {
+			}
+		}(d.keys)
+	}
+	d.done = true
+	return nil
+}
+
+// ReadDir returns the next n blob entries, or all the remaining ones if n <= 0
+func (d *blobDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.keys == nil {
+		d.keys = d.blobs.List()
+	}
+	entries := []fs.DirEntry{}
+	for !d.done && (n <= 0 || len(entries) < n) {
+		keyOrErr, ok := <-d.keys
+		if !ok {
+			d.done = true
+			break
+		}
+		if keyOrErr.err != nil {
+			return entries, keyOrErr.err
+		}
+		entries = append(entries, blobEntry{d.blobs, keyOrErr.key.String()})
+	}
+	if n > 0 && len(entries) == 0 {
+		return entries, io.EOF
+	}
+	return entries, nil
+}
+
+// blobEntry is a directory entry of a blob, its info is only known once asked for
+type blobEntry struct {
+	blobs BlobStore
+	name  string
+}
+
+func (e blobEntry) Name() string      { return e.name }
+func (e blobEntry) IsDir() bool       { return false }
+func (e blobEntry) Type() fs.FileMode { return 0 }
+
+// Info returns the blob file info, sizing the blob
+func (e blobEntry) Info() (fs.FileInfo, error) {
+	key, _ := hex.DecodeString(e.name)
+	size, err := blobSize(e.blobs, key)
+	if err != nil {
+		if isNotFound(err) {
+			err = fs.ErrNotExist
+		}
+		return nil, &fs.PathError{Op: "stat", Path: e.name, Err: err}
+	}
+	return blobInfo{e.name, size, false}, nil
+}
+
+// blobInfo is the info of a blob file or the root directory
+type blobInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i blobInfo) Name() string       { return i.name }
+func (i blobInfo) Size() int64        { return i.size }
+func (i blobInfo) ModTime() time.Time { return time.Time{} }
+func (i blobInfo) IsDir() bool        { return i.dir }
+func (i blobInfo) Sys() interface{}   { return nil }
+
+// Mode returns a read only file or directory mode
+func (i blobInfo) Mode() fs.FileMode {
+	if i.IsDir() {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
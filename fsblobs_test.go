@@ -0,0 +1,96 @@
+package blobstore
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// TestFSReadOnly checks blobs laid out as in fileBlobs on a fs.FS are read, listed but never written
+func TestFSReadOnly(t *testing.T) {
+	// setup
+	fsys := fstest.MapFS{"README": &fstest.MapFile{Data: []byte("not a blob")}}
+	for _, testCase := range testData {
+		fsys[testCase.expectedPath] = &fstest.MapFile{Data: []byte(testCase.input)}
+	}
+	blobs := NewFSBlobServer(fsys, crypto.SHA1, nil)
+	// exercise
+	for _, testCase := range testData {
+		key := toKeyOrDie(t, testCase.expectedHash)
+		reader, err := blobs.Read(key)
+		assert(err == nil, t, "Error fetching %s: %v", key, err)
+		blob, err := ioutil.ReadAll(reader)
+		assert(err == nil, t, "Error reading %s: %v", key, err)
+		assert(string(blob) == testCase.input, t, "Expected to read '%s' but got '%s'", testCase.input, blob)
+		err = blobs.Remove(key)
+		assert(err == ErrReadOnly, t, "Expected a read only error removing %s but got %v", key, err)
+	}
+	_, err := blobs.Write(strings.NewReader("new blob"))
+	assert(err == ErrReadOnly, t, "Expected a read only error writing but got %v", err)
+	err = blobs.Remove(Key(make([]byte, crypto.SHA1.Size())))
+	assert(err == ErrReadOnly, t, "Expected a read only error removing a missing key but got %v", err)
+	wrapped := &VFSBlobServer{struct{ fsBlobs }{blobs.VirtualFS.(fsBlobs)}, crypto.SHA1}
+	err = wrapped.Remove(Key(make([]byte, crypto.SHA1.Size())))
+	assert(err == ErrReadOnly, t, "Expected a read only error removing from a wrapped fs.FS but got %v", err)
+	expectedKeys := buildExpectedKeys()
+	count := 0
+	for keyOrErr := range blobs.List() {
+		assert(keyOrErr.err == nil, t, "Error in List stream: %v", keyOrErr.err)
+		assert(expectedKeys[keyOrErr.key.String()], t, "Unexpected key: %s", keyOrErr.key)
+		count++
+	}
+	assert(count == len(testData), t, "Expected %d keys listed but got %d", len(testData), count)
+}
+
+// TestBlobFS checks a BlobStore exposed as a fs.FS passes the fs.FS conformance tests and can be served
+func TestBlobFS(t *testing.T) {
+	// setup
+	blobs := NewMemBlobStore(crypto.SHA1)
+	names := []string{}
+	for _, testCase := range testData {
+		_, err := blobs.Write(strings.NewReader(testCase.input))
+		assert(err == nil, t, "Error writing blob %s: %v", testCase.expectedHash, err)
+		names = append(names, testCase.expectedHash)
+	}
+	fsys := NewBlobFS(blobs)
+	// exercise
+	err := fstest.TestFS(fsys, names...)
+	assert(err == nil, t, "BlobFS failed the fs.FS tests: %v", err)
+	entries, err := fs.ReadDir(NewBlobFS(&unreadable{blobs.(BlobSizer)}), ".")
+	assert(err == nil && len(entries) == len(names), t, "Expected %d entries but got %v: %v", len(names), entries, err)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		assert(err == nil && info.Size() >= 0, t, "Error sizing %s without reading it: %v", entry.Name(), err)
+	}
+	// and through http.FileServer, with a range
+	server := httptest.NewServer(http.FileServer(http.FS(fsys)))
+	defer server.Close()
+	request, _ := http.NewRequest("GET", server.URL+"/"+testData[1].expectedHash, nil)
+	request.Header.Set("Range", "bytes=3-")
+	response, err := http.DefaultClient.Do(request)
+	assert(err == nil, t, "Error getting %s: %v", testData[1].expectedHash, err)
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	assert(response.StatusCode == http.StatusPartialContent, t, "Expected a partial response but got %s", response.Status)
+	assert(string(body) == testData[1].input[3:], t, "Expected '%s' but got '%s'", testData[1].input[3:], body)
+	response, err = http.Get(server.URL + "/" + strings.Repeat("0", 40))
+	assert(err == nil, t, "Error getting a missing blob: %v", err)
+	response.Body.Close()
+	assert(response.StatusCode == http.StatusNotFound, t, "Expected a missing blob not found but got %s", response.Status)
+}
+
+// unreadable is a BlobSizer failing all reads
+type unreadable struct {
+	BlobSizer
+}
+
+func (u *unreadable) Read(key Key) (io.Reader, error) {
+	return nil, fmt.Errorf("Unexpected read of %v", key)
+}
@@ -0,0 +1,387 @@
+package blobstore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	gitPackIndexVersion = 2
+	gitPackBlob         = 3
+	gitPackOfsDelta     = 6
+	gitPackRefDelta     = 7
+	gitPackCacheSize    = 256
+)
+
+var gitPackIndexMagic = []byte{0xff, 't', 'O', 'c'}
+
+// ImportGit imports the blob objects of the git repository at gitDir, either its working tree, .git
+// directory or a bare repository, into blobs, which must hash with the object format of the repository.
+// Both loose and packed objects are imported, trees, commits & tags are skipped, as are blobs already present.
+// It returns the number of blobs imported
+func ImportGit(gitDir string, blobs *GitBlobServer) (int, error) {
+	if info, err := os.Stat(filepath.Join(gitDir, ".git")); err == nil && info.IsDir() {
+		gitDir = filepath.Join(gitDir, ".git")
+	}
+	objectsDir := filepath.Join(gitDir, "objects")
+	imported, err := importLooseGitObjects(objectsDir, blobs)
+	if err != nil {
+		return imported, err
+	}
+	indexes, err := filepath.Glob(filepath.Join(objectsDir, "pack", "*.idx"))
+	if err != nil {
+		return imported, err
+	}
+	for _, index := range indexes {
+		n, err := importGitPack(index, objectsDir, blobs)
+		imported += n
+		if err != nil {
+			return imported, err
+		}
+	}
+	return imported, nil
+}
+
+// importLooseGitObjects imports the blobs among the zlib compressed objects at objects/xx/<rest of the id>
+func importLooseGitObjects(objectsDir string, blobs *GitBlobServer) (int, error) {
+	dirs, err := filepath.Glob(filepath.Join(objectsDir, "[0-9a-f][0-9a-f]"))
+	if err != nil {
+		return 0, err
+	}
+	imported := 0
+	for _, dir := range dirs {
+		names, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return imported, err
+		}
+		for _, name := range names {
+			key, err := hex.DecodeString(filepath.Base(dir) + name.Name())
+			if err != nil || len(key) != blobs.hash.Size() || hasBlob(blobs, key) {
+				continue
+			}
+			ok, err := importLooseGitObject(filepath.Join(dir, name.Name()), key, blobs)
+			if err != nil {
+				return imported, err
+			}
+			if ok {
+				imported++
+			}
+		}
+	}
+	return imported, nil
+}
+
+// importLooseGitObject imports a loose object if it is a blob
+func importLooseGitObject(filename string, key Key, blobs *GitBlobServer) (bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	inflater, err := zlib.NewReader(file)
+	if err != nil {
+		return false, fmt.Errorf("Corrupted git object %v: %v", key, err)
+	}
+	defer inflater.Close()
+	reader := bufio.NewReader(inflater)
+	header, err := reader.ReadString(0)
+	if err != nil {
+		return false, fmt.Errorf("Corrupted git object %v: %v", key, err)
+	}
+	fields := strings.Fields(strings.TrimSuffix(header, "\x00"))
+	if len(fields) != 2 || fields[0] != gitBlobType {
+		return false, nil
+	}
+	if _, err := strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return false, fmt.Errorf("Corrupted git object %v header %q", key, header)
+	}
+	return true, importGitBlob(reader, key, blobs)
+}
+
+// importGitBlob writes a blob checking it gets the key git gave it before committing it,
+// so a mismatch leaves the stored blobs alone
+func importGitBlob(blob io.Reader, expectedKey Key, blobs *GitBlobServer) error {
+	key, err := blobs.writeChecked(blob, expectedKey)
+	if err == nil && !key.Equals(expectedKey) {
+		err = fmt.Errorf("%s git object %v hashes as %v", corruptedBlobErrorPrefix, expectedKey, key)
+	}
+	return err
+}
+
+// gitPack reads objects from a pack file, resolving deltas against their bases
+type gitPack struct {
+	file       *os.File
+	hash       crypto.Hash
+	objectsDir string
+	offsets    map[string]int64
+	cache      map[int64]gitPackObject
+}
+
+// gitPackObject is an undeltified pack object
+type gitPackObject struct {
+	objectType int
+	data       []byte
+}
+
+// importGitPack imports the blobs of the pack with the given index
+func importGitPack(index, objectsDir string, blobs *GitBlobServer) (int, error) {
+	keys, offsets, err := readGitPackIndex(index, blobs.hash.Size())
+	if err != nil {
+		return 0, err
+	}
+	file, err := os.Open(strings.TrimSuffix(index, ".idx") + ".pack")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	pack := &gitPack{file: file, hash: blobs.hash, objectsDir: objectsDir,
+		offsets: make(map[string]int64, len(keys)), cache: make(map[int64]gitPackObject)}
+	for i, key := range keys {
+		pack.offsets[key.String()] = offsets[i]
+	}
+	imported := 0
+	for i, key := range keys {
+		if hasBlob(blobs, key) {
+			continue
+		}
+		object, err := pack.object(offsets[i])
+		if err != nil {
+			return imported, fmt.Errorf("Reading git object %v from %s: %v", key, file.Name(), err)
+		}
+		if object.objectType != gitPackBlob {
+			continue
+		}
+		if err := importGitBlob(bytes.NewReader(object.data), key, blobs); err != nil {
+			return imported, err
+		}
+		imported++
+	}
+	return imported, nil
+}
+
+// readGitPackIndex returns the object keys & pack offsets of a version 2 pack index
+func readGitPackIndex(index string, keySize int) ([]Key, []int64, error) {
+	data, err := ioutil.ReadFile(index)
+	if err != nil {
+		return nil, nil, err
+	}
+	fanout := 8
+	if len(data) < fanout+256*4 || !bytes.Equal(data[:4], gitPackIndexMagic) ||
+		binary.BigEndian.Uint32(data[4:8]) != gitPackIndexVersion {
+		return nil, nil, fmt.Errorf("Unsupported git pack index %s", index)
+	}
+	count := int(binary.BigEndian.Uint32(data[fanout+255*4:]))
+	keysStart := fanout + 256*4
+	offsetsStart := keysStart + count*(keySize+4) // keys, then their crc32s
+	largeOffsetsStart := offsetsStart + count*4
+	if len(data) < largeOffsetsStart {
+		return nil, nil, fmt.Errorf("Truncated git pack index %s", index)
+	}
+	keys := make([]Key, count)
+	offsets := make([]int64, count)
+	for i := range keys {
+		keys[i] = Key(data[keysStart+i*keySize : keysStart+(i+1)*keySize])
+		offset := binary.BigEndian.Uint32(data[offsetsStart+i*4:])
+		if offset&0x80000000 == 0 {
+			offsets[i] = int64(offset)
+			continue
+		}
+		large := largeOffsetsStart + int(offset&0x7fffffff)*8
+		if len(data) < large+8 {
+			return nil, nil, fmt.Errorf("Truncated git pack index %s", index)
+		}
+		offsets[i] = int64(binary.BigEndian.Uint64(data[large:]))
+	}
+	return keys, offsets, nil
+}
+
+// object returns the object at offset, applying its deltas if any
+func (pack *gitPack) object(offset int64) (gitPackObject, error) {
+	if object, ok := pack.cache[offset]; ok {
+		return object, nil
+	}
+	reader := bufio.NewReader(io.NewSectionReader(pack.file, offset, 1<<62))
+	c, err := reader.ReadByte()
+	objectType, size := int(c>>4)&7, int64(c&0x0f)
+	for shift := uint(4); err == nil && c&0x80 != 0; shift += 7 {
+		c, err = reader.ReadByte()
+		size |= int64(c&0x7f) << shift
+	}
+	var base gitPackObject
+	switch objectType {
+	case gitPackOfsDelta:
+		var distance int64
+		if distance, err = readGitOffset(reader); err == nil {
+			base, err = pack.baseAt(offset - distance)
+		}
+	case gitPackRefDelta:
+		key := make(Key, pack.hash.Size())
+		if _, err = io.ReadFull(reader, key); err == nil {
+			base, err = pack.base(key)
+		}
+	}
+	if err != nil {
+		return gitPackObject{}, err
+	}
+	data, err := inflateGitObject(reader, size)
+	if err != nil {
+		return gitPackObject{}, err
+	}
+	object := gitPackObject{objectType, data}
+	if objectType == gitPackOfsDelta || objectType == gitPackRefDelta {
+		if data, err = applyGitDelta(base.data, data); err != nil {
+			return gitPackObject{}, err
+		}
+		object = gitPackObject{base.objectType, data}
+	}
+	return object, nil
+}
+
+// base returns a delta base by key, from the pack or among the loose objects
+func (pack *gitPack) base(key Key) (gitPackObject, error) {
+	if offset, ok := pack.offsets[key.String()]; ok {
+		return pack.baseAt(offset)
+	}
+	hexKey := key.String()
+	file, err := os.Open(filepath.Join(pack.objectsDir, hexKey[:2], hexKey[2:]))
+	if err != nil {
+		return gitPackObject{}, fmt.Errorf("Delta base %v not found", key)
+	}
+	defer file.Close()
+	inflater, err := zlib.NewReader(file)
+	if err != nil {
+		return gitPackObject{}, err
+	}
+	defer inflater.Close()
+	data, err := ioutil.ReadAll(inflater)
+	if err != nil {
+		return gitPackObject{}, err
+	}
+	header := bytes.IndexByte(data, 0)
+	fields := strings.Fields(string(data[:header+1]))
+	objectTypes := map[string]int{"commit": 1, "tree": 2, gitBlobType: gitPackBlob, "tag": 4}
+	if header < 0 || len(fields) != 2 || objectTypes[fields[0]] == 0 {
+		return gitPackObject{}, fmt.Errorf("Corrupted git object %v", key)
+	}
+	return gitPackObject{objectTypes[fields[0]], data[header+1:]}, nil
+}
+
+// baseAt returns the delta base at offset, remembering it for the other deltas on it
+func (pack *gitPack) baseAt(offset int64) (gitPackObject, error) {
+	base, err := pack.object(offset)
+	if err == nil {
+		pack.remember(offset, base)
+	}
+	return base, err
+}
+
+// remember caches a resolved object, so delta chains sharing bases are not resolved over and over
+func (pack *gitPack) remember(offset int64, object gitPackObject) {
+	if len(pack.cache) >= gitPackCacheSize {
+		pack.cache = make(map[int64]gitPackObject)
+	}
+	pack.cache[offset] = object
+}
+
+// readGitOffset reads the base distance of an offset delta
+func readGitOffset(reader io.ByteReader) (int64, error) {
+	c, err := reader.ReadByte()
+	distance := int64(c & 0x7f)
+	for err == nil && c&0x80 != 0 {
+		c, err = reader.ReadByte()
+		distance = (distance+1)<<7 | int64(c&0x7f)
+	}
+	return distance, err
+}
+
+// inflateGitObject reads the zlib compressed data of an object expected to be size bytes long
+func inflateGitObject(reader io.Reader, size int64) ([]byte, error) {
+	inflater, err := zlib.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	defer inflater.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(inflater, size+1))
+	if err == nil && int64(len(data)) != size {
+		err = fmt.Errorf("Expected %d bytes in git object but got %d", size, len(data))
+	}
+	return data, err
+}
+
+// applyGitDelta rebuilds an object from its base and a delta of copy & insert instructions
+func applyGitDelta(base, delta []byte) ([]byte, error) {
+	baseSize, n := binary.Uvarint(delta)
+	if n <= 0 || baseSize != uint64(len(base)) {
+		return nil, fmt.Errorf("Git delta expected a %d bytes base but got %d", baseSize, len(base))
+	}
+	delta = delta[n:]
+	resultSize, n := binary.Uvarint(delta)
+	if n <= 0 {
+		return nil, fmt.Errorf("Corrupted git delta header")
+	}
+	delta = delta[n:]
+	// the result size is only trusted as a limit, the allocation grows as instructions yield bytes
+	capacity := uint64(len(base) + len(delta))
+	if resultSize < capacity {
+		capacity = resultSize
+	}
+	result := make([]byte, 0, capacity)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		switch {
+		case op&0x80 != 0: // copy from base, offset & size bytes are present as flagged by op
+			var offset, size uint64
+			for i := uint(0); i < 7; i++ {
+				if op&(1<<i) == 0 {
+					continue
+				}
+				if len(delta) == 0 {
+					return nil, fmt.Errorf("Truncated git delta")
+				}
+				if i < 4 {
+					offset |= uint64(delta[0]) << (8 * i)
+				} else {
+					size |= uint64(delta[0]) << (8 * (i - 4))
+				}
+				delta = delta[1:]
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if offset+size > uint64(len(base)) {
+				return nil, fmt.Errorf("Git delta copies beyond its base")
+			}
+			if uint64(len(result))+size > resultSize {
+				return nil, fmt.Errorf("Git delta yields more than its %d bytes result", resultSize)
+			}
+			result = append(result, base[offset:offset+size]...)
+		case op != 0: // insert the next op bytes
+			if int(op) > len(delta) {
+				return nil, fmt.Errorf("Truncated git delta")
+			}
+			if uint64(len(result))+uint64(op) > resultSize {
+				return nil, fmt.Errorf("Git delta yields more than its %d bytes result", resultSize)
+			}
+			result = append(result, delta[:op]...)
+			delta = delta[op:]
+		default:
+			return nil, fmt.Errorf("Reserved git delta instruction")
+		}
+	}
+	if uint64(len(result)) != resultSize {
+		return nil, fmt.Errorf("Git delta expected a %d bytes result but got %d", resultSize, len(result))
+	}
+	return result, nil
+}
@@ -0,0 +1,133 @@
+package blobstore
+
+import (
+	"crypto"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	gitBlobType = "blob"
+)
+
+// GitBlobServer is a VFSBlobServer keying blobs by their git object IDs, that is the hash of a
+// "blob <size>\0" header followed by the contents, so keys can be cross-referenced with git repositories.
+// SHA-1 keys match the default git object format and SHA-256 keys the sha256 one
+type GitBlobServer struct {
+	*VFSBlobServer
+}
+
+// NewGitBlobServer returns a GitBlobServer on vfs, hash must be SHA1 or SHA256
+func NewGitBlobServer(vfs VirtualFS, hash crypto.Hash) (*GitBlobServer, error) {
+	if hash != crypto.SHA1 && hash != crypto.SHA256 {
+		return nil, fmt.Errorf("Git objects are hashed with SHA-1 or SHA-256, not %v", hash)
+	}
+	return &GitBlobServer{&VFSBlobServer{vfs, hash}}, nil
+}
+
+// GitObjectKey returns the git object ID of a blob of the given size read from blob
+func GitObjectKey(hash crypto.Hash, size int64, blob io.Reader) (Key, error) {
+	hasher := gitObjectHasher(hash, gitBlobType, size)
+	n, err := io.Copy(hasher, blob)
+	if err == nil && n != size {
+		err = fmt.Errorf("Expected a %d bytes long blob, but got %d bytes", size, n)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return Key(hasher.Sum(nil)), nil
+}
+
+// gitObjectHasher returns a hasher already fed with the header of a git object of the given type & size
+func gitObjectHasher(hash crypto.Hash, objectType string, size int64) hash.Hash {
+	hasher := hash.New()
+	fmt.Fprintf(hasher, "%s %d\x00", objectType, size)
+	return hasher
+}
+
+// Read retrieves a reader for the given blob, checked against its git object ID.
+// As the header needs the size up front, the blob is read twice when the VirtualFS can not tell its size
+func (gbs *GitBlobServer) Read(key Key) (io.Reader, error) {
+	if err := gbs.checkKey(key); err != nil {
+		return nil, err
+	}
+	keyname := gbs.Keyname(key)
+	size, err := gbs.sizeOf(keyname)
+	if err != nil {
+		return nil, err
+	}
+	file, err := gbs.Open(keyname)
+	if err != nil {
+		return nil, err
+	}
+	return &checkedReader{file, key, gitObjectHasher(gbs.hash, gitBlobType, size)}, nil
+}
+
+// Write stores the bytes from the given reader and returns their git object ID
+func (gbs *GitBlobServer) Write(blob io.Reader) (Key, error) {
+	tmpKeyname, key, err := gbs.spoolObject(blob)
+	if err != nil {
+		return nil, err
+	}
+	return key, gbs.commit(tmpKeyname, key)
+}
+
+// writeChecked writes a blob only if its git object ID is the expected one, returning its ID either way
+func (gbs *GitBlobServer) writeChecked(blob io.Reader, expected Key) (Key, error) {
+	tmpKeyname, key, err := gbs.spoolObject(blob)
+	if err != nil {
+		return nil, err
+	}
+	if !key.Equals(expected) {
+		return key, gbs.Delete(tmpKeyname)
+	}
+	return key, gbs.commit(tmpKeyname, key)
+}
+
+// spoolObject spools a blob, counting its size, as the header needs it, to hash it then from the spooled copy
+func (gbs *GitBlobServer) spoolObject(blob io.Reader) (string, Key, error) {
+	counter := &countingReader{Reader: blob}
+	tmpKeyname, _, err := gbs.spool(counter)
+	if err != nil {
+		return "", nil, err
+	}
+	file, err := gbs.Open(tmpKeyname)
+	var key Key
+	if err == nil {
+		key, err = GitObjectKey(gbs.hash, counter.n, file)
+		file.Close()
+	}
+	if err != nil {
+		gbs.Delete(tmpKeyname)
+		return "", nil, err
+	}
+	return tmpKeyname, key, nil
+}
+
+// sizeOf returns the size of a keyname, from the VirtualFS if it knows it, or by reading it
+func (gbs *GitBlobServer) sizeOf(keyname string) (int64, error) {
+	if sizer, ok := gbs.VirtualFS.(sizer); ok {
+		return sizer.Size(keyname)
+	}
+	file, err := gbs.Open(keyname)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return io.Copy(ioutil.Discard, file)
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+// Read reads and counts
+func (r *countingReader) Read(buf []byte) (int, error) {
+	n, err := r.Reader.Read(buf)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,144 @@
+package blobstore
+
+import (
+	"crypto"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestGitObjectKeys checks blob keys match git object IDs
+func TestGitObjectKeys(t *testing.T) {
+	// setup
+	dir := fileBlobs{""}.TmpKeyname(10)
+	err := os.MkdirAll(dir, defaultPerms)
+	assert(err == nil, t, "Error creating %s: %v", dir, err)
+	files, err := NewGitBlobServer(fileBlobs{dir}, crypto.SHA1)
+	assert(err == nil, t, "Error creating the git blob server: %v", err)
+	mem, err := NewGitBlobServer(newMemBlobs(), crypto.SHA1)
+	assert(err == nil, t, "Error creating the git blob server: %v", err)
+	_, err = NewGitBlobServer(newMemBlobs(), crypto.MD5)
+	assert(err != nil, t, "Expected MD5 git objects to be rejected")
+	// exercise
+	for _, blobs := range []*GitBlobServer{files, mem} {
+		for blob, expectedKey := range map[string]string{
+			"":        "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391",
+			"hello\n": "ce013625030ba8dba906f756967f9e9ca394464a",
+		} {
+			key, err := blobs.Write(strings.NewReader(blob))
+			assert(err == nil, t, "Error writing '%s': %v", blob, err)
+			assert(key.String() == expectedKey, t, "Expected git object ID %s but got %v", expectedKey, key)
+			contents, err := readBlob(blobs, key)
+			assert(err == nil && string(contents) == blob, t, "Expected to read back '%s' but got '%s': %v",
+				blob, contents, err)
+		}
+	}
+	_, err = mem.Read(Key(make([]byte, crypto.SHA1.Size()+1)))
+	assert(errors.Is(err, ErrInvalidKey), t, "Expected an invalid key error for a too long key but got %v", err)
+	// a mismatched import leaves the stored blobs alone
+	key := toKeyOrDie(t, "ce013625030ba8dba906f756967f9e9ca394464a")
+	err = importGitBlob(strings.NewReader("hello\n"), toKeyOrDie(t, "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"), mem)
+	assert(err != nil && strings.HasPrefix(err.Error(), corruptedBlobErrorPrefix), t,
+		"Expected a corrupted blob error but got %v", err)
+	contents, err := readBlob(mem, key)
+	assert(err == nil && string(contents) == "hello\n", t, "Expected the stored blob kept but got '%s': %v",
+		contents, err)
+	// a corrupted blob is detected on read
+	err = ioutil.WriteFile(files.Keyname(key), []byte("hellO\n"), defaultPerms)
+	assert(err == nil, t, "Error corrupting blob: %v", err)
+	reader, err := files.Read(key)
+	assert(err == nil, t, "Error opening blob: %v", err)
+	_, err = ioutil.ReadAll(reader)
+	assert(err != nil && strings.HasPrefix(err.Error(), corruptedBlobErrorPrefix), t,
+		"Expected a corrupted blob error but got %v", err)
+	// cleanup
+	err = os.RemoveAll(dir)
+	assert(err == nil, t, "Error in cleanup removing %s: %v", dir, err)
+}
+
+// TestGitDeltaBounds checks git deltas are not trusted with the size of their result
+func TestGitDeltaBounds(t *testing.T) {
+	base := []byte("hello\n")
+	result, err := applyGitDelta(base, []byte{6, 12, 0x91, 0, 6, 0x91, 0, 6})
+	assert(err == nil && string(result) == "hello\nhello\n", t, "Expected the base twice but got '%s': %v", result, err)
+	huge := append([]byte{6}, binary.AppendUvarint(nil, 1<<62)...)
+	_, err = applyGitDelta(base, append(huge, 0x91, 0, 6))
+	assert(err != nil, t, "Expected a delta yielding less than its result size to fail")
+	_, err = applyGitDelta(base, []byte{6, 6, 0x91, 0, 6, 1, 'x'})
+	assert(err != nil, t, "Expected a delta yielding more than its result size to fail")
+}
+
+// TestImportGit checks loose and packed (deltified) blobs are imported from git repositories of both object formats
+func TestImportGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	for _, format := range []struct {
+		name string
+		hash crypto.Hash
+	}{{"sha1", crypto.SHA1}, {"sha256", crypto.SHA256}} {
+		// setup
+		dir := fileBlobs{""}.TmpKeyname(10)
+		git := func(args ...string) string {
+			command := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=test",
+				"-c", "user.email=test@example.com"}, args...)...)
+			command.Env = append(os.Environ(), "GIT_CONFIG_NOSYSTEM=1", "HOME="+dir)
+			output, err := command.CombinedOutput()
+			assert(err == nil, t, "Error running git %v: %v\n%s", args, err, output)
+			return string(output)
+		}
+		err := os.MkdirAll(dir, defaultPerms)
+		assert(err == nil, t, "Error creating %s: %v", dir, err)
+		git("init", "-q", "--object-format="+format.name)
+		lines := []string{}
+		for version := 0; version < 3; version++ {
+			lines = append(lines, fmt.Sprintf("line %d of a file long enough to be deltified", version))
+			for i := 0; i < 50; i++ {
+				lines = append(lines, fmt.Sprintf("some filler line %d", i))
+			}
+			err = ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte(strings.Join(lines, "\n")), defaultPerms)
+			assert(err == nil, t, "Error writing file: %v", err)
+			err = ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("small%d.txt", version)),
+				[]byte(fmt.Sprintf("small #%d\n", version)), defaultPerms)
+			assert(err == nil, t, "Error writing file: %v", err)
+			git("add", ".")
+			git("commit", "-q", "-m", fmt.Sprintf("version %d", version))
+		}
+		expected := map[string]bool{}
+		for _, line := range strings.Split(git("cat-file", "--batch-all-objects",
+			"--batch-check=%(objecttype) %(objectname)"), "\n") {
+			if strings.HasPrefix(line, gitBlobType+" ") {
+				expected[strings.TrimPrefix(line, gitBlobType+" ")] = true
+			}
+		}
+		// exercise, first loose objects, then a fresh store from the packed repository
+		for _, packed := range []bool{false, true} {
+			if packed {
+				git("repack", "-adfq", "--window=10", "--depth=10")
+				git("prune-packed")
+			}
+			blobs, err := NewGitBlobServer(newMemBlobs(), format.hash)
+			assert(err == nil, t, "Error creating the git blob server: %v", err)
+			imported, err := ImportGit(dir, blobs)
+			assert(err == nil, t, "Error importing %s git objects (packed %v): %v", format.name, packed, err)
+			assert(imported == len(expected), t, "Expected %d blobs imported but got %d", len(expected), imported)
+			for keyOrErr := range blobs.List() {
+				assert(keyOrErr.err == nil, t, "Error in List stream: %v", keyOrErr.err)
+				assert(expected[keyOrErr.key.String()], t, "Unexpected key %v", keyOrErr.key)
+				_, err := readBlob(blobs, keyOrErr.key)
+				assert(err == nil, t, "Error reading imported blob %v: %v", keyOrErr.key, err)
+			}
+			imported, err = ImportGit(dir, blobs)
+			assert(err == nil && imported == 0, t, "Expected nothing new to import but got %d: %v", imported, err)
+		}
+		// cleanup
+		err = os.RemoveAll(dir)
+		assert(err == nil, t, "Error in cleanup removing %s: %v", dir, err)
+	}
+}
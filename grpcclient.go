@@ -0,0 +1,412 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// GRPCBlobClient is a BlobAdmin on a remote gRPC BlobService, that verifies the blobs it reads
+// and the keys of the blobs it writes, never trusting the server
+type GRPCBlobClient struct {
+	url    string
+	hash   crypto.Hash
+	client *http.Client
+}
+
+// NewGRPCBlobClient returns a GRPCBlobClient on the service at url, requests are done by client,
+// or by http.DefaultClient if nil, which must speak HTTP/2, as both do over TLS
+func NewGRPCBlobClient(url string, hash crypto.Hash, client *http.Client) *GRPCBlobClient {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &GRPCBlobClient{strings.TrimSuffix(url, "/") + grpcService, hash, client}
+}
+
+// grpcCall is the client side of a call
+type grpcCall struct {
+	response *http.Response
+}
+
+// Read returns a reader streaming the blob chunks, verified as they are read
+func (c *GRPCBlobClient) Read(key Key) (io.Reader, error) {
+	if err := c.checkKey(key); err != nil {
+		return nil, err
+	}
+	call, err := c.call("Read", requestBody(marshalBytes(key)))
+	if err != nil {
+		return nil, err
+	}
+	// receive the first chunk already, so that missing keys fail here
+	reader := &grpcReader{call: call}
+	if reader.chunk, err = call.recvBytes(); err == io.EOF {
+		reader.done = true
+		call.close()
+	} else if err != nil {
+		call.close()
+		return nil, err
+	}
+	return &checkedReader{reader, key, c.hash.New()}, nil
+}
+
+// Write streams the blob in chunks, checking the key answered matches the blob hash
+func (c *GRPCBlobClient) Write(blob io.Reader) (Key, error) {
+	hasher := c.hash.New()
+	reader, writer := io.Pipe()
+	go func() {
+		chunk := make([]byte, grpcChunkSize)
+		for {
+			n, err := io.ReadFull(io.TeeReader(blob, hasher), chunk)
+			if n > 0 {
+				if err := writeGRPCMessage(writer, marshalBytes(chunk[:n])); err != nil {
+					writer.CloseWithError(err)
+					return
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				writer.Close()
+				return
+			} else if err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	call, err := c.call("Write", reader)
+	if err != nil {
+		reader.CloseWithError(err)
+		return nil, err
+	}
+	answer, err := call.unaryResponse()
+	if err != nil {
+		return nil, err
+	}
+	items, err := unmarshalBytes(answer)
+	if err != nil || len(items) != 1 {
+		return nil, fmt.Errorf("Bad write response: %v", err)
+	}
+	key := Key(hasher.Sum(nil))
+	if !key.Equals(items[0]) {
+		return nil, fmt.Errorf("%s server stored %v but the blob hash is %v", corruptedBlobErrorPrefix, Key(items[0]), key)
+	}
+	return key, nil
+}
+
+// List returns the service keys via a channel, as they are streamed in batches
+func (c *GRPCBlobClient) List() <-chan KeyOrError {
+	keys := make(chan KeyOrError)
+	go func() {
+		call, err := c.call("List", requestBody(nil))
+		if err != nil {
+			failKeyOrError(keys, err)
+			return
+		}
+		defer call.close()
+		for {
+			batch, err := call.recvKeys()
+			if err == io.EOF {
+				close(keys)
+				return
+			} else if err != nil {
+				failKeyOrError(keys, err)
+				return
+			}
+			for _, key := range batch {
+				keys <- KeyOrError{key, nil}
+			}
+		}
+	}()
+	return keys
+}
+
+// checkKey fails keys not as long as the client hash
+func (c *GRPCBlobClient) checkKey(key Key) error {
+	return checkKeySize(c.hash, key)
+}
+
+// Remove the given key, a missing key is not an error
+func (c *GRPCBlobClient) Remove(key Key) error {
+	_, err := c.unary("Remove", marshalBytes(key))
+	return err
+}
+
+// Has tells which of the given keys are present on the service, in a single call
+func (c *GRPCBlobClient) Has(keys ...Key) ([]bool, error) {
+	values, err := c.batch("Has", keys)
+	if err != nil {
+		return nil, err
+	}
+	present := make([]bool, len(values))
+	for i, value := range values {
+		present[i] = value != 0
+	}
+	return present, nil
+}
+
+// Stat returns the sizes of the given keys blobs on the service, -1 for the missing ones, in a single call
+func (c *GRPCBlobClient) Stat(keys ...Key) ([]int64, error) {
+	values, err := c.batch("Stat", keys)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make([]int64, len(values))
+	for i, value := range values {
+		sizes[i] = int64(value)
+	}
+	return sizes, nil
+}
+
+// Size returns the size of the blob, with a Stat call
+func (c *GRPCBlobClient) Size(key Key) (int64, error) {
+	sizes, err := c.Stat(key)
+	if err != nil {
+		return 0, err
+	}
+	if sizes[0] < 0 {
+		return 0, fmt.Errorf("Key not found: %v", key)
+	}
+	return sizes[0], nil
+}
+
+// Push writes to the service the blobs of src it is missing, returning how many were written.
+// The src keys are offered in batches on a Sync stream, while the missing ones answered are written
+func (c *GRPCBlobClient) Push(src BlobStore) (int, error) {
+	reader, writer := io.Pipe()
+	offered := make(chan error, 1)
+	go func() {
+		keys := src.List()
+		defer drainKeys(keys)
+		batch := [][]byte{}
+		for keyOrErr := range keys {
+			err := keyOrErr.err
+			if err == nil {
+				batch = append(batch, keyOrErr.key)
+			}
+			if err == nil && len(batch) == grpcListBatch {
+				err = writeGRPCMessage(writer, marshalBytes(batch...))
+				batch = batch[:0]
+			}
+			if err != nil {
+				offered <- err
+				writer.CloseWithError(err)
+				return
+			}
+		}
+		if len(batch) > 0 {
+			if err := writeGRPCMessage(writer, marshalBytes(batch...)); err != nil {
+				offered <- err
+				writer.CloseWithError(err)
+				return
+			}
+		}
+		offered <- nil
+		writer.Close()
+	}()
+	call, err := c.call("Sync", reader)
+	if err != nil {
+		reader.CloseWithError(err)
+		return 0, err
+	}
+	defer call.close()
+	written := 0
+	for {
+		missing, err := call.recvKeys()
+		if err == io.EOF {
+			return written, <-offered
+		} else if err != nil {
+			reader.CloseWithError(err)
+			if offerErr := <-offered; offerErr != nil {
+				return written, offerErr
+			}
+			return written, err
+		}
+		for _, key := range missing {
+			if err := copyBlob(src, c, key); err != nil {
+				reader.CloseWithError(err)
+				<-offered
+				return written, err
+			}
+			written++
+		}
+	}
+}
+
+// copyBlob copies a blob from src to dst, checking it keeps its key
+func copyBlob(src, dst BlobStore, key Key) error {
+	blob, err := src.Read(key)
+	if err != nil {
+		return err
+	}
+	written, err := dst.Write(blob)
+	if err == nil && !written.Equals(key) {
+		err = fmt.Errorf("%s copied %v as %v", corruptedBlobErrorPrefix, key, written)
+	}
+	return err
+}
+
+// batch does a unary call with keys, answering varints
+func (c *GRPCBlobClient) batch(method string, keys []Key) ([]uint64, error) {
+	items := make([][]byte, len(keys))
+	for i, key := range keys {
+		items[i] = key
+	}
+	answer, err := c.unary(method, marshalBytes(items...))
+	if err != nil {
+		return nil, err
+	}
+	values, err := unmarshalVarints(answer)
+	if err == nil && len(values) != len(keys) {
+		err = fmt.Errorf("Expected %d %s results but got %d", len(keys), method, len(values))
+	}
+	return values, err
+}
+
+// unary does a call with a single request and a single response message
+func (c *GRPCBlobClient) unary(method string, request []byte) ([]byte, error) {
+	call, err := c.call(method, requestBody(request))
+	if err != nil {
+		return nil, err
+	}
+	return call.unaryResponse()
+}
+
+// call starts a call of the method, with the request messages read from body
+func (c *GRPCBlobClient) call(method string, body io.Reader) (*grpcCall, error) {
+	request, err := http.NewRequest("POST", c.url+method, body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", grpcContentType)
+	request.Header.Set("TE", "trailers")
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	call := &grpcCall{response}
+	if response.StatusCode != http.StatusOK {
+		call.close()
+		return nil, fmt.Errorf("gRPC %s call failed with %s", method, response.Status)
+	}
+	// trailers only responses carry the status in the headers
+	if err := call.status(response.Header); err != nil {
+		call.close()
+		return nil, err
+	}
+	return call, nil
+}
+
+// requestBody frames a single request message
+func requestBody(message []byte) io.Reader {
+	body := &bytes.Buffer{}
+	writeGRPCMessage(body, message)
+	return body
+}
+
+// recv reads the next response message, io.EOF at the end of a successful call
+func (call *grpcCall) recv() ([]byte, error) {
+	message, err := readGRPCMessage(call.response.Body)
+	if err == io.EOF {
+		if err := call.status(call.response.Trailer); err != nil {
+			return nil, err
+		}
+		if call.response.Trailer.Get("Grpc-Status") == "" {
+			return nil, fmt.Errorf("gRPC call ended without a status")
+		}
+	}
+	return message, err
+}
+
+// recvBytes reads the next response message single bytes field
+func (call *grpcCall) recvBytes() ([]byte, error) {
+	message, err := call.recv()
+	if err != nil {
+		return nil, err
+	}
+	items, err := unmarshalBytes(message)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Join(items, nil), nil
+}
+
+// recvKeys reads the keys of the next response message
+func (call *grpcCall) recvKeys() ([]Key, error) {
+	message, err := call.recv()
+	if err != nil {
+		return nil, err
+	}
+	items, err := unmarshalBytes(message)
+	keys := make([]Key, len(items))
+	for i, item := range items {
+		keys[i] = Key(item)
+	}
+	return keys, err
+}
+
+// unaryResponse reads the single response message and the final status
+func (call *grpcCall) unaryResponse() ([]byte, error) {
+	defer call.close()
+	message, err := call.recv()
+	if err == io.EOF {
+		return nil, fmt.Errorf("Missing gRPC response message")
+	} else if err != nil {
+		return nil, err
+	}
+	if _, err := call.recv(); err != io.EOF {
+		if err == nil {
+			err = fmt.Errorf("Unexpected gRPC response message")
+		}
+		return nil, err
+	}
+	return message, nil
+}
+
+// status returns the error of the call status in header, if any
+func (call *grpcCall) status(header http.Header) error {
+	code := header.Get("Grpc-Status")
+	if code == "" {
+		return nil
+	}
+	number, err := strconv.Atoi(code)
+	if err != nil {
+		return fmt.Errorf("Bad gRPC status %q", code)
+	}
+	return fromGRPCStatus(&grpcStatus{number, grpcUnescape(header.Get("Grpc-Message"))})
+}
+
+// close ends the call
+func (call *grpcCall) close() {
+	call.response.Body.Close()
+}
+
+// grpcReader reads the chunks of a Read call
+type grpcReader struct {
+	call  *grpcCall
+	chunk []byte
+	done  bool
+}
+
+// Read the current chunk, receiving the next one when exhausted
+func (r *grpcReader) Read(buf []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		chunk, err := r.call.recvBytes()
+		if err == io.EOF {
+			r.done = true
+			r.call.close()
+		} else if err != nil {
+			r.call.close()
+			return 0, err
+		}
+		r.chunk = chunk
+	}
+	n := copy(buf, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
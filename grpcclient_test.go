@@ -0,0 +1,191 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestGRPCBlobClient returns an admin client on an in process gRPC server on blobs
+func newTestGRPCBlobClient(blobs BlobAdmin) (*GRPCBlobClient, *httptest.Server) {
+	return newTestGRPCClient(blobs, GRPCServerOptions{Admin: BasicAuthAdmin("admin", "secret")}, "admin:secret@")
+}
+
+// newTestGRPCClient returns a client, authenticated with userinfo, on an in process gRPC server on blobs,
+// over HTTP/2 on in memory connections, so no sockets are involved
+func newTestGRPCClient(blobs BlobAdmin, options GRPCServerOptions, userinfo string) (*GRPCBlobClient, *httptest.Server) {
+	listener := newPipeListener()
+	server := httptest.NewUnstartedServer(NewGRPCBlobServer(blobs, options))
+	server.Listener = listener
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	client := server.Client()
+	transport := client.Transport.(*http.Transport)
+	transport.DialContext = listener.dial
+	transport.TLSClientConfig.ServerName = "example.com" // as in the test certificate
+	return NewGRPCBlobClient("https://"+userinfo+"example.com", crypto.SHA1, client), server
+}
+
+// pipeListener is an in memory net.Listener, its connections are net.Pipes
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+// newPipeListener returns a pipeListener ready to dial
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+// Accept waits for the next dialed connection
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+// Addr returns a pipe address
+func (l *pipeListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "pipe", Net: "pipe"}
+}
+
+// dial connects to the listener, whatever the address
+func (l *pipeListener) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	server, client := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// TestGRPCReadsNWrites test that a gRPC store does its reads and writes as expected
+func TestGRPCReadsNWrites(t *testing.T) {
+	// setup
+	client, server := newTestGRPCBlobClient(NewMemBlobAdmin(crypto.SHA1))
+	defer server.Close()
+	// exercise
+	readsNWrites(t, client)
+	// and a blob of several chunks
+	blob := bytes.Repeat([]byte("0123456789abcdef"), grpcChunkSize/5)
+	key, err := client.Write(bytes.NewReader(blob))
+	assert(err == nil, t, "Error writing a large blob: %v", err)
+	reader, err := client.Read(key)
+	assert(err == nil, t, "Error fetching %s: %v", key, err)
+	read, err := ioutil.ReadAll(reader)
+	assert(err == nil, t, "Error reading %s: %v", key, err)
+	assert(bytes.Equal(read, blob), t, "Expected to read back %d bytes but got %d", len(blob), len(read))
+	_, err = client.Read(Key(make([]byte, crypto.SHA1.Size()+1)))
+	assert(errors.Is(err, ErrInvalidKey), t, "Expected an invalid key error for a too long key but got %v", err)
+	err = client.Remove(Key(make([]byte, 1)))
+	assert(errors.Is(err, ErrInvalidKey), t, "Expected the service to refuse a short key but got %v", err)
+}
+
+// TestGRPCList test that a gRPC store lists all keys
+func TestGRPCList(t *testing.T) {
+	// setup
+	client, server := newTestGRPCBlobClient(NewMemBlobAdmin(crypto.SHA1))
+	defer server.Close()
+	// exercise
+	listChecks(t, buildExpectedKeys(), client)
+}
+
+// TestGRPCHasStatPush checks the batch calls and pushing the missing blobs on a Sync stream
+func TestGRPCHasStatPush(t *testing.T) {
+	// setup
+	blobs := NewMemBlobAdmin(crypto.SHA1)
+	client, server := newTestGRPCBlobClient(blobs)
+	defer server.Close()
+	src := NewMemBlobAdmin(crypto.SHA1)
+	keys := []Key{}
+	for i := 0; i < grpcListBatch+10; i++ {
+		key, err := src.Write(strings.NewReader(fmt.Sprintf("blob #%d", i)))
+		assert(err == nil, t, "Error writing blob #%d: %v", i, err)
+		keys = append(keys, key)
+		if i%2 == 0 {
+			blobs.Write(strings.NewReader(fmt.Sprintf("blob #%d", i)))
+		}
+	}
+	// exercise
+	present, err := client.Has(keys[0], keys[1])
+	assert(err == nil, t, "Error calling Has: %v", err)
+	assert(present[0] && !present[1], t, "Expected just the first key present but got %v", present)
+	sizes, err := client.Stat(keys[0], keys[1])
+	assert(err == nil, t, "Error calling Stat: %v", err)
+	assert(sizes[0] == int64(len("blob #0")) && sizes[1] == -1, t, "Unexpected sizes %v", sizes)
+	written, err := client.Push(src)
+	assert(err == nil, t, "Error pushing blobs: %v", err)
+	assert(written == len(keys)/2, t, "Expected %d blobs pushed but got %d", len(keys)/2, written)
+	present, err = client.Has(keys...)
+	assert(err == nil, t, "Error calling Has: %v", err)
+	for i := range keys {
+		assert(present[i], t, "Expected key %v present after pushing", keys[i])
+	}
+	written, err = client.Push(src)
+	assert(err == nil && written == 0, t, "Expected nothing left to push but got %d, %v", written, err)
+}
+
+// TestGRPCWire checks the protocol buffers encoding of the BlobService messages
+func TestGRPCWire(t *testing.T) {
+	items, err := unmarshalBytes(marshalBytes([]byte("a"), []byte{}, []byte("bc")))
+	assert(err == nil && fmt.Sprintf("%q", items) == `["a" "" "bc"]`, t, "Unexpected bytes %q, %v", items, err)
+	values, err := unmarshalVarints(marshalVarints(1, 0, uint64(1<<40), ^uint64(0)))
+	assert(err == nil && fmt.Sprint(values) == fmt.Sprint([]uint64{1, 0, 1 << 40, ^uint64(0)}), t,
+		"Unexpected varints %v, %v", values, err)
+	assert(int64(values[3]) == -1, t, "Expected -1 to survive as a varint but got %d", int64(values[3]))
+	// unpacked varints and unknown fields are accepted too
+	values, err = unmarshalVarints([]byte{1 << 3, 7, 2<<3 | 2, 1, 'x', 1 << 3, 9})
+	assert(err == nil && fmt.Sprint(values) == "[7 9]", t, "Unexpected unpacked varints %v, %v", values, err)
+	_, err = unmarshalBytes([]byte{1<<3 | 2, 5, 'x'})
+	assert(err != nil, t, "Expected a truncated message error")
+}
+
+// TestGRPCRemoveAndBadKeys checks removals need admin credentials and bad keys are invalid arguments
+func TestGRPCRemoveAndBadKeys(t *testing.T) {
+	// setup
+	blobs := writeBlobs(t, NewMemBlobAdmin(crypto.SHA1), 1)
+	key := (<-blobs.List()).key
+	options := GRPCServerOptions{Admin: BasicAuthAdmin("admin", "secret")}
+	disabled, server := newTestGRPCClient(blobs, GRPCServerOptions{}, "admin:secret@")
+	defer server.Close()
+	anonymous, server := newTestGRPCClient(blobs, options, "")
+	defer server.Close()
+	admin, server := newTestGRPCClient(blobs, options, "admin:secret@")
+	defer server.Close()
+	// exercise
+	err := disabled.Remove(key)
+	assert(err != nil && strings.Contains(err.Error(), "disabled"), t, "Expected removal disabled but got %v", err)
+	err = anonymous.Remove(key)
+	assert(err != nil && strings.Contains(err.Error(), "status 16"), t, "Expected unauthenticated but got %v", err)
+	assert(hasBlob(blobs, key), t, "Expected %v not removed", key)
+	err = admin.Remove(Key("x"))
+	assert(err != nil && strings.Contains(err.Error(), "status 3"), t, "Expected an invalid argument but got %v", err)
+	_, err = admin.Has(key, Key("x"))
+	assert(err != nil && strings.Contains(err.Error(), "status 3"), t, "Expected an invalid argument but got %v", err)
+	err = admin.Remove(key)
+	// check
+	assert(err == nil, t, "Error removing %v: %v", key, err)
+	assert(!hasBlob(blobs, key), t, "Expected %v removed", key)
+}
@@ -0,0 +1,326 @@
+package blobstore
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// GRPCServerOptions configure a GRPCBlobServer
+type GRPCServerOptions struct {
+	// Admin authorizes Remove calls, blobs can not be removed if nil
+	Admin func(r *http.Request) bool
+}
+
+// GRPCBlobServer is a http.Handler serving a BlobAdmin as the gRPC BlobService of blobstore.proto
+//
+// gRPC runs on HTTP/2, so it must be served with TLS, like with http.Server.ServeTLS, for clients to use it.
+// Remove calls are refused unless authorized by the Admin option
+type GRPCBlobServer struct {
+	blobs   BlobAdmin
+	options GRPCServerOptions
+}
+
+// NewGRPCBlobServer returns a GRPCBlobServer on blobs
+func NewGRPCBlobServer(blobs BlobAdmin, options GRPCServerOptions) *GRPCBlobServer {
+	return &GRPCBlobServer{blobs, options}
+}
+
+// grpcStream is the server side of a call, sending each message as soon as it is written
+type grpcStream struct {
+	w    http.ResponseWriter
+	body io.Reader
+}
+
+// ServeHTTP runs the call of the request path, ending it with its gRPC status trailers
+func (s *GRPCBlobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || !strings.HasPrefix(r.Header.Get("Content-Type"), grpcContentType) {
+		http.Error(w, "Expected a gRPC request", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", grpcContentType)
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	stream := grpcStream{w, r.Body}
+	stream.flush() // let streaming clients start
+	var err error
+	switch strings.TrimPrefix(r.URL.Path, grpcService) {
+	case "Write":
+		err = s.write(stream)
+	case "Read":
+		err = s.read(stream)
+	case "List":
+		err = s.list(stream)
+	case "Remove":
+		err = s.remove(stream, r)
+	case "Has":
+		err = s.has(stream)
+	case "Stat":
+		err = s.stat(stream)
+	case "Sync":
+		err = s.sync(stream)
+	default:
+		err = &grpcStatus{grpcUnimplemented, "Unknown method " + r.URL.Path}
+	}
+	status := toGRPCStatus(err)
+	w.Header().Set("Grpc-Status", strconv.Itoa(status.code))
+	w.Header().Set("Grpc-Message", grpcEscape(status.message))
+}
+
+// write stores the chunks streamed by the client as a blob, answering its key
+func (s *GRPCBlobServer) write(stream grpcStream) error {
+	reader, writer := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			message, err := stream.recv()
+			if err == io.EOF {
+				writer.Close()
+				return
+			}
+			var chunks [][]byte
+			if err == nil {
+				chunks, err = unmarshalBytes(message)
+			}
+			for _, chunk := range chunks {
+				if err == nil {
+					_, err = writer.Write(chunk)
+				}
+			}
+			if err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	key, err := s.blobs.Write(reader)
+	reader.CloseWithError(io.ErrClosedPipe) // unblock the receiver if the write failed early
+	<-done
+	if err != nil {
+		return err
+	}
+	return stream.send(marshalBytes(key))
+}
+
+// read streams the requested blob in chunks
+func (s *GRPCBlobServer) read(stream grpcStream) error {
+	key, err := s.requestKey(stream)
+	if err != nil {
+		return err
+	}
+	reader, err := s.blobs.Read(key)
+	if err != nil {
+		return err
+	}
+	chunk := make([]byte, grpcChunkSize)
+	for {
+		n, err := io.ReadFull(reader, chunk)
+		if n > 0 {
+			if sendErr := stream.send(marshalBytes(chunk[:n])); sendErr != nil {
+				return sendErr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// list streams all keys in batches
+func (s *GRPCBlobServer) list(stream grpcStream) error {
+	if _, err := stream.request(); err != nil {
+		return err
+	}
+	keys := s.blobs.List()
+	defer drainKeys(keys)
+	batch := [][]byte{}
+	for keyOrErr := range keys {
+		if keyOrErr.err != nil {
+			return keyOrErr.err
+		}
+		if batch = append(batch, keyOrErr.key); len(batch) == grpcListBatch {
+			if err := stream.send(marshalBytes(batch...)); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		return stream.send(marshalBytes(batch...))
+	}
+	return nil
+}
+
+// remove removes the requested key, if the request is authorized
+func (s *GRPCBlobServer) remove(stream grpcStream, r *http.Request) error {
+	if s.options.Admin == nil {
+		return &grpcStatus{grpcPermissionDenied, "Blob removal is disabled"}
+	}
+	if !s.options.Admin(r) {
+		return &grpcStatus{grpcUnauthenticated, "Blob removal requires admin credentials"}
+	}
+	key, err := s.requestKey(stream)
+	if err == nil {
+		err = s.blobs.Remove(key)
+	}
+	if err != nil {
+		return err
+	}
+	return stream.send(nil)
+}
+
+// has answers which of the requested keys are present
+func (s *GRPCBlobServer) has(stream grpcStream) error {
+	keys, err := s.requestKeys(stream)
+	if err != nil {
+		return err
+	}
+	present := make([]uint64, len(keys))
+	for i, key := range keys {
+		if hasBlob(s.blobs, key) {
+			present[i] = 1
+		}
+	}
+	return stream.send(marshalVarints(present...))
+}
+
+// stat answers the sizes of the requested keys blobs, -1 for the missing ones
+func (s *GRPCBlobServer) stat(stream grpcStream) error {
+	keys, err := s.requestKeys(stream)
+	if err != nil {
+		return err
+	}
+	sizes := make([]uint64, len(keys))
+	for i, key := range keys {
+		size, err := blobSize(s.blobs, key)
+		if err != nil && !isNotFound(err) {
+			return err
+		} else if err != nil {
+			size = -1
+		}
+		sizes[i] = uint64(size)
+	}
+	return stream.send(marshalVarints(sizes...))
+}
+
+// sync answers each batch of keys offered by the client with the ones missing
+func (s *GRPCBlobServer) sync(stream grpcStream) error {
+	for {
+		message, err := stream.recv()
+		if err == io.EOF {
+			return nil
+		}
+		var keys [][]byte
+		if err == nil {
+			keys, err = unmarshalBytes(message)
+		}
+		for _, key := range keys {
+			if err == nil {
+				err = s.checkKey(key)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		missing := [][]byte{}
+		for _, key := range keys {
+			if !hasBlob(s.blobs, key) {
+				missing = append(missing, key)
+			}
+		}
+		if err := stream.send(marshalBytes(missing...)); err != nil {
+			return err
+		}
+	}
+}
+
+// requestKeys reads the keys of the request message, checking they are valid keys of the store
+func (s *GRPCBlobServer) requestKeys(stream grpcStream) ([]Key, error) {
+	keys, err := stream.requestKeys()
+	for _, key := range keys {
+		if err == nil {
+			err = s.checkKey(key)
+		}
+	}
+	return keys, err
+}
+
+// requestKey reads the single key of the request message, checking it is a valid key of the store
+func (s *GRPCBlobServer) requestKey(stream grpcStream) (Key, error) {
+	key, err := stream.requestKey()
+	if err == nil {
+		err = s.checkKey(key)
+	}
+	return key, err
+}
+
+// checkKey fails with an invalid argument status keys the store can not hold
+func (s *GRPCBlobServer) checkKey(key Key) error {
+	if err := checkKey(s.blobs, key); err != nil {
+		return &grpcStatus{grpcInvalidArgument, err.Error()}
+	}
+	return nil
+}
+
+// send writes and flushes a message
+func (stream grpcStream) send(message []byte) error {
+	if err := writeGRPCMessage(stream.w, message); err != nil {
+		return err
+	}
+	stream.flush()
+	return nil
+}
+
+// flush sends any buffered response bytes
+func (stream grpcStream) flush() {
+	if flusher, ok := stream.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// recv reads the next request message
+func (stream grpcStream) recv() ([]byte, error) {
+	return readGRPCMessage(stream.body)
+}
+
+// request reads the single request message of a unary or server streaming call
+func (stream grpcStream) request() ([]byte, error) {
+	message, err := stream.recv()
+	if err == io.EOF {
+		return nil, &grpcStatus{grpcInvalidArgument, "Missing request message"}
+	}
+	return message, err
+}
+
+// requestKeys reads the keys of the request message
+func (stream grpcStream) requestKeys() ([]Key, error) {
+	message, err := stream.request()
+	if err != nil {
+		return nil, err
+	}
+	items, err := unmarshalBytes(message)
+	if err != nil {
+		return nil, &grpcStatus{grpcInvalidArgument, err.Error()}
+	}
+	keys := make([]Key, len(items))
+	for i, item := range items {
+		keys[i] = Key(item)
+	}
+	return keys, nil
+}
+
+// requestKey reads the single key of the request message
+func (stream grpcStream) requestKey() (Key, error) {
+	keys, err := stream.requestKeys()
+	if err == nil && len(keys) != 1 {
+		err = &grpcStatus{grpcInvalidArgument, "Expected a single key in the request"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return keys[0], nil
+}
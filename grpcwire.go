@@ -0,0 +1,225 @@
+package blobstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+const (
+	grpcContentType = "application/grpc"
+	grpcService     = "/blobstore.BlobService/"
+	grpcChunkSize   = 64 << 10
+	grpcListBatch   = 100
+	grpcMaxMessage  = 4 << 20
+	grpcHeaderSize  = 5
+)
+
+// gRPC status codes used by the BlobService
+const (
+	grpcOK               = 0
+	grpcInvalidArgument  = 3
+	grpcNotFound         = 5
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcDataLoss         = 15
+	grpcUnauthenticated  = 16
+)
+
+// grpcStatus is a gRPC call status, as sent on the grpc-status & grpc-message trailers
+type grpcStatus struct {
+	code    int
+	message string
+}
+
+// Error returns the status as an error message
+func (s *grpcStatus) Error() string {
+	return fmt.Sprintf("gRPC status %d: %s", s.code, s.message)
+}
+
+// Unwrap returns ErrInvalidKey for the statuses of invalid keys, so they are told apart from other invalid arguments
+func (s *grpcStatus) Unwrap() error {
+	if s.code == grpcInvalidArgument && strings.HasPrefix(s.message, ErrInvalidKey.Error()) {
+		return ErrInvalidKey
+	}
+	return nil
+}
+
+// toGRPCStatus maps a store error to its gRPC status
+func toGRPCStatus(err error) *grpcStatus {
+	status := &grpcStatus{}
+	switch {
+	case err == nil:
+		return &grpcStatus{grpcOK, ""}
+	case errors.As(err, &status):
+		return status
+	case isNotFound(err):
+		return &grpcStatus{grpcNotFound, err.Error()}
+	case errors.Is(err, ErrInvalidKey):
+		return &grpcStatus{grpcInvalidArgument, err.Error()}
+	case errors.Is(err, ErrReadOnly):
+		return &grpcStatus{grpcPermissionDenied, err.Error()}
+	case strings.HasPrefix(err.Error(), corruptedBlobErrorPrefix):
+		return &grpcStatus{grpcDataLoss, err.Error()}
+	}
+	return &grpcStatus{grpcInternal, err.Error()}
+}
+
+// fromGRPCStatus maps a gRPC status back to a store error, nil if OK
+func fromGRPCStatus(status *grpcStatus) error {
+	switch status.code {
+	case grpcOK:
+		return nil
+	case grpcNotFound:
+		if strings.HasPrefix(status.message, "Key not found") {
+			return errors.New(status.message)
+		}
+		return fmt.Errorf("Key not found: %s", status.message)
+	case grpcPermissionDenied:
+		return fmt.Errorf("%w: %s", ErrReadOnly, status.message)
+	}
+	return status
+}
+
+// grpcEscape percent encodes a grpc-message
+func grpcEscape(message string) string {
+	escaped := strings.Builder{}
+	for _, b := range []byte(message) {
+		if b < 0x20 || b > 0x7e || b == '%' {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		} else {
+			escaped.WriteByte(b)
+		}
+	}
+	return escaped.String()
+}
+
+// grpcUnescape decodes a percent encoded grpc-message
+func grpcUnescape(message string) string {
+	if unescaped, err := url.PathUnescape(message); err == nil {
+		return unescaped
+	}
+	return message
+}
+
+// writeGRPCMessage writes a length prefixed, uncompressed, gRPC message
+func writeGRPCMessage(w io.Writer, message []byte) error {
+	frame := make([]byte, grpcHeaderSize, grpcHeaderSize+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	_, err := w.Write(append(frame, message...))
+	return err
+}
+
+// readGRPCMessage reads the next length prefixed gRPC message, io.EOF when there are no more
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, grpcHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, &grpcStatus{grpcUnimplemented, "Compressed messages are not supported"}
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > grpcMaxMessage {
+		return nil, &grpcStatus{grpcInvalidArgument, fmt.Sprintf("Message of %d bytes is too large", size)}
+	}
+	message := make([]byte, size)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return message, nil
+}
+
+// BlobService messages all have a single field, numbered 1, of bytes or of packed varints,
+// so they are encoded and decoded directly as protocol buffers
+
+// marshalBytes encodes a (repeated) bytes field 1
+func marshalBytes(items ...[]byte) []byte {
+	message := []byte{}
+	for _, item := range items {
+		message = append(appendUvarints(append(message, 1<<3|2), uint64(len(item))), item...)
+	}
+	return message
+}
+
+// marshalVarints encodes a packed repeated varint field 1
+func marshalVarints(values ...uint64) []byte {
+	packed := appendUvarints(nil, values...)
+	return append(appendUvarints([]byte{1<<3 | 2}, uint64(len(packed))), packed...)
+}
+
+// unmarshalBytes decodes the bytes of field 1, skipping any other field
+func unmarshalBytes(message []byte) ([][]byte, error) {
+	items := [][]byte{}
+	err := walkFields(message, func(field, wire uint64, value uint64, data []byte) error {
+		if field == 1 && wire == 2 {
+			items = append(items, data)
+		}
+		return nil
+	})
+	return items, err
+}
+
+// unmarshalVarints decodes the varints of field 1, packed or not, skipping any other field
+func unmarshalVarints(message []byte) ([]uint64, error) {
+	values := []uint64{}
+	err := walkFields(message, func(field, wire uint64, value uint64, data []byte) error {
+		switch {
+		case field == 1 && wire == 0:
+			values = append(values, value)
+		case field == 1 && wire == 2:
+			for len(data) > 0 {
+				value, n := binary.Uvarint(data)
+				if n <= 0 {
+					return fmt.Errorf("Bad packed varint in message")
+				}
+				values, data = append(values, value), data[n:]
+			}
+		}
+		return nil
+	})
+	return values, err
+}
+
+// walkFields calls found for each field in a protocol buffers message
+func walkFields(message []byte, found func(field, wire uint64, value uint64, data []byte) error) error {
+	for len(message) > 0 {
+		tag, n := binary.Uvarint(message)
+		if n <= 0 {
+			return fmt.Errorf("Bad field tag in message")
+		}
+		message = message[n:]
+		var value uint64
+		var data []byte
+		switch tag & 7 {
+		case 0:
+			if value, n = binary.Uvarint(message); n <= 0 {
+				return fmt.Errorf("Bad varint in message")
+			}
+		case 1:
+			n = 8
+		case 2:
+			length, m := binary.Uvarint(message)
+			if m <= 0 || length > uint64(len(message)-m) {
+				return fmt.Errorf("Bad length delimited field in message")
+			}
+			data, n = message[m:m+int(length)], m+int(length)
+		case 5:
+			n = 4
+		default:
+			return fmt.Errorf("Unsupported wire type %d in message", tag&7)
+		}
+		if n > len(message) {
+			return fmt.Errorf("Truncated message")
+		}
+		if err := found(tag>>3, tag&7, value, data); err != nil {
+			return err
+		}
+		message = message[n:]
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package blobstore
+
+import (
+	"crypto"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHTTPTimeout      = 30 * time.Second
+	defaultHTTPIdleConns    = 16
+	defaultHTTPRetries      = 3
+	defaultHTTPRetryBackoff = 100 * time.Millisecond
+	maxHTTPErrorMessage     = 512
+)
+
+// HTTPClientOptions configure a HTTPBlobClient
+type HTTPClientOptions struct {
+	// Client does the requests, if nil a pooled client is built with the Timeout and IdleConns options
+	Client *http.Client
+	// Timeout to connect and to get each response headers, 30s by default, bodies are streamed without timeout
+	Timeout time.Duration
+	// IdleConns is the number of idle connections kept to the server, 16 by default
+	IdleConns int
+	// Retries of idempotent requests failed on the network or on a temporary server error, 3 by default
+	Retries int
+	// RetryBackoff is the wait before the first retry, doubled on each further retry, 100ms by default
+	RetryBackoff time.Duration
+	// Admin adds credentials to remove requests, like a basic auth header
+	Admin func(r *http.Request)
+}
+
+// HTTPBlobClient is a remote BlobAdmin on a BlobHandler server
+//
+// The server is never trusted: read blobs are verified locally and written blobs keys are checked
+type HTTPBlobClient struct {
+	url     string
+	hash    crypto.Hash
+	options HTTPClientOptions
+}
+
+// NewHTTPBlobClient returns a HTTPBlobClient on the BlobHandler at url
+func NewHTTPBlobClient(url string, hash crypto.Hash, options HTTPClientOptions) *HTTPBlobClient {
+	if options.Timeout <= 0 {
+		options.Timeout = defaultHTTPTimeout
+	}
+	if options.IdleConns <= 0 {
+		options.IdleConns = defaultHTTPIdleConns
+	}
+	if options.Retries <= 0 {
+		options.Retries = defaultHTTPRetries
+	}
+	if options.RetryBackoff <= 0 {
+		options.RetryBackoff = defaultHTTPRetryBackoff
+	}
+	if options.Client == nil {
+		options.Client = &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: options.Timeout, KeepAlive: 30 * time.Second}).DialContext,
+			MaxIdleConns:          options.IdleConns,
+			MaxIdleConnsPerHost:   options.IdleConns,
+			IdleConnTimeout:       90 * time.Second,
+			ResponseHeaderTimeout: options.Timeout,
+		}}
+	}
+	return &HTTPBlobClient{strings.TrimSuffix(url, "/") + blobsPath, hash, options}
+}
+
+// Read returns a reader streaming the blob from the server, verified as it is read
+func (c *HTTPBlobClient) Read(key Key) (io.Reader, error) {
+	if err := c.checkKey(key); err != nil {
+		return nil, err
+	}
+	response, err := c.do("GET", "/"+key.String(), nil, nil, key)
+	if err != nil {
+		return nil, err
+	}
+	return &checkedReader{bodyReader{response.Body}, key, c.hash.New()}, nil
+}
+
+// Write streams the blob to the server, checking the key it answers matches the blob hash
+func (c *HTTPBlobClient) Write(blob io.Reader) (Key, error) {
+	hasher := c.hash.New()
+	response, err := c.do("POST", "", io.TeeReader(blob, hasher), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	answer, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	key := Key(hasher.Sum(nil))
+	if strings.TrimSpace(string(answer)) != key.String() {
+		return nil, fmt.Errorf("%s server stored %s but the blob hash is %v",
+			corruptedBlobErrorPrefix, strings.TrimSpace(string(answer)), key)
+	}
+	return key, nil
+}
+
+// List returns the server keys via a channel, a page at a time
+func (c *HTTPBlobClient) List() <-chan KeyOrError {
+	keys := make(chan KeyOrError)
+	go func() {
+		cursor := ""
+		for {
+			next, err := c.listPage(keys, cursor)
+			if err != nil {
+				failKeyOrError(keys, err)
+				return
+			}
+			if next == "" {
+				close(keys)
+				return
+			}
+			cursor = next
+		}
+	}()
+	return keys
+}
+
+// checkKey fails keys not as long as the client hash
+func (c *HTTPBlobClient) checkKey(key Key) error {
+	return checkKeySize(c.hash, key)
+}
+
+// Size returns the size of the blob, as answered to a HEAD request
+func (c *HTTPBlobClient) Size(key Key) (int64, error) {
+	response, err := c.do("HEAD", "/"+key.String(), nil, nil, key)
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+	return response.ContentLength, nil
+}
+
+// Remove the given key, a missing key is not an error
+func (c *HTTPBlobClient) Remove(key Key) error {
+	response, err := c.do("DELETE", "/"+key.String(), nil, nil, key)
+	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	return response.Body.Close()
+}
+
+// listPage sends the keys of the page after cursor, returning the cursor of the next page, if any
+func (c *HTTPBlobClient) listPage(keys chan<- KeyOrError, cursor string) (string, error) {
+	response, err := c.do("GET", "?cursor="+url.QueryEscape(cursor), nil,
+		http.Header{"Accept": {ndjsonContentType}}, nil)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	decoder := json.NewDecoder(response.Body)
+	for {
+		line := struct {
+			Key, Next, Error string
+		}{}
+		if err := decoder.Decode(&line); err == io.EOF {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+		switch {
+		case line.Error != "":
+			return "", fmt.Errorf("Listing failed on the server: %s", line.Error)
+		case line.Next != "":
+			return line.Next, nil
+		}
+		key, err := hex.DecodeString(line.Key)
+		if err != nil {
+			return "", fmt.Errorf("Bad key %q listed by the server: %v", line.Key, err)
+		}
+		keys <- KeyOrError{Key(key), nil}
+	}
+}
+
+// do sends a request, retrying it if it has no body, so it is idempotent, and fails on a temporary error.
+// Non 2XX responses are mapped to errors, a 404 to a key not found on key
+func (c *HTTPBlobClient) do(method, path string, body io.Reader, header http.Header, key Key) (*http.Response, error) {
+	backoff := c.options.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		request, err := http.NewRequest(method, c.url+path, body)
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range header {
+			request.Header[name] = values
+		}
+		if method == "DELETE" && c.options.Admin != nil {
+			c.options.Admin(request)
+		}
+		response, err := c.options.Client.Do(request)
+		if body != nil || attempt >= c.options.Retries || (err == nil && !temporaryStatus(response.StatusCode)) {
+			if err == nil {
+				err = statusError(response, method, key)
+			}
+			if err != nil {
+				return nil, err
+			}
+			return response, nil
+		}
+		if err == nil {
+			io.Copy(ioutil.Discard, response.Body)
+			response.Body.Close()
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// temporaryStatus tells whether a response status is worth a retry
+func temporaryStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// statusError returns the error for a non 2XX response, closing its body
+func statusError(response *http.Response, method string, key Key) error {
+	if response.StatusCode/100 == 2 {
+		return nil
+	}
+	defer response.Body.Close()
+	message, _ := ioutil.ReadAll(io.LimitReader(response.Body, maxHTTPErrorMessage))
+	switch response.StatusCode {
+	case http.StatusNotFound:
+		return fmt.Errorf("Key not found: %v", key)
+	case http.StatusBadRequest:
+		return fmt.Errorf("%w: %v", ErrInvalidKey, key)
+	case http.StatusForbidden, http.StatusMethodNotAllowed:
+		return fmt.Errorf("%w: %s", ErrReadOnly, strings.TrimSpace(string(message)))
+	}
+	return fmt.Errorf("HTTP %s %v failed with %s: %s", method, key, response.Status, strings.TrimSpace(string(message)))
+}
+
+// bodyReader closes a response body as soon as it is read to the end or fails,
+// as blob readers are never closed
+type bodyReader struct {
+	io.ReadCloser
+}
+
+// Read from the body, closing it on any error, including EOF
+func (r bodyReader) Read(buf []byte) (int, error) {
+	n, err := r.ReadCloser.Read(buf)
+	if err != nil {
+		r.Close()
+	}
+	return n, err
+}
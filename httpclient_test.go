@@ -0,0 +1,108 @@
+package blobstore
+
+import (
+	"crypto"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestHTTPBlobClient returns a client on a BlobHandler server wrapped by intercept, if not nil
+func newTestHTTPBlobClient(intercept func(http.Handler) http.Handler) (*HTTPBlobClient, *httptest.Server) {
+	var handler http.Handler = NewBlobHandler(NewMemBlobAdmin(crypto.SHA1),
+		HandlerOptions{Admin: BasicAuthAdmin("admin", "secret")})
+	if intercept != nil {
+		handler = intercept(handler)
+	}
+	server := httptest.NewServer(handler)
+	return NewHTTPBlobClient(server.URL, crypto.SHA1, HTTPClientOptions{
+		RetryBackoff: time.Millisecond,
+		Admin:        func(r *http.Request) { r.SetBasicAuth("admin", "secret") },
+	}), server
+}
+
+// TestHTTPClientReadsNWrites test that a remote store does its reads and writes as expected
+func TestHTTPClientReadsNWrites(t *testing.T) {
+	// setup
+	client, server := newTestHTTPBlobClient(nil)
+	defer server.Close()
+	// exercise
+	readsNWrites(t, client)
+	_, err := client.Read(Key(make([]byte, crypto.SHA1.Size()+1)))
+	assert(errors.Is(err, ErrInvalidKey), t, "Expected an invalid key error for a too long key but got %v", err)
+	_, err = client.Size(Key(make([]byte, 1)))
+	assert(errors.Is(err, ErrInvalidKey), t, "Expected the server to refuse a short key but got %v", err)
+}
+
+// TestHTTPClientList test that a remote store lists all keys, across pages
+func TestHTTPClientList(t *testing.T) {
+	// setup
+	blobs := NewMemBlobAdmin(crypto.SHA1)
+	server := httptest.NewServer(NewBlobHandler(blobs, HandlerOptions{ListLimit: 1}))
+	defer server.Close()
+	client := NewHTTPBlobClient(server.URL, crypto.SHA1, HTTPClientOptions{})
+	// exercise
+	listChecks(t, buildExpectedKeys(), client)
+	count := 0
+	for keyOrErr := range client.List() {
+		assert(keyOrErr.err == nil, t, "Error in List stream: %v", keyOrErr.err)
+		count++
+	}
+	assert(count == len(testData), t, "Expected %d keys listed but got %d", len(testData), count)
+	err := client.Remove(toKeyOrDie(t, testData[0].expectedHash))
+	assert(err != nil && strings.Contains(err.Error(), ErrReadOnly.Error()), t,
+		"Expected a read only error removing without admin but got %v", err)
+}
+
+// TestHTTPClientRetries checks idempotent requests are retried on temporary server errors
+func TestHTTPClientRetries(t *testing.T) {
+	// setup
+	failures := int32(2)
+	client, server := newTestHTTPBlobClient(func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" && atomic.AddInt32(&failures, -1) >= 0 {
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return
+			}
+			handler.ServeHTTP(w, r)
+		})
+	})
+	defer server.Close()
+	key, err := client.Write(strings.NewReader(testData[0].input))
+	assert(err == nil, t, "Error writing blob: %v", err)
+	// exercise
+	reader, err := client.Read(key)
+	assert(err == nil, t, "Error fetching %s after retries: %v", key, err)
+	err = readAll(reader)
+	assert(err == io.EOF, t, "Error reading %s: %v", key, err)
+	_, err = client.Read(toKeyOrDie(t, testData[1].expectedHash))
+	assert(err != nil && isNotFound(err), t, "Expected a key not found but got %v", err)
+}
+
+// TestHTTPClientDistrust checks corrupted reads and wrong write keys from the server are detected
+func TestHTTPClientDistrust(t *testing.T) {
+	// setup
+	client, server := newTestHTTPBlobClient(func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" {
+				w.Write([]byte("not the blob"))
+			} else {
+				w.Write([]byte(testData[1].expectedHash))
+			}
+		})
+	})
+	defer server.Close()
+	// exercise
+	_, err := client.Write(strings.NewReader(testData[0].input))
+	assert(err != nil && strings.HasPrefix(err.Error(), corruptedBlobErrorPrefix), t,
+		"Expected a wrong key error writing but got %v", err)
+	reader, err := client.Read(toKeyOrDie(t, testData[0].expectedHash))
+	assert(err == nil, t, "Error fetching blob: %v", err)
+	err = readAll(reader)
+	assert(strings.HasPrefix(err.Error(), corruptedBlobErrorPrefix), t, "Expected a corrupted blob but got %v", err)
+}
@@ -0,0 +1,311 @@
+package blobstore
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	blobsPath             = "/blobs"
+	defaultListLimit      = 1000
+	immutableCacheControl = "public, max-age=31536000, immutable"
+	ndjsonContentType     = "application/x-ndjson"
+)
+
+// HandlerOptions configure a BlobHandler
+type HandlerOptions struct {
+	// Admin authorizes DELETE requests, blobs can not be removed if nil
+	Admin func(r *http.Request) bool
+	// ListLimit is the maximum number of keys in a listing page, 1000 by default
+	ListLimit int
+}
+
+// BlobHandler is a http.Handler exposing a BlobAdmin:
+//
+//	PUT|POST /blobs          writes the request body as a blob, answering its key
+//	GET      /blobs          lists keys as JSON, or NDJSON if accepted, a page at a time after ?cursor=
+//	GET|HEAD /blobs/{key}    reads a blob, or a byte range of it, with the key as ETag
+//	DELETE   /blobs/{key}    removes a blob, if authorized by the Admin option
+type BlobHandler struct {
+	blobs   BlobAdmin
+	options HandlerOptions
+}
+
+// NewBlobHandler returns a BlobHandler on blobs
+func NewBlobHandler(blobs BlobAdmin, options HandlerOptions) *BlobHandler {
+	if options.ListLimit <= 0 {
+		options.ListLimit = defaultListLimit
+	}
+	return &BlobHandler{blobs, options}
+}
+
+// BasicAuthAdmin returns an Admin option authorizing requests with the given basic auth credentials
+func BasicAuthAdmin(user, password string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		requestUser, requestPassword, ok := r.BasicAuth()
+		return ok && subtle.ConstantTimeCompare([]byte(requestUser), []byte(user)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(requestPassword), []byte(password)) == 1
+	}
+}
+
+// ServeHTTP routes the request by path and method
+func (h *BlobHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == blobsPath || r.URL.Path == blobsPath+"/" {
+		switch r.Method {
+		case "GET", "HEAD":
+			h.list(w, r)
+		case "PUT", "POST":
+			h.write(w, r)
+		default:
+			methodNotAllowed(w, "GET, HEAD, PUT, POST")
+		}
+		return
+	}
+	hexKey := strings.TrimPrefix(r.URL.Path, blobsPath+"/")
+	if hexKey == r.URL.Path || strings.Contains(hexKey, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Bad key %s: %v", hexKey, err), http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		h.read(w, r, Key(key))
+	case "DELETE":
+		h.remove(w, r, Key(key))
+	default:
+		methodNotAllowed(w, "GET, HEAD, DELETE")
+	}
+}
+
+// write stores the request body, answering its key
+func (h *BlobHandler) write(w http.ResponseWriter, r *http.Request) {
+	key, err := h.blobs.Write(r.Body)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	w.Header().Set("Location", blobsPath+"/"+key.String())
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, key)
+}
+
+// read streams a blob, or the requested range of it
+//
+// The blob is verified as it is streamed, so a corrupted blob aborts the response. HEAD and range requests
+// take its size from the store if it knows it, ranges are not verified, as the rest of the blob is not read
+func (h *BlobHandler) read(w http.ResponseWriter, r *http.Request, key Key) {
+	etag := `"` + key.String() + `"`
+	if match := r.Header.Get("If-None-Match"); match == "*" || strings.Contains(match, etag) {
+		if !hasBlob(h.blobs, key) {
+			http.Error(w, fmt.Sprintf("Key not found: %v", key), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	size, start, length, status := int64(-1), int64(0), int64(-1), http.StatusOK
+	if r.Method == "HEAD" || r.Header.Get("Range") != "" {
+		var err error
+		if size, err = blobSize(h.blobs, key); err != nil {
+			httpError(w, err)
+			return
+		}
+		if r.Method == "GET" {
+			start, length, status = parseRange(r.Header.Get("Range"), size)
+		}
+	}
+	if status == http.StatusRequestedRangeNotSatisfiable {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(w, "Range not satisfiable", status)
+		return
+	}
+	reader, err := h.blobs.Read(key)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	header := w.Header()
+	header.Set("ETag", etag)
+	header.Set("Cache-Control", immutableCacheControl)
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("Content-Type", "application/octet-stream")
+	if status == http.StatusPartialContent {
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+		size = length
+	}
+	if size >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	w.WriteHeader(status)
+	if r.Method == "HEAD" {
+		return
+	}
+	if status == http.StatusPartialContent {
+		if _, err = io.CopyN(ioutil.Discard, reader, start); err == nil {
+			_, err = io.CopyN(w, reader, length)
+		}
+	} else {
+		_, err = io.Copy(w, reader)
+	}
+	if err != nil {
+		// too late for an error status, make sure the client does not take a truncated or corrupted blob
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// remove removes a blob, if the request is authorized
+func (h *BlobHandler) remove(w http.ResponseWriter, r *http.Request, key Key) {
+	if h.options.Admin == nil {
+		http.Error(w, "Blob removal is disabled", http.StatusForbidden)
+		return
+	}
+	if !h.options.Admin(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="blobstore"`)
+		http.Error(w, "Blob removal requires admin credentials", http.StatusUnauthorized)
+		return
+	}
+	if err := h.blobs.Remove(key); err != nil {
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// list streams a page of keys after the cursor, as a JSON object with the keys array, or as NDJSON
+// with an object per key. Either ends with the next page cursor, if any, or an error, if the listing failed.
+// The listing starts right after the cursor if the store can, so paging does not list the previous pages again
+func (h *BlobHandler) list(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > h.options.ListLimit {
+		limit = h.options.ListLimit
+	}
+	cursor := strings.ToLower(r.URL.Query().Get("cursor"))
+	ndjson := strings.Contains(r.Header.Get("Accept"), ndjsonContentType)
+	if ndjson {
+		w.Header().Set("Content-Type", ndjsonContentType)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Method == "HEAD" {
+		return
+	}
+	keys := h.blobs.List()
+	if after, err := hex.DecodeString(cursor); err == nil && len(after) > 0 {
+		keys = listAfter(h.blobs, Key(after))
+	}
+	defer drainKeys(keys)
+	if !ndjson {
+		io.WriteString(w, `{"keys":[`)
+	}
+	count, last, next := 0, "", ""
+	var listErr error
+	for keyOrErr := range keys {
+		if keyOrErr.err != nil {
+			listErr = keyOrErr.err
+			break
+		}
+		hexKey := keyOrErr.key.String()
+		if hexKey <= cursor {
+			continue
+		}
+		if count == limit {
+			next = last
+			break
+		}
+		if ndjson {
+			fmt.Fprintf(w, "{\"key\":%q}\n", hexKey)
+		} else if count > 0 {
+			fmt.Fprintf(w, ",%q", hexKey)
+		} else {
+			fmt.Fprintf(w, "%q", hexKey)
+		}
+		count, last = count+1, hexKey
+	}
+	tail := ""
+	if next != "" {
+		tail = fmt.Sprintf("\"next\":%q", next)
+	} else if listErr != nil {
+		message, _ := json.Marshal(listErr.Error())
+		tail = fmt.Sprintf("\"error\":%s", message)
+	}
+	if ndjson && tail != "" {
+		fmt.Fprintf(w, "{%s}\n", tail)
+	} else if !ndjson && tail != "" {
+		fmt.Fprintf(w, "],%s}\n", tail)
+	} else if !ndjson {
+		io.WriteString(w, "]}\n")
+	}
+}
+
+// parseRange parses a single range header spec on a blob of the given size, answering the range start,
+// its length and the status to respond with, as multiple ranges are served as the whole blob
+func parseRange(spec string, size int64) (int64, int64, int) {
+	if !strings.HasPrefix(spec, "bytes=") || strings.Contains(spec, ",") {
+		return 0, size, http.StatusOK
+	}
+	first, last, ok := strings.Cut(strings.TrimPrefix(spec, "bytes="), "-")
+	if !ok {
+		return 0, size, http.StatusOK
+	}
+	start, end := int64(0), size-1
+	if first == "" { // suffix range of the last bytes
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix <= 0 {
+			return 0, 0, http.StatusRequestedRangeNotSatisfiable
+		}
+		if suffix < size {
+			start = size - suffix
+		}
+	} else {
+		var err error
+		if start, err = strconv.ParseInt(first, 10, 64); err != nil || start < 0 || start >= size {
+			return 0, 0, http.StatusRequestedRangeNotSatisfiable
+		}
+		if last != "" {
+			if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+				return 0, 0, http.StatusRequestedRangeNotSatisfiable
+			}
+			if end >= size {
+				end = size - 1
+			}
+		}
+	}
+	if end < start {
+		return 0, 0, http.StatusRequestedRangeNotSatisfiable
+	}
+	return start, end - start + 1, http.StatusPartialContent
+}
+
+// httpError answers a store error, not found keys are 404s and invalid ones 400s
+func httpError(w http.ResponseWriter, err error) {
+	if isNotFound(err) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrInvalidKey) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// methodNotAllowed answers a 405 with the allowed methods
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,142 @@
+package blobstore
+
+import (
+	"bufio"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestHTTPHandler checks the blob handler writes, reads, ranges & removes blobs as expected
+func TestHTTPHandler(t *testing.T) {
+	// setup
+	server := httptest.NewServer(NewBlobHandler(NewMemBlobAdmin(crypto.SHA1),
+		HandlerOptions{Admin: BasicAuthAdmin("admin", "secret")}))
+	defer server.Close()
+	testCase := testData[1]
+	blobURL := server.URL + blobsPath + "/" + testCase.expectedHash
+	// exercise
+	response, body := httpDo(t, "POST", server.URL+blobsPath, testCase.input, nil)
+	assert(response.StatusCode == http.StatusCreated, t, "Expected blob created but got %s", response.Status)
+	assert(strings.TrimSpace(body) == testCase.expectedHash, t, "Expected key %s but got %s", testCase.expectedHash, body)
+	response, body = httpDo(t, "GET", blobURL, "", nil)
+	assert(response.StatusCode == http.StatusOK, t, "Expected blob read but got %s", response.Status)
+	assert(body == testCase.input, t, "Expected to read '%s' but got '%s'", testCase.input, body)
+	assert(response.Header.Get("ETag") == `"`+testCase.expectedHash+`"`, t, "Unexpected ETag %s", response.Header.Get("ETag"))
+	assert(strings.Contains(response.Header.Get("Cache-Control"), "immutable"), t,
+		"Expected immutable caching but got %s", response.Header.Get("Cache-Control"))
+	for _, check := range []struct {
+		method, header, value string
+		status                int
+		body                  string
+	}{
+		{"GET", "If-None-Match", `"` + testCase.expectedHash + `"`, http.StatusNotModified, ""},
+		{"HEAD", "", "", http.StatusOK, ""},
+		{"GET", "Range", "bytes=3-", http.StatusPartialContent, testCase.input[3:]},
+		{"GET", "Range", "bytes=1-2", http.StatusPartialContent, testCase.input[1:3]},
+		{"GET", "Range", "bytes=-2", http.StatusPartialContent, testCase.input[len(testCase.input)-2:]},
+		{"GET", "Range", "bytes=100-", http.StatusRequestedRangeNotSatisfiable, "Range not satisfiable\n"},
+		{"DELETE", "", "", http.StatusUnauthorized, "Blob removal requires admin credentials\n"},
+	} {
+		response, body = httpDo(t, check.method, blobURL, "", map[string]string{check.header: check.value})
+		assert(response.StatusCode == check.status, t, "Expected %s %s:%s to answer %d but got %s",
+			check.method, check.header, check.value, check.status, response.Status)
+		assert(body == check.body, t, "Expected %s %s:%s to return '%s' but got '%s'",
+			check.method, check.header, check.value, check.body, body)
+	}
+	response, _ = httpDo(t, "HEAD", blobURL, "", nil)
+	assert(response.ContentLength == int64(len(testCase.input)), t, "Expected HEAD size %d but got %d",
+		len(testCase.input), response.ContentLength)
+	request, _ := http.NewRequest("DELETE", blobURL, nil)
+	request.SetBasicAuth("admin", "secret")
+	response, err := http.DefaultClient.Do(request)
+	assert(err == nil, t, "Error removing blob: %v", err)
+	response.Body.Close()
+	assert(response.StatusCode == http.StatusNoContent, t, "Expected blob removed but got %s", response.Status)
+	response, _ = httpDo(t, "GET", blobURL, "", nil)
+	assert(response.StatusCode == http.StatusNotFound, t, "Expected removed blob not found but got %s", response.Status)
+	response, _ = httpDo(t, "GET", blobURL, "", map[string]string{"If-None-Match": `"` + testCase.expectedHash + `"`})
+	assert(response.StatusCode == http.StatusNotFound, t, "Expected a missing blob not to be cached but got %s",
+		response.Status)
+	request, _ = http.NewRequest("DELETE", server.URL+blobsPath+"/f648", nil)
+	request.SetBasicAuth("admin", "secret")
+	response, err = http.DefaultClient.Do(request)
+	assert(err == nil, t, "Error removing blob: %v", err)
+	response.Body.Close()
+	assert(response.StatusCode == http.StatusBadRequest, t, "Expected a short key to be rejected but got %s",
+		response.Status)
+}
+
+// TestHTTPList checks keys are listed in pages, as JSON and NDJSON
+func TestHTTPList(t *testing.T) {
+	// setup
+	blobs := NewMemBlobAdmin(crypto.SHA1)
+	server := httptest.NewServer(NewBlobHandler(blobs, HandlerOptions{ListLimit: 2}))
+	defer server.Close()
+	expected := []string{}
+	for keyOrErr := range writeBlobs(t, blobs, 5).List() {
+		expected = append(expected, keyOrErr.key.String())
+	}
+	// exercise JSON pages
+	listed := []string{}
+	page := struct {
+		Keys  []string
+		Next  string
+		Error string
+	}{}
+	for {
+		_, body := httpDo(t, "GET", server.URL+blobsPath+"?cursor="+page.Next, "", nil)
+		page.Next = ""
+		err := json.Unmarshal([]byte(body), &page)
+		assert(err == nil, t, "Error decoding listing page '%s': %v", body, err)
+		assert(len(page.Keys) <= 2, t, "Expected pages of 2 keys at most but got %d", len(page.Keys))
+		listed = append(listed, page.Keys...)
+		if page.Next == "" {
+			break
+		}
+	}
+	assert(fmt.Sprint(listed) == fmt.Sprint(expected), t, "Expected keys %v but got %v", expected, listed)
+	// exercise NDJSON
+	response, body := httpDo(t, "GET", server.URL+blobsPath+"?limit=1", "", map[string]string{"Accept": ndjsonContentType})
+	assert(response.Header.Get("Content-Type") == ndjsonContentType, t, "Unexpected content type %s",
+		response.Header.Get("Content-Type"))
+	lines := []string{}
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	assert(len(lines) == 2, t, "Expected a key and the next cursor but got %v", lines)
+	assert(lines[0] == fmt.Sprintf(`{"key":"%s"}`, expected[0]), t, "Unexpected key line %s", lines[0])
+	assert(lines[1] == fmt.Sprintf(`{"next":"%s"}`, expected[0]), t, "Unexpected cursor line %s", lines[1])
+}
+
+// writeBlobs writes n different blobs on blobs
+func writeBlobs(t *testing.T, blobs BlobAdmin, n int) BlobAdmin {
+	for i := 0; i < n; i++ {
+		_, err := blobs.Write(strings.NewReader(fmt.Sprintf("blob #%d", i)))
+		assert(err == nil, t, "Error writing blob #%d: %v", i, err)
+	}
+	return blobs
+}
+
+// httpDo does a request with the given body and headers, returning the response and its body
+func httpDo(t *testing.T, method, url, body string, headers map[string]string) (*http.Response, string) {
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	assert(err == nil, t, "Error building request %s %s: %v", method, url, err)
+	for name, value := range headers {
+		if name != "" {
+			request.Header.Set(name, value)
+		}
+	}
+	response, err := http.DefaultClient.Do(request)
+	assert(err == nil, t, "Error requesting %s %s: %v", method, url, err)
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	assert(err == nil, t, "Error reading response of %s %s: %v", method, url, err)
+	return response, string(data)
+}
@@ -0,0 +1,221 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	kvListBatch = 100
+)
+
+// KVBlobServer is a VFSBlobServer storing all blobs in a single B+tree file, small blobs inline in its leaves
+// and bigger ones in overflow pages, avoiding the file per blob and directory levels of fileBlobs
+// for millions of small blobs
+type KVBlobServer struct {
+	*VFSBlobServer
+	kv *kvFile
+}
+
+// NewKVBlobServer returns a KVBlobServer on the B+tree file at path, which is created if missing
+func NewKVBlobServer(path string, hash crypto.Hash) (*KVBlobServer, error) {
+	kv, err := openKVFile(path)
+	if err != nil {
+		return nil, err
+	}
+	vfs := &kvBlobs{kv: kv, dir: filepath.Dir(path), tmps: make(map[string]string)}
+	return &KVBlobServer{&VFSBlobServer{vfs, hash}, kv}, nil
+}
+
+// Close closes the underlying B+tree file
+func (kbs *KVBlobServer) Close() error {
+	return kbs.kv.Close()
+}
+
+// kvBlobs is a VirtualFS on a kvFile
+//
+// Temporary blobs are spooled to os files next to the B+tree file till renamed, so each blob is written
+// to the B+tree file just once, in a single transaction
+type kvBlobs struct {
+	kv   *kvFile
+	dir  string
+	lock sync.Mutex
+	tmps map[string]string // temporary keynames to their os files
+}
+
+// kvWriter buffers a blob to be put on the kvFile when closed
+type kvWriter struct {
+	bytes.Buffer
+	kv      *kvFile
+	keyname string
+}
+
+// Close puts the buffered blob in the kvFile
+func (w *kvWriter) Close() error {
+	return w.kv.update(func(tx *kvTx) error {
+		return tx.put(w.keyname, w.Bytes())
+	})
+}
+
+// Open a key contents for reading
+func (vfs *kvBlobs) Open(keyname string) (io.ReadCloser, error) {
+	vfs.lock.Lock()
+	filename, ok := vfs.tmps[keyname]
+	vfs.lock.Unlock()
+	if ok {
+		return os.Open(filename)
+	}
+	value, ok, err := vfs.kv.get(keyname)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Key not found: %s", keyname)
+	}
+	return ioutil.NopCloser(bytes.NewReader(value)), nil
+}
+
+// Create a key to write its contents, temporary keys are spooled to os files
+func (vfs *kvBlobs) Create(keyname string) (io.WriteCloser, error) {
+	if strings.HasSuffix(keyname, tmpSuffix) {
+		file, err := ioutil.TempFile(vfs.dir, "kvblob-*"+tmpSuffix)
+		if err != nil {
+			return nil, err
+		}
+		vfs.lock.Lock()
+		defer vfs.lock.Unlock()
+		vfs.tmps[keyname] = file.Name()
+		return file, nil
+	}
+	return &kvWriter{kv: vfs.kv, keyname: keyname}, nil
+}
+
+// Delete a key & contents
+func (vfs *kvBlobs) Delete(keyname string) error {
+	vfs.lock.Lock()
+	filename, ok := vfs.tmps[keyname]
+	delete(vfs.tmps, keyname)
+	vfs.lock.Unlock()
+	if ok {
+		return os.Remove(filename)
+	}
+	return vfs.kv.update(func(tx *kvTx) error {
+		_, err := tx.delete(keyname)
+		return err
+	})
+}
+
+// Does the given key exists? It is looked up without reading its value, and as in fileBlobs,
+// a failed lookup does not make it missing
+func (vfs *kvBlobs) Exists(keyname string) bool {
+	vfs.lock.Lock()
+	_, ok := vfs.tmps[keyname]
+	vfs.lock.Unlock()
+	if !ok {
+		var err error
+		_, ok, err = vfs.kv.size(keyname)
+		ok = ok || err != nil
+	}
+	return ok
+}
+
+// Size returns a key contents size, without reading them
+func (vfs *kvBlobs) Size(keyname string) (int64, error) {
+	vfs.lock.Lock()
+	filename, ok := vfs.tmps[keyname]
+	vfs.lock.Unlock()
+	if ok {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+	size, ok, err := vfs.kv.size(keyname)
+	if err == nil && !ok {
+		err = fmt.Errorf("Key not found: %s", keyname)
+	}
+	return size, err
+}
+
+// Rename a key in a single transaction, a temporary key is streamed to the file for the first time
+func (vfs *kvBlobs) Rename(oldkey, newkey string) error {
+	vfs.lock.Lock()
+	filename, ok := vfs.tmps[oldkey]
+	delete(vfs.tmps, oldkey)
+	vfs.lock.Unlock()
+	if ok {
+		defer os.Remove(filename)
+		return vfs.putFile(newkey, filename)
+	}
+	return vfs.kv.update(func(tx *kvTx) error {
+		value, found, err := tx.get(oldkey)
+		if err == nil && !found {
+			err = fmt.Errorf("Key not found: %s", oldkey)
+		}
+		if err == nil {
+			_, err = tx.delete(oldkey)
+		}
+		if err == nil {
+			err = tx.put(newkey, value)
+		}
+		return err
+	})
+}
+
+// putFile puts the contents of an os file as the value of keyname
+func (vfs *kvBlobs) putFile(keyname, filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return vfs.kv.update(func(tx *kvTx) error {
+		return tx.putFrom(keyname, file, info.Size())
+	})
+}
+
+// ListTo lists all present keys in sort order to the keys channel, in batches, so that the
+// file is not locked while the keys are consumed
+func (vfs *kvBlobs) ListTo(keys chan<- KeyOrError, acceptor func(string) Key) bool {
+	after := ""
+	for {
+		keynames, err := vfs.kv.keysAfter(after, kvListBatch)
+		if err != nil {
+			return failKeyOrError(keys, err)
+		}
+		if len(keynames) == 0 {
+			return true
+		}
+		for _, keyname := range keynames {
+			if key := acceptor(keyname); key != nil {
+				keys <- KeyOrError{key, nil}
+			}
+		}
+		after = keynames[len(keynames)-1]
+	}
+}
+
+// Keyname returns a key name, the hash key is used directly as key name
+func (vfs *kvBlobs) Keyname(key Key) string {
+	return key.String()
+}
+
+// TmpKeyname returns a temporary keyname
+func (vfs *kvBlobs) TmpKeyname(size int) string {
+	key := make([]byte, size)
+	rand.Reader.Read(key)
+	return Key(key).String() + tmpSuffix
+}
@@ -0,0 +1,136 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// TestKVReadsNWrites test that the B+tree file blobserver does its reads and writes as expected
+func TestKVReadsNWrites(t *testing.T) {
+	// setup
+	dir := fileBlobs{""}.TmpKeyname(10)
+	os.Mkdir(dir, 0700)
+	kbs, err := NewKVBlobServer(filepath.Join(dir, "blobs.db"), crypto.SHA1)
+	assert(err == nil, t, "Error opening the store: %v", err)
+	// exercise
+	readsNWrites(t, kbs)
+	listChecks(t, buildExpectedKeys(), kbs)
+	// cleanup
+	kbs.Close()
+	err = os.RemoveAll(dir)
+	assert(err == nil, t, "Error in cleanup removing %s: %v", dir, err)
+}
+
+// TestKVFile checks the B+tree against a map on random puts & deletes, reopening the file in between
+func TestKVFile(t *testing.T) {
+	// setup
+	dir := fileBlobs{""}.TmpKeyname(10)
+	os.Mkdir(dir, 0700)
+	path := filepath.Join(dir, "kv.db")
+	kv, err := openKVFile(path)
+	assert(err == nil, t, "Error opening %s: %v", path, err)
+	expected := make(map[string][]byte)
+	random := rand.New(rand.NewSource(1))
+	// exercise
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 500; i++ {
+			key := fmt.Sprintf("key%04d", random.Intn(1000))
+			if random.Intn(3) == 0 {
+				delete(expected, key)
+				err = kv.update(func(tx *kvTx) error {
+					_, err := tx.delete(key)
+					return err
+				})
+			} else {
+				value := bytes.Repeat([]byte{byte(i)}, random.Intn(2*kvPageSize))
+				expected[key] = value
+				err = kv.update(func(tx *kvTx) error { return tx.put(key, value) })
+			}
+			assert(err == nil, t, "Error updating %s: %v", key, err)
+		}
+		kv.Close()
+		kv, err = openKVFile(path)
+		assert(err == nil, t, "Error reopening %s: %v", path, err)
+		checkKVFile(t, kv, expected)
+	}
+	// check pages are reused: deleting everything and writing it back should not grow the file much
+	highwater := kv.meta.highwater
+	for key, value := range expected {
+		kv.update(func(tx *kvTx) error {
+			_, err := tx.delete(key)
+			return err
+		})
+		kv.update(func(tx *kvTx) error { return tx.put(key, value) })
+	}
+	assert(kv.meta.highwater < 2*highwater, t, "File grew from %d to %d pages", highwater, kv.meta.highwater)
+	checkKVFile(t, kv, expected)
+	// cleanup
+	kv.Close()
+	err = os.RemoveAll(dir)
+	assert(err == nil, t, "Error in cleanup removing %s: %v", dir, err)
+}
+
+// TestKVOverflow checks big values go to overflow pages, which are not rewritten along with their leaf
+func TestKVOverflow(t *testing.T) {
+	// setup
+	dir := fileBlobs{""}.TmpKeyname(10)
+	os.Mkdir(dir, 0700)
+	path := filepath.Join(dir, "kv.db")
+	kv, err := openKVFile(path)
+	assert(err == nil, t, "Error opening %s: %v", path, err)
+	big := bytes.Repeat([]byte("big"), 100*kvPageSize)
+	err = kv.update(func(tx *kvTx) error { return tx.put("big", big) })
+	assert(err == nil, t, "Error putting a big value: %v", err)
+	highwater := kv.meta.highwater
+	expected := map[string][]byte{"big": big}
+	// exercise
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("small%d", i)
+		expected[key] = []byte("small")
+		err = kv.update(func(tx *kvTx) error { return tx.put(key, expected[key]) })
+		assert(err == nil, t, "Error putting a small value: %v", err)
+	}
+	// check
+	assert(kv.meta.highwater < highwater+10, t, "File grew from %d to %d pages", highwater, kv.meta.highwater)
+	checkKVFile(t, kv, expected)
+	for key, value := range expected {
+		size, ok, err := kv.size(key)
+		assert(err == nil && ok && size == int64(len(value)), t, "Expected %s size %d but got %d (%v): %v",
+			key, len(value), size, ok, err)
+	}
+	_, ok, err := kv.size("missing")
+	assert(err == nil && !ok, t, "Expected a missing key not sized but got %v: %v", ok, err)
+	// cleanup
+	kv.Close()
+	err = os.RemoveAll(dir)
+	assert(err == nil, t, "Error in cleanup removing %s: %v", dir, err)
+}
+
+// checkKVFile checks a kvFile holds exactly the expected keys & values
+func checkKVFile(t *testing.T, kv *kvFile, expected map[string][]byte) {
+	keys := []string{}
+	for key, value := range expected {
+		keys = append(keys, key)
+		actual, ok, err := kv.get(key)
+		assert(err == nil && ok, t, "Key %s not found (%v)", key, err)
+		assert(bytes.Equal(actual, value), t, "Key %s value does not match", key)
+	}
+	sort.Strings(keys)
+	listed := []string{}
+	for after := ""; ; {
+		batch, err := kv.keysAfter(after, 7)
+		assert(err == nil, t, "Error listing keys: %v", err)
+		if len(batch) == 0 {
+			break
+		}
+		listed = append(listed, batch...)
+		after = batch[len(batch)-1]
+	}
+	assert(fmt.Sprint(keys) == fmt.Sprint(listed), t, "Expected keys %v but listed %v", keys, listed)
+}
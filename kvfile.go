@@ -0,0 +1,778 @@
+package blobstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+const (
+	kvPageSize   = 4096
+	kvMagic      = 0xb10b5707
+	kvVersion    = 1
+	kvMetaPages  = 2  // two alternating meta pages, the one with the highest valid txid is the current one
+	kvMetaSize   = 56 // magic, version, page size, padding, root, freelist, highwater, txid & checksum
+	kvNodeHeader = 12 // flags, count & overflow pages
+	kvLeafFlag   = 1
+	kvBranchFlag = 2
+	kvFreeFlag   = 4
+	kvFilePerms  = 0640
+	kvInlineSize = kvPageSize / 4 // values bigger than this are stored in their own overflow pages
+	kvValueRef   = 1 << 31        // value length flag of overflow values, stored as their first page & size
+	kvCopyBuffer = 64 * 1024
+)
+
+// kvFile is a single file copy-on-write B+tree of string keys and byte values, in the style of bbolt
+//
+// Every change is a transaction writing the modified nodes to free pages and then switching the
+// meta page to point to the new root, so a crash leaves either the old or the new tree, never a mix.
+// Small values are stored inline in the leaves, bigger ones in their own contiguous overflow pages, so they
+// are not rewritten along with their leaf. Nodes larger than a page span several contiguous pages
+type kvFile struct {
+	lock sync.RWMutex
+	file *os.File
+	meta kvMeta
+	free []uint64 // sorted pages free to be reused
+}
+
+// kvMeta is the root of a committed tree
+type kvMeta struct {
+	root      uint64 // root node page, 0 for an empty tree
+	freelist  uint64 // freelist node page, 0 if none
+	highwater uint64 // first page never allocated
+	txid      uint64
+}
+
+// kvNode is an in memory B+tree node, branch keys are the smallest key of each child
+type kvNode struct {
+	leaf     bool
+	pgid     uint64 // page the node was read from, 0 when modified or new
+	overflow uint64
+	keys     []string
+	values   []kvValue // leaf values
+	children []uint64  // branch children pages
+	kids     []*kvNode // branch children already loaded, or nil
+}
+
+// kvValue is a leaf value, either inline data or the size & first page of an overflow value
+type kvValue struct {
+	data []byte
+	page uint64
+	size uint64
+}
+
+// kvTx is a transaction over a kvFile
+type kvTx struct {
+	kv        *kvFile
+	root      *kvNode
+	free      []uint64
+	freed     []uint64 // pages to be freed once committed
+	highwater uint64
+}
+
+// openKVFile opens or creates a kvFile at path
+func openKVFile(path string) (*kvFile, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, kvFilePerms)
+	if err != nil {
+		return nil, err
+	}
+	kv := &kvFile{file: file}
+	info, err := file.Stat()
+	if err == nil && info.Size() == 0 {
+		kv.meta = kvMeta{highwater: kvMetaPages}
+		for i := uint64(0); i < kvMetaPages && err == nil; i++ {
+			_, err = file.WriteAt(kv.meta.encode(), int64(i*kvPageSize))
+		}
+		if err == nil {
+			err = file.Sync()
+		}
+	} else if err == nil {
+		err = kv.load()
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return kv, nil
+}
+
+// load reads the current meta page and the freelist
+func (kv *kvFile) load() error {
+	found := false
+	for i := uint64(0); i < kvMetaPages; i++ {
+		page := make([]byte, kvMetaSize)
+		if _, err := kv.file.ReadAt(page, int64(i*kvPageSize)); err != nil {
+			continue
+		}
+		meta, err := decodeKVMeta(page)
+		if err == nil && (!found || meta.txid > kv.meta.txid) {
+			kv.meta, found = meta, true
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s no valid meta page found in %s", corruptedBlobErrorPrefix, kv.file.Name())
+	}
+	if kv.meta.freelist != 0 {
+		node, err := kv.readNode(kv.meta.freelist)
+		if err != nil {
+			return err
+		}
+		kv.free = node.children
+	}
+	return nil
+}
+
+// Close closes the underlying file
+func (kv *kvFile) Close() error {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	return kv.file.Close()
+}
+
+// get returns the value of key, if present
+func (kv *kvFile) get(key string) ([]byte, bool, error) {
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+	tx, err := kv.begin()
+	if err != nil {
+		return nil, false, err
+	}
+	return tx.get(key)
+}
+
+// size returns the size of the value of key, if present, without reading it
+func (kv *kvFile) size(key string) (int64, bool, error) {
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+	tx, err := kv.begin()
+	if err != nil {
+		return 0, false, err
+	}
+	value, ok, err := tx.lookup(key)
+	return value.length(), ok, err
+}
+
+// update runs fn on a new transaction and commits it if fn succeeds
+func (kv *kvFile) update(fn func(tx *kvTx) error) error {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	tx, err := kv.begin()
+	if err == nil {
+		err = fn(tx)
+	}
+	if err == nil {
+		err = tx.commit()
+	}
+	return err
+}
+
+// keysAfter returns up to limit keys greater than after, in sort order
+func (kv *kvFile) keysAfter(after string, limit int) ([]string, error) {
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+	tx, err := kv.begin()
+	if err != nil || tx.root == nil {
+		return nil, err
+	}
+	keys := make([]string, 0, limit)
+	return keys, tx.collect(tx.root, after, limit, &keys)
+}
+
+// begin starts a transaction on the current tree
+func (kv *kvFile) begin() (*kvTx, error) {
+	tx := &kvTx{kv: kv, free: append([]uint64{}, kv.free...), highwater: kv.meta.highwater}
+	if kv.meta.root != 0 {
+		root, err := kv.readNode(kv.meta.root)
+		if err != nil {
+			return nil, err
+		}
+		tx.root = root
+	}
+	return tx, nil
+}
+
+// get returns the value of key, if present
+func (tx *kvTx) get(key string) ([]byte, bool, error) {
+	value, ok, err := tx.lookup(key)
+	if !ok || err != nil {
+		return nil, false, err
+	}
+	data, err := tx.kv.readValue(value)
+	return data, err == nil, err
+}
+
+// lookup returns the leaf value of key, if present, without reading its overflow pages
+func (tx *kvTx) lookup(key string) (kvValue, bool, error) {
+	node := tx.root
+	for node != nil && !node.leaf {
+		var err error
+		if node, err = tx.child(node, node.childIndex(key)); err != nil {
+			return kvValue{}, false, err
+		}
+	}
+	if node == nil {
+		return kvValue{}, false, nil
+	}
+	index := sort.SearchStrings(node.keys, key)
+	if index < len(node.keys) && node.keys[index] == key {
+		return node.values[index], true, nil
+	}
+	return kvValue{}, false, nil
+}
+
+// put sets the value of key
+func (tx *kvTx) put(key string, value []byte) error {
+	return tx.putFrom(key, bytes.NewReader(value), int64(len(value)))
+}
+
+// putFrom sets the value of key to the size bytes read from reader, streaming big values to overflow pages
+func (tx *kvTx) putFrom(key string, reader io.Reader, size int64) error {
+	value, err := tx.store(reader, size)
+	if err != nil {
+		return err
+	}
+	if tx.root == nil {
+		tx.root = &kvNode{leaf: true}
+	}
+	nodes, err := tx.insert(tx.root, key, value)
+	if err != nil {
+		return err
+	}
+	for len(nodes) > 1 { // the root was split, grow the tree one level
+		root := &kvNode{}
+		root.adopt(0, 0, nodes)
+		nodes = root.split()
+	}
+	tx.root = nodes[0]
+	return nil
+}
+
+// delete removes key, returning whether it was present
+func (tx *kvTx) delete(key string) (bool, error) {
+	if tx.root == nil {
+		return false, nil
+	}
+	found, nodes, err := tx.remove(tx.root, key)
+	if err != nil || !found {
+		return found, err
+	}
+	tx.root = nil
+	if len(nodes) > 1 {
+		tx.root = &kvNode{}
+		tx.root.adopt(0, 0, nodes)
+	} else if len(nodes) == 1 {
+		tx.root = nodes[0]
+	}
+	for tx.root != nil && !tx.root.leaf && len(tx.root.keys) == 1 { // shrink the tree while the root has one child
+		child, err := tx.child(tx.root, 0)
+		if err != nil {
+			return true, err
+		}
+		tx.touch(tx.root)
+		tx.root = child
+	}
+	return true, nil
+}
+
+// store keeps a value of size bytes from reader, inline if small or else on newly allocated overflow pages.
+// Those pages are free in the committed tree, so writing them before the commit is crash safe
+func (tx *kvTx) store(reader io.Reader, size int64) (kvValue, error) {
+	if size <= kvInlineSize {
+		data := make([]byte, size)
+		_, err := io.ReadFull(reader, data)
+		return kvValue{data: data}, err
+	}
+	value := kvValue{page: tx.allocate(kvPages(int(size))), size: uint64(size)}
+	buf := make([]byte, kvCopyBuffer)
+	offset := int64(value.page * kvPageSize)
+	for left := size; left > 0; {
+		chunk := buf
+		if left < int64(len(chunk)) {
+			chunk = buf[:left]
+		}
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return kvValue{}, err
+		}
+		if _, err := tx.kv.file.WriteAt(chunk, offset); err != nil {
+			return kvValue{}, err
+		}
+		offset += int64(len(chunk))
+		left -= int64(len(chunk))
+	}
+	return value, nil
+}
+
+// release frees the overflow pages of a value once committed, if any
+func (tx *kvTx) release(value kvValue) {
+	if value.page != 0 {
+		for page := value.page; page < value.page+kvPages(int(value.size)); page++ {
+			tx.freed = append(tx.freed, page)
+		}
+	}
+}
+
+// insert puts key & value under node, returning the nodes replacing it
+func (tx *kvTx) insert(node *kvNode, key string, value kvValue) ([]*kvNode, error) {
+	tx.touch(node)
+	if node.leaf {
+		index := sort.SearchStrings(node.keys, key)
+		if index < len(node.keys) && node.keys[index] == key {
+			tx.release(node.values[index])
+			node.values[index] = value
+		} else {
+			node.keys = append(node.keys[:index], append([]string{key}, node.keys[index:]...)...)
+			node.values = append(node.values[:index], append([]kvValue{value}, node.values[index:]...)...)
+		}
+		return node.split(), nil
+	}
+	index := node.childIndex(key)
+	child, err := tx.child(node, index)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := tx.insert(child, key, value)
+	if err != nil {
+		return nil, err
+	}
+	node.adopt(index, 1, nodes)
+	return node.split(), nil
+}
+
+// remove deletes key under node, returning whether it was found and the nodes replacing node
+func (tx *kvTx) remove(node *kvNode, key string) (bool, []*kvNode, error) {
+	if node.leaf {
+		index := sort.SearchStrings(node.keys, key)
+		if index == len(node.keys) || node.keys[index] != key {
+			return false, []*kvNode{node}, nil
+		}
+		tx.touch(node)
+		tx.release(node.values[index])
+		node.keys = append(node.keys[:index], node.keys[index+1:]...)
+		node.values = append(node.values[:index], node.values[index+1:]...)
+		if len(node.keys) == 0 {
+			return true, nil, nil
+		}
+		return true, []*kvNode{node}, nil
+	}
+	index := node.childIndex(key)
+	child, err := tx.child(node, index)
+	if err != nil {
+		return false, nil, err
+	}
+	found, nodes, err := tx.remove(child, key)
+	if err != nil || !found {
+		return found, []*kvNode{node}, err
+	}
+	tx.touch(node)
+	node.adopt(index, 1, nodes)
+	// merge an underfilled child with its right sibling (or left one if it is the last), splitting again if needed
+	if len(nodes) == 1 && nodes[0].size() < kvPageSize/4 && len(node.keys) > 1 {
+		if index == len(node.keys)-1 {
+			index--
+		}
+		left, err := tx.child(node, index)
+		if err != nil {
+			return false, nil, err
+		}
+		right, err := tx.child(node, index+1)
+		if err != nil {
+			return false, nil, err
+		}
+		tx.touch(left)
+		tx.touch(right)
+		left.keys = append(left.keys, right.keys...)
+		left.values = append(left.values, right.values...)
+		left.children = append(left.children, right.children...)
+		left.kids = append(left.kids, right.kids...)
+		node.adopt(index, 2, left.split())
+	}
+	if len(node.keys) == 0 {
+		return true, nil, nil
+	}
+	return true, node.split(), nil
+}
+
+// collect appends to keys up to limit keys greater than after under node
+func (tx *kvTx) collect(node *kvNode, after string, limit int, keys *[]string) error {
+	if node.leaf {
+		for _, key := range node.keys[sort.SearchStrings(node.keys, after):] {
+			if key > after && len(*keys) < limit {
+				*keys = append(*keys, key)
+			}
+		}
+		return nil
+	}
+	for index := node.childIndex(after); index < len(node.keys) && len(*keys) < limit; index++ {
+		child, err := tx.child(node, index)
+		if err != nil {
+			return err
+		}
+		if err := tx.collect(child, after, limit, keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// child returns the child at index of a branch node, reading it if needed
+func (tx *kvTx) child(node *kvNode, index int) (*kvNode, error) {
+	if node.kids[index] == nil {
+		child, err := tx.kv.readNode(node.children[index])
+		if err != nil {
+			return nil, err
+		}
+		node.kids[index] = child
+	}
+	return node.kids[index], nil
+}
+
+// touch marks a node as modified, its pages will be freed on commit
+func (tx *kvTx) touch(node *kvNode) {
+	if node.pgid != 0 {
+		for page := node.pgid; page <= node.pgid+node.overflow; page++ {
+			tx.freed = append(tx.freed, page)
+		}
+		node.pgid = 0
+	}
+}
+
+// commit writes the modified nodes and freelist, then switches the meta page to the new tree
+func (tx *kvTx) commit() error {
+	meta := kvMeta{highwater: tx.highwater, txid: tx.kv.meta.txid + 1}
+	if tx.root != nil {
+		if err := tx.write(tx.root); err != nil {
+			return err
+		}
+		meta.root = tx.root.pgid
+	}
+	// the old freelist is replaced, and pages freed now can only be reused after this commit
+	if old := tx.kv.meta.freelist; old != 0 {
+		node, err := tx.kv.readNode(old)
+		if err != nil {
+			return err
+		}
+		tx.touch(node)
+	}
+	freelist := &kvNode{children: make([]uint64, 0, len(tx.free)+len(tx.freed))}
+	pages := kvPages(kvNodeHeader + 8*(len(tx.free)+len(tx.freed)))
+	meta.freelist = tx.allocate(pages)
+	freelist.children = append(append(freelist.children, tx.free...), tx.freed...)
+	sort.Slice(freelist.children, func(i, j int) bool { return freelist.children[i] < freelist.children[j] })
+	freelist.pgid, freelist.overflow = meta.freelist, pages-1
+	if _, err := tx.kv.file.WriteAt(freelist.encode(kvFreeFlag), int64(meta.freelist*kvPageSize)); err != nil {
+		return err
+	}
+	meta.highwater = tx.highwater
+	if err := tx.kv.file.Sync(); err != nil {
+		return err
+	}
+	slot := int64(meta.txid%kvMetaPages) * kvPageSize
+	if _, err := tx.kv.file.WriteAt(meta.encode(), slot); err != nil {
+		return err
+	}
+	if err := tx.kv.file.Sync(); err != nil {
+		return err
+	}
+	tx.kv.meta, tx.kv.free = meta, freelist.children
+	return nil
+}
+
+// write stores the modified nodes under node, children first so their pages are known by their parents
+func (tx *kvTx) write(node *kvNode) error {
+	if node.pgid != 0 {
+		return nil
+	}
+	for i, kid := range node.kids {
+		if kid != nil && kid.pgid == 0 {
+			if err := tx.write(kid); err != nil {
+				return err
+			}
+			node.children[i] = kid.pgid
+		}
+	}
+	flag := kvBranchFlag
+	if node.leaf {
+		flag = kvLeafFlag
+	}
+	pages := kvPages(node.size())
+	node.pgid, node.overflow = tx.allocate(pages), pages-1
+	_, err := tx.kv.file.WriteAt(node.encode(flag), int64(node.pgid*kvPageSize))
+	return err
+}
+
+// allocate reserves count contiguous pages, from the free ones if possible
+func (tx *kvTx) allocate(count uint64) uint64 {
+	run := uint64(0)
+	for i, page := range tx.free {
+		if run > 0 && page == tx.free[i-1]+1 {
+			run++
+		} else {
+			run = 1
+		}
+		if run == count {
+			start := i + 1 - int(count)
+			first := tx.free[start]
+			tx.free = append(tx.free[:start:start], tx.free[i+1:]...)
+			return first
+		}
+	}
+	first := tx.highwater
+	tx.highwater += count
+	return first
+}
+
+// readNode reads the node stored at page pgid
+func (kv *kvFile) readNode(pgid uint64) (*kvNode, error) {
+	buf := make([]byte, kvPageSize)
+	if _, err := kv.file.ReadAt(buf, int64(pgid*kvPageSize)); err != nil {
+		return nil, err
+	}
+	overflow := uint64(binary.BigEndian.Uint32(buf[8:]))
+	if overflow > 0 {
+		buf = make([]byte, (overflow+1)*kvPageSize)
+		if _, err := kv.file.ReadAt(buf, int64(pgid*kvPageSize)); err != nil {
+			return nil, err
+		}
+	}
+	node, err := decodeKVNode(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s page %d: %v", corruptedBlobErrorPrefix, pgid, err)
+	}
+	node.pgid = pgid
+	return node, nil
+}
+
+// readValue returns the bytes of a value, reading them from its overflow pages if needed
+func (kv *kvFile) readValue(value kvValue) ([]byte, error) {
+	if value.page == 0 {
+		return value.data, nil
+	}
+	data := make([]byte, value.size)
+	if _, err := kv.file.ReadAt(data, int64(value.page*kvPageSize)); err != nil {
+		return nil, fmt.Errorf("%s overflow value at page %d: %v", corruptedBlobErrorPrefix, value.page, err)
+	}
+	return data, nil
+}
+
+// length returns the size of a value, inline or overflow
+func (value kvValue) length() int64 {
+	if value.page == 0 {
+		return int64(len(value.data))
+	}
+	return int64(value.size)
+}
+
+// childIndex returns the index of the child of a branch node where key belongs
+func (node *kvNode) childIndex(key string) int {
+	index := sort.Search(len(node.keys), func(i int) bool { return node.keys[i] > key }) - 1
+	if index < 0 {
+		return 0
+	}
+	return index
+}
+
+// adopt replaces count children of a branch node from index with the given nodes
+func (node *kvNode) adopt(index, count int, nodes []*kvNode) {
+	keys, children := make([]string, len(nodes)), make([]uint64, len(nodes))
+	for i, child := range nodes {
+		keys[i] = child.keys[0]
+	}
+	node.keys = append(node.keys[:index:index], append(keys, node.keys[index+count:]...)...)
+	node.children = append(node.children[:index:index], append(children, node.children[index+count:]...)...)
+	node.kids = append(node.kids[:index:index], append(nodes, node.kids[index+count:]...)...)
+}
+
+// split breaks a node bigger than a page into several nodes, each fitting in a page if possible
+func (node *kvNode) split() []*kvNode {
+	if node.size() <= kvPageSize || len(node.keys) < 2 {
+		return []*kvNode{node}
+	}
+	var nodes []*kvNode
+	start, size := 0, kvNodeHeader
+	for i := range node.keys {
+		elementSize := node.elementSize(i)
+		if i > start && size+elementSize > kvPageSize {
+			nodes = append(nodes, node.slice(start, i))
+			start, size = i, kvNodeHeader
+		}
+		size += elementSize
+	}
+	return append(nodes, node.slice(start, len(node.keys)))
+}
+
+// slice returns a new node with the elements from start to end of node
+func (node *kvNode) slice(start, end int) *kvNode {
+	slice := &kvNode{leaf: node.leaf, keys: append([]string{}, node.keys[start:end]...)}
+	if node.leaf {
+		slice.values = append([]kvValue{}, node.values[start:end]...)
+	} else {
+		slice.children = append([]uint64{}, node.children[start:end]...)
+		slice.kids = append([]*kvNode{}, node.kids[start:end]...)
+	}
+	return slice
+}
+
+// size returns the encoded size of the node
+func (node *kvNode) size() int {
+	size := kvNodeHeader
+	for i := range node.keys {
+		size += node.elementSize(i)
+	}
+	return size
+}
+
+// elementSize returns the encoded size of the element at index
+func (node *kvNode) elementSize(index int) int {
+	if node.leaf && node.values[index].page != 0 {
+		return 8 + len(node.keys[index]) + 16
+	}
+	if node.leaf {
+		return 8 + len(node.keys[index]) + len(node.values[index].data)
+	}
+	return 12 + len(node.keys[index])
+}
+
+// kvPages returns the number of pages needed to hold size bytes
+func kvPages(size int) uint64 {
+	return uint64((size + kvPageSize - 1) / kvPageSize)
+}
+
+// encode serializes the node with the given flag into its pages
+func (node *kvNode) encode(flag int) []byte {
+	buf := make([]byte, (node.overflow+1)*kvPageSize)
+	count := len(node.keys)
+	if flag == kvFreeFlag {
+		count = len(node.children)
+	}
+	binary.BigEndian.PutUint32(buf, uint32(flag))
+	binary.BigEndian.PutUint32(buf[4:], uint32(count))
+	binary.BigEndian.PutUint32(buf[8:], uint32(node.overflow))
+	offset := kvNodeHeader
+	for i := 0; i < count; i++ {
+		switch flag {
+		case kvLeafFlag:
+			value := node.values[i]
+			binary.BigEndian.PutUint32(buf[offset:], uint32(len(node.keys[i])))
+			binary.BigEndian.PutUint32(buf[offset+4:], uint32(len(value.data)))
+			if value.page != 0 {
+				binary.BigEndian.PutUint32(buf[offset+4:], kvValueRef|16)
+			}
+			offset += 8
+			offset += copy(buf[offset:], node.keys[i])
+			if value.page != 0 {
+				binary.BigEndian.PutUint64(buf[offset:], value.page)
+				binary.BigEndian.PutUint64(buf[offset+8:], value.size)
+				offset += 16
+			} else {
+				offset += copy(buf[offset:], value.data)
+			}
+		case kvBranchFlag:
+			binary.BigEndian.PutUint32(buf[offset:], uint32(len(node.keys[i])))
+			binary.BigEndian.PutUint64(buf[offset+4:], node.children[i])
+			offset += 12
+			offset += copy(buf[offset:], node.keys[i])
+		case kvFreeFlag:
+			binary.BigEndian.PutUint64(buf[offset:], node.children[i])
+			offset += 8
+		}
+	}
+	return buf
+}
+
+// decodeKVNode deserializes a node from its pages
+func decodeKVNode(buf []byte) (*kvNode, error) {
+	flag := binary.BigEndian.Uint32(buf)
+	count := int(binary.BigEndian.Uint32(buf[4:]))
+	node := &kvNode{leaf: flag == kvLeafFlag, overflow: uint64(binary.BigEndian.Uint32(buf[8:]))}
+	offset := kvNodeHeader
+	for i := 0; i < count; i++ {
+		switch flag {
+		case kvLeafFlag:
+			if offset+8 > len(buf) {
+				return nil, fmt.Errorf("truncated leaf node")
+			}
+			keyLen := int(binary.BigEndian.Uint32(buf[offset:]))
+			valueLen := binary.BigEndian.Uint32(buf[offset+4:])
+			ref := valueLen&kvValueRef != 0
+			valueLen &^= kvValueRef
+			offset += 8
+			if offset+keyLen+int(valueLen) > len(buf) || (ref && valueLen != 16) {
+				return nil, fmt.Errorf("truncated leaf node")
+			}
+			node.keys = append(node.keys, string(buf[offset:offset+keyLen]))
+			offset += keyLen
+			value := kvValue{data: append([]byte{}, buf[offset:offset+int(valueLen)]...)}
+			if ref {
+				value = kvValue{page: binary.BigEndian.Uint64(buf[offset:]), size: binary.BigEndian.Uint64(buf[offset+8:])}
+			}
+			node.values = append(node.values, value)
+			offset += int(valueLen)
+		case kvBranchFlag:
+			if offset+12 > len(buf) {
+				return nil, fmt.Errorf("truncated branch node")
+			}
+			keyLen := int(binary.BigEndian.Uint32(buf[offset:]))
+			node.children = append(node.children, binary.BigEndian.Uint64(buf[offset+4:]))
+			offset += 12
+			if offset+keyLen > len(buf) {
+				return nil, fmt.Errorf("truncated branch node")
+			}
+			node.keys = append(node.keys, string(buf[offset:offset+keyLen]))
+			offset += keyLen
+		case kvFreeFlag:
+			if offset+8 > len(buf) {
+				return nil, fmt.Errorf("truncated freelist node")
+			}
+			node.children = append(node.children, binary.BigEndian.Uint64(buf[offset:]))
+			offset += 8
+		default:
+			return nil, fmt.Errorf("unknown node type %d", flag)
+		}
+	}
+	if flag == kvBranchFlag {
+		node.kids = make([]*kvNode, count)
+	}
+	return node, nil
+}
+
+// encode serializes the meta page
+func (meta kvMeta) encode() []byte {
+	buf := make([]byte, kvMetaSize)
+	binary.BigEndian.PutUint32(buf, kvMagic)
+	binary.BigEndian.PutUint32(buf[4:], kvVersion)
+	binary.BigEndian.PutUint32(buf[8:], kvPageSize)
+	binary.BigEndian.PutUint64(buf[16:], meta.root)
+	binary.BigEndian.PutUint64(buf[24:], meta.freelist)
+	binary.BigEndian.PutUint64(buf[32:], meta.highwater)
+	binary.BigEndian.PutUint64(buf[40:], meta.txid)
+	hasher := fnv.New64a()
+	hasher.Write(buf[:48])
+	binary.BigEndian.PutUint64(buf[48:], hasher.Sum64())
+	return buf
+}
+
+// decodeKVMeta deserializes and validates a meta page
+func decodeKVMeta(buf []byte) (kvMeta, error) {
+	hasher := fnv.New64a()
+	hasher.Write(buf[:48])
+	if binary.BigEndian.Uint32(buf) != kvMagic || binary.BigEndian.Uint64(buf[48:]) != hasher.Sum64() {
+		return kvMeta{}, fmt.Errorf("invalid meta page")
+	}
+	if version := binary.BigEndian.Uint32(buf[4:]); version != kvVersion {
+		return kvMeta{}, fmt.Errorf("unsupported version %d", version)
+	}
+	if pageSize := binary.BigEndian.Uint32(buf[8:]); pageSize != kvPageSize {
+		return kvMeta{}, fmt.Errorf("unsupported page size %d", pageSize)
+	}
+	return kvMeta{
+		root:      binary.BigEndian.Uint64(buf[16:]),
+		freelist:  binary.BigEndian.Uint64(buf[24:]),
+		highwater: binary.BigEndian.Uint64(buf[32:]),
+		txid:      binary.BigEndian.Uint64(buf[40:]),
+	}, nil
+}
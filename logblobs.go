@@ -0,0 +1,578 @@
+package blobstore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	logRecordHeader       = 12 // crc, key length & value length
+	logHintHeader         = 16 // key length, value length & record offset
+	logTombstone          = 0xffffffff
+	logDataExt            = ".data"
+	logHintExt            = ".hint"
+	defaultMaxSegmentSize = 64 << 20
+)
+
+// LogOptions configures a LogBlobServer
+type LogOptions struct {
+	// MaxSegmentSize is the size at which the active segment is closed and a new one started
+	MaxSegmentSize int64
+	// SyncWrites flushes each write to disk before returning
+	SyncWrites bool
+}
+
+// LogBlobServer is a VFSBlobServer on a Bitcask style log structured store,
+// blobs are appended to segment files and located through an in memory index (the keydir)
+type LogBlobServer struct {
+	*VFSBlobServer
+	log *logBlobs
+}
+
+// NewLogBlobServer returns a LogBlobServer on dir, rebuilding the keydir from the existing segments
+func NewLogBlobServer(dir string, hash crypto.Hash, options LogOptions) (*LogBlobServer, error) {
+	log, err := openLogBlobs(dir, options)
+	if err != nil {
+		return nil, err
+	}
+	return &LogBlobServer{&VFSBlobServer{log, hash}, log}, nil
+}
+
+// Close closes all segment files
+func (lbs *LogBlobServer) Close() error {
+	return lbs.log.Close()
+}
+
+// Compact rewrites the live blobs of the closed segments with at least minDeadRatio of dead bytes
+// into the active segment and drops them, it returns the number of segments compacted
+func (lbs *LogBlobServer) Compact(minDeadRatio float64) (int, error) {
+	return lbs.log.compact(minDeadRatio)
+}
+
+// logBlobs is a log structured VirtualFS
+//
+// Each segment is a sequence of records: crc32, key length, value length (or tombstone), key & value.
+// Closed segments get a hint file listing their keys and record offsets, so the keydir can be rebuilt
+// on open without reading the blobs. Temporary blobs are kept in memory till renamed
+type logBlobs struct {
+	dir      string
+	options  LogOptions
+	lock     sync.RWMutex
+	keydir   map[string]logEntry
+	segments map[uint32]*logSegment
+	active   *logSegment
+	retired  map[uint32]*logSegment // compacted segments, kept open till their last reader is done
+	tmps     map[string]*bytes.Buffer
+}
+
+// logEntry locates the latest record of a key
+type logEntry struct {
+	segment uint32
+	offset  int64 // record offset
+	size    uint32
+}
+
+// logSegment is a segment file, its byte accounting and the number of readers using it
+type logSegment struct {
+	id        uint32
+	file      *os.File
+	size      int64
+	liveBytes int64
+	readers   int32 // updated atomically, as readers open under the read lock
+}
+
+// logReader reads a blob from its segment, releasing the segment at the end of the blob, on errors or when closed
+type logReader struct {
+	*io.SectionReader
+	log     *logBlobs
+	segment *logSegment
+}
+
+// logRecord is a decoded record, or hint
+type logRecord struct {
+	key    string
+	offset int64
+	size   uint32
+	dead   bool // a tombstone
+}
+
+// openLogBlobs opens the log at dir, creating dir if needed
+func openLogBlobs(dir string, options LogOptions) (*logBlobs, error) {
+	if options.MaxSegmentSize <= 0 {
+		options.MaxSegmentSize = defaultMaxSegmentSize
+	}
+	if err := os.MkdirAll(dir, defaultPerms); err != nil {
+		return nil, err
+	}
+	log := &logBlobs{
+		dir:      dir,
+		options:  options,
+		keydir:   make(map[string]logEntry),
+		segments: make(map[uint32]*logSegment),
+		retired:  make(map[uint32]*logSegment),
+		tmps:     make(map[string]*bytes.Buffer),
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*"+logDataExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	last := uint32(0)
+	for _, name := range names {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), logDataExt), 10, 32)
+		if err != nil {
+			continue
+		}
+		if err := log.load(uint32(id)); err != nil {
+			log.Close()
+			return nil, err
+		}
+		last = uint32(id)
+	}
+	if err := log.rotate(last + 1); err != nil {
+		log.Close()
+		return nil, err
+	}
+	return log, nil
+}
+
+// load opens a closed segment, replaying its hints or records into the keydir
+func (log *logBlobs) load(id uint32) error {
+	file, err := os.OpenFile(log.segmentName(id, logDataExt), os.O_RDWR, defaultPerms)
+	if err != nil {
+		return err
+	}
+	records, err := readHints(log.segmentName(id, logHintExt))
+	if os.IsNotExist(err) {
+		records, err = scanRecords(file)
+		if err == nil && len(records) > 0 {
+			err = log.writeHints(id, records)
+		}
+	}
+	var info os.FileInfo
+	if err == nil {
+		info, err = file.Stat()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if info.Size() == 0 { // an active segment that never got any write
+		file.Close()
+		return os.Remove(log.segmentName(id, logDataExt))
+	}
+	segment := &logSegment{id: id, file: file, size: info.Size()}
+	log.segments[id] = segment
+	for _, record := range records {
+		log.apply(segment, record)
+	}
+	return nil
+}
+
+// Close closes all segment files
+func (log *logBlobs) Close() error {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	var firstErr error
+	for _, segment := range log.segments {
+		if err := segment.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, segment := range log.retired {
+		segment.file.Close()
+	}
+	return firstErr
+}
+
+// Open a key contents for reading straight from its segment
+func (log *logBlobs) Open(keyname string) (io.ReadCloser, error) {
+	log.lock.RLock()
+	defer log.lock.RUnlock()
+	if buf, ok := log.tmps[keyname]; ok {
+		return ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	}
+	entry, ok := log.keydir[keyname]
+	if !ok {
+		return nil, fmt.Errorf("Key not found: %s", keyname)
+	}
+	valueOffset := entry.offset + logRecordHeader + int64(len(keyname))
+	segment := log.segments[entry.segment]
+	atomic.AddInt32(&segment.readers, 1)
+	return &logReader{io.NewSectionReader(segment.file, valueOffset, int64(entry.size)), log, segment}, nil
+}
+
+// Read reads from the segment, releasing it once the blob is fully read or fails
+func (r *logReader) Read(buf []byte) (int, error) {
+	n, err := r.SectionReader.Read(buf)
+	if err != nil {
+		r.Close()
+	}
+	return n, err
+}
+
+// Close releases the segment, closing its file if it was retired and this was its last reader
+func (r *logReader) Close() error {
+	r.log.lock.Lock()
+	defer r.log.lock.Unlock()
+	if r.segment == nil {
+		return nil
+	}
+	segment := r.segment
+	r.segment = nil
+	readers := atomic.AddInt32(&segment.readers, -1)
+	if _, retired := r.log.retired[segment.id]; retired && readers == 0 {
+		delete(r.log.retired, segment.id)
+		return segment.file.Close()
+	}
+	return nil
+}
+
+// Create a key to write its contents, temporary keys stay in memory and the rest are appended when closed
+func (log *logBlobs) Create(keyname string) (io.WriteCloser, error) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	buf := &bytes.Buffer{}
+	if strings.HasSuffix(keyname, tmpSuffix) {
+		log.tmps[keyname] = buf
+		return nopWriterCloser(buf), nil
+	}
+	return &logWriter{buf, log, keyname}, nil
+}
+
+// logWriter buffers a blob to be appended to the log when closed
+type logWriter struct {
+	*bytes.Buffer
+	log     *logBlobs
+	keyname string
+}
+
+// Close appends the buffered blob to the log
+func (w *logWriter) Close() error {
+	w.log.lock.Lock()
+	defer w.log.lock.Unlock()
+	return w.log.append(w.keyname, w.Bytes(), false)
+}
+
+// Delete a key appending a tombstone
+func (log *logBlobs) Delete(keyname string) error {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	if _, ok := log.tmps[keyname]; ok {
+		delete(log.tmps, keyname)
+		return nil
+	}
+	if _, ok := log.keydir[keyname]; !ok {
+		return nil
+	}
+	return log.append(keyname, nil, true)
+}
+
+// Does the given key exists?
+func (log *logBlobs) Exists(keyname string) bool {
+	log.lock.RLock()
+	defer log.lock.RUnlock()
+	_, tmp := log.tmps[keyname]
+	_, ok := log.keydir[keyname]
+	return tmp || ok
+}
+
+// Rename a key, a temporary key is appended to the log for the first time
+func (log *logBlobs) Rename(oldkey, newkey string) error {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	if buf, ok := log.tmps[oldkey]; ok {
+		delete(log.tmps, oldkey)
+		return log.append(newkey, buf.Bytes(), false)
+	}
+	entry, ok := log.keydir[oldkey]
+	if !ok {
+		return fmt.Errorf("Key not found: %s", oldkey)
+	}
+	value := make([]byte, entry.size)
+	valueOffset := entry.offset + logRecordHeader + int64(len(oldkey))
+	if _, err := log.segments[entry.segment].file.ReadAt(value, valueOffset); err != nil {
+		return err
+	}
+	if err := log.append(newkey, value, false); err != nil {
+		return err
+	}
+	return log.append(oldkey, nil, true)
+}
+
+// ListTo lists all present keys in sort order to the keys channel
+func (log *logBlobs) ListTo(keys chan<- KeyOrError, acceptor func(string) Key) bool {
+	log.lock.RLock()
+	keynames := make([]string, 0, len(log.keydir))
+	for keyname := range log.keydir {
+		keynames = append(keynames, keyname)
+	}
+	log.lock.RUnlock()
+	sort.Strings(keynames)
+	for _, keyname := range keynames {
+		if key := acceptor(keyname); key != nil {
+			keys <- KeyOrError{key, nil}
+		}
+	}
+	return true
+}
+
+// Keyname returns a key name, the hash key is used directly as key name
+func (log *logBlobs) Keyname(key Key) string {
+	return key.String()
+}
+
+// TmpKeyname returns a temporary keyname
+func (log *logBlobs) TmpKeyname(size int) string {
+	key := make([]byte, size)
+	rand.Reader.Read(key)
+	return Key(key).String() + tmpSuffix
+}
+
+// append writes a record to the active segment and updates the keydir, rotating the segment if full
+func (log *logBlobs) append(keyname string, value []byte, dead bool) error {
+	record := encodeRecord(keyname, value, dead)
+	segment := log.active
+	if _, err := segment.file.WriteAt(record, segment.size); err != nil {
+		return err
+	}
+	if log.options.SyncWrites {
+		if err := segment.file.Sync(); err != nil {
+			return err
+		}
+	}
+	log.apply(segment, logRecord{keyname, segment.size, uint32(len(value)), dead})
+	segment.size += int64(len(record))
+	if segment.size >= log.options.MaxSegmentSize {
+		return log.rotate(segment.id + 1)
+	}
+	return nil
+}
+
+// apply updates the keydir and the live bytes accounting with a record of segment
+func (log *logBlobs) apply(segment *logSegment, record logRecord) {
+	if old, ok := log.keydir[record.key]; ok {
+		if oldSegment, ok := log.segments[old.segment]; ok {
+			oldSegment.liveBytes -= logRecordHeader + int64(len(record.key)) + int64(old.size)
+		}
+	}
+	if record.dead {
+		delete(log.keydir, record.key)
+		return
+	}
+	log.keydir[record.key] = logEntry{segment.id, record.offset, record.size}
+	segment.liveBytes += logRecordHeader + int64(len(record.key)) + int64(record.size)
+}
+
+// rotate closes the active segment, writing its hints, and starts a new one
+func (log *logBlobs) rotate(id uint32) error {
+	if log.active != nil {
+		if err := log.active.file.Sync(); err != nil {
+			return err
+		}
+		records, err := scanRecords(log.active.file)
+		if err == nil {
+			err = log.writeHints(log.active.id, records)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(log.segmentName(id, logDataExt), os.O_RDWR|os.O_CREATE|os.O_TRUNC, defaultPerms)
+	if err != nil {
+		return err
+	}
+	log.active = &logSegment{id: id, file: file}
+	log.segments[id] = log.active
+	return nil
+}
+
+// compact rewrites the live records of mostly dead closed segments into the active one and drops them
+func (log *logBlobs) compact(minDeadRatio float64) (int, error) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	ids := make([]int, 0, len(log.segments))
+	for id := range log.segments {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	compacted := 0
+	for i, id := range ids {
+		segment := log.segments[uint32(id)]
+		if segment == log.active || segment.size == 0 ||
+			float64(segment.size-segment.liveBytes)/float64(segment.size) < minDeadRatio {
+			continue
+		}
+		records, err := scanRecords(segment.file)
+		if err != nil {
+			return compacted, err
+		}
+		for _, record := range records {
+			entry, live := log.keydir[record.key]
+			if !record.dead && live && entry.segment == segment.id && entry.offset == record.offset {
+				value := make([]byte, record.size)
+				if _, err := segment.file.ReadAt(value, record.offset+logRecordHeader+int64(len(record.key))); err != nil {
+					return compacted, err
+				}
+				if err := log.append(record.key, value, false); err != nil {
+					return compacted, err
+				}
+			} else if record.dead && !live && i > 0 {
+				// keep the tombstone while older segments may still hold the deleted record
+				if err := log.append(record.key, nil, true); err != nil {
+					return compacted, err
+				}
+			}
+		}
+		if err := log.active.file.Sync(); err != nil {
+			return compacted, err
+		}
+		delete(log.segments, segment.id)
+		if atomic.LoadInt32(&segment.readers) > 0 {
+			log.retired[segment.id] = segment
+		} else if err := segment.file.Close(); err != nil {
+			return compacted, err
+		}
+		os.Remove(log.segmentName(segment.id, logHintExt))
+		if err := os.Remove(log.segmentName(segment.id, logDataExt)); err != nil {
+			return compacted, err
+		}
+		compacted++
+	}
+	return compacted, nil
+}
+
+// writeHints writes the hint file of a closed segment, atomically
+func (log *logBlobs) writeHints(id uint32, records []logRecord) error {
+	buf := &bytes.Buffer{}
+	header := make([]byte, logHintHeader)
+	for _, record := range records {
+		size := record.size
+		if record.dead {
+			size = logTombstone
+		}
+		binary.BigEndian.PutUint32(header, uint32(len(record.key)))
+		binary.BigEndian.PutUint32(header[4:], size)
+		binary.BigEndian.PutUint64(header[8:], uint64(record.offset))
+		buf.Write(header)
+		buf.WriteString(record.key)
+	}
+	tmpName := log.segmentName(id, logHintExt+tmpSuffix)
+	if err := ioutil.WriteFile(tmpName, buf.Bytes(), defaultPerms); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, log.segmentName(id, logHintExt))
+}
+
+// segmentName returns the file name of a segment with the given extension
+func (log *logBlobs) segmentName(id uint32, ext string) string {
+	return filepath.Join(log.dir, fmt.Sprintf("%08d%s", id, ext))
+}
+
+// encodeRecord returns a record ready to be appended
+func encodeRecord(keyname string, value []byte, dead bool) []byte {
+	record := make([]byte, logRecordHeader, logRecordHeader+len(keyname)+len(value))
+	size := uint32(len(value))
+	if dead {
+		size = logTombstone
+	}
+	binary.BigEndian.PutUint32(record[4:], uint32(len(keyname)))
+	binary.BigEndian.PutUint32(record[8:], size)
+	record = append(append(record, keyname...), value...)
+	binary.BigEndian.PutUint32(record, crc32.ChecksumIEEE(record[4:]))
+	return record
+}
+
+// scanRecords reads all the valid records of a segment, truncating a torn write at its end.
+// A record failing its crc before the end of the segment is reported as corruption, not truncated
+func scanRecords(file *os.File) ([]logRecord, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var records []logRecord
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, 1<<62))
+	offset := int64(0)
+	header := make([]byte, logRecordHeader)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return records, truncateTail(file, offset, err)
+		}
+		keyLen, size := binary.BigEndian.Uint32(header[4:]), binary.BigEndian.Uint32(header[8:])
+		dataLen := keyLen
+		if size != logTombstone {
+			dataLen += size
+		}
+		data := make([]byte, dataLen)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return records, truncateTail(file, offset, err)
+		}
+		hasher := crc32.NewIEEE()
+		hasher.Write(header[4:])
+		hasher.Write(data)
+		if end := offset + logRecordHeader + int64(dataLen); hasher.Sum32() != binary.BigEndian.Uint32(header) {
+			if end < info.Size() {
+				return nil, fmt.Errorf("%s record at %d of %s fails its crc", corruptedBlobErrorPrefix, offset,
+					file.Name())
+			}
+			return records, truncateTail(file, offset, io.ErrUnexpectedEOF)
+		}
+		record := logRecord{string(data[:keyLen]), offset, size, size == logTombstone}
+		if record.dead {
+			record.size = 0
+		}
+		records = append(records, record)
+		offset += logRecordHeader + int64(dataLen)
+	}
+}
+
+// truncateTail drops a partially written record at the end of a segment, err is io.EOF when there was none
+func truncateTail(file *os.File, offset int64, err error) error {
+	if err == io.EOF {
+		return nil
+	}
+	if err == io.ErrUnexpectedEOF {
+		return file.Truncate(offset)
+	}
+	return err
+}
+
+// readHints reads the records of a segment hint file
+func readHints(name string) ([]logRecord, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var records []logRecord
+	for len(data) > 0 {
+		if len(data) < logHintHeader {
+			return nil, fmt.Errorf("%s truncated hint file %s", corruptedBlobErrorPrefix, name)
+		}
+		keyLen, size := int(binary.BigEndian.Uint32(data)), binary.BigEndian.Uint32(data[4:])
+		offset := int64(binary.BigEndian.Uint64(data[8:]))
+		if len(data) < logHintHeader+keyLen {
+			return nil, fmt.Errorf("%s truncated hint file %s", corruptedBlobErrorPrefix, name)
+		}
+		record := logRecord{string(data[logHintHeader : logHintHeader+keyLen]), offset, size, size == logTombstone}
+		if record.dead {
+			record.size = 0
+		}
+		records = append(records, record)
+		data = data[logHintHeader+keyLen:]
+	}
+	return records, nil
+}
@@ -0,0 +1,140 @@
+package blobstore
+
+import (
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestLogReadsNWrites test that the log structured blobserver does its reads and writes as expected
+func TestLogReadsNWrites(t *testing.T) {
+	// setup
+	dir := fileBlobs{""}.TmpKeyname(10)
+	lbs, err := NewLogBlobServer(dir, crypto.SHA1, LogOptions{})
+	assert(err == nil, t, "Error opening the store: %v", err)
+	// exercise
+	readsNWrites(t, lbs)
+	listChecks(t, buildExpectedKeys(), lbs)
+	// cleanup
+	lbs.Close()
+	err = os.RemoveAll(dir)
+	assert(err == nil, t, "Error in cleanup removing %s: %v", dir, err)
+}
+
+// TestLogCompaction checks the keydir survives reopening and compaction drops the dead segments
+func TestLogCompaction(t *testing.T) {
+	// setup
+	dir := fileBlobs{""}.TmpKeyname(10)
+	options := LogOptions{MaxSegmentSize: 256}
+	lbs, err := NewLogBlobServer(dir, crypto.SHA1, options)
+	assert(err == nil, t, "Error opening the store: %v", err)
+	keys := []Key{}
+	for i := 0; i < 40; i++ {
+		key, err := lbs.Write(strings.NewReader(fmt.Sprintf("blob #%d", i)))
+		assert(err == nil, t, "Error writing blob #%d: %v", i, err)
+		keys = append(keys, key)
+	}
+	for _, key := range keys[:30] {
+		err = lbs.Remove(key)
+		assert(err == nil, t, "Error removing %v: %v", key, err)
+	}
+	keys = keys[30:]
+	// exercise reopening, from hints, and compacting
+	lbs.Close()
+	lbs, err = NewLogBlobServer(dir, crypto.SHA1, options)
+	assert(err == nil, t, "Error reopening the store: %v", err)
+	assertLogKeys(t, lbs, keys)
+	before, _ := filepath.Glob(filepath.Join(dir, "*"+logDataExt))
+	compacted, err := lbs.Compact(0.5)
+	assert(err == nil, t, "Error compacting: %v", err)
+	assert(compacted > 0, t, "Expected some segments to be compacted")
+	after, _ := filepath.Glob(filepath.Join(dir, "*"+logDataExt))
+	assert(len(after) < len(before), t, "Expected less than %d segments but got %d", len(before), len(after))
+	assertLogKeys(t, lbs, keys)
+	// removed keys must not come back after reopening
+	lbs.Close()
+	lbs, err = NewLogBlobServer(dir, crypto.SHA1, options)
+	assert(err == nil, t, "Error reopening the store: %v", err)
+	assertLogKeys(t, lbs, keys)
+	// cleanup
+	lbs.Close()
+	err = os.RemoveAll(dir)
+	assert(err == nil, t, "Error in cleanup removing %s: %v", dir, err)
+}
+
+// assertLogKeys checks the store has exactly the given keys and all of them can be read
+func assertLogKeys(t *testing.T, lbs *LogBlobServer, keys []Key) {
+	for _, key := range keys {
+		_, err := readBlob(lbs, key)
+		assert(err == nil, t, "Error reading %v: %v", key, err)
+	}
+	count := 0
+	for keyOrErr := range lbs.List() {
+		assert(keyOrErr.err == nil, t, "Error in List stream: %v", keyOrErr.err)
+		count++
+	}
+	assert(count == len(keys), t, "Expected %d keys listed but got %d", len(keys), count)
+}
+
+// TestLogRetiredSegments checks compacted segments are closed once their readers are done
+func TestLogRetiredSegments(t *testing.T) {
+	// setup
+	dir := fileBlobs{""}.TmpKeyname(10)
+	lbs, err := NewLogBlobServer(dir, crypto.SHA1, LogOptions{MaxSegmentSize: 64})
+	assert(err == nil, t, "Error opening the store: %v", err)
+	kept := strings.Repeat("kept blob ", 6)
+	key, err := lbs.Write(strings.NewReader(kept))
+	assert(err == nil, t, "Error writing blob: %v", err)
+	reader, err := lbs.Read(key)
+	assert(err == nil, t, "Error reading %v: %v", key, err)
+	// exercise
+	compacted, err := lbs.Compact(0)
+	assert(err == nil && compacted > 0, t, "Expected some segments compacted but got %d: %v", compacted, err)
+	assert(len(lbs.log.retired) == 1, t, "Expected the segment being read to be retired, not closed")
+	blob, err := ioutil.ReadAll(reader)
+	// check
+	assert(err == nil && string(blob) == kept, t, "Unexpected blob '%s': %v", blob, err)
+	assert(len(lbs.log.retired) == 0, t, "Expected the retired segment to be closed after its last read")
+	// cleanup
+	lbs.Close()
+	err = os.RemoveAll(dir)
+	assert(err == nil, t, "Error in cleanup removing %s: %v", dir, err)
+}
+
+// TestLogCorruptedRecord checks a corrupted record before the end of a segment fails instead of truncating it
+func TestLogCorruptedRecord(t *testing.T) {
+	// setup
+	dir := fileBlobs{""}.TmpKeyname(10)
+	lbs, err := NewLogBlobServer(dir, crypto.SHA1, LogOptions{})
+	assert(err == nil, t, "Error opening the store: %v", err)
+	for i := 0; i < 3; i++ {
+		_, err := lbs.Write(strings.NewReader(fmt.Sprintf("blob #%d", i)))
+		assert(err == nil, t, "Error writing blob #%d: %v", i, err)
+	}
+	lbs.Close()
+	segment := filepath.Join(dir, fmt.Sprintf("%08d%s", 1, logDataExt))
+	data, err := ioutil.ReadFile(segment)
+	assert(err == nil, t, "Error reading segment: %v", err)
+	data[len(data)/2] ^= 0xff
+	// exercise torn tail truncation first
+	err = ioutil.WriteFile(segment, append(data[:len(data)/2:len(data)/2], 1, 2, 3), 0640)
+	assert(err == nil, t, "Error writing segment: %v", err)
+	lbs, err = NewLogBlobServer(dir, crypto.SHA1, LogOptions{})
+	assert(err == nil, t, "Expected a torn tail to be truncated but got %v", err)
+	lbs.Close()
+	os.Remove(filepath.Join(dir, fmt.Sprintf("%08d%s", 1, logHintExt)))
+	// exercise a mid segment corruption
+	err = ioutil.WriteFile(segment, data, 0640)
+	assert(err == nil, t, "Error writing segment: %v", err)
+	_, err = NewLogBlobServer(dir, crypto.SHA1, LogOptions{})
+	// check
+	assert(err != nil && strings.HasPrefix(err.Error(), corruptedBlobErrorPrefix), t,
+		"Expected a corrupted record error but got %v", err)
+	// cleanup
+	err = os.RemoveAll(dir)
+	assert(err == nil, t, "Error in cleanup removing %s: %v", dir, err)
+}
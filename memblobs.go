@@ -8,6 +8,7 @@ import (
 	"io"
 	"io/ioutil"
 	"sort"
+	"sync"
 )
 
 const (
@@ -21,27 +22,33 @@ func NewMemBlobServer(hash crypto.Hash) *VFSBlobServer {
 
 // newMemBlobs returns a new memBlobs
 func newMemBlobs() *memBlobs {
-	return &memBlobs{make(map[string]*bytes.Buffer), make(sort.StringSlice, 0)}
+	return &memBlobs{blobs: make(map[string]*bytes.Buffer), keynames: make(sort.StringSlice, 0)}
 }
 
 // VirtualFS blob support on memory. Useful for testing abut also for in memory cache
 // Content Addressed Blobs have perfect caching, as they are immutable
 type memBlobs struct {
+	lock     sync.RWMutex
 	blobs    map[string]*bytes.Buffer
 	keynames sort.StringSlice
 }
 
 // Open a key contents for reading
 func (mem *memBlobs) Open(key string) (io.ReadCloser, error) {
+	mem.lock.RLock()
+	defer mem.lock.RUnlock()
 	buf, ok := mem.blobs[key]
 	if !ok {
 		return nil, fmt.Errorf("Key not found: %s", key)
 	}
-	return ioutil.NopCloser(buf), nil
+	// read from a fresh reader so that the blob can be opened more than once
+	return ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
 }
 
 // Create a key to set its contents
 func (mem *memBlobs) Create(keyname string) (io.WriteCloser, error) {
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
 	buf := make([]byte, 0, initialMemBuffer)
 	mem.blobs[keyname] = bytes.NewBuffer(buf)
 	mem.insert(keyname)
@@ -50,18 +57,36 @@ func (mem *memBlobs) Create(keyname string) (io.WriteCloser, error) {
 
 // Delete a key & contents from memory (and never fails)
 func (mem *memBlobs) Delete(keyname string) error {
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
 	delete(mem.blobs, keyname)
+	mem.extract(keyname)
 	return nil
 }
 
 // Does the given key exists in memory
 func (mem *memBlobs) Exists(keyname string) bool {
+	mem.lock.RLock()
+	defer mem.lock.RUnlock()
 	_, ok := mem.blobs[keyname]
 	return ok
 }
 
+// Size returns a key contents size
+func (mem *memBlobs) Size(keyname string) (int64, error) {
+	mem.lock.RLock()
+	defer mem.lock.RUnlock()
+	buf, ok := mem.blobs[keyname]
+	if !ok {
+		return 0, fmt.Errorf("Key not found: %s", keyname)
+	}
+	return int64(buf.Len()), nil
+}
+
 // Rename a key, usually only used once, when the contents are done writting and the correspoding hash key is known
 func (mem *memBlobs) Rename(oldkey, newkey string) error {
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
 	mem.blobs[newkey] = mem.blobs[oldkey]
 	mem.insert(newkey)
 	delete(mem.blobs, oldkey)
@@ -71,7 +96,30 @@ func (mem *memBlobs) Rename(oldkey, newkey string) error {
 
 // List all present keys in sort order to the keys channel
 func (mem *memBlobs) ListTo(keys chan<- KeyOrError, acceptor func(string) Key) bool {
-	for _, keyname := range mem.keynames {
+	// list from a snapshot, so that the blobs can be changed while listing
+	return mem.listFrom(keys, acceptor, 0)
+}
+
+// ListAfterTo lists the keys after the given one in sort order, starting at its position in the sorted keynames
+func (mem *memBlobs) ListAfterTo(keys chan<- KeyOrError, acceptor func(string) Key, after Key) bool {
+	mem.lock.RLock()
+	index := mem.keynames.Search(after.String())
+	if index < len(mem.keynames) && mem.keynames[index] == after.String() {
+		index++
+	}
+	mem.lock.RUnlock()
+	return mem.listFrom(keys, acceptor, index)
+}
+
+// listFrom lists the keynames from index on, from a snapshot, so that the blobs can be changed while listing
+func (mem *memBlobs) listFrom(keys chan<- KeyOrError, acceptor func(string) Key, index int) bool {
+	mem.lock.RLock()
+	if index > len(mem.keynames) {
+		index = len(mem.keynames)
+	}
+	keynames := append([]string{}, mem.keynames[index:]...)
+	mem.lock.RUnlock()
+	for _, keyname := range keynames {
 		key := acceptor(keyname)
 		if key != nil {
 			keys <- KeyOrError{key, nil}
@@ -89,12 +137,15 @@ func (mem *memBlobs) Keyname(key Key) string {
 func (mem *memBlobs) TmpKeyname(size int) string {
 	key := make([]byte, size)
 	rand.Reader.Read(key)
-	return fmt.Sprintf("%s.new", Key(key).String())
+	return Key(key).String() + tmpSuffix
 }
 
 // insert places a keyname ordered within the keynames list
 func (mem *memBlobs) insert(keyname string) {
 	index := mem.keynames.Search(keyname)
+	if index < len(mem.keynames) && mem.keynames[index] == keyname { // already there, overwritten contents
+		return
+	}
 	mem.keynames = append(mem.keynames, keyname)       // optimistically we place it in the end and hope for the best
 	for i := (len(mem.keynames) - 1); i > index; i-- { // shift everything after index one position to the 'right'
 		mem.keynames[i] = mem.keynames[i-1]
@@ -107,7 +158,7 @@ func (mem *memBlobs) insert(keyname string) {
 // extract removes a keyname from the ordered keynames list
 func (mem *memBlobs) extract(keyname string) bool {
 	index := mem.keynames.Search(keyname)
-	if mem.keynames[index] != keyname {
+	if index >= len(mem.keynames) || mem.keynames[index] != keyname {
 		return false
 	}
 	for i := index; i < (len(mem.keynames) - 1); i++ { // shift everything after index one position to the 'left'
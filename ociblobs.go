@@ -0,0 +1,62 @@
+package blobstore
+
+import (
+	"crypto"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	ociLayoutFile    = "oci-layout"
+	ociLayoutVersion = `{"imageLayoutVersion":"1.0.0"}`
+	ociIndexFile     = "index.json"
+	ociEmptyIndex    = `{"schemaVersion":2,"manifests":[]}`
+	ociBlobsDir      = "blobs"
+	ociAlgorithm     = "sha256"
+)
+
+// NewOCILayoutBlobServer returns a SHA-256 VFSBlobServer on an OCI image layout directory,
+// with the blobs at blobs/sha256/<hex>, creating the layout if missing
+func NewOCILayoutBlobServer(dir string) (*VFSBlobServer, error) {
+	if err := os.MkdirAll(filepath.Join(dir, ociBlobsDir, ociAlgorithm), defaultPerms); err != nil {
+		return nil, err
+	}
+	for name, contents := range map[string]string{ociLayoutFile: ociLayoutVersion, ociIndexFile: ociEmptyIndex} {
+		filename := filepath.Join(dir, name)
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			if err := ioutil.WriteFile(filename, []byte(contents), defaultPerms); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &VFSBlobServer{ociBlobs{fileBlobs{dir}}, crypto.SHA256}, nil
+}
+
+// ociBlobs is a fileBlobs laid out as an OCI image layout, so that tools reading layouts can use it directly
+type ociBlobs struct {
+	fileBlobs
+}
+
+// ListTo lists all present keys in sort order to the keys channel
+func (vfs ociBlobs) ListTo(keys chan<- KeyOrError, acceptor func(string) Key) bool {
+	return vfs.listTo(keys, acceptor, filepath.Join(vfs.dir, ociBlobsDir, ociAlgorithm), "", "")
+}
+
+// ListAfterTo lists the keys after the given one in sort order
+func (vfs ociBlobs) ListAfterTo(keys chan<- KeyOrError, acceptor func(string) Key, after Key) bool {
+	return vfs.listTo(keys, acceptor, filepath.Join(vfs.dir, ociBlobsDir, ociAlgorithm), "", after.String())
+}
+
+// Keyname returns the blobs/sha256/<hex> filename of a key
+func (vfs ociBlobs) Keyname(key Key) string {
+	return filepath.Join(vfs.dir, ociBlobsDir, ociAlgorithm, key.String())
+}
+
+// TmpKeyname returns a temporary filename in the blobs directory, next to but outside blobs/sha256
+func (vfs ociBlobs) TmpKeyname(size int) string {
+	key := make([]byte, size)
+	rand.Reader.Read(key)
+	return filepath.Join(vfs.dir, ociBlobsDir, Key(key).String()+tmpSuffix)
+}
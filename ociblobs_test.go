@@ -0,0 +1,48 @@
+package blobstore
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestOCILayout checks blobs are laid out and listed as in an OCI image layout
+func TestOCILayout(t *testing.T) {
+	// setup
+	dir := fileBlobs{""}.TmpKeyname(10)
+	blobs, err := NewOCILayoutBlobServer(dir)
+	assert(err == nil, t, "Error creating the OCI layout: %v", err)
+	layout, err := ioutil.ReadFile(filepath.Join(dir, ociLayoutFile))
+	assert(err == nil && string(layout) == ociLayoutVersion, t, "Unexpected oci-layout '%s': %v", layout, err)
+	// exercise
+	expected := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		blob := fmt.Sprintf("layer #%d", i)
+		key, err := blobs.Write(strings.NewReader(blob))
+		assert(err == nil, t, "Error writing blob #%d: %v", i, err)
+		hexKey := fmt.Sprintf("%x", sha256.Sum256([]byte(blob)))
+		assert(key.String() == hexKey, t, "Expected key %s but got %v", hexKey, key)
+		contents, err := ioutil.ReadFile(filepath.Join(dir, "blobs", "sha256", hexKey))
+		assert(err == nil && string(contents) == blob, t, "Expected '%s' in the layout but got '%s': %v", blob, contents, err)
+		expected[hexKey] = true
+	}
+	count := 0
+	for keyOrErr := range blobs.List() {
+		assert(keyOrErr.err == nil, t, "Error in List stream: %v", keyOrErr.err)
+		assert(expected[keyOrErr.key.String()], t, "Unexpected key: %v", keyOrErr.key)
+		count++
+	}
+	assert(count == len(expected), t, "Expected %d keys listed but got %d", len(expected), count)
+	err = syncDir(blobs.VirtualFS, filepath.Join(dir, "missing", "keyname"))
+	assert(os.IsNotExist(err), t, "Expected the layout directories to be synced but got %v", err)
+	// reopening keeps the existing layout
+	_, err = NewOCILayoutBlobServer(dir)
+	assert(err == nil, t, "Error reopening the OCI layout: %v", err)
+	// cleanup
+	err = os.RemoveAll(dir)
+	assert(err == nil, t, "Error in cleanup removing %s: %v", dir, err)
+}
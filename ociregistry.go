@@ -0,0 +1,328 @@
+package blobstore
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ociAPIPath      = "/v2/"
+	ociBlobsPath    = "/blobs/"
+	ociUploadsPath  = "uploads/"
+	ociDigestHeader = "Docker-Content-Digest"
+	ociUUIDHeader   = "Docker-Upload-UUID"
+)
+
+// ociUploadTimeout is how long an upload session may stay idle before it is dropped
+var ociUploadTimeout = time.Hour
+
+// OCIRegistry is a http.Handler implementing the blob endpoints of the OCI distribution API v2:
+//
+//	GET|HEAD       /v2/<name>/blobs/<digest>          reads a blob
+//	POST           /v2/<name>/blobs/uploads/          starts an upload, or uploads a blob with ?digest=,
+//	                                                  or mounts an existing blob with ?mount=<digest>&from=<repo>
+//	GET|PATCH      /v2/<name>/blobs/uploads/<uuid>    tells the upload progress, or appends a chunk to it
+//	PUT|DELETE     /v2/<name>/blobs/uploads/<uuid>    completes the upload with ?digest=, or cancels it
+//
+// All repositories share the blobs, which must be a SHA-256 BlobAdmin, so mounts always succeed for
+// present blobs. Upload chunks are kept in temporary files till completed, when they are verified and stored,
+// uploads left idle for too long are dropped
+type OCIRegistry struct {
+	blobs     BlobAdmin
+	uploadDir string
+	lock      sync.Mutex
+	uploads   map[string]*ociUpload
+}
+
+// ociUpload is an upload session in progress, till dropped when completed, cancelled or idle for too long
+type ociUpload struct {
+	lock    sync.Mutex
+	file    *os.File
+	hasher  hash.Hash
+	size    int64
+	idle    *time.Timer
+	dropped bool
+}
+
+// NewOCIRegistry returns an OCIRegistry on blobs, keyed by hash, keeping uploads in progress in uploadDir,
+// or in the default temporary directory if empty. It fails if hash is not SHA-256, as digests are
+func NewOCIRegistry(blobs BlobAdmin, hash crypto.Hash, uploadDir string) (*OCIRegistry, error) {
+	if hash != crypto.SHA256 {
+		return nil, fmt.Errorf("The OCI registry blobs must be a SHA-256 store")
+	}
+	return &OCIRegistry{blobs: blobs, uploadDir: uploadDir, uploads: make(map[string]*ociUpload)}, nil
+}
+
+// ServeHTTP routes the request by path and method
+func (reg *OCIRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == ociAPIPath || r.URL.Path == strings.TrimSuffix(ociAPIPath, "/") {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, "{}")
+		return
+	}
+	index := strings.LastIndex(r.URL.Path, ociBlobsPath)
+	if !strings.HasPrefix(r.URL.Path, ociAPIPath) || index <= len(ociAPIPath) {
+		ociError(w, http.StatusNotFound, "NAME_UNKNOWN", "Unknown endpoint "+r.URL.Path)
+		return
+	}
+	name, rest := r.URL.Path[len(ociAPIPath):index], r.URL.Path[index+len(ociBlobsPath):]
+	switch {
+	case rest == ociUploadsPath && r.Method == "POST":
+		reg.startUpload(w, r, name)
+	case strings.HasPrefix(rest, ociUploadsPath) && rest != ociUploadsPath:
+		reg.upload(w, r, name, strings.TrimPrefix(rest, ociUploadsPath))
+	case !strings.HasPrefix(rest, ociUploadsPath) && (r.Method == "GET" || r.Method == "HEAD"):
+		reg.read(w, r, rest)
+	default:
+		ociError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", r.Method+" is not supported on "+r.URL.Path)
+	}
+}
+
+// read answers a blob, or just its size for HEAD, without reading it if the store knows it
+func (reg *OCIRegistry) read(w http.ResponseWriter, r *http.Request, digest string) {
+	key, err := parseDigest(digest)
+	if err != nil {
+		ociError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+	var reader io.Reader
+	if r.Method == "HEAD" {
+		var size int64
+		if size, err = blobSize(reg.blobs, key); err == nil {
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+	} else {
+		reader, err = reg.blobs.Read(key)
+	}
+	if err != nil {
+		reg.fail(w, err)
+		return
+	}
+	w.Header().Set(ociDigestHeader, digest)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", immutableCacheControl)
+	w.WriteHeader(http.StatusOK)
+	if reader != nil {
+		if _, err := io.Copy(w, reader); err != nil {
+			// too late for an error status, make sure the client does not take a truncated or corrupted blob
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// startUpload mounts an existing blob, uploads a whole blob, or starts a new upload session
+func (reg *OCIRegistry) startUpload(w http.ResponseWriter, r *http.Request, name string) {
+	query := r.URL.Query()
+	if mount := query.Get("mount"); mount != "" {
+		key, err := parseDigest(mount)
+		if err == nil && hasBlob(reg.blobs, key) {
+			reg.created(w, name, mount)
+			return
+		}
+		// not mountable, so start a regular upload
+	}
+	if digest := query.Get("digest"); digest != "" {
+		if _, err := parseDigest(digest); err != nil {
+			ociError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+			return
+		}
+	}
+	upload, uuid, err := reg.newUpload()
+	if err != nil {
+		reg.fail(w, err)
+		return
+	}
+	if digest := query.Get("digest"); digest != "" { // monolithic upload
+		upload.lock.Lock()
+		defer upload.lock.Unlock()
+		reg.complete(w, r, name, uuid, upload, digest)
+		return
+	}
+	reg.accepted(w, name, uuid, 0)
+}
+
+// upload reports, appends to, completes or cancels an upload session
+func (reg *OCIRegistry) upload(w http.ResponseWriter, r *http.Request, name, uuid string) {
+	reg.lock.Lock()
+	upload, ok := reg.uploads[uuid]
+	reg.lock.Unlock()
+	if ok {
+		upload.lock.Lock()
+		defer upload.lock.Unlock()
+	}
+	if !ok || upload.dropped { // dropped meanwhile
+		ociError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "Unknown upload "+uuid)
+		return
+	}
+	upload.idle.Reset(ociUploadTimeout)
+	switch r.Method {
+	case "GET":
+		reg.progress(w, name, uuid, upload.size, http.StatusNoContent)
+	case "PATCH":
+		if contentRange := r.Header.Get("Content-Range"); contentRange != "" &&
+			!strings.HasPrefix(contentRange, fmt.Sprintf("%d-", upload.size)) {
+			w.Header().Set("Range", ociRange(upload.size))
+			ociError(w, http.StatusRequestedRangeNotSatisfiable, "BLOB_UPLOAD_INVALID",
+				fmt.Sprintf("Chunk %s does not continue the upload at %d", contentRange, upload.size))
+			return
+		}
+		if err := upload.append(r.Body); err != nil {
+			reg.fail(w, err)
+			return
+		}
+		reg.accepted(w, name, uuid, upload.size)
+	case "PUT":
+		reg.complete(w, r, name, uuid, upload, r.URL.Query().Get("digest"))
+	case "DELETE":
+		reg.dropUpload(uuid, upload)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		ociError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", r.Method+" is not supported on uploads")
+	}
+}
+
+// complete appends the last chunk, if any, verifies the upload matches its digest and stores it as a blob,
+// the upload must be locked
+func (reg *OCIRegistry) complete(w http.ResponseWriter, r *http.Request, name, uuid string, upload *ociUpload,
+	digest string) {
+	expectedKey, err := parseDigest(digest)
+	if err != nil {
+		ociError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+	if err := upload.append(r.Body); err != nil {
+		reg.fail(w, err)
+		return
+	}
+	defer reg.dropUpload(uuid, upload)
+	if key := Key(upload.hasher.Sum(nil)); !key.Equals(expectedKey) {
+		ociError(w, http.StatusBadRequest, "DIGEST_INVALID",
+			fmt.Sprintf("Uploaded blob digest is %s:%v, not %s", ociAlgorithm, key, digest))
+		return
+	}
+	if _, err := upload.file.Seek(0, io.SeekStart); err != nil {
+		reg.fail(w, err)
+		return
+	}
+	key, err := reg.blobs.Write(upload.file)
+	if err == nil && !key.Equals(expectedKey) {
+		err = fmt.Errorf("The blob store is not SHA-256, it stored %s as %v", digest, key)
+	}
+	if err != nil {
+		reg.fail(w, err)
+		return
+	}
+	reg.created(w, name, digest)
+}
+
+// newUpload starts an upload session
+func (reg *OCIRegistry) newUpload() (*ociUpload, string, error) {
+	file, err := ioutil.TempFile(reg.uploadDir, "upload")
+	if err != nil {
+		return nil, "", err
+	}
+	id := make([]byte, 16)
+	rand.Reader.Read(id)
+	uuid := hex.EncodeToString(id)
+	upload := &ociUpload{file: file, hasher: sha256.New()}
+	upload.idle = time.AfterFunc(ociUploadTimeout, func() {
+		upload.lock.Lock()
+		defer upload.lock.Unlock()
+		if !upload.dropped {
+			reg.dropUpload(uuid, upload)
+		}
+	})
+	reg.lock.Lock()
+	reg.uploads[uuid] = upload
+	reg.lock.Unlock()
+	return upload, uuid, nil
+}
+
+// dropUpload ends a locked upload session, removing its temporary file
+func (reg *OCIRegistry) dropUpload(uuid string, upload *ociUpload) {
+	reg.lock.Lock()
+	delete(reg.uploads, uuid)
+	reg.lock.Unlock()
+	upload.idle.Stop()
+	upload.dropped = true
+	upload.file.Close()
+	os.Remove(upload.file.Name())
+}
+
+// append adds a chunk to the upload
+func (upload *ociUpload) append(chunk io.Reader) error {
+	n, err := io.Copy(io.MultiWriter(upload.file, upload.hasher), chunk)
+	upload.size += n
+	return err
+}
+
+// accepted answers an upload in progress
+func (reg *OCIRegistry) accepted(w http.ResponseWriter, name, uuid string, size int64) {
+	reg.progress(w, name, uuid, size, http.StatusAccepted)
+}
+
+// progress answers the location and range received of an upload
+func (reg *OCIRegistry) progress(w http.ResponseWriter, name, uuid string, size int64, status int) {
+	w.Header().Set("Location", ociAPIPath+name+ociBlobsPath+ociUploadsPath+uuid)
+	w.Header().Set("Range", ociRange(size))
+	w.Header().Set(ociUUIDHeader, uuid)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(status)
+}
+
+// created answers a stored blob location
+func (reg *OCIRegistry) created(w http.ResponseWriter, name, digest string) {
+	w.Header().Set("Location", ociAPIPath+name+ociBlobsPath+digest)
+	w.Header().Set(ociDigestHeader, digest)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// fail answers a store error
+func (reg *OCIRegistry) fail(w http.ResponseWriter, err error) {
+	if isNotFound(err) {
+		ociError(w, http.StatusNotFound, "BLOB_UNKNOWN", err.Error())
+		return
+	}
+	ociError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+}
+
+// ociRange returns the Range header of an upload of size bytes
+func ociRange(size int64) string {
+	if size == 0 {
+		return "0-0"
+	}
+	return fmt.Sprintf("0-%d", size-1)
+}
+
+// parseDigest returns the key of a sha256:<hex> digest
+func parseDigest(digest string) (Key, error) {
+	hexKey := strings.TrimPrefix(digest, ociAlgorithm+":")
+	key, err := hex.DecodeString(hexKey)
+	if hexKey == digest || err != nil || len(key) != sha256.Size {
+		return nil, fmt.Errorf("Unsupported digest %q, expected %s:<hex>", digest, ociAlgorithm)
+	}
+	return Key(key), nil
+}
+
+// ociError answers an error in the distribution API format
+func ociError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
@@ -0,0 +1,96 @@
+package blobstore
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// TestOCIRegistryUploads checks chunked, monolithic & mounted blob uploads and their reads
+func TestOCIRegistryUploads(t *testing.T) {
+	// setup
+	registry, err := NewOCIRegistry(NewMemBlobAdmin(crypto.SHA256), crypto.SHA256, "")
+	assert(err == nil, t, "Error creating the registry: %v", err)
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	blob := "a layer in two chunks"
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(blob)))
+	// exercise the API check
+	response, _ := httpDo(t, "GET", server.URL+"/v2/", "", nil)
+	assert(response.StatusCode == http.StatusOK, t, "Expected the API check to succeed but got %s", response.Status)
+	// a chunked upload
+	response, _ = httpDo(t, "POST", server.URL+"/v2/library/app/blobs/uploads/", "", nil)
+	assert(response.StatusCode == http.StatusAccepted, t, "Expected an upload started but got %s", response.Status)
+	location := server.URL + response.Header.Get("Location")
+	response, _ = httpDo(t, "PATCH", location, blob[:7], map[string]string{"Content-Range": "0-6"})
+	assert(response.StatusCode == http.StatusAccepted, t, "Expected a chunk accepted but got %s", response.Status)
+	assert(response.Header.Get("Range") == "0-6", t, "Unexpected range %s", response.Header.Get("Range"))
+	response, _ = httpDo(t, "PATCH", location, "wrong", map[string]string{"Content-Range": "0-4"})
+	assert(response.StatusCode == http.StatusRequestedRangeNotSatisfiable, t,
+		"Expected an out of order chunk rejected but got %s", response.Status)
+	response, _ = httpDo(t, "PATCH", location, blob[7:], nil)
+	assert(response.StatusCode == http.StatusAccepted, t, "Expected a chunk accepted but got %s", response.Status)
+	response, _ = httpDo(t, "PUT", location+"?digest="+digest, "", nil)
+	assert(response.StatusCode == http.StatusCreated, t, "Expected the blob created but got %s", response.Status)
+	assert(response.Header.Get("Location") == "/v2/library/app/blobs/"+digest, t,
+		"Unexpected location %s", response.Header.Get("Location"))
+	// reads
+	blobURL := server.URL + "/v2/library/app/blobs/" + digest
+	response, _ = httpDo(t, "HEAD", blobURL, "", nil)
+	assert(response.StatusCode == http.StatusOK && response.ContentLength == int64(len(blob)), t,
+		"Expected HEAD with size %d but got %s with %d", len(blob), response.Status, response.ContentLength)
+	assert(response.Header.Get(ociDigestHeader) == digest, t, "Unexpected digest %s", response.Header.Get(ociDigestHeader))
+	response, body := httpDo(t, "GET", blobURL, "", nil)
+	assert(response.StatusCode == http.StatusOK && body == blob, t, "Expected '%s' but got %s '%s'",
+		blob, response.Status, body)
+	// a mount from another repository and one of a missing blob
+	response, _ = httpDo(t, "POST", server.URL+"/v2/other/blobs/uploads/?mount="+digest+"&from=library/app", "", nil)
+	assert(response.StatusCode == http.StatusCreated, t, "Expected the blob mounted but got %s", response.Status)
+	missing := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("missing")))
+	response, _ = httpDo(t, "POST", server.URL+"/v2/other/blobs/uploads/?mount="+missing+"&from=library/app", "", nil)
+	assert(response.StatusCode == http.StatusAccepted, t, "Expected an upload started instead but got %s", response.Status)
+	// monolithic uploads, the second with the wrong digest
+	other := "a monolithic layer"
+	response, _ = httpDo(t, "POST", fmt.Sprintf("%s/v2/other/blobs/uploads/?digest=sha256:%x", server.URL,
+		sha256.Sum256([]byte(other))), other, nil)
+	assert(response.StatusCode == http.StatusCreated, t, "Expected the blob created but got %s", response.Status)
+	response, _ = httpDo(t, "POST", server.URL+"/v2/other/blobs/uploads/?digest="+missing, other, nil)
+	assert(response.StatusCode == http.StatusBadRequest, t, "Expected a digest mismatch but got %s", response.Status)
+	response, _ = httpDo(t, "GET", server.URL+"/v2/other/blobs/"+missing, "", nil)
+	assert(response.StatusCode == http.StatusNotFound, t, "Expected a missing blob but got %s", response.Status)
+}
+
+// TestOCIRegistryChecks checks the registry needs SHA-256 blobs and drops idle uploads
+func TestOCIRegistryChecks(t *testing.T) {
+	// setup
+	_, err := NewOCIRegistry(NewMemBlobAdmin(crypto.SHA1), crypto.SHA1, "")
+	assert(err != nil, t, "Expected a SHA-1 store to be refused")
+	_, err = NewOCIRegistry(NewFSBlobServer(fstest.MapFS{}, crypto.SHA256, nil), crypto.SHA256, "")
+	assert(err == nil, t, "Error creating a registry on a read only store: %v", err)
+	defer func(timeout time.Duration) { ociUploadTimeout = timeout }(ociUploadTimeout)
+	ociUploadTimeout = 50 * time.Millisecond
+	dir := fileBlobs{""}.TmpKeyname(10)
+	os.Mkdir(dir, 0700)
+	defer os.RemoveAll(dir)
+	registry, err := NewOCIRegistry(NewMemBlobAdmin(crypto.SHA256), crypto.SHA256, dir)
+	assert(err == nil, t, "Error creating the registry: %v", err)
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	// exercise
+	response, _ := httpDo(t, "POST", server.URL+"/v2/library/app/blobs/uploads/", "", nil)
+	assert(response.StatusCode == http.StatusAccepted, t, "Expected an upload started but got %s", response.Status)
+	location := server.URL + response.Header.Get("Location")
+	time.Sleep(4 * ociUploadTimeout)
+	// check
+	response, _ = httpDo(t, "PATCH", location, "late chunk", nil)
+	assert(response.StatusCode == http.StatusNotFound, t, "Expected the idle upload dropped but got %s", response.Status)
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	assert(len(files) == 0, t, "Expected no upload files left but got %v", files)
+}
@@ -0,0 +1,616 @@
+package blobstore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	packDir              = "pack"
+	packExt              = ".pack"
+	packIdxExt           = ".idx"
+	packDelExt           = ".del"
+	packMagic            = "PACK"
+	packIdxMagic         = "BIDX"
+	packVersion          = 1
+	packFull             = 0
+	packDelta            = 1
+	defaultMaxPackedSize = 1 << 20
+	defaultDeltaWindow   = 10
+)
+
+// PackOptions configures how loose blobs are packed
+type PackOptions struct {
+	// MaxBlobSize is the size of the biggest blob to be packed, bigger ones stay loose
+	MaxBlobSize int64
+	// Delta compresses blobs against a similar one recently packed
+	Delta bool
+	// DeltaWindow is the number of recently packed blobs tried as delta bases
+	DeltaWindow int
+}
+
+// PackedBlobServer is a VFSBlobServer that consolidates its small loose blobs into git style pack files,
+// blobs are read and listed alike, whether they are loose or packed.
+// Removed packed blobs are just marked as deleted, their packs are rewritten without them on the next Pack
+type PackedBlobServer struct {
+	*VFSBlobServer
+	packs *packBlobs
+}
+
+// NewPackedFileBlobServer returns a PackedBlobServer on the os files, with the packs in the pack subdir
+func NewPackedFileBlobServer(dir string, hash crypto.Hash) (*PackedBlobServer, error) {
+	return NewPackedBlobServer(fileBlobs{dir}, filepath.Join(dir, packDir), hash)
+}
+
+// NewPackedBlobServer returns a PackedBlobServer with loose blobs on a VirtualFS and packs on packsDir
+func NewPackedBlobServer(loose VirtualFS, packsDir string, hash crypto.Hash) (*PackedBlobServer, error) {
+	packs := &packBlobs{VirtualFS: loose, dir: packsDir, hash: hash}
+	if err := packs.load(); err != nil {
+		return nil, err
+	}
+	return &PackedBlobServer{&VFSBlobServer{packs, hash}, packs}, nil
+}
+
+// Pack consolidates the loose blobs into a new pack and rewrites the packs with deleted blobs,
+// it returns the number of loose blobs packed. Corrupted loose blobs are left loose
+func (pbs *PackedBlobServer) Pack(options PackOptions) (int, error) {
+	return pbs.packs.pack(options, pbs.acceptor)
+}
+
+// AutoPack packs the loose blobs every interval till the returned stop function is called,
+// packing errors are sent to errs if not nil
+func (pbs *PackedBlobServer) AutoPack(interval time.Duration, options PackOptions, errs chan<- error) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := pbs.Pack(options); err != nil && errs != nil {
+					errs <- err
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// Close closes all pack files
+func (pbs *PackedBlobServer) Close() error {
+	return pbs.packs.Close()
+}
+
+// packBlobs is a VirtualFS of loose blobs plus packs of blobs
+type packBlobs struct {
+	VirtualFS
+	dir   string
+	hash  crypto.Hash
+	lock  sync.RWMutex
+	packs []*pack
+}
+
+// pack is a pack file and its index, like git, a fanout table of the keys by their first byte,
+// and the sorted keys along their offsets within the pack. Deleted keys are appended to a .del file
+type pack struct {
+	name    string // path without extension
+	file    *os.File
+	fanout  [256]uint32
+	keys    []Key
+	offsets []uint64
+	deleted map[string]bool
+}
+
+// load opens all the packs found in the packs dir
+func (pb *packBlobs) load() error {
+	if err := os.MkdirAll(pb.dir, defaultPerms); err != nil {
+		return err
+	}
+	names, err := filepath.Glob(filepath.Join(pb.dir, "*"+packIdxExt))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		p, err := openPack(strings.TrimSuffix(name, packIdxExt))
+		if err != nil {
+			pb.Close()
+			return err
+		}
+		pb.packs = append(pb.packs, p)
+	}
+	return nil
+}
+
+// Close closes all pack files
+func (pb *packBlobs) Close() error {
+	pb.lock.Lock()
+	defer pb.lock.Unlock()
+	var firstErr error
+	for _, p := range pb.packs {
+		if err := p.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	pb.packs = nil
+	return firstErr
+}
+
+// Open a key contents for reading, loose or packed, a loose blob may be packed meanwhile
+func (pb *packBlobs) Open(keyname string) (io.ReadCloser, error) {
+	file, err := pb.VirtualFS.Open(keyname)
+	if err == nil || !isNotFound(err) {
+		return file, err
+	}
+	pb.lock.RLock()
+	defer pb.lock.RUnlock()
+	p, offset := pb.find(pb.keyOf(keyname))
+	if p == nil {
+		return nil, fmt.Errorf("Key not found: %s", keyname)
+	}
+	blob, err := p.read(offset)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(blob)), nil
+}
+
+// Delete a key & contents, packed blobs are marked as deleted till their pack is rewritten
+func (pb *packBlobs) Delete(keyname string) error {
+	if pb.VirtualFS.Exists(keyname) {
+		if err := pb.VirtualFS.Delete(keyname); err != nil {
+			return err
+		}
+	}
+	key := pb.keyOf(keyname)
+	if key == nil {
+		return nil
+	}
+	pb.lock.Lock()
+	defer pb.lock.Unlock()
+	for _, p := range pb.packs {
+		if _, found := p.find(key); found {
+			if err := p.delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Does the given key exists, loose or packed?
+func (pb *packBlobs) Exists(keyname string) bool {
+	if pb.VirtualFS.Exists(keyname) {
+		return true
+	}
+	pb.lock.RLock()
+	defer pb.lock.RUnlock()
+	p, _ := pb.find(pb.keyOf(keyname))
+	return p != nil
+}
+
+// ListTo lists all loose and packed keys in sort order to the keys channel
+func (pb *packBlobs) ListTo(keys chan<- KeyOrError, acceptor func(string) Key) bool {
+	loose := make(chan KeyOrError)
+	go func() {
+		if pb.VirtualFS.ListTo(loose, acceptor) {
+			close(loose)
+		}
+	}()
+	pb.lock.RLock()
+	lists := []<-chan KeyOrError{loose}
+	for _, p := range pb.packs {
+		lists = append(lists, p.list(acceptor))
+	}
+	pb.lock.RUnlock()
+	err := joinKeys(lists, func(key Key, present []bool) error {
+		keys <- KeyOrError{key, nil}
+		return nil
+	})
+	if err != nil {
+		return failKeyOrError(keys, err)
+	}
+	return true
+}
+
+// keyOf returns the key of a keyname, that is the hex key with an optional extension and directory
+func (pb *packBlobs) keyOf(keyname string) Key {
+	name := filepath.Base(keyname)
+	if strings.Contains(name, ".") {
+		name = strings.Split(name, ".")[0]
+	}
+	key, err := hex.DecodeString(name)
+	if err != nil || len(key) != pb.hash.Size() {
+		return nil
+	}
+	return Key(key)
+}
+
+// find looks for key in all packs, returning the pack and offset where it is
+func (pb *packBlobs) find(key Key) (*pack, uint64) {
+	if key == nil {
+		return nil, 0
+	}
+	for _, p := range pb.packs {
+		if offset, found := p.find(key); found {
+			return p, offset
+		}
+	}
+	return nil, 0
+}
+
+// pack writes all loose blobs into a new pack and deletes them once packed
+func (pb *packBlobs) pack(options PackOptions, acceptor func(string) Key) (int, error) {
+	if options.MaxBlobSize <= 0 {
+		options.MaxBlobSize = defaultMaxPackedSize
+	}
+	loose := make(chan KeyOrError)
+	go func() {
+		if pb.VirtualFS.ListTo(loose, acceptor) {
+			close(loose)
+		}
+	}()
+	var keys []Key
+	for keyOrErr := range loose {
+		if keyOrErr.err != nil {
+			return 0, keyOrErr.err
+		}
+		keys = append(keys, keyOrErr.key)
+	}
+	pb.lock.Lock()
+	defer pb.lock.Unlock()
+	if err := pb.repack(); err != nil {
+		return 0, err
+	}
+	p, packed, err := pb.writePack(keys, func(key Key) ([]byte, error) {
+		file, err := pb.VirtualFS.Open(pb.VirtualFS.Keyname(key))
+		if err != nil && isNotFound(err) {
+			return nil, nil // removed meanwhile
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		blob, err := ioutil.ReadAll(io.LimitReader(&checkedReader{file, key, pb.hash.New()}, options.MaxBlobSize+1))
+		if int64(len(blob)) > options.MaxBlobSize {
+			return nil, nil // too big to be packed
+		}
+		if err != nil && strings.HasPrefix(err.Error(), corruptedBlobErrorPrefix) {
+			return nil, nil // left loose to be found and repaired
+		}
+		return blob, err
+	}, options)
+	if err != nil || p == nil {
+		return 0, err
+	}
+	pb.packs = append(pb.packs, p)
+	for _, key := range packed {
+		if err := pb.VirtualFS.Delete(pb.VirtualFS.Keyname(key)); err != nil {
+			return len(packed), err
+		}
+	}
+	return len(packed), nil
+}
+
+// repack rewrites the packs with deleted blobs without them, all at once
+func (pb *packBlobs) repack() error {
+	for i := 0; i < len(pb.packs); i++ {
+		p := pb.packs[i]
+		if len(p.deleted) == 0 {
+			continue
+		}
+		var keys []Key
+		for _, key := range p.keys {
+			if !p.deleted[string(key)] {
+				keys = append(keys, key)
+			}
+		}
+		repacked, _, err := pb.writePack(keys, func(key Key) ([]byte, error) {
+			offset, _ := p.find(key)
+			return p.read(offset)
+		}, PackOptions{})
+		if err != nil {
+			return err
+		}
+		pb.packs = append(pb.packs[:i:i], pb.packs[i+1:]...)
+		i--
+		if repacked != nil {
+			pb.packs = append(pb.packs, repacked)
+		}
+		p.file.Close()
+		os.Remove(p.name + packIdxExt)
+		os.Remove(p.name + packDelExt)
+		if err := os.Remove(p.name + packExt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePack writes a pack and its index with the blobs of the given sorted keys, as loaded by load.
+// Blobs loaded as nil are skipped. It returns the new pack, or nil if empty, and the keys packed
+func (pb *packBlobs) writePack(keys []Key, load func(Key) ([]byte, error), options PackOptions) (*pack, []Key, error) {
+	// a short random name, so that it is never listed as a loose blob when the packs are within the blobs dir
+	tmpName := fileBlobs{pb.dir}.TmpKeyname(8)
+	file, err := os.OpenFile(tmpName+packExt, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, defaultPerms)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(tmpName + packExt)
+	checksum := sha1.New()
+	writer := bufio.NewWriter(io.MultiWriter(file, checksum))
+	writer.WriteString(packMagic)
+	binary.Write(writer, binary.BigEndian, uint32(packVersion))
+	offset := uint64(len(packMagic) + 4)
+	type base struct {
+		offset uint64
+		blob   []byte
+	}
+	var window []base
+	windowSize := options.DeltaWindow
+	if windowSize <= 0 {
+		windowSize = defaultDeltaWindow
+	}
+	p := &pack{}
+	for _, key := range keys {
+		blob, err := load(key)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		if blob == nil {
+			continue
+		}
+		header, data := appendUvarints([]byte{packFull}, uint64(len(blob))), blob
+		if options.Delta {
+			for _, candidate := range window {
+				if delta := encodeDelta(candidate.blob, blob); len(delta) < len(blob)/2 && len(delta) < len(data) {
+					header = appendUvarints([]byte{packDelta}, uint64(len(blob)), candidate.offset)
+					data = delta
+				}
+			}
+			if header[0] == packFull {
+				window = append(window, base{offset, blob})
+				if len(window) > windowSize {
+					window = window[1:]
+				}
+			}
+		}
+		compressed := &bytes.Buffer{}
+		compressor := zlib.NewWriter(compressed)
+		compressor.Write(data)
+		compressor.Close()
+		writer.Write(header)
+		writer.Write(compressed.Bytes())
+		p.keys = append(p.keys, key)
+		p.offsets = append(p.offsets, offset)
+		offset += uint64(len(header) + compressed.Len())
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	sum := checksum.Sum(nil)
+	file.Write(sum)
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	file.Close()
+	if len(p.keys) == 0 {
+		return nil, nil, nil
+	}
+	p.name = filepath.Join(pb.dir, "pack-"+hex.EncodeToString(sum))
+	for _, key := range p.keys {
+		for b := int(key[0]); b < len(p.fanout); b++ {
+			p.fanout[b]++
+		}
+	}
+	if err := os.Rename(tmpName+packExt, p.name+packExt); err != nil {
+		return nil, nil, err
+	}
+	// the pack becomes visible once its index is in place
+	if err := writeAtomically(p.name+packIdxExt, p.encodeIndex(len(p.keys[0]), sum)); err != nil {
+		return nil, nil, err
+	}
+	if p.file, err = os.Open(p.name + packExt); err != nil {
+		return nil, nil, err
+	}
+	return p, p.keys, nil
+}
+
+// openPack opens the pack at name, loading its index
+func openPack(name string) (*pack, error) {
+	data, err := ioutil.ReadFile(name + packIdxExt)
+	if err != nil {
+		return nil, err
+	}
+	p := &pack{name: name}
+	if err := p.decodeIndex(data); err != nil {
+		return nil, fmt.Errorf("%s %s%s: %v", corruptedBlobErrorPrefix, name, packIdxExt, err)
+	}
+	deleted, err := ioutil.ReadFile(name + packDelExt)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for len(p.keys) > 0 && len(deleted) >= len(p.keys[0]) {
+		p.markDeleted(Key(deleted[:len(p.keys[0])]))
+		deleted = deleted[len(p.keys[0]):]
+	}
+	if p.file, err = os.Open(name + packExt); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// delete marks key as deleted, appending it to the pack .del file
+func (p *pack) delete(key Key) error {
+	file, err := os.OpenFile(p.name+packDelExt, os.O_CREATE|os.O_WRONLY|os.O_APPEND, defaultPerms)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(key)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		p.markDeleted(key)
+	}
+	return err
+}
+
+// markDeleted hides key from the pack finds & listings
+func (p *pack) markDeleted(key Key) {
+	if p.deleted == nil {
+		p.deleted = make(map[string]bool)
+	}
+	p.deleted[string(key)] = true
+}
+
+// find returns the offset of key within the pack, deleted keys are not found
+func (p *pack) find(key Key) (uint64, bool) {
+	if p.deleted[string(key)] {
+		return 0, false
+	}
+	lo := uint32(0)
+	if key[0] > 0 {
+		lo = p.fanout[key[0]-1]
+	}
+	hi := p.fanout[key[0]]
+	index := int(lo) + sort.Search(int(hi-lo), func(i int) bool { return bytes.Compare(p.keys[int(lo)+i], key) >= 0 })
+	if index < int(hi) && p.keys[index].Equals(key) {
+		return p.offsets[index], true
+	}
+	return 0, false
+}
+
+// read returns the blob stored at offset, applying its delta if needed
+func (p *pack) read(offset uint64) ([]byte, error) {
+	reader := bufio.NewReader(io.NewSectionReader(p.file, int64(offset), 1<<62))
+	kind, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	size, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	var baseOffset uint64
+	if kind == packDelta {
+		if baseOffset, err = binary.ReadUvarint(reader); err != nil {
+			return nil, err
+		}
+		// bases are always written before their deltas, so a base after the entry is corrupted
+		if baseOffset >= offset {
+			return nil, fmt.Errorf("%s pack entry at %d of %s has a wrong delta base %d", corruptedBlobErrorPrefix,
+				offset, p.name, baseOffset)
+		}
+	}
+	decompressor, err := zlib.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(decompressor)
+	if err != nil {
+		return nil, err
+	}
+	if kind == packDelta {
+		base, err := p.read(baseOffset)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = applyDelta(base, data); err != nil {
+			return nil, err
+		}
+	}
+	if uint64(len(data)) != size {
+		return nil, fmt.Errorf("%s pack entry at %d of %s has the wrong size", corruptedBlobErrorPrefix, offset, p.name)
+	}
+	return data, nil
+}
+
+// list sends the accepted pack keys in sort order through the returned channel
+func (p *pack) list(acceptor func(string) Key) <-chan KeyOrError {
+	keys := make(chan KeyOrError)
+	go func() {
+		for _, key := range p.keys {
+			if !p.deleted[string(key)] && acceptor(key.String()) != nil {
+				keys <- KeyOrError{key, nil}
+			}
+		}
+		close(keys)
+	}()
+	return keys
+}
+
+// encodeIndex serializes the pack index: magic, version, key size & count, fanout, keys & offsets,
+// the pack checksum and the index checksum
+func (p *pack) encodeIndex(keySize int, packSum []byte) []byte {
+	buf := bytes.NewBufferString(packIdxMagic)
+	binary.Write(buf, binary.BigEndian, []uint32{packVersion, uint32(keySize), uint32(len(p.keys))})
+	binary.Write(buf, binary.BigEndian, p.fanout[:])
+	for i, key := range p.keys {
+		buf.Write(key)
+		binary.Write(buf, binary.BigEndian, p.offsets[i])
+	}
+	buf.Write(packSum)
+	sum := sha1.Sum(buf.Bytes())
+	buf.Write(sum[:])
+	return buf.Bytes()
+}
+
+// decodeIndex deserializes a pack index
+func (p *pack) decodeIndex(data []byte) error {
+	headerLen := len(packIdxMagic) + 12 + 4*len(p.fanout)
+	if len(data) < headerLen+2*sha1.Size || string(data[:len(packIdxMagic)]) != packIdxMagic {
+		return fmt.Errorf("not a pack index")
+	}
+	if sum := sha1.Sum(data[:len(data)-sha1.Size]); !bytes.Equal(sum[:], data[len(data)-sha1.Size:]) {
+		return fmt.Errorf("index checksum mismatch")
+	}
+	header := data[len(packIdxMagic):]
+	if version := binary.BigEndian.Uint32(header); version != packVersion {
+		return fmt.Errorf("unsupported version %d", version)
+	}
+	keySize, count := int(binary.BigEndian.Uint32(header[4:])), int(binary.BigEndian.Uint32(header[8:]))
+	if len(data) != headerLen+count*(keySize+8)+2*sha1.Size {
+		return fmt.Errorf("index size mismatch")
+	}
+	for b := range p.fanout {
+		p.fanout[b] = binary.BigEndian.Uint32(header[12+4*b:])
+	}
+	entries := data[headerLen:]
+	for i := 0; i < count; i++ {
+		entry := entries[i*(keySize+8):]
+		p.keys = append(p.keys, Key(append([]byte{}, entry[:keySize]...)))
+		p.offsets = append(p.offsets, binary.BigEndian.Uint64(entry[keySize:]))
+	}
+	return nil
+}
+
+// writeAtomically writes data to a temporary file and renames it to name
+func writeAtomically(name string, data []byte) error {
+	tmpName := name + tmpSuffix
+	if err := ioutil.WriteFile(tmpName, data, defaultPerms); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, name)
+}
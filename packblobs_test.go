@@ -0,0 +1,136 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestDelta checks a delta rebuilds its target from its base
+func TestDelta(t *testing.T) {
+	base := []byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 20))
+	target := append(append([]byte("Prefix! "), base[:300]...), []byte(" and a different ending")...)
+	delta := encodeDelta(base, target)
+	assert(len(delta) < len(target)/4, t, "Delta of %d bytes is too big for a %d bytes target", len(delta), len(target))
+	rebuilt, err := applyDelta(base, delta)
+	assert(err == nil, t, "Error applying delta: %v", err)
+	assert(bytes.Equal(rebuilt, target), t, "Expected '%s' but got '%s'", target, rebuilt)
+}
+
+// TestPackedReadsNWrites test that the packed blobserver does its reads and writes as expected
+func TestPackedReadsNWrites(t *testing.T) {
+	// setup
+	dir := fileBlobs{""}.TmpKeyname(10)
+	os.Mkdir(dir, 0700)
+	pbs, err := NewPackedFileBlobServer(dir, crypto.SHA1)
+	assert(err == nil, t, "Error opening the store: %v", err)
+	// exercise
+	readsNWrites(t, pbs)
+	// cleanup
+	pbs.Close()
+	err = os.RemoveAll(dir)
+	assert(err == nil, t, "Error in cleanup removing %s: %v", dir, err)
+}
+
+// TestPacking checks packed blobs are still read, listed and removed as if they were loose
+func TestPacking(t *testing.T) {
+	// setup
+	dir := fileBlobs{""}.TmpKeyname(10)
+	os.Mkdir(dir, 0700)
+	pbs, err := NewPackedFileBlobServer(dir, crypto.SHA1)
+	assert(err == nil, t, "Error opening the store: %v", err)
+	blobs := map[string]string{}
+	for i := 0; i < 20; i++ {
+		blob := strings.Repeat(fmt.Sprintf("Similar blob, "), 10) + fmt.Sprintf("#%d", i)
+		key, err := pbs.Write(strings.NewReader(blob))
+		assert(err == nil, t, "Error writing blob #%d: %v", i, err)
+		blobs[key.String()] = blob
+	}
+	// exercise
+	packed, err := pbs.Pack(PackOptions{Delta: true})
+	assert(err == nil, t, "Error packing: %v", err)
+	assert(packed == len(blobs), t, "Expected %d blobs packed but got %d", len(blobs), packed)
+	loose, _ := filepath.Glob(filepath.Join(dir, "*", "*", "*", "*", "*.blob"))
+	assert(len(loose) == 0, t, "Expected no loose blobs left, but found %v", loose)
+	extra, err := pbs.Write(strings.NewReader("a loose blob"))
+	assert(err == nil, t, "Error writing blob: %v", err)
+	blobs[extra.String()] = "a loose blob"
+	// reopen and check all are there
+	pbs.Close()
+	pbs, err = NewPackedFileBlobServer(dir, crypto.SHA1)
+	assert(err == nil, t, "Error reopening the store: %v", err)
+	assertPackedBlobs(t, pbs, blobs)
+	// remove a packed blob
+	for hexKey := range blobs {
+		err = pbs.Remove(toKeyOrDie(t, hexKey))
+		assert(err == nil, t, "Error removing %s: %v", hexKey, err)
+		delete(blobs, hexKey)
+		break
+	}
+	assertPackedBlobs(t, pbs, blobs)
+	// deletions survive reopening and are dropped by the next pack
+	pbs.Close()
+	pbs, err = NewPackedFileBlobServer(dir, crypto.SHA1)
+	assert(err == nil, t, "Error reopening the store: %v", err)
+	assertPackedBlobs(t, pbs, blobs)
+	_, err = pbs.Pack(PackOptions{})
+	assert(err == nil, t, "Error packing: %v", err)
+	deletions, _ := filepath.Glob(filepath.Join(dir, "*"+packDelExt))
+	assert(len(deletions) == 0, t, "Expected the deletions to be repacked, but found %v", deletions)
+	assertPackedBlobs(t, pbs, blobs)
+	// cleanup
+	pbs.Close()
+	err = os.RemoveAll(dir)
+	assert(err == nil, t, "Error in cleanup removing %s: %v", dir, err)
+}
+
+// assertPackedBlobs checks the store holds exactly the given blobs
+func assertPackedBlobs(t *testing.T, pbs *PackedBlobServer, blobs map[string]string) {
+	for hexKey, expected := range blobs {
+		blob, err := readBlob(pbs, toKeyOrDie(t, hexKey))
+		assert(err == nil, t, "Error reading %s: %v", hexKey, err)
+		assert(string(blob) == expected, t, "Expected '%s' but got '%s'", expected, blob)
+	}
+	count := 0
+	for keyOrErr := range pbs.List() {
+		assert(keyOrErr.err == nil, t, "Error in List stream: %v", keyOrErr.err)
+		_, ok := blobs[keyOrErr.key.String()]
+		assert(ok, t, "Unexpected key listed: %v", keyOrErr.key)
+		count++
+	}
+	assert(count == len(blobs), t, "Expected %d keys listed but got %d", len(blobs), count)
+}
+
+// TestPackingCorruptedBlob checks a corrupted loose blob is left loose instead of failing the whole pack
+func TestPackingCorruptedBlob(t *testing.T) {
+	// setup
+	dir := fileBlobs{""}.TmpKeyname(10)
+	os.Mkdir(dir, 0700)
+	pbs, err := NewPackedFileBlobServer(dir, crypto.SHA1)
+	assert(err == nil, t, "Error opening the store: %v", err)
+	var keys []Key
+	for i := 0; i < 3; i++ {
+		key, err := pbs.Write(strings.NewReader(fmt.Sprintf("blob #%d", i)))
+		assert(err == nil, t, "Error writing blob #%d: %v", i, err)
+		keys = append(keys, key)
+	}
+	corrupted := pbs.Keyname(keys[0])
+	err = ioutil.WriteFile(corrupted, []byte("corrupted"), 0640)
+	assert(err == nil, t, "Error corrupting %s: %v", corrupted, err)
+	// exercise
+	packed, err := pbs.Pack(PackOptions{})
+	// check
+	assert(err == nil, t, "Error packing: %v", err)
+	assert(packed == len(keys)-1, t, "Expected %d blobs packed but got %d", len(keys)-1, packed)
+	_, err = os.Stat(corrupted)
+	assert(err == nil, t, "Expected the corrupted blob to be left loose: %v", err)
+	// cleanup
+	pbs.Close()
+	err = os.RemoveAll(dir)
+	assert(err == nil, t, "Error in cleanup removing %s: %v", dir, err)
+}
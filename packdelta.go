@@ -0,0 +1,111 @@
+package blobstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+)
+
+const (
+	deltaBlock  = 16 // size of the base blocks indexed to find copies
+	deltaInsert = 0
+	deltaCopy   = 1
+)
+
+// encodeDelta returns the instructions to rebuild target from base: the sizes of both,
+// followed by inserts of literal bytes and copies of base ranges
+func encodeDelta(base, target []byte) []byte {
+	index := make(map[uint64]int)
+	for offset := 0; offset+deltaBlock <= len(base); offset += deltaBlock {
+		if _, ok := index[blockHash(base[offset:offset+deltaBlock])]; !ok {
+			index[blockHash(base[offset:offset+deltaBlock])] = offset
+		}
+	}
+	delta := appendUvarints(nil, uint64(len(base)), uint64(len(target)))
+	var literal []byte
+	flush := func() {
+		if len(literal) > 0 {
+			delta = append(appendUvarints(append(delta, deltaInsert), uint64(len(literal))), literal...)
+			literal = nil
+		}
+	}
+	for i := 0; i < len(target); {
+		if i+deltaBlock <= len(target) {
+			if offset, ok := index[blockHash(target[i:i+deltaBlock])]; ok &&
+				bytes.Equal(base[offset:offset+deltaBlock], target[i:i+deltaBlock]) {
+				length := deltaBlock
+				for offset+length < len(base) && i+length < len(target) && base[offset+length] == target[i+length] {
+					length++
+				}
+				flush()
+				delta = appendUvarints(append(delta, deltaCopy), uint64(offset), uint64(length))
+				i += length
+				continue
+			}
+		}
+		literal = append(literal, target[i])
+		i++
+	}
+	flush()
+	return delta
+}
+
+// applyDelta rebuilds a target from its base and delta
+func applyDelta(base, delta []byte) ([]byte, error) {
+	reader := bytes.NewReader(delta)
+	baseSize, err := binary.ReadUvarint(reader)
+	if err != nil || baseSize != uint64(len(base)) {
+		return nil, fmt.Errorf("%s delta base size mismatch", corruptedBlobErrorPrefix)
+	}
+	targetSize, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	target := make([]byte, 0, targetSize)
+	for reader.Len() > 0 {
+		op, _ := reader.ReadByte()
+		switch op {
+		case deltaInsert:
+			length, err := binary.ReadUvarint(reader)
+			if err != nil || length > uint64(reader.Len()) {
+				return nil, fmt.Errorf("%s truncated delta insert", corruptedBlobErrorPrefix)
+			}
+			literal := make([]byte, length)
+			reader.Read(literal)
+			target = append(target, literal...)
+		case deltaCopy:
+			offset, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return nil, err
+			}
+			length, err := binary.ReadUvarint(reader)
+			if err != nil || offset+length > uint64(len(base)) {
+				return nil, fmt.Errorf("%s delta copy out of the base", corruptedBlobErrorPrefix)
+			}
+			target = append(target, base[offset:offset+length]...)
+		default:
+			return nil, fmt.Errorf("%s unknown delta instruction %d", corruptedBlobErrorPrefix, op)
+		}
+	}
+	if uint64(len(target)) != targetSize {
+		return nil, fmt.Errorf("%s delta target size mismatch", corruptedBlobErrorPrefix)
+	}
+	return target, nil
+}
+
+// blockHash hashes a delta block
+func blockHash(block []byte) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write(block)
+	return hasher.Sum64()
+}
+
+// appendUvarints appends the given values as uvarints to buf
+func appendUvarints(buf []byte, values ...uint64) []byte {
+	varint := make([]byte, binary.MaxVarintLen64)
+	for _, value := range values {
+		buf = append(buf, varint[:binary.PutUvarint(varint, value)]...)
+	}
+	return buf
+}
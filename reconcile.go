@@ -0,0 +1,455 @@
+package blobstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+const (
+	defaultReconcileBranches  = 16
+	defaultReconcileThreshold = 16
+	reconcileFingerprint      = 1 // count & xor of the keys in the range
+	reconcileKeys             = 2 // all keys in the range, to be answered with the differences
+	reconcileDifferences      = 3 // keys the receiver lacks & keys the sender lacks in the range, final
+
+	reconcileBlockKeys = 256 // keys per block of the index, just the first key & xor of each are in memory
+)
+
+// ReconcileOptions configures a Reconciler
+type ReconcileOptions struct {
+	// Branches is the number of subranges a mismatching range is split into, defaultReconcileBranches if not set
+	Branches int
+	// Threshold is the number of keys up to which a range is sent as keys instead of being split,
+	// defaultReconcileThreshold if not set
+	Threshold int
+}
+
+// Reconciler is one side of a range based set reconciliation between two BlobStores.
+//
+// The sides exchange messages of key ranges, starting with a fingerprint of the whole key space.
+// A side whose fingerprint for a range differs from the one received splits the range by its own keys
+// and answers fingerprints of the subranges, or sends all its keys in the range when they are few.
+// Key lists are answered with the differences, so both sides learn what they miss in just as many rounds
+// as the ranges need splitting, and with bandwidth proportional to the differences, not the keys.
+// Fingerprints are the count and xor of the keys in the range, keys being hashes already.
+//
+// The keys are kept sorted in a temporary index file, in memory there is just the first key and the xor of
+// the keys before each block of them, so a Reconciler must be closed to remove its index
+type Reconciler struct {
+	index   *os.File
+	keySize int
+	count   int
+	fences  []Key    // fences[b] is the first key of block b
+	xors    [][]byte // xors[b] is the xor of the keys before block b, so range fingerprints read at most two blocks
+	options ReconcileOptions
+	missing []Key
+	surplus []Key
+}
+
+// reconcileRange is a range of keys in a message, from lower (inclusive) to upper (exclusive),
+// nil bounds being the start & end of the key space
+type reconcileRange struct {
+	lower, upper Key
+	mode         byte
+	count        uint64
+	xor          []byte
+	keys         []Key
+	lacking      []Key
+}
+
+// NewReconciler returns a Reconciler on the keys of blobs, which are all listed, in key order, to its index
+func NewReconciler(blobs BlobStore, options ReconcileOptions) (*Reconciler, error) {
+	if options.Branches < 2 {
+		options.Branches = defaultReconcileBranches
+	}
+	if options.Threshold < 1 {
+		options.Threshold = defaultReconcileThreshold
+	}
+	index, err := ioutil.TempFile("", "reconcile")
+	if err != nil {
+		return nil, err
+	}
+	r := &Reconciler{index: index, options: options, xors: [][]byte{nil}}
+	keys := blobs.List()
+	defer drainKeys(keys)
+	if err := r.load(keys); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// load writes the listed keys to the index, keeping the fence & xor of each block
+func (r *Reconciler) load(keys <-chan KeyOrError) error {
+	writer := bufio.NewWriter(r.index)
+	xor := []byte(nil)
+	var last Key
+	for keyOrErr := range keys {
+		key := keyOrErr.key
+		switch {
+		case keyOrErr.err != nil:
+			return keyOrErr.err
+		case r.count == 0:
+			r.keySize = len(key)
+		case len(key) != r.keySize:
+			return fmt.Errorf("Expected %d bytes long keys but got %v", r.keySize, key)
+		case bytes.Compare(last, key) >= 0:
+			return fmt.Errorf("Keys listed out of order, %v after %v", key, last)
+		}
+		if r.count%reconcileBlockKeys == 0 {
+			if r.count > 0 {
+				r.xors = append(r.xors, xor)
+			}
+			r.fences = append(r.fences, key)
+		}
+		if _, err := writer.Write(key); err != nil {
+			return err
+		}
+		xor = xorKeys(xor, key)
+		last = key
+		r.count++
+	}
+	r.xors = append(r.xors, xor)
+	return writer.Flush()
+}
+
+// Close removes the index
+func (r *Reconciler) Close() error {
+	err := r.index.Close()
+	if removeErr := os.Remove(r.index.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// Start returns the first message, the fingerprint of all keys
+func (r *Reconciler) Start() []byte {
+	all := reconcileRange{mode: reconcileFingerprint, count: uint64(r.count), xor: r.xors[len(r.xors)-1]}
+	return encodeReconcileRanges([]reconcileRange{all})
+}
+
+// Respond processes a message from the other side and returns the reply, or nil if there is nothing more to say
+func (r *Reconciler) Respond(message []byte) ([]byte, error) {
+	ranges, err := decodeReconcileRanges(message)
+	if err != nil {
+		return nil, err
+	}
+	reply := []reconcileRange{}
+	for _, received := range ranges {
+		switch received.mode {
+		case reconcileFingerprint:
+			subranges, err := r.split(received)
+			if err != nil {
+				return nil, err
+			}
+			reply = append(reply, subranges...)
+		case reconcileKeys:
+			own, err := r.rangeKeys(received.lower, received.upper)
+			if err != nil {
+				return nil, err
+			}
+			answer := reconcileRange{lower: received.lower, upper: received.upper, mode: reconcileDifferences}
+			answer.keys, answer.lacking = diffKeys(own, received.keys)
+			r.surplus = append(r.surplus, answer.keys...)
+			r.missing = append(r.missing, answer.lacking...)
+			reply = append(reply, answer)
+		case reconcileDifferences:
+			r.missing = append(r.missing, received.keys...)
+			r.surplus = append(r.surplus, received.lacking...)
+		}
+	}
+	if len(reply) == 0 {
+		return nil, nil
+	}
+	return encodeReconcileRanges(reply), nil
+}
+
+// Missing returns the keys found on the other side but not on this one
+func (r *Reconciler) Missing() []Key {
+	return sortKeys(r.missing)
+}
+
+// Surplus returns the keys found on this side but not on the other one
+func (r *Reconciler) Surplus() []Key {
+	return sortKeys(r.surplus)
+}
+
+// Reconcile runs a reconciliation between two Reconcilers in process, exchanging the same messages as it would
+// over the wire, and returns the number of bytes exchanged
+func Reconcile(local, remote *Reconciler) (int, error) {
+	exchanged := 0
+	sides := []*Reconciler{remote, local}
+	var err error
+	for message := local.Start(); message != nil; sides[0], sides[1] = sides[1], sides[0] {
+		exchanged += len(message)
+		if message, err = sides[0].Respond(message); err != nil {
+			return exchanged, err
+		}
+	}
+	return exchanged, nil
+}
+
+// split answers a received fingerprint: nothing if it matches, the keys in the range if they are few,
+// or the fingerprints of subranges splitting the range by this side keys
+func (r *Reconciler) split(received reconcileRange) ([]reconcileRange, error) {
+	own, err := r.fingerprint(received.lower, received.upper)
+	if err != nil || (own.count == received.count && bytes.Equal(own.xor, received.xor)) {
+		return nil, err
+	}
+	start, end, err := r.bounds(received.lower, received.upper)
+	if err != nil {
+		return nil, err
+	}
+	if end-start <= r.options.Threshold {
+		keys, err := r.readKeys(start, end)
+		return []reconcileRange{{lower: received.lower, upper: received.upper, mode: reconcileKeys,
+			keys: keys}}, err
+	}
+	subranges := make([]reconcileRange, 0, r.options.Branches)
+	lower := received.lower
+	for i := 1; i <= r.options.Branches; i++ {
+		upper := received.upper
+		if i < r.options.Branches {
+			index := start + (end-start)*i/r.options.Branches
+			keys, err := r.readKeys(index, index+1)
+			if err != nil {
+				return nil, err
+			}
+			upper = keys[0]
+		}
+		if upper != nil && lower != nil && bytes.Equal(lower, upper) {
+			continue // an empty subrange, when there are fewer keys than branches
+		}
+		subrange, err := r.fingerprint(lower, upper)
+		if err != nil {
+			return nil, err
+		}
+		subranges = append(subranges, subrange)
+		lower = upper
+	}
+	return subranges, nil
+}
+
+// fingerprint returns the fingerprint range of this side keys between lower & upper
+func (r *Reconciler) fingerprint(lower, upper Key) (reconcileRange, error) {
+	start, end, err := r.bounds(lower, upper)
+	var before, until []byte
+	if err == nil {
+		before, err = r.xorBefore(start)
+	}
+	if err == nil {
+		until, err = r.xorBefore(end)
+	}
+	return reconcileRange{lower: lower, upper: upper, mode: reconcileFingerprint,
+		count: uint64(end - start), xor: xorKeys(before, until)}, err
+}
+
+// rangeKeys returns this side keys between lower & upper
+func (r *Reconciler) rangeKeys(lower, upper Key) ([]Key, error) {
+	start, end, err := r.bounds(lower, upper)
+	if err != nil {
+		return nil, err
+	}
+	return r.readKeys(start, end)
+}
+
+// bounds returns the indexes of the keys between lower & upper
+func (r *Reconciler) bounds(lower, upper Key) (int, int, error) {
+	start, end := 0, r.count
+	var err error
+	if lower != nil {
+		start, err = r.search(lower)
+	}
+	if upper != nil && err == nil {
+		end, err = r.search(upper)
+	}
+	if end < start {
+		end = start
+	}
+	return start, end, err
+}
+
+// search returns the index of the first key not below bound, looking for it in the block its fences point to
+func (r *Reconciler) search(bound Key) (int, error) {
+	block := sort.Search(len(r.fences), func(b int) bool { return bytes.Compare(r.fences[b], bound) >= 0 })
+	if block == 0 {
+		return 0, nil
+	}
+	start := (block - 1) * reconcileBlockKeys
+	keys, err := r.readKeys(start, r.blockEnd(start))
+	if err != nil {
+		return 0, err
+	}
+	return start + sort.Search(len(keys), func(i int) bool { return bytes.Compare(keys[i], bound) >= 0 }), nil
+}
+
+// xorBefore returns the xor of the keys before the given index, from the xor of its block and its keys before it
+func (r *Reconciler) xorBefore(index int) ([]byte, error) {
+	block := index / reconcileBlockKeys
+	keys, err := r.readKeys(block*reconcileBlockKeys, index)
+	if err != nil {
+		return nil, err
+	}
+	xor := r.xors[block]
+	for _, key := range keys {
+		xor = xorKeys(xor, key)
+	}
+	return xor, nil
+}
+
+// blockEnd returns the index after the last key of the block starting at start
+func (r *Reconciler) blockEnd(start int) int {
+	if end := start + reconcileBlockKeys; end < r.count {
+		return end
+	}
+	return r.count
+}
+
+// readKeys reads the keys from start to end from the index
+func (r *Reconciler) readKeys(start, end int) ([]Key, error) {
+	if end <= start {
+		return []Key{}, nil
+	}
+	data := make([]byte, (end-start)*r.keySize)
+	if _, err := r.index.ReadAt(data, int64(start*r.keySize)); err != nil {
+		return nil, err
+	}
+	keys := make([]Key, end-start)
+	for i := range keys {
+		keys[i] = Key(data[i*r.keySize : (i+1)*r.keySize : (i+1)*r.keySize])
+	}
+	return keys, nil
+}
+
+// diffKeys returns the keys only in own and the keys only in other, both sorted
+func diffKeys(own, other []Key) ([]Key, []Key) {
+	other = sortKeys(append([]Key{}, other...))
+	onlyOwn, onlyOther := []Key{}, []Key{}
+	i, j := 0, 0
+	for i < len(own) || j < len(other) {
+		switch {
+		case j == len(other) || (i < len(own) && bytes.Compare(own[i], other[j]) < 0):
+			onlyOwn = append(onlyOwn, own[i])
+			i++
+		case i == len(own) || bytes.Compare(own[i], other[j]) > 0:
+			onlyOther = append(onlyOther, other[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	return onlyOwn, onlyOther
+}
+
+// xorKeys returns the xor of a & b, the shorter one padded with zeros
+func xorKeys(a, b []byte) []byte {
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+	xor := append([]byte{}, a...)
+	for i := range b {
+		xor[i] ^= b[i]
+	}
+	return xor
+}
+
+// sortKeys sorts keys in place and returns them
+func sortKeys(keys []Key) []Key {
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	return keys
+}
+
+// encodeReconcileRanges encodes a message as a count of ranges, each with its length prefixed bounds, mode
+// and either a count & xor, a list of keys or two lists of keys
+func encodeReconcileRanges(ranges []reconcileRange) []byte {
+	message := appendUvarints(nil, uint64(len(ranges)))
+	appendKeys := func(message []byte, keys ...Key) []byte {
+		for _, key := range keys {
+			message = append(appendUvarints(message, uint64(len(key))), key...)
+		}
+		return message
+	}
+	for _, rr := range ranges {
+		message = append(appendKeys(message, rr.lower, rr.upper), rr.mode)
+		switch rr.mode {
+		case reconcileFingerprint:
+			message = appendKeys(appendUvarints(message, rr.count), rr.xor)
+		case reconcileKeys:
+			message = appendKeys(appendUvarints(message, uint64(len(rr.keys))), rr.keys...)
+		case reconcileDifferences:
+			message = appendKeys(appendUvarints(message, uint64(len(rr.keys))), rr.keys...)
+			message = appendKeys(appendUvarints(message, uint64(len(rr.lacking))), rr.lacking...)
+		}
+	}
+	return message
+}
+
+// decodeReconcileRanges decodes a message encoded by encodeReconcileRanges
+func decodeReconcileRanges(message []byte) ([]reconcileRange, error) {
+	reader := bytes.NewReader(message)
+	readKey := func() (Key, error) {
+		size, err := binary.ReadUvarint(reader)
+		if err != nil || uint64(reader.Len()) < size {
+			return nil, fmt.Errorf("Truncated reconciliation message")
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		key := make(Key, size)
+		_, err = io.ReadFull(reader, key)
+		return key, err
+	}
+	readKeys := func() ([]Key, error) {
+		count, err := binary.ReadUvarint(reader)
+		if err != nil || uint64(reader.Len()) < count {
+			return nil, fmt.Errorf("Truncated reconciliation message")
+		}
+		keys := make([]Key, count)
+		for i := range keys {
+			if keys[i], err = readKey(); err != nil {
+				return nil, err
+			}
+		}
+		return keys, nil
+	}
+	count, err := binary.ReadUvarint(reader)
+	if err != nil || uint64(reader.Len()) < count {
+		return nil, fmt.Errorf("Truncated reconciliation message")
+	}
+	ranges := make([]reconcileRange, count)
+	for i := range ranges {
+		rr := &ranges[i]
+		if rr.lower, err = readKey(); err == nil {
+			rr.upper, err = readKey()
+		}
+		if err == nil {
+			rr.mode, err = reader.ReadByte()
+		}
+		switch {
+		case err != nil:
+		case rr.mode == reconcileFingerprint:
+			if rr.count, err = binary.ReadUvarint(reader); err == nil {
+				rr.xor, err = readKey()
+			}
+		case rr.mode == reconcileKeys:
+			rr.keys, err = readKeys()
+		case rr.mode == reconcileDifferences:
+			if rr.keys, err = readKeys(); err == nil {
+				rr.lacking, err = readKeys()
+			}
+		default:
+			err = fmt.Errorf("Unknown reconciliation range mode %d", rr.mode)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ranges, nil
+}
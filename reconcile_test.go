@@ -0,0 +1,83 @@
+package blobstore
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestReconcile checks both sides learn their differences with bandwidth proportional to them
+func TestReconcile(t *testing.T) {
+	// setup
+	common := 3000
+	local := writeBlobs(t, NewMemBlobAdmin(crypto.SHA1), common)
+	remote := writeBlobs(t, NewMemBlobAdmin(crypto.SHA1), common)
+	onlyLocal, onlyRemote := map[string]bool{}, map[string]bool{}
+	for i := 0; i < 5; i++ {
+		key, err := local.Write(strings.NewReader(fmt.Sprintf("local blob #%d", i)))
+		assert(err == nil, t, "Error writing blob: %v", err)
+		onlyLocal[key.String()] = true
+	}
+	for i := 0; i < 3; i++ {
+		key, err := remote.Write(strings.NewReader(fmt.Sprintf("remote blob #%d", i)))
+		assert(err == nil, t, "Error writing blob: %v", err)
+		onlyRemote[key.String()] = true
+	}
+	// exercise
+	for _, options := range []ReconcileOptions{{}, {Branches: 2, Threshold: 1}, {Branches: 4, Threshold: 4}} {
+		localSide, err := NewReconciler(local, options)
+		assert(err == nil, t, "Error creating local reconciler: %v", err)
+		remoteSide, err := NewReconciler(remote, options)
+		assert(err == nil, t, "Error creating remote reconciler: %v", err)
+		exchanged, err := Reconcile(localSide, remoteSide)
+		assert(err == nil, t, "Error reconciling: %v", err)
+		listing := (common + len(onlyRemote)) * crypto.SHA1.Size()
+		assert(exchanged < listing/5, t, "Expected far less than the %d bytes of a listing but exchanged %d with %+v",
+			listing, exchanged, options)
+		defer localSide.Close()
+		defer remoteSide.Close()
+		for _, check := range []struct {
+			name     string
+			keys     []Key
+			expected map[string]bool
+		}{
+			{"local missing", localSide.Missing(), onlyRemote},
+			{"local surplus", localSide.Surplus(), onlyLocal},
+			{"remote missing", remoteSide.Missing(), onlyLocal},
+			{"remote surplus", remoteSide.Surplus(), onlyRemote},
+		} {
+			assert(len(check.keys) == len(check.expected), t, "Expected %d %s keys but got %v with %+v",
+				len(check.expected), check.name, check.keys, options)
+			for _, key := range check.keys {
+				assert(check.expected[key.String()], t, "Unexpected %s key %v", check.name, key)
+			}
+		}
+	}
+	// identical stores are done with a single fingerprint
+	localSide, err := NewReconciler(local, ReconcileOptions{})
+	assert(err == nil, t, "Error creating reconciler: %v", err)
+	sameSide, err := NewReconciler(local, ReconcileOptions{})
+	assert(err == nil, t, "Error creating reconciler: %v", err)
+	defer localSide.Close()
+	defer sameSide.Close()
+	exchanged, err := Reconcile(localSide, sameSide)
+	assert(err == nil, t, "Error reconciling: %v", err)
+	assert(exchanged == len(localSide.Start()) && len(sameSide.Missing()) == 0, t,
+		"Expected a single message exchanged but got %d bytes", exchanged)
+	// an empty side gets everything as missing
+	emptySide, err := NewReconciler(NewMemBlobServer(crypto.SHA1), ReconcileOptions{})
+	assert(err == nil, t, "Error creating reconciler: %v", err)
+	_, err = Reconcile(emptySide, localSide)
+	assert(err == nil, t, "Error reconciling: %v", err)
+	assert(len(emptySide.Missing()) == common+len(onlyLocal), t, "Expected all %d keys missing but got %d",
+		common+len(onlyLocal), len(emptySide.Missing()))
+	_, err = localSide.Respond([]byte{1, 0})
+	assert(err != nil, t, "Expected a truncated message to be rejected")
+	// closing removes the index
+	err = emptySide.Close()
+	assert(err == nil, t, "Error closing reconciler: %v", err)
+	_, err = os.Stat(emptySide.index.Name())
+	assert(os.IsNotExist(err), t, "Expected the index removed but got %v", err)
+}
@@ -0,0 +1,192 @@
+package blobstore
+
+import (
+	"fmt"
+)
+
+const (
+	// gfPolynomial is the irreducible polynomial generating the GF(2^8) field, as used by most Reed-Solomon codes
+	gfPolynomial = 0x11d
+	gfSize       = 256
+)
+
+// gfExp and gfLog are the exponent and logarithm tables of GF(2^8), exp is doubled to skip a modulo on mul
+var gfExp, gfLog = gfTables()
+
+// gfTables builds the exponent and logarithm tables of GF(2^8) over the generator 2
+func gfTables() ([2 * gfSize]byte, [gfSize]byte) {
+	var exp [2 * gfSize]byte
+	var log [gfSize]byte
+	x := 1
+	for i := 0; i < gfSize-1; i++ {
+		exp[i] = byte(x)
+		exp[i+gfSize-1] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x >= gfSize {
+			x ^= gfPolynomial
+		}
+	}
+	return exp, log
+}
+
+// gfMul multiplies a and b in GF(2^8)
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// gfInv returns the multiplicative inverse of a non zero a in GF(2^8)
+func gfInv(a byte) byte {
+	return gfExp[gfSize-1-int(gfLog[a])]
+}
+
+// gfPow returns a to the n in GF(2^8)
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])*n)%(gfSize-1)]
+}
+
+// reedSolomon is a systematic Reed-Solomon erasure code of data shards plus parity shards
+type reedSolomon struct {
+	data, parity int
+	// matrix is the (data+parity) x data encoding matrix, its top data rows are the identity
+	matrix [][]byte
+}
+
+// newReedSolomon returns a reedSolomon code able to recover any parity missing shards out of data+parity
+func newReedSolomon(data, parity int) (*reedSolomon, error) {
+	if data <= 0 || parity < 0 || data+parity > gfSize {
+		return nil, fmt.Errorf("Invalid erasure code of %d data and %d parity shards", data, parity)
+	}
+	// any data rows of a vandermonde matrix are invertible, and keep being so after making it systematic
+	vandermonde := make([][]byte, data+parity)
+	for r := range vandermonde {
+		vandermonde[r] = make([]byte, data)
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = gfPow(byte(r), c)
+		}
+	}
+	top, err := gfInvert(vandermonde[:data])
+	if err != nil {
+		return nil, err
+	}
+	return &reedSolomon{data, parity, gfMatMul(vandermonde, top)}, nil
+}
+
+// encode computes the parity shards from the data shards, all shards must be allocated and of equal size
+func (rs *reedSolomon) encode(shards [][]byte) {
+	for p := rs.data; p < rs.data+rs.parity; p++ {
+		rs.combine(rs.matrix[p], shards[:rs.data], shards[p])
+	}
+}
+
+// reconstruct regenerates the missing (nil) shards, as long as no more than parity shards are missing
+func (rs *reedSolomon) reconstruct(shards [][]byte) error {
+	present, rows, size := make([][]byte, 0, rs.data), make([][]byte, 0, rs.data), 0
+	for i, shard := range shards {
+		if shard != nil && len(present) < rs.data {
+			present = append(present, shard)
+			rows = append(rows, rs.matrix[i])
+			size = len(shard)
+		}
+	}
+	if len(present) < rs.data {
+		return fmt.Errorf("Too many missing shards, need %d but only %d are left", rs.data, len(present))
+	}
+	decoder, err := gfInvert(rows)
+	if err != nil {
+		return err
+	}
+	// recover the missing data shards first, the missing parity shards can then be encoded again
+	for d := 0; d < rs.data; d++ {
+		if shards[d] == nil {
+			shards[d] = make([]byte, size)
+			rs.combine(decoder[d], present, shards[d])
+		}
+	}
+	for p := rs.data; p < rs.data+rs.parity; p++ {
+		if shards[p] == nil {
+			shards[p] = make([]byte, size)
+			rs.combine(rs.matrix[p], shards[:rs.data], shards[p])
+		}
+	}
+	return nil
+}
+
+// combine writes into out the linear combination of the inputs by the given coefficients
+func (rs *reedSolomon) combine(coefficients []byte, inputs [][]byte, out []byte) {
+	for i := range out {
+		out[i] = 0
+	}
+	for c, input := range inputs {
+		coefficient := coefficients[c]
+		if coefficient == 0 {
+			continue
+		}
+		for i, b := range input {
+			out[i] ^= gfMul(coefficient, b)
+		}
+	}
+}
+
+// gfMatMul multiplies the matrices a and b in GF(2^8)
+func gfMatMul(a, b [][]byte) [][]byte {
+	result := make([][]byte, len(a))
+	for r := range a {
+		result[r] = make([]byte, len(b[0]))
+		for c := range result[r] {
+			var value byte
+			for i := range b {
+				value ^= gfMul(a[r][i], b[i][c])
+			}
+			result[r][c] = value
+		}
+	}
+	return result
+}
+
+// gfInvert returns the inverse of the square matrix m in GF(2^8) by Gauss-Jordan elimination
+func gfInvert(m [][]byte) ([][]byte, error) {
+	size := len(m)
+	work := make([][]byte, size)
+	for r := range m {
+		work[r] = make([]byte, 2*size)
+		copy(work[r], m[r])
+		work[r][size+r] = 1
+	}
+	for c := 0; c < size; c++ {
+		pivot := c
+		for pivot < size && work[pivot][c] == 0 {
+			pivot++
+		}
+		if pivot == size {
+			return nil, fmt.Errorf("Singular matrix can't be inverted")
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+		scale := gfInv(work[c][c])
+		for i := range work[c] {
+			work[c][i] = gfMul(work[c][i], scale)
+		}
+		for r := 0; r < size; r++ {
+			if r != c && work[r][c] != 0 {
+				factor := work[r][c]
+				for i := range work[r] {
+					work[r][i] ^= gfMul(factor, work[c][i])
+				}
+			}
+		}
+	}
+	inverse := make([][]byte, size)
+	for r := range work {
+		inverse[r] = work[r][size:]
+	}
+	return inverse, nil
+}
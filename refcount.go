@@ -0,0 +1,213 @@
+package blobstore
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RefCountBlobAdmin is a BlobAdmin that keeps a reference count per blob,
+// so that blobs can be dropped as soon as nobody references them, without a full mark & sweep
+type RefCountBlobAdmin interface {
+	BlobAdmin
+	// AddRef adds a reference to an already stored blob
+	AddRef(key Key) error
+	// Release drops a reference to a blob, which is removed when no references are left
+	Release(key Key) error
+	// RefCount returns the current number of references to a blob
+	RefCount(key Key) (int, error)
+}
+
+// RefCountBlobServer wraps a VFSBlobServer keeping persisted reference counters on another VirtualFS
+//
+// Counter updates are crash consistent, as they are written to a temporary keyname, synced and then renamed in place.
+// A crash may still leave blobs without counters or counters without blobs, Reconcile fixes both.
+type RefCountBlobServer struct {
+	*VFSBlobServer
+	refs VirtualFS
+	lock sync.Mutex
+}
+
+// NewRefCountBlobServer returns a RefCountBlobServer over blobs keeping the counters at refs
+func NewRefCountBlobServer(blobs *VFSBlobServer, refs VirtualFS) *RefCountBlobServer {
+	return &RefCountBlobServer{VFSBlobServer: blobs, refs: refs}
+}
+
+// NewFileRefCountServer returns a RefCountBlobServer on the os files, refsDir must be outside dir
+func NewFileRefCountServer(dir, refsDir string, hash crypto.Hash) *RefCountBlobServer {
+	return NewRefCountBlobServer(NewFileBlobServer(dir, hash), fileBlobs{refsDir})
+}
+
+// NewMemRefCountServer returns a RefCountBlobServer in memory
+func NewMemRefCountServer(hash crypto.Hash) *RefCountBlobServer {
+	return NewRefCountBlobServer(NewMemBlobServer(hash), newMemBlobs())
+}
+
+// Write stores a blob and adds a reference to it, the blob is spooled unlocked so writes can run in parallel
+func (rcs *RefCountBlobServer) Write(blob io.Reader) (Key, error) {
+	tmpKeyname, key, err := rcs.spool(blob)
+	if err != nil {
+		return nil, err
+	}
+	rcs.lock.Lock()
+	defer rcs.lock.Unlock()
+	if err := rcs.commit(tmpKeyname, key); err != nil {
+		return nil, err
+	}
+	return key, rcs.addRef(key, 1)
+}
+
+// AddRef adds a reference to an already stored blob
+func (rcs *RefCountBlobServer) AddRef(key Key) error {
+	rcs.lock.Lock()
+	defer rcs.lock.Unlock()
+	if !rcs.Exists(rcs.Keyname(key)) {
+		return fmt.Errorf("Key not found: %v", key)
+	}
+	return rcs.addRef(key, 1)
+}
+
+// Release drops a reference to the blob, the blob is deleted when its count reaches zero
+func (rcs *RefCountBlobServer) Release(key Key) error {
+	rcs.lock.Lock()
+	defer rcs.lock.Unlock()
+	count, err := rcs.refCount(key)
+	if err != nil {
+		return err
+	}
+	if count <= 0 {
+		return fmt.Errorf("Key %v has no references to release", key)
+	}
+	if count > 1 {
+		return rcs.addRef(key, -1)
+	}
+	// drop the counter first, a crash now leaves an unreferenced blob, which Reconcile removes
+	if err := rcs.refs.Delete(rcs.refs.Keyname(key)); err != nil {
+		return err
+	}
+	return rcs.VFSBlobServer.Remove(key)
+}
+
+// RefCount returns the current number of references to a blob, 0 if none
+func (rcs *RefCountBlobServer) RefCount(key Key) (int, error) {
+	rcs.lock.Lock()
+	defer rcs.lock.Unlock()
+	return rcs.refCount(key)
+}
+
+// Remove forcibly removes a blob and its counter, whatever its references
+func (rcs *RefCountBlobServer) Remove(key Key) error {
+	rcs.lock.Lock()
+	defer rcs.lock.Unlock()
+	refname := rcs.refs.Keyname(key)
+	if rcs.refs.Exists(refname) {
+		if err := rcs.refs.Delete(refname); err != nil {
+			return err
+		}
+	}
+	return rcs.VFSBlobServer.Remove(key)
+}
+
+// Reconcile repairs the counters after a crash or an external change to the blobs:
+// blobs without references are removed and counters without blobs are dropped.
+// On dryRun nothing is changed, it just reports what would be done
+func (rcs *RefCountBlobServer) Reconcile(dryRun bool) (orphans, dangling []Key, err error) {
+	rcs.lock.Lock()
+	defer rcs.lock.Unlock()
+	// collect first, as some VirtualFS can't be changed while listing
+	for keyOrErr := range rcs.VFSBlobServer.List() {
+		if keyOrErr.err != nil {
+			return nil, nil, keyOrErr.err
+		}
+		count, err := rcs.refCount(keyOrErr.key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if count <= 0 {
+			orphans = append(orphans, keyOrErr.key)
+		}
+	}
+	refKeys := make(chan KeyOrError)
+	go func() {
+		if rcs.refs.ListTo(refKeys, rcs.acceptor) {
+			close(refKeys)
+		}
+	}()
+	for keyOrErr := range refKeys {
+		if keyOrErr.err != nil {
+			return nil, nil, keyOrErr.err
+		}
+		if !rcs.Exists(rcs.Keyname(keyOrErr.key)) {
+			dangling = append(dangling, keyOrErr.key)
+		}
+	}
+	if dryRun {
+		return orphans, dangling, nil
+	}
+	for _, key := range orphans {
+		if err := rcs.VFSBlobServer.Remove(key); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, key := range dangling {
+		if err := rcs.refs.Delete(rcs.refs.Keyname(key)); err != nil {
+			return nil, nil, err
+		}
+	}
+	return orphans, dangling, nil
+}
+
+// refCount reads the persisted counter for key, a missing counter means no references
+func (rcs *RefCountBlobServer) refCount(key Key) (int, error) {
+	refname := rcs.refs.Keyname(key)
+	if !rcs.refs.Exists(refname) {
+		return 0, nil
+	}
+	file, err := rcs.refs.Open(refname)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return 0, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("Corrupted reference counter for %v: %v", key, err)
+	}
+	return count, nil
+}
+
+// addRef adds delta to the counter of key, writing & syncing it aside and renaming it in place
+func (rcs *RefCountBlobServer) addRef(key Key, delta int) error {
+	count, err := rcs.refCount(key)
+	if err != nil {
+		return err
+	}
+	tmpRefname := rcs.refs.TmpKeyname(rcs.hash.Size())
+	counter, err := rcs.refs.Create(tmpRefname)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(counter, strconv.Itoa(count+delta))
+	if err == nil {
+		err = syncFile(counter)
+	}
+	if closeErr := counter.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		rcs.refs.Delete(tmpRefname)
+		return err
+	}
+	refname := rcs.refs.Keyname(key)
+	if err := rcs.refs.Rename(tmpRefname, refname); err != nil {
+		return err
+	}
+	return syncDir(rcs.refs, refname)
+}
@@ -0,0 +1,93 @@
+package blobstore
+
+import (
+	"crypto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestFileRefCounts test the reference counting over the os files
+func TestFileRefCounts(t *testing.T) {
+	// setup
+	dir := fileBlobs{""}.TmpKeyname(10)
+	blobsDir, refsDir := filepath.Join(dir, "blobs"), filepath.Join(dir, "refs")
+	os.MkdirAll(blobsDir, 0700)
+	os.MkdirAll(refsDir, 0700)
+	rcs := NewFileRefCountServer(blobsDir, refsDir, crypto.SHA1)
+	// exercise
+	refCounts(t, rcs)
+	// cleanup
+	err := os.RemoveAll(dir)
+	assert(err == nil, t, "Error in cleanup removing %s: %v", dir, err)
+}
+
+// TestMemRefCounts test the reference counting in memory
+func TestMemRefCounts(t *testing.T) {
+	refCounts(t, NewMemRefCountServer(crypto.SHA1))
+}
+
+// TestParallelRefCountWrites checks concurrent writes of the same blob count every reference
+func TestParallelRefCountWrites(t *testing.T) {
+	rcs := NewMemRefCountServer(crypto.SHA1)
+	var writes sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		writes.Add(1)
+		go func() {
+			defer writes.Done()
+			_, err := rcs.Write(strings.NewReader(testData[0].input))
+			assert(err == nil, t, "Error writing blob: %v", err)
+		}()
+	}
+	writes.Wait()
+	assertRefCount(t, rcs, toKeyOrDie(t, testData[0].expectedHash), 10)
+}
+
+// refCounts exercises a write, addref, release & reconcile sequence from testData
+func refCounts(t *testing.T, rcs *RefCountBlobServer) {
+	for _, testCase := range testData {
+		// 1 write twice counts 2 references
+		key, err := rcs.Write(strings.NewReader(testCase.input))
+		assert(err == nil, t, "Error writing blob %s:%s", testCase.expectedHash, err)
+		_, err = rcs.Write(strings.NewReader(testCase.input))
+		assert(err == nil, t, "Error writing blob %s:%s", testCase.expectedHash, err)
+		assertRefCount(t, rcs, key, 2)
+		// 2 addref makes it 3
+		err = rcs.AddRef(key)
+		assert(err == nil, t, "Error adding a reference to %s: %v", key, err)
+		assertRefCount(t, rcs, key, 3)
+		// 3 releases keep the blob till the last one
+		for i := 2; i >= 0; i-- {
+			err = rcs.Release(key)
+			assert(err == nil, t, "Error releasing %s: %v", key, err)
+			assertRefCount(t, rcs, key, i)
+			assert(rcs.Exists(rcs.Keyname(key)) == (i > 0), t, "Expected %s present to be %v", key, i > 0)
+		}
+		// 4 releasing or adding refs to a missing blob fails
+		assert(rcs.Release(key) != nil, t, "Releasing unreferenced %s should had failed", key)
+		assert(rcs.AddRef(key) != nil, t, "Adding a reference to missing %s should had failed", key)
+	}
+	// 5 reconcile drops orphan blobs and dangling counters
+	orphan, err := rcs.VFSBlobServer.Write(strings.NewReader(testData[0].input))
+	assert(err == nil, t, "Error writing orphan blob: %v", err)
+	dangling, err := rcs.Write(strings.NewReader(testData[1].input))
+	assert(err == nil, t, "Error writing blob: %v", err)
+	err = rcs.VFSBlobServer.Remove(dangling)
+	assert(err == nil, t, "Error removing blob: %v", err)
+	orphans, danglings, err := rcs.Reconcile(false)
+	assert(err == nil, t, "Error reconciling: %v", err)
+	assert(len(orphans) == 1 && orphans[0].Equals(orphan), t, "Expected orphans [%v] but got %v", orphan, orphans)
+	assert(len(danglings) == 1 && danglings[0].Equals(dangling), t,
+		"Expected dangling [%v] but got %v", dangling, danglings)
+	assert(!rcs.Exists(rcs.Keyname(orphan)), t, "Orphan %v was not removed", orphan)
+	assertRefCount(t, rcs, dangling, 0)
+}
+
+// assertRefCount checks the reference count of key is expected
+func assertRefCount(t *testing.T, rcs *RefCountBlobServer, key Key, expected int) {
+	count, err := rcs.RefCount(key)
+	assert(err == nil, t, "Error getting the reference count of %s: %v", key, err)
+	assert(count == expected, t, "Expected %d references to %s but got %d", expected, key, count)
+}
@@ -0,0 +1,370 @@
+package blobstore
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	refKeyPrefix   = "ref:" // makes ref keys long enough for any VirtualFS layout
+	refLogSize     = 1000
+	refLogMissing  = "-"
+	maxRefNameSize = 120 // keeps the hex filenames of refs, and their temporary ones, within 255 bytes
+	refLockName    = "refs.lock"
+)
+
+var (
+	// ErrRefNotFound is returned, wrapped, for refs that do not exist
+	ErrRefNotFound = errors.New("Ref not found")
+	// ErrRefConflict is returned, wrapped, when a ref compare and swap finds another key than expected
+	ErrRefConflict = errors.New("Ref conflict")
+)
+
+// RefStore keeps named references to keys, the mutable pointers, like "latest", content addressed blobs lack
+type RefStore interface {
+	// GetRef returns the key a ref points to, or an ErrRefNotFound error
+	GetRef(name string) (Key, error)
+	// SetRef points a ref to key if it points to old, or does not exist if old is nil, or fails with ErrRefConflict
+	SetRef(name string, old, key Key) error
+	// DeleteRef deletes a ref if it points to old, or whatever it points to if old is nil
+	DeleteRef(name string, old Key) error
+	// ListRefs returns the refs starting with prefix, sorted by name
+	ListRefs(prefix string) ([]Ref, error)
+	// RefLog returns the history of changes of a ref, oldest first, which survives the ref deletion
+	RefLog(name string) ([]RefLogEntry, error)
+}
+
+// Ref is a named reference to a key
+type Ref struct {
+	Name string
+	Key  Key
+}
+
+// RefLogEntry is a ref change, a nil Old for a creation and a nil New for a deletion
+type RefLogEntry struct {
+	Time time.Time
+	Old  Key
+	New  Key
+}
+
+// VFSRefStore is a RefStore on two VirtualFS, one for the refs and another for their logs.
+//
+// Each ref is a small file with the hex key it points to, and each log a file with a line per change,
+// both written to a temporary keyname and renamed in place, so they are never seen half written.
+// Changes are logged before they are made, so the log misses none, even if a crash may leave the last one undone.
+// Compare and swap is atomic within the process, and across processes for file stores on unix systems, which
+// hold an advisory lock on a lock file to change refs. Other stores must not be shared with other processes
+type VFSRefStore struct {
+	refs     VirtualFS
+	logs     VirtualFS
+	lock     sync.Mutex
+	lockFile string
+	locked   *os.File // the lock file while held
+}
+
+// NewVFSRefStore returns a VFSRefStore keeping refs & their logs on the given VirtualFS,
+// which must not be shared with blobs
+func NewVFSRefStore(refs, logs VirtualFS) *VFSRefStore {
+	return &VFSRefStore{refs: refs, logs: logs}
+}
+
+// NewFileRefStore returns a VFSRefStore on the os files at dir/refs & dir/logs, dir must be outside the
+// blobs root, usually next to it
+func NewFileRefStore(dir string) (*VFSRefStore, error) {
+	for _, subdir := range []string{"refs", "logs"} {
+		if err := os.MkdirAll(filepath.Join(dir, subdir), defaultPerms); err != nil {
+			return nil, err
+		}
+	}
+	rs := NewVFSRefStore(fileBlobs{filepath.Join(dir, "refs")}, fileBlobs{filepath.Join(dir, "logs")})
+	rs.lockFile = filepath.Join(dir, refLockName)
+	return rs, nil
+}
+
+// NewMemRefStore returns a VFSRefStore in memory
+func NewMemRefStore() *VFSRefStore {
+	return NewVFSRefStore(newMemBlobs(), newMemBlobs())
+}
+
+// GetRef returns the key a ref points to
+func (rs *VFSRefStore) GetRef(name string) (Key, error) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	key, err := rs.getRef(name)
+	if err == nil && key == nil {
+		err = fmt.Errorf("%w: %s", ErrRefNotFound, name)
+	}
+	return key, err
+}
+
+// SetRef points a ref to key if it currently points to old
+func (rs *VFSRefStore) SetRef(name string, old, key Key) error {
+	if name == "" || key == nil {
+		return fmt.Errorf("Refs need a name and a key")
+	}
+	if len(name) > maxRefNameSize {
+		return fmt.Errorf("Ref names can not be longer than %d bytes, but %q is %d", maxRefNameSize, name, len(name))
+	}
+	if err := rs.lockRefs(); err != nil {
+		return err
+	}
+	defer rs.unlockRefs()
+	current, err := rs.getRef(name)
+	if err != nil {
+		return err
+	}
+	if !current.Equals(old) {
+		return fmt.Errorf("%w: %s points to %s, not %s", ErrRefConflict, name, refLogKey(current), refLogKey(old))
+	}
+	return rs.change(name, current, key, func() error {
+		return rs.write(rs.refs, name, key.String()+"\n")
+	})
+}
+
+// DeleteRef deletes a ref if it points to old, or unconditionally if old is nil
+func (rs *VFSRefStore) DeleteRef(name string, old Key) error {
+	if err := rs.lockRefs(); err != nil {
+		return err
+	}
+	defer rs.unlockRefs()
+	current, err := rs.getRef(name)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return fmt.Errorf("%w: %s", ErrRefNotFound, name)
+	}
+	if old != nil && !current.Equals(old) {
+		return fmt.Errorf("%w: %s points to %v, not %v", ErrRefConflict, name, current, old)
+	}
+	return rs.change(name, current, nil, func() error {
+		keyname := rs.refs.Keyname(refKey(name))
+		if err := rs.refs.Delete(keyname); err != nil {
+			return err
+		}
+		return syncDir(rs.refs, keyname)
+	})
+}
+
+// ListRefs returns the refs starting with prefix, sorted by name
+func (rs *VFSRefStore) ListRefs(prefix string) ([]Ref, error) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	keys := make(chan KeyOrError)
+	go func() {
+		if rs.refs.ListTo(keys, refAcceptor) {
+			close(keys)
+		}
+	}()
+	names := []string{}
+	for keyOrErr := range keys {
+		if keyOrErr.err != nil {
+			return nil, keyOrErr.err
+		}
+		if name := string(keyOrErr.key[len(refKeyPrefix):]); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	refs := make([]Ref, 0, len(names))
+	for _, name := range names {
+		key, err := rs.getRef(name)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			refs = append(refs, Ref{name, key})
+		}
+	}
+	return refs, nil
+}
+
+// RefLog returns the history of changes of a ref, oldest first
+func (rs *VFSRefStore) RefLog(name string) ([]RefLogEntry, error) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	return rs.refLog(name)
+}
+
+// lockRefs takes the lock to change refs, and the lock on the lock file shared with other processes for file
+// stores. The lock file is never removed, its lock is released by the system if the holder dies
+func (rs *VFSRefStore) lockRefs() error {
+	rs.lock.Lock()
+	if rs.lockFile == "" {
+		return nil
+	}
+	file, err := os.OpenFile(rs.lockFile, os.O_RDWR|os.O_CREATE, defaultPerms)
+	if err == nil {
+		if err = lockFile(file); err != nil {
+			file.Close()
+		}
+	}
+	if err != nil {
+		rs.lock.Unlock()
+		return err
+	}
+	rs.locked = file
+	return nil
+}
+
+// unlockRefs releases the locks taken by lockRefs
+func (rs *VFSRefStore) unlockRefs() {
+	if rs.locked != nil {
+		rs.locked.Close() // closing releases the lock
+		rs.locked = nil
+	}
+	rs.lock.Unlock()
+}
+
+// change logs a ref change and then applies it, restoring the log if applying it fails
+func (rs *VFSRefStore) change(name string, old, key Key, apply func() error) error {
+	previous, err := rs.read(rs.logs, name)
+	if err != nil {
+		return err
+	}
+	if err := rs.log(name, old, key); err != nil {
+		return err
+	}
+	if err := apply(); err != nil {
+		if previous == nil {
+			rs.logs.Delete(rs.logs.Keyname(refKey(name)))
+		} else {
+			rs.write(rs.logs, name, string(previous))
+		}
+		return err
+	}
+	return nil
+}
+
+// getRef reads the key a ref points to, nil if it does not exist
+func (rs *VFSRefStore) getRef(name string) (Key, error) {
+	data, err := rs.read(rs.refs, name)
+	if data == nil || err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("Corrupted ref %s: %v", name, err)
+	}
+	return Key(key), nil
+}
+
+// refLog reads the log of a ref, with a line per change: unix nanoseconds, old & new key, - if missing
+func (rs *VFSRefStore) refLog(name string) ([]RefLogEntry, error) {
+	data, err := rs.read(rs.logs, name)
+	if err != nil {
+		return nil, err
+	}
+	entries := []RefLogEntry{}
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Corrupted ref log %s line %q", name, scanner.Text())
+		}
+		nanos, err := strconv.ParseInt(fields[0], 10, 64)
+		old, oldErr := parseRefLogKey(fields[1])
+		key, keyErr := parseRefLogKey(fields[2])
+		if err != nil || oldErr != nil || keyErr != nil {
+			return nil, fmt.Errorf("Corrupted ref log %s line %q", name, scanner.Text())
+		}
+		entries = append(entries, RefLogEntry{time.Unix(0, nanos), old, key})
+	}
+	return entries, nil
+}
+
+// log appends a change to the log of a ref, dropping the oldest ones beyond refLogSize
+func (rs *VFSRefStore) log(name string, old, key Key) error {
+	entries, err := rs.refLog(name)
+	if err != nil {
+		return err
+	}
+	entries = append(entries, RefLogEntry{time.Now(), old, key})
+	if len(entries) > refLogSize {
+		entries = entries[len(entries)-refLogSize:]
+	}
+	lines := &strings.Builder{}
+	for _, entry := range entries {
+		fmt.Fprintf(lines, "%d %s %s\n", entry.Time.UnixNano(), refLogKey(entry.Old), refLogKey(entry.New))
+	}
+	return rs.write(rs.logs, name, lines.String())
+}
+
+// read returns the contents of a ref or log, nil if missing
+func (rs *VFSRefStore) read(vfs VirtualFS, name string) ([]byte, error) {
+	keyname := vfs.Keyname(refKey(name))
+	if !vfs.Exists(keyname) {
+		return nil, nil
+	}
+	file, err := vfs.Open(keyname)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+// write replaces the contents of a ref or log, writing them aside and renaming them in place, durably
+func (rs *VFSRefStore) write(vfs VirtualFS, name, contents string) error {
+	tmpKeyname := vfs.TmpKeyname(len(refKey(name)))
+	file, err := vfs.Create(tmpKeyname)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(file, contents)
+	if err == nil {
+		err = syncFile(file)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	keyname := vfs.Keyname(refKey(name))
+	if err == nil {
+		err = vfs.Rename(tmpKeyname, keyname)
+	}
+	if err != nil {
+		vfs.Delete(tmpKeyname)
+		return err
+	}
+	return syncDir(vfs, keyname)
+}
+
+// refKey returns the VirtualFS key of a ref name
+func refKey(name string) Key {
+	return Key(refKeyPrefix + name)
+}
+
+// refAcceptor accepts the VirtualFS keys of refs
+func refAcceptor(keyname string) Key {
+	key, err := hex.DecodeString(keyname)
+	if err != nil || !strings.HasPrefix(string(key), refKeyPrefix) {
+		return nil
+	}
+	return Key(key)
+}
+
+// refLogKey returns a key as written in ref logs
+func refLogKey(key Key) string {
+	if key == nil {
+		return refLogMissing
+	}
+	return key.String()
+}
+
+// parseRefLogKey parses a key as written in ref logs
+func parseRefLogKey(field string) (Key, error) {
+	if field == refLogMissing {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(field)
+	return Key(key), err
+}
@@ -0,0 +1,133 @@
+package blobstore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestRefs checks compare and swap updates, listings and logs of refs on files & memory
+func TestRefs(t *testing.T) {
+	// setup
+	dir := fileBlobs{""}.TmpKeyname(10)
+	files, err := NewFileRefStore(dir)
+	assert(err == nil, t, "Error creating file refs: %v", err)
+	first, second := toKeyOrDie(t, testData[0].expectedHash), toKeyOrDie(t, testData[1].expectedHash)
+	// exercise
+	for _, refs := range []RefStore{files, NewMemRefStore()} {
+		_, err := refs.GetRef("latest")
+		assert(errors.Is(err, ErrRefNotFound), t, "Expected a missing ref but got %v", err)
+		err = refs.SetRef("latest", nil, first)
+		assert(err == nil, t, "Error creating ref: %v", err)
+		err = refs.SetRef("latest", nil, second)
+		assert(errors.Is(err, ErrRefConflict), t, "Expected a conflict creating an existing ref but got %v", err)
+		err = refs.SetRef("latest", second, second)
+		assert(errors.Is(err, ErrRefConflict), t, "Expected a conflict with a stale key but got %v", err)
+		err = refs.SetRef("latest", first, second)
+		assert(err == nil, t, "Error updating ref: %v", err)
+		key, err := refs.GetRef("latest")
+		assert(err == nil && key.Equals(second), t, "Expected the ref at %v but got %v: %v", second, key, err)
+		for _, name := range []string{"heads/main", "heads/dev", "tags/v1", "a"} {
+			err = refs.SetRef(name, nil, first)
+			assert(err == nil, t, "Error creating ref %s: %v", name, err)
+		}
+		list, err := refs.ListRefs("heads/")
+		assert(err == nil && fmt.Sprint(list) == fmt.Sprintf("[{heads/dev %v} {heads/main %v}]", first, first), t,
+			"Unexpected refs listed %v: %v", list, err)
+		list, err = refs.ListRefs("")
+		assert(err == nil && len(list) == 5, t, "Expected 5 refs listed but got %v: %v", list, err)
+		err = refs.DeleteRef("latest", first)
+		assert(errors.Is(err, ErrRefConflict), t, "Expected a conflict deleting with a stale key but got %v", err)
+		err = refs.DeleteRef("latest", second)
+		assert(err == nil, t, "Error deleting ref: %v", err)
+		err = refs.DeleteRef("latest", nil)
+		assert(errors.Is(err, ErrRefNotFound), t, "Expected a missing ref but got %v", err)
+		log, err := refs.RefLog("latest")
+		assert(err == nil && len(log) == 3, t, "Expected 3 changes logged but got %v: %v", log, err)
+		assert(log[0].Old == nil && log[0].New.Equals(first) && log[1].Old.Equals(first) && log[1].New.Equals(second) &&
+			log[2].Old.Equals(second) && log[2].New == nil, t, "Unexpected log %v", log)
+		// concurrent updates from the same key, only one wins
+		var wins sync.WaitGroup
+		won := make(chan bool, 10)
+		for i := 0; i < 10; i++ {
+			wins.Add(1)
+			go func() {
+				defer wins.Done()
+				won <- refs.SetRef("a", first, second) == nil
+			}()
+		}
+		wins.Wait()
+		close(won)
+		count := 0
+		for ok := range won {
+			if ok {
+				count++
+			}
+		}
+		assert(count == 1, t, "Expected a single compare and swap to win but got %d", count)
+		err = refs.SetRef(strings.Repeat("x", maxRefNameSize+1), nil, first)
+		assert(err != nil, t, "Expected a too long ref name to be rejected")
+	}
+	// cleanup
+	err = os.RemoveAll(dir)
+	assert(err == nil, t, "Error in cleanup removing %s: %v", dir, err)
+}
+
+// TestRefsLockFile checks file stores on the same dir, as used by several processes, take turns changing refs
+func TestRefsLockFile(t *testing.T) {
+	// setup
+	dir := fileBlobs{""}.TmpKeyname(10)
+	defer os.RemoveAll(dir)
+	first, second := toKeyOrDie(t, testData[0].expectedHash), toKeyOrDie(t, testData[1].expectedHash)
+	stores := []*VFSRefStore{}
+	for i := 0; i < 2; i++ {
+		refs, err := NewFileRefStore(dir)
+		assert(err == nil, t, "Error creating file refs: %v", err)
+		stores = append(stores, refs)
+	}
+	err := stores[0].SetRef("latest", nil, first)
+	assert(err == nil, t, "Error creating ref: %v", err)
+	// exercise concurrent updates from both stores, only one wins
+	var wins sync.WaitGroup
+	won := make(chan bool, 10)
+	for i := 0; i < 10; i++ {
+		wins.Add(1)
+		go func(refs *VFSRefStore) {
+			defer wins.Done()
+			won <- refs.SetRef("latest", first, second) == nil
+		}(stores[i%2])
+	}
+	wins.Wait()
+	close(won)
+	count := 0
+	for ok := range won {
+		if ok {
+			count++
+		}
+	}
+	assert(count == 1, t, "Expected a single compare and swap to win but got %d", count)
+	if !refLockShared {
+		return
+	}
+	// a lock held by another process blocks changes till it is released
+	held, err := os.OpenFile(filepath.Join(dir, refLockName), os.O_RDWR, defaultPerms)
+	assert(err == nil, t, "Error opening lock file: %v", err)
+	err = lockFile(held)
+	assert(err == nil, t, "Error locking lock file: %v", err)
+	done := make(chan error)
+	go func() { done <- stores[1].SetRef("held", nil, first) }()
+	select {
+	case err = <-done:
+		t.Fatalf("Expected the change to wait for the lock but got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	held.Close()
+	// check
+	err = <-done
+	assert(err == nil, t, "Error creating ref after the lock release: %v", err)
+}
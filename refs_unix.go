@@ -0,0 +1,21 @@
+//go:build unix
+
+package blobstore
+
+import (
+	"os"
+	"syscall"
+)
+
+// refLockShared tells whether ref lock files lock out other processes
+const refLockShared = true
+
+// lockFile takes an exclusive advisory lock on file, waiting for whoever holds it
+func lockFile(file *os.File) error {
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
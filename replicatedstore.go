@@ -0,0 +1,204 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	replicatedReadAhead = 64 * 1024
+)
+
+// ReplicatedStore is a BlobAdmin writing each blob to several replicas
+//
+// Writes succeed when at least a quorum of replicas stored the blob,
+// reads fall back to the next replica when one fails or returns a corrupted blob
+type ReplicatedStore struct {
+	replicas []BlobStore
+	quorum   int
+}
+
+// NewReplicatedStore returns a ReplicatedStore over replicas requiring quorum successful writes,
+// a quorum out of range means all replicas must succeed
+func NewReplicatedStore(replicas []BlobStore, quorum int) *ReplicatedStore {
+	if quorum <= 0 || quorum > len(replicas) {
+		quorum = len(replicas)
+	}
+	return &ReplicatedStore{replicas, quorum}
+}
+
+// Read returns the blob from the first replica that has it unharmed, see readReplicas
+func (rs *ReplicatedStore) Read(key Key) (io.Reader, error) {
+	return readReplicas(rs.replicas, key)
+}
+
+// Write stores the blob on all replicas, it fails if less than quorum replicas succeeded
+func (rs *ReplicatedStore) Write(blob io.Reader) (Key, error) {
+	keys, errs := fanoutWrite(rs.replicas, blob)
+	votes := make(map[string]int)
+	var lastErr error
+	for i, key := range keys {
+		if errs[i] != nil {
+			lastErr = errs[i]
+			continue
+		}
+		votes[string(key)]++
+		if votes[string(key)] >= rs.quorum {
+			return key, nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("Replicas disagree on the blob key")
+	}
+	return nil, fmt.Errorf("Write quorum of %d not reached: %v", rs.quorum, lastErr)
+}
+
+// List returns the sorted and deduplicated keys of all replicas
+func (rs *ReplicatedStore) List() <-chan KeyOrError {
+	lists := make([]<-chan KeyOrError, 0, len(rs.replicas))
+	for _, replica := range rs.replicas {
+		lists = append(lists, replica.List())
+	}
+	return mergeKeys(lists...)
+}
+
+// Remove the given key from all BlobAdmin replicas, returns the first error found, if any
+func (rs *ReplicatedStore) Remove(key Key) error {
+	var firstErr error
+	for _, replica := range rs.replicas {
+		if admin, ok := replica.(BlobAdmin); ok {
+			if err := admin.Remove(key); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// AntiEntropy copies the keys missing on any replica from the replicas that have them,
+// it returns the number of blobs copied
+func (rs *ReplicatedStore) AntiEntropy() (int, error) {
+	lists := make([]<-chan KeyOrError, 0, len(rs.replicas))
+	for _, replica := range rs.replicas {
+		lists = append(lists, replica.List())
+	}
+	copies := 0
+	err := joinKeys(lists, func(key Key, present []bool) error {
+		healthy := []BlobStore{}
+		for i, replica := range rs.replicas {
+			if present[i] {
+				healthy = append(healthy, replica)
+			}
+		}
+		for i, replica := range rs.replicas {
+			if present[i] {
+				continue
+			}
+			reader, err := readReplicas(healthy, key)
+			if err != nil {
+				return fmt.Errorf("No healthy replica for %v: %v", key, err)
+			}
+			if _, err := replica.Write(reader); err != nil {
+				return err
+			}
+			copies++
+		}
+		return nil
+	})
+	return copies, err
+}
+
+// readReplicas returns a blob from the first replica that has it unharmed.
+// Blobs up to replicatedReadAhead bytes are read and verified before returning them, so corrupted replicas
+// are skipped. Bigger blobs are streamed, and when a replica fails mid blob the stream goes on from the next one,
+// as long as it agrees on the bytes already read
+func readReplicas(replicas []BlobStore, key Key) (io.Reader, error) {
+	err := fmt.Errorf("Key not found: %v", key)
+	for i, replica := range replicas {
+		var reader io.Reader
+		if reader, err = replica.Read(key); err != nil {
+			continue
+		}
+		var head []byte
+		if head, err = ioutil.ReadAll(io.LimitReader(reader, replicatedReadAhead+1)); err != nil {
+			continue
+		}
+		if len(head) <= replicatedReadAhead {
+			return bytes.NewReader(head), nil
+		}
+		delivered := sha256.New()
+		delivered.Write(head)
+		rest := &failoverReader{replicas: replicas, key: key, next: i + 1, reader: reader,
+			read: int64(len(head)), delivered: delivered}
+		return io.MultiReader(bytes.NewReader(head), rest), nil
+	}
+	return nil, err
+}
+
+// failoverReader streams a blob from a list of replicas, going on from the next one when a replica fails.
+// A digest of the bytes delivered so far checks the next replica agrees on them before going on
+type failoverReader struct {
+	replicas  []BlobStore
+	key       Key
+	next      int
+	reader    io.Reader
+	read      int64
+	delivered hash.Hash
+	err       error
+}
+
+// Read reads from the current replica, failing over to the next one on errors
+func (fr *failoverReader) Read(buf []byte) (int, error) {
+	for {
+		if fr.reader == nil {
+			if err := fr.open(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := fr.reader.Read(buf)
+		fr.delivered.Write(buf[:n])
+		fr.read += int64(n)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		fr.reader, fr.err = nil, err
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// open opens the next replica with the blob, skipping the bytes already delivered
+func (fr *failoverReader) open() error {
+	for ; fr.next < len(fr.replicas); fr.next++ {
+		reader, err := fr.replicas[fr.next].Read(fr.key)
+		if err != nil {
+			fr.err = err
+			continue
+		}
+		if fr.read > 0 {
+			prefix := sha256.New()
+			if _, err := io.CopyN(prefix, reader, fr.read); err != nil {
+				fr.err = err
+				continue
+			}
+			if !bytes.Equal(prefix.Sum(nil), fr.delivered.Sum(nil)) {
+				fr.next = len(fr.replicas)
+				fr.err = fmt.Errorf("%s %v bytes already read differ from those in other replicas",
+					corruptedBlobErrorPrefix, fr.key)
+				break
+			}
+		}
+		fr.next++
+		fr.reader = reader
+		return nil
+	}
+	if fr.err == nil {
+		fr.err = fmt.Errorf("Key not found: %v", fr.key)
+	}
+	return fr.err
+}
@@ -0,0 +1,74 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// TestReplicatedReadsNWrites test that a replicated store does its reads and writes as expected
+func TestReplicatedReadsNWrites(t *testing.T) {
+	replicas := []BlobStore{NewMemBlobAdmin(crypto.SHA1), NewMemBlobAdmin(crypto.SHA1), NewMemBlobAdmin(crypto.SHA1)}
+	readsNWrites(t, NewReplicatedStore(replicas, 2))
+}
+
+// TestReplicatedCorruption checks reads skip a corrupted replica and anti entropy restores missing blobs
+func TestReplicatedCorruption(t *testing.T) {
+	// setup
+	first, second := NewMemBlobServer(crypto.SHA1), NewMemBlobServer(crypto.SHA1)
+	rs := NewReplicatedStore([]BlobStore{first, second}, 0)
+	key, err := rs.Write(strings.NewReader(testData[0].input))
+	assert(err == nil, t, "Error writing blob: %v", err)
+	first.VirtualFS.(*memBlobs).blobs[first.Keyname(key)] = bytes.NewBufferString("corrupted!")
+	// exercise
+	reader, err := rs.Read(key)
+	assert(err == nil, t, "Error reading %v: %v", key, err)
+	blob, err := ioutil.ReadAll(reader)
+	assert(err == nil && string(blob) == testData[0].input, t, "Expected '%s' but got '%s' (%v)",
+		testData[0].input, blob, err)
+	// exercise anti entropy after losing the corrupted blob
+	err = first.Remove(key)
+	assert(err == nil, t, "Error removing %v: %v", key, err)
+	copies, err := rs.AntiEntropy()
+	assert(err == nil, t, "Error on anti entropy: %v", err)
+	assert(copies == 1, t, "Expected 1 blob copied but got %d", copies)
+	_, err = readBlob(first, key)
+	assert(err == nil, t, "Blob %v was not restored: %v", key, err)
+}
+
+// TestReplicatedFailover checks a big blob read goes on from another replica when one fails mid blob
+func TestReplicatedFailover(t *testing.T) {
+	// setup
+	first, second := NewMemBlobServer(crypto.SHA1), NewMemBlobServer(crypto.SHA1)
+	rs := NewReplicatedStore([]BlobStore{first, second}, 0)
+	big := strings.Repeat("0123456789", replicatedReadAhead/5)
+	key, err := rs.Write(strings.NewReader(big))
+	assert(err == nil, t, "Error writing blob: %v", err)
+	truncated := &truncatedStore{first, len(big) - 10}
+	rs = NewReplicatedStore([]BlobStore{truncated, second}, 0)
+	// exercise
+	reader, err := rs.Read(key)
+	assert(err == nil, t, "Error reading %v: %v", key, err)
+	blob, err := ioutil.ReadAll(reader)
+	// check
+	assert(err == nil && string(blob) == big, t, "Expected the whole blob but got %d bytes: %v", len(blob), err)
+}
+
+// truncatedStore is a BlobStore whose blob reads fail after a number of bytes
+type truncatedStore struct {
+	BlobStore
+	size int
+}
+
+// Read returns a reader failing after ts.size bytes
+func (ts *truncatedStore) Read(key Key) (io.Reader, error) {
+	reader, err := ts.BlobStore.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	return io.MultiReader(io.LimitReader(reader, int64(ts.size)), iotest.ErrReader(io.ErrUnexpectedEOF)), nil
+}
@@ -0,0 +1,457 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultS3PartSize = 8 << 20
+	defaultS3Region   = "us-east-1"
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3DateFormat      = "20060102T150405Z"
+	s3MaxParts        = 10000
+)
+
+// s3MaxCopySize is the largest object S3 copies in a single request, bigger ones are copied a part at a time
+var s3MaxCopySize int64 = 5 << 30
+
+// S3Options locate and authenticate a bucket on any S3 compatible object storage
+type S3Options struct {
+	// Endpoint is the service URL, like https://s3.amazonaws.com or http://localhost:9000, buckets are path style
+	Endpoint string
+	// Bucket holding the blobs
+	Bucket string
+	// Prefix of all blob object keys in the bucket, like "blobs/"
+	Prefix string
+	// Region to sign requests for, us-east-1 by default
+	Region string
+	// AccessKey & SecretKey sign requests with AWS signature V4, requests are anonymous if AccessKey is empty
+	AccessKey, SecretKey string
+	// PartSize is the size of multipart upload parts, 8MB by default, S3 requires at least 5MB
+	PartSize int
+	// Client performs the requests, http.DefaultClient if nil
+	Client *http.Client
+}
+
+// NewS3BlobServer returns a VFSBlobServer on a S3 compatible bucket
+func NewS3BlobServer(options S3Options, hash crypto.Hash) *VFSBlobServer {
+	if options.Region == "" {
+		options.Region = defaultS3Region
+	}
+	if options.PartSize <= 0 {
+		options.PartSize = defaultS3PartSize
+	}
+	if options.Client == nil {
+		options.Client = http.DefaultClient
+	}
+	options.Endpoint = strings.TrimSuffix(options.Endpoint, "/")
+	return &VFSBlobServer{&s3Blobs{options}, hash}
+}
+
+// s3Blobs is a VirtualFS on a S3 bucket, each blob is an object keyed by the prefix and the hex key
+//
+// Blobs are uploaded to a temporary object, in a single PUT or as a multipart upload if larger than a part,
+// and then renamed with a server side copy, so their bytes never travel back to the client
+type s3Blobs struct {
+	S3Options
+}
+
+// s3Error is the error document returned by S3
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+// s3ListResult is a ListObjectsV2 page
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// s3Part is an uploaded part of a multipart upload
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// Open a key contents for reading, streamed from a GET
+func (vfs *s3Blobs) Open(keyname string) (io.ReadCloser, error) {
+	response, err := vfs.do("GET", keyname, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+// Create a key to write its contents, uploaded a part at a time
+func (vfs *s3Blobs) Create(keyname string) (io.WriteCloser, error) {
+	return &s3Writer{vfs: vfs, keyname: keyname}, nil
+}
+
+// Delete a key & contents
+func (vfs *s3Blobs) Delete(keyname string) error {
+	return vfs.call("DELETE", keyname, nil, nil, nil, nil)
+}
+
+// Does the given key exists?
+func (vfs *s3Blobs) Exists(keyname string) bool {
+	return vfs.call("HEAD", keyname, nil, nil, nil, nil) == nil
+}
+
+// Rename a key with a server side copy, a part at a time if too big for a single copy, then deleting the old key.
+// A temporary old key is deleted even if the copy fails, so it is not left behind
+func (vfs *s3Blobs) Rename(oldkey, newkey string) error {
+	err := vfs.copy(oldkey, newkey)
+	if err != nil && !strings.HasSuffix(oldkey, tmpSuffix) {
+		return err
+	}
+	if deleteErr := vfs.Delete(oldkey); err == nil {
+		err = deleteErr
+	}
+	return err
+}
+
+// copy copies oldkey to newkey server side, with a multipart upload of copied parts over s3MaxCopySize
+func (vfs *s3Blobs) copy(oldkey, newkey string) error {
+	size, err := vfs.Size(oldkey)
+	if err != nil {
+		return err
+	}
+	source := "/" + vfs.Bucket + "/" + uriEncode(oldkey, false)
+	if size <= s3MaxCopySize {
+		return vfs.call("PUT", newkey, nil, http.Header{"X-Amz-Copy-Source": {source}}, nil, &struct {
+			XMLName xml.Name `xml:"CopyObjectResult"`
+		}{})
+	}
+	partSize := int64(vfs.PartSize)
+	if minPartSize := (size + s3MaxParts - 1) / s3MaxParts; partSize < minPartSize {
+		partSize = minPartSize
+	}
+	w := &s3Writer{vfs: vfs, keyname: newkey}
+	for start := int64(0); start < size && err == nil; start += partSize {
+		end := start + partSize
+		if end > size {
+			end = size
+		}
+		err = w.copyPart(source, start, end)
+	}
+	if err == nil {
+		err = w.complete()
+	}
+	if err != nil {
+		w.abort()
+	}
+	return err
+}
+
+// Size returns a key contents size, from a HEAD
+func (vfs *s3Blobs) Size(keyname string) (int64, error) {
+	response, err := vfs.do("HEAD", keyname, nil, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+	return response.ContentLength, nil
+}
+
+// ListTo lists all present keys in sort order to the keys channel, a ListObjectsV2 page at a time
+func (vfs *s3Blobs) ListTo(keys chan<- KeyOrError, acceptor func(string) Key) bool {
+	return vfs.listTo(keys, acceptor, url.Values{"list-type": {"2"}, "prefix": {vfs.Prefix}})
+}
+
+// ListAfterTo lists the keys after the given one in sort order, starting the listing after it
+func (vfs *s3Blobs) ListAfterTo(keys chan<- KeyOrError, acceptor func(string) Key, after Key) bool {
+	return vfs.listTo(keys, acceptor, url.Values{"list-type": {"2"}, "prefix": {vfs.Prefix},
+		"start-after": {vfs.Keyname(after)}})
+}
+
+// listTo lists the keys of a ListObjectsV2 query, a page at a time
+func (vfs *s3Blobs) listTo(keys chan<- KeyOrError, acceptor func(string) Key, query url.Values) bool {
+	for {
+		page := s3ListResult{}
+		if err := vfs.call("GET", "", query, nil, nil, &page); err != nil {
+			return failKeyOrError(keys, err)
+		}
+		for _, object := range page.Contents {
+			name := strings.TrimPrefix(object.Key, vfs.Prefix)
+			if strings.HasSuffix(name, tmpSuffix) {
+				continue
+			}
+			if key := acceptor(name); key != nil {
+				keys <- KeyOrError{key, nil}
+			}
+		}
+		if !page.IsTruncated {
+			return true
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+// Keyname returns the object key of a blob, the prefix followed by the hex key
+func (vfs *s3Blobs) Keyname(key Key) string {
+	return vfs.Prefix + key.String()
+}
+
+// TmpKeyname returns a temporary object key
+func (vfs *s3Blobs) TmpKeyname(size int) string {
+	key := make([]byte, size)
+	rand.Reader.Read(key)
+	return vfs.Prefix + Key(key).String() + tmpSuffix
+}
+
+// call does a request, decoding the XML response into result, if not nil
+func (vfs *s3Blobs) call(method, keyname string, query url.Values, header http.Header, body []byte,
+	result interface{}) error {
+	response, err := vfs.do(method, keyname, query, header, body)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if result == nil {
+		return nil
+	}
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	// S3 may fail a copy or a multipart completion after answering 200 OK
+	s3err := s3Error{}
+	if xml.Unmarshal(data, &s3err) == nil {
+		return fmt.Errorf("S3 %s %s failed: %s %s", method, keyname, s3err.Code, s3err.Message)
+	}
+	return xml.Unmarshal(data, result)
+}
+
+// do sends a signed request for the object keyname, or the bucket if empty,
+// failing on any non 2XX response
+func (vfs *s3Blobs) do(method, keyname string, query url.Values, header http.Header,
+	body []byte) (*http.Response, error) {
+	request, err := http.NewRequest(method, vfs.Endpoint+"/"+vfs.Bucket+"/"+uriEncode(keyname, false),
+		bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.URL.RawQuery = canonicalQuery(query)
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	payloadHash := sha256.Sum256(body)
+	vfs.sign(request, hex.EncodeToString(payloadHash[:]), time.Now())
+	response, err := vfs.Client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode/100 == 2 {
+		return response, nil
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound && keyname != "" {
+		return nil, fmt.Errorf("Key not found: %s", keyname)
+	}
+	s3err := s3Error{}
+	data, _ := ioutil.ReadAll(response.Body)
+	xml.Unmarshal(data, &s3err)
+	return nil, fmt.Errorf("S3 %s %s failed with %s: %s %s", method, keyname, response.Status, s3err.Code, s3err.Message)
+}
+
+// sign adds the AWS signature V4 headers to the request, signing the host and all headers already set
+func (vfs *s3Blobs) sign(request *http.Request, payloadHash string, now time.Time) {
+	date := now.UTC().Format(s3DateFormat)
+	request.Header.Set("X-Amz-Date", date)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if vfs.AccessKey == "" {
+		return
+	}
+	values := map[string]string{"host": request.URL.Host}
+	for name, value := range request.Header {
+		values[strings.ToLower(name)] = strings.TrimSpace(strings.Join(value, ","))
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + values[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{request.Method, request.URL.EscapedPath(), request.URL.RawQuery,
+		canonicalHeaders, signedHeaders, payloadHash}, "\n")
+	scope := strings.Join([]string{date[:8], vfs.Region, "s3", "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{s3Algorithm, date, scope, hex.EncodeToString(requestHash[:])}, "\n")
+	key := []byte("AWS4" + vfs.SecretKey)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	request.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, vfs.AccessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data with key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery returns the query sorted and encoded as signed requests require
+func canonicalQuery(query url.Values) string {
+	params := []string{}
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// uriEncode percent encodes all but the unreserved characters, and the slashes unless encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	encoded := strings.Builder{}
+	for _, b := range []byte(s) {
+		if ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z') || ('0' <= b && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
+
+// s3Writer uploads a blob in a single PUT when closed, or as a multipart upload once it outgrows a part
+type s3Writer struct {
+	vfs      *s3Blobs
+	keyname  string
+	buf      []byte
+	uploadID string
+	parts    []s3Part
+	err      error
+}
+
+// Write buffers the bytes, uploading each part as soon as it is full
+func (w *s3Writer) Write(buf []byte) (int, error) {
+	w.buf = append(w.buf, buf...)
+	for len(w.buf) > w.vfs.PartSize {
+		if w.err = w.uploadPart(w.buf[:w.vfs.PartSize]); w.err != nil {
+			w.abort()
+			return 0, w.err
+		}
+		w.buf = append([]byte{}, w.buf[w.vfs.PartSize:]...)
+	}
+	return len(buf), nil
+}
+
+// Close uploads the buffered bytes, completing the multipart upload if there is one
+func (w *s3Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.uploadID == "" {
+		return w.vfs.call("PUT", w.keyname, nil, nil, w.buf, nil)
+	}
+	err := w.uploadPart(w.buf)
+	if err == nil {
+		err = w.complete()
+	}
+	if err != nil {
+		w.abort()
+	}
+	return err
+}
+
+// complete completes the multipart upload with the parts uploaded so far
+func (w *s3Writer) complete() error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		return err
+	}
+	return w.vfs.call("POST", w.keyname, url.Values{"uploadId": {w.uploadID}}, nil, body, &struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	}{})
+}
+
+// uploadPart uploads the next part, starting the multipart upload first if needed
+func (w *s3Writer) uploadPart(part []byte) error {
+	if err := w.initiate(); err != nil {
+		return err
+	}
+	number := len(w.parts) + 1
+	response, err := w.vfs.do("PUT", w.keyname,
+		url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {w.uploadID}}, nil, part)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	w.parts = append(w.parts, s3Part{number, response.Header.Get("ETag")})
+	return nil
+}
+
+// initiate starts the multipart upload, unless already started
+func (w *s3Writer) initiate() error {
+	if w.uploadID != "" {
+		return nil
+	}
+	initiated := struct {
+		UploadID string `xml:"UploadId"`
+	}{}
+	if err := w.vfs.call("POST", w.keyname, url.Values{"uploads": {""}}, nil, nil, &initiated); err != nil {
+		return err
+	}
+	w.uploadID = initiated.UploadID
+	return nil
+}
+
+// copyPart copies the source bytes from start to end as the next part, starting the multipart upload if needed
+func (w *s3Writer) copyPart(source string, start, end int64) error {
+	if err := w.initiate(); err != nil {
+		return err
+	}
+	number := len(w.parts) + 1
+	header := http.Header{"X-Amz-Copy-Source": {source},
+		"X-Amz-Copy-Source-Range": {fmt.Sprintf("bytes=%d-%d", start, end-1)}}
+	copied := struct {
+		XMLName xml.Name `xml:"CopyPartResult"`
+		ETag    string   `xml:"ETag"`
+	}{}
+	if err := w.vfs.call("PUT", w.keyname,
+		url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {w.uploadID}}, header, nil, &copied); err != nil {
+		return err
+	}
+	w.parts = append(w.parts, s3Part{number, copied.ETag})
+	return nil
+}
+
+// abort drops the multipart upload, if any, so that its parts are not kept
+func (w *s3Writer) abort() {
+	if w.uploadID != "" {
+		w.vfs.call("DELETE", w.keyname, url.Values{"uploadId": {w.uploadID}}, nil, nil, nil)
+		w.uploadID = ""
+	}
+}
@@ -0,0 +1,272 @@
+package blobstore
+
+import (
+	"crypto"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// ShardedStore is a BlobAdmin spreading its blobs over several VFSBlobServer shards,
+// such as fileBlobs roots on different disks
+//
+// Each key is placed by rendezvous hashing of the shard names and key bytes,
+// so adding or removing a shard only moves the blobs that change owner
+type ShardedStore struct {
+	lock        sync.RWMutex
+	rebalancing sync.Mutex // moves blobs without holding lock, so reads & writes go on meanwhile
+	shards      []shard
+	spools      uint32
+}
+
+// shard is a named VFSBlobServer of a ShardedStore, a draining shard owns no keys and is just read from
+type shard struct {
+	name string
+	*VFSBlobServer
+	draining bool
+}
+
+// NewShardedStore returns an empty ShardedStore, use AddShard to populate it
+func NewShardedStore() *ShardedStore {
+	return &ShardedStore{}
+}
+
+// NewFileShardedStore returns a ShardedStore with a fileBlobs shard for each of dirs, named after them
+func NewFileShardedStore(dirs []string, hash crypto.Hash) *ShardedStore {
+	ss := NewShardedStore()
+	for _, dir := range dirs {
+		ss.shards = append(ss.shards, shard{dir, NewFileBlobServer(dir, hash), false})
+	}
+	return ss
+}
+
+// AddShard adds a new shard, call Rebalance afterwards to move to it the blobs it now owns
+func (ss *ShardedStore) AddShard(name string, blobs *VFSBlobServer) error {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	if ss.find(name) >= 0 {
+		return fmt.Errorf("Shard %s already exists", name)
+	}
+	ss.shards = append(ss.shards, shard{name, blobs, false})
+	return nil
+}
+
+// RemoveShard removes a shard moving all its blobs to their new owners, it returns the number of blobs moved.
+// The shard is drained while still being read from, and restored if moving its blobs fails
+func (ss *ShardedStore) RemoveShard(name string) (int, error) {
+	ss.rebalancing.Lock()
+	defer ss.rebalancing.Unlock()
+	removed, err := ss.setDraining(name, true)
+	if err != nil {
+		return 0, err
+	}
+	moved, err := ss.rebalance(removed)
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	index := ss.find(name)
+	if err != nil {
+		ss.shards[index].draining = false
+		return moved, err
+	}
+	ss.shards = append(ss.shards[:index:index], ss.shards[index+1:]...)
+	return moved, nil
+}
+
+// setDraining marks the shard called name as draining or not, returning it
+func (ss *ShardedStore) setDraining(name string, draining bool) (shard, error) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	index := ss.find(name)
+	if index < 0 {
+		return shard{}, fmt.Errorf("Shard %s not found", name)
+	}
+	if len(ss.live()) == 1 {
+		return shard{}, fmt.Errorf("Can't remove %s, the last shard", name)
+	}
+	ss.shards[index].draining = draining
+	return ss.shards[index], nil
+}
+
+// Rebalance moves the blobs not placed on their owner shard, it returns the number of blobs moved
+func (ss *ShardedStore) Rebalance() (int, error) {
+	ss.rebalancing.Lock()
+	defer ss.rebalancing.Unlock()
+	ss.lock.RLock()
+	shards := append([]shard{}, ss.shards...)
+	ss.lock.RUnlock()
+	moved := 0
+	for _, from := range shards {
+		count, err := ss.rebalance(from)
+		moved += count
+		if err != nil {
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+// Read retrieves the blob from its owner shard, or from any other if not yet rebalanced
+func (ss *ShardedStore) Read(key Key) (io.Reader, error) {
+	ss.lock.RLock()
+	defer ss.lock.RUnlock()
+	if len(ss.shards) == 0 {
+		return nil, fmt.Errorf("No shards to read from")
+	}
+	owner := ss.owner(key)
+	reader, err := owner.Read(key)
+	if err == nil {
+		return reader, nil
+	}
+	for _, other := range ss.shards {
+		if other.name != owner.name && other.Exists(other.Keyname(key)) {
+			return other.Read(key)
+		}
+	}
+	return nil, err
+}
+
+// Size returns the size of the blob on its owner shard, or on any other if not yet rebalanced
+func (ss *ShardedStore) Size(key Key) (int64, error) {
+	ss.lock.RLock()
+	defer ss.lock.RUnlock()
+	if len(ss.shards) == 0 {
+		return 0, fmt.Errorf("No shards to read from")
+	}
+	owner := ss.owner(key)
+	size, err := owner.Size(key)
+	if err == nil {
+		return size, nil
+	}
+	for _, other := range ss.shards {
+		if other.name != owner.name && other.Exists(other.Keyname(key)) {
+			return other.Size(key)
+		}
+	}
+	return 0, err
+}
+
+// Write spools the blob on the next shard in turn and places it on its owner shard once the key is known
+func (ss *ShardedStore) Write(blob io.Reader) (Key, error) {
+	ss.lock.RLock()
+	defer ss.lock.RUnlock()
+	live := ss.live()
+	if len(live) == 0 {
+		return nil, fmt.Errorf("No shards to write to")
+	}
+	spool := live[int(atomic.AddUint32(&ss.spools, 1))%len(live)]
+	tmpKeyname, key, err := spool.spool(blob)
+	if err != nil {
+		return nil, err
+	}
+	owner := ss.owner(key)
+	if owner.name == spool.name {
+		return key, spool.commit(tmpKeyname, key)
+	}
+	defer spool.Delete(tmpKeyname)
+	return key, copyTo(owner, key, spool.Open, tmpKeyname)
+}
+
+// List returns the sorted keys of all shards
+func (ss *ShardedStore) List() <-chan KeyOrError {
+	ss.lock.RLock()
+	defer ss.lock.RUnlock()
+	lists := make([]<-chan KeyOrError, 0, len(ss.shards))
+	for _, shard := range ss.shards {
+		lists = append(lists, shard.List())
+	}
+	return mergeKeys(lists...)
+}
+
+// Remove the given key from all shards
+func (ss *ShardedStore) Remove(key Key) error {
+	ss.lock.RLock()
+	defer ss.lock.RUnlock()
+	for _, shard := range ss.shards {
+		if err := shard.Remove(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebalance moves the blobs of from not owned by it anymore to their owners,
+// the lock is only held to find each owner, so blobs are read from either shard while moving
+func (ss *ShardedStore) rebalance(from shard) (int, error) {
+	var misplaced []Key
+	for keyOrErr := range from.List() {
+		if keyOrErr.err != nil {
+			return 0, keyOrErr.err
+		}
+		if ss.lockedOwner(keyOrErr.key).name != from.name {
+			misplaced = append(misplaced, keyOrErr.key)
+		}
+	}
+	for i, key := range misplaced {
+		if err := copyTo(ss.lockedOwner(key), key, from.Open, from.Keyname(key)); err != nil {
+			return i, err
+		}
+		if err := from.Remove(key); err != nil {
+			return i, err
+		}
+	}
+	return len(misplaced), nil
+}
+
+// lockedOwner returns the owner of key taking the read lock
+func (ss *ShardedStore) lockedOwner(key Key) shard {
+	ss.lock.RLock()
+	defer ss.lock.RUnlock()
+	return ss.owner(key)
+}
+
+// owner returns the live shard with the highest rendezvous score for key
+func (ss *ShardedStore) owner(key Key) shard {
+	var owner shard
+	var best uint64
+	for i, shard := range ss.live() {
+		hasher := fnv.New64a()
+		io.WriteString(hasher, shard.name)
+		hasher.Write(key)
+		if score := hasher.Sum64(); i == 0 || score > best {
+			owner, best = shard, score
+		}
+	}
+	return owner
+}
+
+// live returns the shards not being drained
+func (ss *ShardedStore) live() []shard {
+	live := make([]shard, 0, len(ss.shards))
+	for _, shard := range ss.shards {
+		if !shard.draining {
+			live = append(live, shard)
+		}
+	}
+	return live
+}
+
+// find returns the index of the shard called name, or -1 if not found
+func (ss *ShardedStore) find(name string) int {
+	for i, shard := range ss.shards {
+		if shard.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// copyTo writes the blob at keyname, as opened by open, into blobs checking its key is the expected one
+func copyTo(blobs BlobStore, key Key, open func(string) (io.ReadCloser, error), keyname string) error {
+	source, err := open(keyname)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	written, err := blobs.Write(source)
+	if err == nil && !key.Equals(written) {
+		err = fmt.Errorf("%s expected hash was %v but got %v", corruptedBlobErrorPrefix, key, written)
+	}
+	return err
+}
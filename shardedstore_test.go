@@ -0,0 +1,98 @@
+package blobstore
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestShardedReadsNWrites test that a sharded store does its reads and writes as expected
+func TestShardedReadsNWrites(t *testing.T) {
+	// setup
+	dir := fileBlobs{""}.TmpKeyname(10)
+	dirs := []string{filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "c")}
+	for _, shardDir := range dirs {
+		os.MkdirAll(shardDir, 0700)
+	}
+	// exercise
+	ss := NewFileShardedStore(dirs, crypto.SHA1)
+	readsNWrites(t, ss)
+	listChecks(t, buildExpectedKeys(), ss)
+	// cleanup
+	err := os.RemoveAll(dir)
+	assert(err == nil, t, "Error in cleanup removing %s: %v", dir, err)
+}
+
+// TestShardedRebalance checks blobs are placed on their owners and only the affected ones move
+func TestShardedRebalance(t *testing.T) {
+	// setup
+	ss := NewShardedStore()
+	for _, name := range []string{"a", "b"} {
+		ss.AddShard(name, NewMemBlobServer(crypto.SHA1))
+	}
+	keys := []Key{}
+	for i := 0; i < 50; i++ {
+		key, err := ss.Write(strings.NewReader(fmt.Sprintf("blob #%d", i)))
+		assert(err == nil, t, "Error writing blob #%d: %v", i, err)
+		keys = append(keys, key)
+	}
+	assertPlacement(t, ss, keys)
+	// exercise adding a shard
+	ss.AddShard("c", NewMemBlobServer(crypto.SHA1))
+	moved, err := ss.Rebalance()
+	assert(err == nil, t, "Error rebalancing: %v", err)
+	owned := 0
+	for _, key := range keys {
+		if ss.owner(key).name == "c" {
+			owned++
+		}
+	}
+	assert(moved == owned, t, "Expected %d blobs moved to the new shard but %d were", owned, moved)
+	assertPlacement(t, ss, keys)
+	// exercise removing a shard
+	_, err = ss.RemoveShard("a")
+	assert(err == nil, t, "Error removing shard: %v", err)
+	assertPlacement(t, ss, keys)
+	count := 0
+	for keyOrErr := range ss.List() {
+		assert(keyOrErr.err == nil, t, "Error in List stream: %v", keyOrErr.err)
+		count++
+	}
+	assert(count == len(keys), t, "Expected %d keys listed but got %d", len(keys), count)
+}
+
+// assertPlacement checks all keys are found on their owner shards
+func assertPlacement(t *testing.T, ss *ShardedStore, keys []Key) {
+	for _, key := range keys {
+		owner := ss.owner(key)
+		assert(owner.Exists(owner.Keyname(key)), t, "Blob %v not found in its owner shard %s", key, owner.name)
+		_, err := readBlob(ss, key)
+		assert(err == nil, t, "Error reading %v: %v", key, err)
+	}
+}
+
+// TestShardedFailedRemoval checks a shard is restored when its blobs can not be moved out
+func TestShardedFailedRemoval(t *testing.T) {
+	// setup
+	ss := NewShardedStore()
+	ss.AddShard("a", NewMemBlobServer(crypto.SHA1))
+	keys := []Key{}
+	for i := 0; i < 10; i++ {
+		key, err := ss.Write(strings.NewReader(fmt.Sprintf("blob #%d", i)))
+		assert(err == nil, t, "Error writing blob #%d: %v", i, err)
+		keys = append(keys, key)
+	}
+	ss.AddShard("broken", NewFileBlobServer(fileBlobs{""}.TmpKeyname(10), crypto.SHA1))
+	// exercise
+	_, err := ss.RemoveShard("a")
+	// check
+	assert(err != nil, t, "Expected the removal to fail moving blobs to a broken shard")
+	assert(ss.find("a") >= 0 && !ss.shards[ss.find("a")].draining, t, "Expected shard a to be restored")
+	for _, key := range keys {
+		_, err := readBlob(ss, key)
+		assert(err == nil, t, "Error reading %v: %v", key, err)
+	}
+}
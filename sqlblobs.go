@@ -0,0 +1,323 @@
+package blobstore
+
+import (
+	"crypto"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	sqlChunkSize  = 256 << 10
+	sqlListBatch  = 100
+	sqlWAL        = "PRAGMA journal_mode=WAL"
+	sqlBlobsTable = "CREATE TABLE IF NOT EXISTS blobs (keyname TEXT PRIMARY KEY, size INTEGER NOT NULL) WITHOUT ROWID"
+	sqlChunkTable = "CREATE TABLE IF NOT EXISTS chunks (keyname TEXT NOT NULL, seq INTEGER NOT NULL, " +
+		"data BLOB NOT NULL, PRIMARY KEY (keyname, seq)) WITHOUT ROWID"
+	sqlSelectSize   = "SELECT size FROM blobs WHERE keyname = ?"
+	sqlSelectChunk  = "SELECT data FROM chunks WHERE keyname = ? AND seq = ?"
+	sqlInsertChunk  = "INSERT INTO chunks (keyname, seq, data) VALUES (?, ?, ?)"
+	sqlInsertBlob   = "INSERT OR REPLACE INTO blobs (keyname, size) VALUES (?, ?)"
+	sqlDeleteBlob   = "DELETE FROM blobs WHERE keyname = ?"
+	sqlDeleteChunks = "DELETE FROM chunks WHERE keyname = ?"
+	sqlRenameBlob   = "UPDATE blobs SET keyname = ? WHERE keyname = ?"
+	sqlRenameChunks = "UPDATE chunks SET keyname = ? WHERE keyname = ?"
+	sqlListKeys     = "SELECT keyname FROM blobs WHERE keyname > ? ORDER BY keyname LIMIT ?"
+)
+
+// OpenSQLiteBlobServer opens the SQLite database at path with the given database/sql driver,
+// which must be registered by the caller (e.g. "sqlite3" or "sqlite"), and returns a VFSBlobServer on it
+func OpenSQLiteBlobServer(driver, path string, hash crypto.Hash) (*VFSBlobServer, error) {
+	db, err := sql.Open(driver, path)
+	if err != nil {
+		return nil, err
+	}
+	vbs, err := NewSQLiteBlobServer(db, hash)
+	if err != nil {
+		db.Close()
+	}
+	return vbs, err
+}
+
+// NewSQLiteBlobServer returns a VFSBlobServer on a SQLite database, creating its tables if needed
+func NewSQLiteBlobServer(db *sql.DB, hash crypto.Hash) (*VFSBlobServer, error) {
+	vfs, err := newSQLBlobs(db)
+	if err != nil {
+		return nil, err
+	}
+	return &VFSBlobServer{vfs, hash}, nil
+}
+
+// sqlBlobs is a VirtualFS on a SQLite database, so that a whole store is a single portable file
+//
+// Blobs are rows of the blobs table, keyed by keyname, with their contents split in rows of the chunks
+// table, so large blobs are read and written incrementally, a chunk at a time. A blob row is only
+// inserted once all its chunks are written, so readers never see partial blobs.
+// A blob is written in a single transaction, so an aborted write leaves no chunks behind,
+// and as SQLite has a single writer, writes are queued on a lock instead of failing as busy.
+// The database is switched to WAL mode, so that readers do not block on writers
+type sqlBlobs struct {
+	db     *sql.DB
+	writer sync.Mutex
+}
+
+// newSQLBlobs prepares the database for a sqlBlobs
+func newSQLBlobs(db *sql.DB) (*sqlBlobs, error) {
+	for _, statement := range []string{sqlWAL, sqlBlobsTable, sqlChunkTable} {
+		if _, err := db.Exec(statement); err != nil {
+			return nil, err
+		}
+	}
+	return &sqlBlobs{db: db}, nil
+}
+
+// Open a key contents for reading, chunk by chunk
+func (vfs *sqlBlobs) Open(keyname string) (io.ReadCloser, error) {
+	if !vfs.Exists(keyname) {
+		return nil, fmt.Errorf("Key not found: %s", keyname)
+	}
+	return &sqlReader{db: vfs.db, keyname: keyname}, nil
+}
+
+// Create a key to write its contents, dropping any previous ones, in a transaction committed on Close
+func (vfs *sqlBlobs) Create(keyname string) (io.WriteCloser, error) {
+	vfs.writer.Lock()
+	tx, err := vfs.db.Begin()
+	if err == nil {
+		if err = deleteBlob(tx, keyname); err != nil {
+			tx.Rollback()
+		}
+	}
+	if err != nil {
+		vfs.writer.Unlock()
+		return nil, err
+	}
+	return &sqlWriter{vfs: vfs, tx: tx, keyname: keyname}, nil
+}
+
+// Delete a key & contents
+func (vfs *sqlBlobs) Delete(keyname string) error {
+	return vfs.transaction(func(tx *sql.Tx) error {
+		return deleteBlob(tx, keyname)
+	})
+}
+
+// Does the given key exists?
+func (vfs *sqlBlobs) Exists(keyname string) bool {
+	var size int64
+	return vfs.db.QueryRow(sqlSelectSize, keyname).Scan(&size) == nil
+}
+
+// Size returns a key contents size, from its blob row
+func (vfs *sqlBlobs) Size(keyname string) (int64, error) {
+	var size int64
+	err := vfs.db.QueryRow(sqlSelectSize, keyname).Scan(&size)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("Key not found: %s", keyname)
+	}
+	return size, err
+}
+
+// Rename a key in a single transaction, replacing newkey if present
+func (vfs *sqlBlobs) Rename(oldkey, newkey string) error {
+	return vfs.transaction(func(tx *sql.Tx) error {
+		for _, statement := range []struct {
+			query string
+			args  []interface{}
+		}{
+			{sqlDeleteBlob, []interface{}{newkey}},
+			{sqlDeleteChunks, []interface{}{newkey}},
+			{sqlRenameBlob, []interface{}{newkey, oldkey}},
+			{sqlRenameChunks, []interface{}{newkey, oldkey}},
+		} {
+			if _, err := tx.Exec(statement.query, statement.args...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ListTo lists all present keys in sort order to the keys channel, an index scan a batch at a time
+func (vfs *sqlBlobs) ListTo(keys chan<- KeyOrError, acceptor func(string) Key) bool {
+	return vfs.listAfter(keys, acceptor, "")
+}
+
+// ListAfterTo lists the keys after the given one in sort order, the index scan starts right after it
+func (vfs *sqlBlobs) ListAfterTo(keys chan<- KeyOrError, acceptor func(string) Key, after Key) bool {
+	return vfs.listAfter(keys, acceptor, vfs.Keyname(after))
+}
+
+// listAfter lists the keynames after the given one, a batch at a time
+func (vfs *sqlBlobs) listAfter(keys chan<- KeyOrError, acceptor func(string) Key, after string) bool {
+	for {
+		keynames, err := vfs.keysAfter(after)
+		if err != nil {
+			return failKeyOrError(keys, err)
+		}
+		if len(keynames) == 0 {
+			return true
+		}
+		for _, keyname := range keynames {
+			if key := acceptor(keyname); key != nil {
+				keys <- KeyOrError{key, nil}
+			}
+		}
+		after = keynames[len(keynames)-1]
+	}
+}
+
+// Keyname returns a key name, the hash key is used directly as key name
+func (vfs *sqlBlobs) Keyname(key Key) string {
+	return key.String()
+}
+
+// TmpKeyname returns a temporary keyname
+func (vfs *sqlBlobs) TmpKeyname(size int) string {
+	key := make([]byte, size)
+	rand.Reader.Read(key)
+	return Key(key).String() + tmpSuffix
+}
+
+// keysAfter returns the next batch of keynames after the given one
+func (vfs *sqlBlobs) keysAfter(after string) ([]string, error) {
+	rows, err := vfs.db.Query(sqlListKeys, after, sqlListBatch)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keynames []string
+	for rows.Next() {
+		var keyname string
+		if err := rows.Scan(&keyname); err != nil {
+			return nil, err
+		}
+		keynames = append(keynames, keyname)
+	}
+	return keynames, rows.Err()
+}
+
+// transaction runs fn in a write transaction, committed if fn succeeds
+func (vfs *sqlBlobs) transaction(fn func(tx *sql.Tx) error) error {
+	vfs.writer.Lock()
+	defer vfs.writer.Unlock()
+	tx, err := vfs.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteBlob deletes a blob row & chunks within tx
+func deleteBlob(tx *sql.Tx, keyname string) error {
+	if _, err := tx.Exec(sqlDeleteBlob, keyname); err != nil {
+		return err
+	}
+	_, err := tx.Exec(sqlDeleteChunks, keyname)
+	return err
+}
+
+// sqlReader reads a blob a chunk at a time
+type sqlReader struct {
+	db      *sql.DB
+	keyname string
+	seq     int64
+	chunk   []byte
+	done    bool
+}
+
+// Read the blob, fetching the next chunk when the current one is exhausted
+func (r *sqlReader) Read(buf []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		err := r.db.QueryRow(sqlSelectChunk, r.keyname, r.seq).Scan(&r.chunk)
+		if err == sql.ErrNoRows {
+			r.done = true
+		} else if err != nil {
+			return 0, err
+		}
+		r.seq++
+	}
+	n := copy(buf, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+// Close does nothing, as each chunk is fetched on its own
+func (r *sqlReader) Close() error {
+	return nil
+}
+
+// sqlWriter writes a blob a chunk at a time, and its blob row when closed, all in a transaction
+type sqlWriter struct {
+	vfs     *sqlBlobs
+	tx      *sql.Tx
+	keyname string
+	seq     int64
+	size    int64
+	chunk   []byte
+	err     error
+}
+
+// Write buffers the bytes, inserting each chunk as soon as it is full
+func (w *sqlWriter) Write(buf []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	written := len(buf)
+	for len(buf) > 0 {
+		n := sqlChunkSize - len(w.chunk)
+		if n > len(buf) {
+			n = len(buf)
+		}
+		w.chunk = append(w.chunk, buf[:n]...)
+		buf = buf[n:]
+		if len(w.chunk) == sqlChunkSize {
+			if err := w.flush(); err != nil {
+				return written - len(buf), err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close inserts the last chunk and the blob row and commits, making the blob visible,
+// on any write error the transaction is rolled back instead
+func (w *sqlWriter) Close() error {
+	if w.tx == nil {
+		return w.err
+	}
+	defer w.vfs.writer.Unlock()
+	if len(w.chunk) > 0 && w.err == nil {
+		w.flush()
+	}
+	if w.err == nil {
+		_, w.err = w.tx.Exec(sqlInsertBlob, w.keyname, w.size)
+	}
+	if w.err != nil {
+		w.tx.Rollback()
+	} else {
+		w.err = w.tx.Commit()
+	}
+	w.tx = nil
+	return w.err
+}
+
+// flush inserts the current chunk, any error aborts the whole blob
+func (w *sqlWriter) flush() error {
+	if _, w.err = w.tx.Exec(sqlInsertChunk, w.keyname, w.seq, w.chunk); w.err != nil {
+		return w.err
+	}
+	w.seq++
+	w.size += int64(len(w.chunk))
+	w.chunk = nil
+	return nil
+}
@@ -0,0 +1,83 @@
+//go:build sqlite
+
+package blobstore
+
+import (
+	"crypto"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Tests against a real SQLite, run with: go test -tags sqlite
+
+// TestRealSQLiteReadsNWrites test that the SQLite blobserver does its reads and writes on a real SQLite
+func TestRealSQLiteReadsNWrites(t *testing.T) {
+	// setup
+	db, dir := openRealSQLite(t)
+	defer os.RemoveAll(dir)
+	defer db.Close()
+	vbs, err := NewSQLiteBlobServer(db, crypto.SHA1)
+	assert(err == nil, t, "Error opening the store: %v", err)
+	// exercise
+	readsNWrites(t, vbs)
+	listChecks(t, buildExpectedKeys(), vbs)
+}
+
+// TestRealSQLiteAbortedWrite checks a failed write leaves no chunks behind and parallel writes queue up
+func TestRealSQLiteAbortedWrite(t *testing.T) {
+	// setup
+	db, dir := openRealSQLite(t)
+	defer os.RemoveAll(dir)
+	defer db.Close()
+	vbs, err := NewSQLiteBlobServer(db, crypto.SHA1)
+	assert(err == nil, t, "Error opening the store: %v", err)
+	input := strings.NewReader(strings.Repeat("0123456789", sqlChunkSize/4))
+	failure := errors.New("Broken input")
+	// exercise
+	_, err = vbs.Write(io.MultiReader(input, &failingReader{failure}))
+	assert(errors.Is(err, failure), t, "Expected the input failure but got %v", err)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := vbs.Write(strings.NewReader(strings.Repeat(fmt.Sprintf("blob #%04d", i), sqlChunkSize/4)))
+			assert(err == nil, t, "Error writing blob #%d: %v", i, err)
+		}(i)
+	}
+	wg.Wait()
+	// check
+	var blobs, chunks int
+	err = db.QueryRow("SELECT COUNT(*) FROM blobs").Scan(&blobs)
+	assert(err == nil && blobs == 8, t, "Expected 8 blobs but got %d: %v", blobs, err)
+	err = db.QueryRow("SELECT COUNT(*) FROM chunks").Scan(&chunks)
+	assert(err == nil && chunks == 8*3, t, "Expected %d chunks but got %d: %v", 8*3, chunks, err)
+}
+
+// openRealSQLite opens a SQLite database in a temporary directory
+func openRealSQLite(t *testing.T) (*sql.DB, string) {
+	dir := fileBlobs{""}.TmpKeyname(10)
+	err := os.Mkdir(dir, 0700)
+	assert(err == nil, t, "Error creating %s: %v", dir, err)
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "blobs.db"))
+	assert(err == nil, t, "Error opening the database: %v", err)
+	return db, dir
+}
+
+// failingReader fails with err on every read
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
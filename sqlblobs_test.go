@@ -0,0 +1,165 @@
+package blobstore
+
+import (
+	"crypto"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestSQLiteReadsNWrites test that the SQLite blobserver does its reads and writes as expected
+func TestSQLiteReadsNWrites(t *testing.T) {
+	// setup
+	vbs, err := OpenSQLiteBlobServer(fakeSQLiteDriver, "reads", crypto.SHA1)
+	assert(err == nil, t, "Error opening the store: %v", err)
+	// exercise
+	readsNWrites(t, vbs)
+	listChecks(t, buildExpectedKeys(), vbs)
+}
+
+// TestSQLiteChunks checks blobs bigger than a chunk are written and read back whole
+func TestSQLiteChunks(t *testing.T) {
+	// setup
+	vbs, err := OpenSQLiteBlobServer(fakeSQLiteDriver, "chunks", crypto.SHA1)
+	assert(err == nil, t, "Error opening the store: %v", err)
+	input := strings.Repeat("0123456789", sqlChunkSize/4)
+	// exercise
+	key, err := vbs.Write(strings.NewReader(input))
+	assert(err == nil, t, "Error writing blob: %v", err)
+	blob, err := readBlob(vbs, key)
+	assert(err == nil, t, "Error reading %v: %v", key, err)
+	assert(string(blob) == input, t, "Expected %d bytes but got %d", len(input), len(blob))
+	chunks := fakeSQLiteDBs["chunks"].chunks[vbs.Keyname(key)]
+	assert(len(chunks) == 3, t, "Expected 3 chunks but got %d", len(chunks))
+}
+
+const fakeSQLiteDriver = "fakesqlite"
+
+func init() {
+	sql.Register(fakeSQLiteDriver, fakeSQLite{})
+}
+
+// fakeSQLiteDBs are the fake databases by name
+var fakeSQLiteDBs = map[string]*fakeSQLiteDB{}
+
+// fakeSQLite is a database/sql driver understanding just the statements sqlBlobs uses,
+// so it can be tested without a real SQLite driver
+type fakeSQLite struct{}
+
+// fakeSQLiteDB is a fake database, its tables are maps
+type fakeSQLiteDB struct {
+	lock   sync.Mutex
+	blobs  map[string]int64
+	chunks map[string]map[int64][]byte
+}
+
+// fakeSQLiteStmt is a statement on a fake database
+type fakeSQLiteStmt struct {
+	db    *fakeSQLiteDB
+	query string
+}
+
+// fakeSQLiteRows are query results
+type fakeSQLiteRows struct {
+	values []driver.Value
+}
+
+func (fakeSQLite) Open(name string) (driver.Conn, error) {
+	if _, ok := fakeSQLiteDBs[name]; !ok {
+		fakeSQLiteDBs[name] = &fakeSQLiteDB{blobs: map[string]int64{}, chunks: map[string]map[int64][]byte{}}
+	}
+	return fakeSQLiteDBs[name], nil
+}
+
+func (db *fakeSQLiteDB) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSQLiteStmt{db, query}, nil
+}
+
+func (db *fakeSQLiteDB) Close() error              { return nil }
+func (db *fakeSQLiteDB) Begin() (driver.Tx, error) { return db, nil }
+func (db *fakeSQLiteDB) Commit() error             { return nil }
+func (db *fakeSQLiteDB) Rollback() error           { return nil }
+
+func (stmt *fakeSQLiteStmt) Close() error  { return nil }
+func (stmt *fakeSQLiteStmt) NumInput() int { return -1 }
+
+func (stmt *fakeSQLiteStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db := stmt.db
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	switch stmt.query {
+	case sqlWAL, sqlBlobsTable, sqlChunkTable:
+	case sqlInsertChunk:
+		keyname := args[0].(string)
+		if db.chunks[keyname] == nil {
+			db.chunks[keyname] = map[int64][]byte{}
+		}
+		db.chunks[keyname][args[1].(int64)] = append([]byte{}, args[2].([]byte)...)
+	case sqlInsertBlob:
+		db.blobs[args[0].(string)] = args[1].(int64)
+	case sqlDeleteBlob:
+		delete(db.blobs, args[0].(string))
+	case sqlDeleteChunks:
+		delete(db.chunks, args[0].(string))
+	case sqlRenameBlob:
+		if size, ok := db.blobs[args[1].(string)]; ok {
+			db.blobs[args[0].(string)] = size
+			delete(db.blobs, args[1].(string))
+		}
+	case sqlRenameChunks:
+		if chunks, ok := db.chunks[args[1].(string)]; ok {
+			db.chunks[args[0].(string)] = chunks
+			delete(db.chunks, args[1].(string))
+		}
+	default:
+		return nil, fmt.Errorf("unexpected statement: %s", stmt.query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (stmt *fakeSQLiteStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := stmt.db
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	rows := &fakeSQLiteRows{}
+	switch stmt.query {
+	case sqlSelectSize:
+		if size, ok := db.blobs[args[0].(string)]; ok {
+			rows.values = append(rows.values, size)
+		}
+	case sqlSelectChunk:
+		if chunk, ok := db.chunks[args[0].(string)][args[1].(int64)]; ok {
+			rows.values = append(rows.values, chunk)
+		}
+	case sqlListKeys:
+		keynames := []string{}
+		for keyname := range db.blobs {
+			if keyname > args[0].(string) {
+				keynames = append(keynames, keyname)
+			}
+		}
+		sort.Strings(keynames)
+		for i := 0; i < len(keynames) && i < int(args[1].(int64)); i++ {
+			rows.values = append(rows.values, keynames[i])
+		}
+	default:
+		return nil, fmt.Errorf("unexpected query: %s", stmt.query)
+	}
+	return rows, nil
+}
+
+func (rows *fakeSQLiteRows) Columns() []string { return []string{"value"} }
+func (rows *fakeSQLiteRows) Close() error      { return nil }
+
+func (rows *fakeSQLiteRows) Next(dest []driver.Value) error {
+	if len(rows.values) == 0 {
+		return io.EOF
+	}
+	dest[0], rows.values = rows.values[0], rows.values[1:]
+	return nil
+}
@@ -0,0 +1,213 @@
+package blobstore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultSyncParallelism = 8
+	syncCursorInterval     = 1000
+)
+
+// SyncMode tells which ways Sync copies missing blobs
+type SyncMode int
+
+const (
+	// SyncOneWay copies to dst the src blobs it is missing
+	SyncOneWay SyncMode = iota
+	// SyncBothWays also copies back to src the dst blobs it is missing
+	SyncBothWays
+)
+
+// SyncOptions configures a Sync
+type SyncOptions struct {
+	// Mode is one way, from src to dst, by default
+	Mode SyncMode
+	// Parallelism is the maximum number of blobs copied at once, defaultSyncParallelism if not set
+	Parallelism int
+	// Cursor, if set, persists how far the sync got, so that an interrupted one resumes after it
+	Cursor SyncCursor
+}
+
+// SyncCursor persists the key up to which a Sync is done
+type SyncCursor interface {
+	// Load returns the persisted key, or nil if there is none
+	Load() (Key, error)
+	// Save persists key, or clears the cursor if key is nil
+	Save(key Key) error
+}
+
+// Sync copies the blobs missing on dst from src, or both ways, returning how many were copied.
+// Both sorted lists are merge-joined to find the missing keys, which are copied with up to
+// Parallelism copies at once, each verified on read and checked to get the same key on write.
+// With a Cursor, the keys up to the one persisted are skipped, not even listed by the stores that can list
+// after it, and as copies complete in order the cursor is moved forward every syncCursorInterval keys and
+// on errors; it is cleared once the sync is complete
+func Sync(src, dst BlobStore, options SyncOptions) (int, error) {
+	parallelism := options.Parallelism
+	if parallelism <= 0 {
+		parallelism = defaultSyncParallelism
+	}
+	var after Key
+	if options.Cursor != nil {
+		var err error
+		if after, err = options.Cursor.Load(); err != nil {
+			return 0, err
+		}
+	}
+	progress := &syncProgress{cursor: options.Cursor, keys: make(map[int]Key), done: make(map[int]bool)}
+	slots := make(chan struct{}, parallelism)
+	var copying sync.WaitGroup
+	lists := []<-chan KeyOrError{listAfter(src, after), listAfter(dst, after)}
+	err := joinKeys(lists, func(key Key, present []bool) error {
+		if after != nil && bytes.Compare(key, after) <= 0 {
+			return nil
+		}
+		if err := progress.failed(); err != nil {
+			return err
+		}
+		seq := progress.start(key)
+		from, to := src, dst
+		switch {
+		case present[0] && present[1]:
+			progress.finish(seq, false, nil)
+			return nil
+		case !present[0] && options.Mode != SyncBothWays:
+			progress.finish(seq, false, nil)
+			return nil
+		case !present[0]:
+			from, to = dst, src
+		}
+		slots <- struct{}{}
+		copying.Add(1)
+		go func() {
+			defer copying.Done()
+			err := copyBlob(from, to, key)
+			<-slots
+			progress.finish(seq, true, err)
+		}()
+		return nil
+	})
+	copying.Wait()
+	return progress.end(err)
+}
+
+// syncProgress tracks the copies of a Sync, to move its cursor past the keys done in order
+type syncProgress struct {
+	lock   sync.Mutex
+	cursor SyncCursor
+	keys   map[int]Key  // keys started & not yet below the low watermark, by sequence
+	done   map[int]bool // sequences done above the low watermark
+	next   int
+	low    int
+	saved  int
+	last   Key // the last key below the low watermark
+	copies int
+	err    error
+}
+
+// start registers a key in the sync, returning its sequence
+func (p *syncProgress) start(key Key) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	seq := p.next
+	p.keys[seq] = key
+	p.next++
+	return seq
+}
+
+// finish marks a sequence done, moving the low watermark & cursor forward if possible
+func (p *syncProgress) finish(seq int, copied bool, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err != nil {
+		if p.err == nil {
+			p.err = err
+		}
+		return
+	}
+	if copied {
+		p.copies++
+	}
+	p.done[seq] = true
+	for p.done[p.low] {
+		p.last = p.keys[p.low]
+		delete(p.done, p.low)
+		delete(p.keys, p.low)
+		p.low++
+	}
+	if p.cursor != nil && p.err == nil && p.low-p.saved >= syncCursorInterval {
+		p.err = p.cursor.Save(p.last)
+		p.saved = p.low
+	}
+}
+
+// failed returns the first error of the sync, if any
+func (p *syncProgress) failed() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.err
+}
+
+// end returns the copies done and the first error, clearing the cursor if the sync completed,
+// or moving it as far as it got if not
+func (p *syncProgress) end(err error) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err == nil {
+		err = p.err
+	}
+	if p.cursor == nil {
+		return p.copies, err
+	}
+	if err == nil {
+		return p.copies, p.cursor.Save(nil)
+	}
+	if p.last != nil {
+		p.cursor.Save(p.last)
+	}
+	return p.copies, err
+}
+
+// FileSyncCursor is a SyncCursor persisted as a hex key in a file
+type FileSyncCursor struct {
+	filename string
+}
+
+// NewFileSyncCursor returns a FileSyncCursor on filename, which does not need to exist
+func NewFileSyncCursor(filename string) *FileSyncCursor {
+	return &FileSyncCursor{filename}
+}
+
+// Load returns the key in the file, or nil if there is no file
+func (fsc *FileSyncCursor) Load() (Key, error) {
+	data, err := ioutil.ReadFile(fsc.filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	return Key(key), err
+}
+
+// Save writes key to the file, atomically, or removes the file if key is nil
+func (fsc *FileSyncCursor) Save(key Key) error {
+	if key == nil {
+		if err := os.Remove(fsc.filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	tmpFilename := fsc.filename + tmpSuffix
+	if err := ioutil.WriteFile(tmpFilename, []byte(key.String()+"\n"), defaultPerms); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, fsc.filename)
+}
@@ -0,0 +1,82 @@
+package blobstore
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// failingStore is a BlobStore failing writes once it got the given number of them
+type failingStore struct {
+	BlobStore
+	writes int
+}
+
+// Write fails once the writes left are exhausted
+func (fs *failingStore) Write(blob io.Reader) (Key, error) {
+	if fs.writes == 0 {
+		return nil, fmt.Errorf("Failing write")
+	}
+	fs.writes--
+	return fs.BlobStore.Write(blob)
+}
+
+// unlistable is a BlobPager failing to list all its keys, it can only list them after a given one
+type unlistable struct {
+	BlobPager
+}
+
+func (u unlistable) List() <-chan KeyOrError {
+	keys := make(chan KeyOrError, 1)
+	keys <- KeyOrError{nil, fmt.Errorf("Unexpected full listing")}
+	close(keys)
+	return keys
+}
+
+// TestSync checks one way & bidirectional syncs, their verification and resuming them
+func TestSync(t *testing.T) {
+	// setup
+	src := writeBlobs(t, NewMemBlobAdmin(crypto.SHA1), 10)
+	dst := NewMemBlobServer(crypto.SHA1)
+	for i := 0; i < 3; i++ {
+		_, err := dst.Write(strings.NewReader(fmt.Sprintf("blob #%d", i)))
+		assert(err == nil, t, "Error writing blob: %v", err)
+	}
+	onlyOnDst, err := dst.Write(strings.NewReader("blob only on dst"))
+	assert(err == nil, t, "Error writing blob: %v", err)
+	filename := fileBlobs{""}.TmpKeyname(10)
+	cursor := NewFileSyncCursor(filename)
+	// exercise a sync interrupted by failing writes, then resumed
+	copies, err := Sync(src, &failingStore{dst, 4}, SyncOptions{Parallelism: 1, Cursor: cursor})
+	assert(err != nil && copies == 4, t, "Expected a sync failing after 4 copies but got %d: %v", copies, err)
+	saved, err := cursor.Load()
+	assert(err == nil && saved != nil, t, "Expected a cursor saved but got %v: %v", saved, err)
+	copies, err = Sync(unlistable{src.(BlobPager)}, unlistable{dst}, SyncOptions{Parallelism: 3, Cursor: cursor})
+	assert(err == nil && copies == 3, t, "Expected the sync resumed with 3 copies but got %d: %v", copies, err)
+	saved, err = cursor.Load()
+	assert(err == nil && saved == nil, t, "Expected the cursor cleared but got %v: %v", saved, err)
+	assert(!hasBlob(src, onlyOnDst), t, "Expected a one way sync not to copy back")
+	// a sync both ways
+	copies, err = Sync(src, dst, SyncOptions{Mode: SyncBothWays})
+	assert(err == nil && copies == 1 && hasBlob(src, onlyOnDst), t,
+		"Expected just %v copied back but got %d copies: %v", onlyOnDst, copies, err)
+	copies, err = Sync(dst, src, SyncOptions{Mode: SyncBothWays})
+	assert(err == nil && copies == 0, t, "Expected nothing left to copy but got %d: %v", copies, err)
+	// a corrupted source blob is not copied
+	corrupted := NewMemBlobServer(crypto.SHA1)
+	key, err := corrupted.Write(strings.NewReader("to be corrupted"))
+	assert(err == nil, t, "Error writing blob: %v", err)
+	writer, err := corrupted.Create(corrupted.Keyname(key))
+	assert(err == nil, t, "Error corrupting blob: %v", err)
+	io.WriteString(writer, "corrupted")
+	writer.Close()
+	_, err = Sync(corrupted, NewMemBlobServer(crypto.SHA1), SyncOptions{})
+	assert(err != nil && strings.HasPrefix(err.Error(), corruptedBlobErrorPrefix), t,
+		"Expected a corrupted blob error but got %v", err)
+	// cleanup
+	err = os.RemoveAll(filename)
+	assert(err == nil, t, "Error in cleanup removing %s: %v", filename, err)
+}
@@ -0,0 +1,106 @@
+package blobstore
+
+import (
+	"archive/tar"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+const (
+	tarBlobMode = 0444
+)
+
+// TarOptions configures tar stream exports & imports
+type TarOptions struct {
+	// After resumes an export after the given key, the last one reported by Progress before an interruption
+	After Key
+	// Progress is called, if set, after each blob is exported or imported, with its key and size.
+	// Blobs already present on import are reported too, with a negative size
+	Progress func(key Key, size int64)
+}
+
+// ExportTar writes the blobs with the given keys, or all blobs if keys is nil, to w as a tar stream with an
+// entry per blob named after its key in hex. The stream is deterministic, entries go in key order and carry
+// no timestamps nor owners, so the same blobs always give the same bytes.
+// Entry sizes come from the store if it is a BlobSizer, otherwise each blob is read twice, first to learn its size,
+// so memory use does not grow with it
+func ExportTar(w io.Writer, blobs BlobStore, keys []Key, options TarOptions) error {
+	if keys == nil {
+		for keyOrErr := range blobs.List() {
+			if keyOrErr.err != nil {
+				return keyOrErr.err
+			}
+			keys = append(keys, keyOrErr.key)
+		}
+	}
+	sorted := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if options.After == nil || key.String() > options.After.String() {
+			sorted = append(sorted, key.String())
+		}
+	}
+	sort.Strings(sorted)
+	writer := tar.NewWriter(w)
+	for _, hexKey := range sorted {
+		key, _ := hex.DecodeString(hexKey)
+		size, err := blobSize(blobs, key)
+		if err != nil {
+			return err
+		}
+		header := &tar.Header{Name: hexKey, Mode: tarBlobMode, Size: size, ModTime: time.Unix(0, 0),
+			Typeflag: tar.TypeReg, Format: tar.FormatPAX}
+		if err := writer.WriteHeader(header); err != nil {
+			return err
+		}
+		reader, err := blobs.Read(key)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(writer, reader); err != nil {
+			return err
+		}
+		if options.Progress != nil {
+			options.Progress(key, size)
+		}
+	}
+	return writer.Close()
+}
+
+// ImportTar writes the blobs of a tar stream made by ExportTar to blobs, verifying each gets the key it was
+// named after before it is kept. Blobs already present are skipped, so an interrupted import can be resumed by importing
+// the same stream again. It returns the number of blobs imported
+func ImportTar(r io.Reader, blobs BlobStore, options TarOptions) (int, error) {
+	reader := tar.NewReader(r)
+	imported := 0
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return imported, nil
+		}
+		if err != nil {
+			return imported, err
+		}
+		expectedKey, err := hex.DecodeString(header.Name)
+		if err != nil || header.Typeflag != tar.TypeReg {
+			return imported, fmt.Errorf("Unexpected tar entry %q, expected blobs named after their hex keys", header.Name)
+		}
+		size := int64(-1)
+		if !hasBlob(blobs, expectedKey) {
+			key, err := writeExpected(blobs, reader, Key(expectedKey))
+			if err == nil && !key.Equals(Key(expectedKey)) {
+				err = fmt.Errorf("%s tar entry %s hashes as %v", corruptedBlobErrorPrefix, header.Name, key)
+			}
+			if err != nil {
+				return imported, err
+			}
+			imported++
+			size = header.Size
+		}
+		if options.Progress != nil {
+			options.Progress(Key(expectedKey), size)
+		}
+	}
+}
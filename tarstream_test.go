@@ -0,0 +1,73 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestTarStream checks deterministic exports, verified imports and resuming both
+func TestTarStream(t *testing.T) {
+	// setup
+	blobs := writeBlobs(t, NewMemBlobAdmin(crypto.SHA1), 5)
+	keys := []Key{}
+	for keyOrErr := range blobs.List() {
+		assert(keyOrErr.err == nil, t, "Error in List stream: %v", keyOrErr.err)
+		keys = append(keys, keyOrErr.key)
+	}
+	dir := fileBlobs{""}.TmpKeyname(10)
+	err := os.MkdirAll(dir, defaultPerms)
+	assert(err == nil, t, "Error creating %s: %v", dir, err)
+	files := NewFileBlobServer(dir, crypto.SHA1)
+	// exercise
+	stream, again := &bytes.Buffer{}, &bytes.Buffer{}
+	exported := []Key{}
+	err = ExportTar(stream, blobs, nil, TarOptions{Progress: func(key Key, size int64) {
+		exported = append(exported, key)
+	}})
+	assert(err == nil, t, "Error exporting: %v", err)
+	assert(len(exported) == len(keys), t, "Expected %d blobs exported but got %d", len(keys), len(exported))
+	err = ExportTar(again, blobs, []Key{keys[3], keys[1], keys[0], keys[4], keys[2]}, TarOptions{})
+	assert(err == nil && bytes.Equal(stream.Bytes(), again.Bytes()), t, "Expected the same stream again: %v", err)
+	// an import interrupted half way, then resumed
+	imported, err := ImportTar(bytes.NewReader(stream.Bytes()[:stream.Len()/2+100]), files, TarOptions{})
+	assert(err != nil && imported > 0 && imported < len(keys), t, "Expected a partial import but got %d: %v",
+		imported, err)
+	skipped := 0
+	resumed, err := ImportTar(bytes.NewReader(stream.Bytes()), files, TarOptions{Progress: func(key Key, size int64) {
+		if size < 0 {
+			skipped++
+		}
+	}})
+	assert(err == nil && imported+resumed == len(keys) && skipped == imported, t,
+		"Expected %d more blobs imported and %d skipped but got %d and %d: %v",
+		len(keys)-imported, imported, resumed, skipped, err)
+	for _, key := range keys {
+		assert(hasBlob(files, key), t, "Expected %v imported", key)
+	}
+	// an export resumed after a key
+	stream.Reset()
+	exported = exported[:0]
+	err = ExportTar(stream, blobs, nil, TarOptions{After: keys[1], Progress: func(key Key, size int64) {
+		exported = append(exported, key)
+	}})
+	assert(err == nil && len(exported) == 3 && exported[0].Equals(keys[2]), t,
+		"Expected the export to resume at %v but got %v: %v", keys[2], exported, err)
+	// a tampered entry
+	tampered := bytes.Replace(stream.Bytes(), []byte("blob #"), []byte("blob $"), 1)
+	tiered := NewTieredStore([]BlobStore{NewMemBlobAdmin(crypto.SHA1)}, TieredOptions{})
+	for _, store := range []BlobStore{NewMemBlobServer(crypto.SHA1), tiered} {
+		_, err = ImportTar(bytes.NewReader(tampered), store, TarOptions{})
+		assert(err != nil && strings.HasPrefix(err.Error(), corruptedBlobErrorPrefix), t,
+			"Expected a corrupted blob error but got %v", err)
+		for keyOrErr := range store.List() {
+			assert(keyOrErr.err == nil, t, "Error in List stream: %v", keyOrErr.err)
+			assert(hasBlob(blobs, keyOrErr.key), t, "Expected the tampered blob not kept but found %v", keyOrErr.key)
+		}
+	}
+	// cleanup
+	err = os.RemoveAll(dir)
+	assert(err == nil, t, "Error in cleanup removing %s: %v", dir, err)
+}
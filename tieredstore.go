@@ -0,0 +1,404 @@
+package blobstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+const (
+	defaultFlushQueueSize = 100
+)
+
+// TieredOptions configures how a TieredStore writes its blobs
+type TieredOptions struct {
+	// WriteTiers are the indexes of the tiers written to, all tiers if empty
+	WriteTiers []int
+	// WriteBack writes just to the first of WriteTiers, the rest are written asynchronously
+	WriteBack bool
+	// FlushQueueSize is the number of blobs waiting to be written back before Write blocks
+	FlushQueueSize int
+}
+
+// TieredStore composes several BlobStores in tiers, from the fastest to the slowest
+//
+// Read tries the tiers in order and promotes the blobs found to the upper tiers,
+// Write goes to the configured tiers, List merges all tiers and Remove removes from all BlobAdmin tiers.
+// Write back blobs are kept in memory till written back, so the first write tier may be a cache
+type TieredStore struct {
+	tiers      []BlobStore
+	writeTiers []BlobStore
+	writeBack  bool
+	flushes    chan writeBack
+	lock       sync.Mutex
+	flushed    *sync.Cond // signaled on ts.lock whenever pending drops
+	pending    int
+	queued     map[string][]byte // blobs waiting to be written back, read from here as the first tier may evict them
+	closed     bool
+	flushErr   error
+}
+
+// writeBack is a blob queued to be written back
+type writeBack struct {
+	key  Key
+	blob []byte
+}
+
+// NewTieredStore returns a TieredStore over the given tiers, the first being the fastest.
+// A write back TieredStore must be closed when done with it
+func NewTieredStore(tiers []BlobStore, options TieredOptions) *TieredStore {
+	ts := &TieredStore{tiers: tiers, writeTiers: tiers, writeBack: options.WriteBack, queued: make(map[string][]byte)}
+	ts.flushed = sync.NewCond(&ts.lock)
+	if len(options.WriteTiers) > 0 {
+		ts.writeTiers = make([]BlobStore, 0, len(options.WriteTiers))
+		for _, index := range options.WriteTiers {
+			ts.writeTiers = append(ts.writeTiers, tiers[index])
+		}
+	}
+	if ts.writeBack {
+		queueSize := options.FlushQueueSize
+		if queueSize <= 0 {
+			queueSize = defaultFlushQueueSize
+		}
+		ts.flushes = make(chan writeBack, queueSize)
+		go ts.flusher()
+	}
+	return ts
+}
+
+// Read returns the blob from the first tier that has it, promoting it to the tiers above, or from the write back
+// queue. Promoted blobs are fully read and verified before returning them, a failed promotion does not fail the read
+func (ts *TieredStore) Read(key Key) (io.Reader, error) {
+	if blob := ts.queuedBlob(key); blob != nil {
+		return bytes.NewReader(blob), nil
+	}
+	reader, err := ts.tiers[0].Read(key)
+	if err == nil {
+		return reader, nil
+	}
+	for i, tier := range ts.tiers[1:] {
+		var blob []byte
+		blob, err = readBlob(tier, key)
+		if err != nil {
+			continue
+		}
+		for _, upper := range ts.tiers[:i+1] {
+			upper.Write(bytes.NewReader(blob)) // upper tiers may be full or read only
+		}
+		return bytes.NewReader(blob), nil
+	}
+	return nil, err
+}
+
+// Size returns the size of the blob on the write back queue or the first tier that has it, without promoting it
+func (ts *TieredStore) Size(key Key) (int64, error) {
+	if blob := ts.queuedBlob(key); blob != nil {
+		return int64(len(blob)), nil
+	}
+	var err error
+	for _, tier := range ts.tiers {
+		var size int64
+		if size, err = blobSize(tier, key); err == nil {
+			return size, nil
+		}
+	}
+	return 0, err
+}
+
+// Write stores the blob on the write tiers, or on the first one and queues it for the rest on write back
+func (ts *TieredStore) Write(blob io.Reader) (Key, error) {
+	if !ts.writeBack || len(ts.writeTiers) == 1 {
+		return writeToAll(ts.writeTiers, blob)
+	}
+	data, err := ioutil.ReadAll(blob)
+	if err != nil {
+		return nil, err
+	}
+	ts.lock.Lock()
+	if ts.closed {
+		ts.lock.Unlock()
+		return nil, fmt.Errorf("TieredStore is closed")
+	}
+	ts.pending++
+	ts.lock.Unlock()
+	key, err := ts.writeTiers[0].Write(bytes.NewReader(data))
+	if errors.Is(err, ErrBlobTooLarge) {
+		// a cache first tier may not admit the blob, write it through instead
+		key, err = writeToAll(ts.writeTiers[1:], bytes.NewReader(data))
+		ts.done(nil, nil)
+		return key, err
+	}
+	if err != nil {
+		ts.done(nil, nil)
+		return nil, err
+	}
+	ts.lock.Lock()
+	ts.queued[key.String()] = data
+	ts.lock.Unlock()
+	ts.flushes <- writeBack{key, data}
+	return key, nil
+}
+
+// List returns the sorted and deduplicated keys of all tiers
+func (ts *TieredStore) List() <-chan KeyOrError {
+	lists := make([]<-chan KeyOrError, 0, len(ts.tiers))
+	for _, tier := range ts.tiers {
+		lists = append(lists, tier.List())
+	}
+	return mergeKeys(lists...)
+}
+
+// Remove the given key from all BlobAdmin tiers, waiting for any pending write back first.
+// Write back errors are left for Flush to report
+func (ts *TieredStore) Remove(key Key) error {
+	ts.lock.Lock()
+	ts.wait()
+	ts.lock.Unlock()
+	for _, tier := range ts.tiers {
+		if admin, ok := tier.(BlobAdmin); ok {
+			if err := admin.Remove(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Flush waits for all the pending write backs and returns the first error found writing them back, if any
+func (ts *TieredStore) Flush() error {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.wait()
+	err := ts.flushErr
+	ts.flushErr = nil
+	return err
+}
+
+// Close flushes a write back TieredStore and stops its background flusher, later writes fail
+func (ts *TieredStore) Close() error {
+	if !ts.writeBack {
+		return nil
+	}
+	ts.lock.Lock()
+	if ts.closed {
+		ts.lock.Unlock()
+		return nil
+	}
+	ts.closed = true
+	ts.lock.Unlock()
+	err := ts.Flush()
+	close(ts.flushes)
+	return err
+}
+
+// wait waits, holding ts.lock, for all the pending write backs
+func (ts *TieredStore) wait() {
+	for ts.pending > 0 {
+		ts.flushed.Wait()
+	}
+}
+
+// queuedBlob returns the blob of key if it is waiting to be written back, nil otherwise
+func (ts *TieredStore) queuedBlob(key Key) []byte {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	return ts.queued[key.String()]
+}
+
+// flusher writes back the queued blobs to the write tiers after the first
+func (ts *TieredStore) flusher() {
+	for queued := range ts.flushes {
+		written, err := writeToAll(ts.writeTiers[1:], bytes.NewReader(queued.blob))
+		if err == nil && !queued.key.Equals(written) {
+			err = fmt.Errorf("%s expected hash was %v but got %v", corruptedBlobErrorPrefix, queued.key, written)
+		}
+		ts.done(queued.key, err)
+	}
+}
+
+// done accounts for a finished write back, of key if it was queued, keeping its error, if any, for the next Flush
+func (ts *TieredStore) done(key Key, err error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if key != nil {
+		delete(ts.queued, key.String())
+	}
+	if err != nil && ts.flushErr == nil {
+		ts.flushErr = err
+	}
+	ts.pending--
+	ts.flushed.Broadcast()
+}
+
+// writeToAll writes the blob to all the stores, failing if any of them fails or they disagree on the key.
+// Caches not admitting a blob too large for them do not fail the write, as long as another store took it
+func writeToAll(stores []BlobStore, blob io.Reader) (Key, error) {
+	if len(stores) == 0 {
+		return nil, fmt.Errorf("No stores to write to")
+	}
+	keys, errs := fanoutWrite(stores, blob)
+	var key Key
+	var tooLarge error
+	for i, err := range errs {
+		if errors.Is(err, ErrBlobTooLarge) {
+			tooLarge = err
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if key != nil && !keys[i].Equals(key) {
+			return nil, fmt.Errorf("Stores disagree on the blob key: %v vs %v", key, keys[i])
+		}
+		key = keys[i]
+	}
+	if key == nil {
+		return nil, tooLarge
+	}
+	return key, nil
+}
+
+// fanoutWrite streams the blob to all the stores at once, returning each store's key or error
+func fanoutWrite(stores []BlobStore, blob io.Reader) ([]Key, []error) {
+	keys := make([]Key, len(stores))
+	errs := make([]error, len(stores))
+	fanout := &fanoutWriter{make([]*io.PipeWriter, len(stores)), make([]error, len(stores))}
+	var done sync.WaitGroup
+	for i, store := range stores {
+		reader, writer := io.Pipe()
+		fanout.writers[i] = writer
+		done.Add(1)
+		go func(i int, store BlobStore) {
+			defer done.Done()
+			keys[i], errs[i] = store.Write(reader)
+			// unblock the fanout if the store gave up before the end of the blob
+			reader.CloseWithError(fmt.Errorf("Store stopped reading the blob: %v", errs[i]))
+		}(i, store)
+	}
+	_, err := io.Copy(fanout, blob)
+	for _, writer := range fanout.writers {
+		writer.CloseWithError(err)
+	}
+	done.Wait()
+	for i, err := range fanout.errs {
+		if errs[i] == nil && err != nil {
+			errs[i] = err
+		}
+	}
+	return keys, errs
+}
+
+// fanoutWriter writes to all its writers, dropping the ones that fail
+type fanoutWriter struct {
+	writers []*io.PipeWriter
+	errs    []error
+}
+
+// Write to all still healthy writers, it fails only when all of them failed
+func (fw *fanoutWriter) Write(buf []byte) (int, error) {
+	var lastErr error
+	alive := 0
+	for i, writer := range fw.writers {
+		if fw.errs[i] != nil {
+			continue
+		}
+		if _, err := writer.Write(buf); err != nil {
+			fw.errs[i] = err
+			lastErr = err
+			continue
+		}
+		alive++
+	}
+	if alive == 0 && lastErr != nil {
+		return 0, lastErr
+	}
+	return len(buf), nil
+}
+
+// mergeKeys merges several sorted key lists into a single sorted list without duplicates
+func mergeKeys(lists ...<-chan KeyOrError) <-chan KeyOrError {
+	keys := make(chan KeyOrError)
+	go func() {
+		err := joinKeys(lists, func(key Key, present []bool) error {
+			keys <- KeyOrError{key, nil}
+			return nil
+		})
+		if err != nil {
+			failKeyOrError(keys, err)
+			return
+		}
+		close(keys)
+	}()
+	return keys
+}
+
+// joinKeys merge-joins several sorted key lists calling found once per distinct key,
+// with the lists where it is present. The first error from the lists or found stops the join
+func joinKeys(lists []<-chan KeyOrError, found func(key Key, present []bool) error) error {
+	heads := make([]*KeyOrError, len(lists))
+	next := func(i int) error {
+		keyOrErr, ok := <-lists[i]
+		heads[i] = nil
+		if ok {
+			heads[i] = &keyOrErr
+			return keyOrErr.err
+		}
+		return nil
+	}
+	fail := func(err error) error {
+		drainKeys(lists...)
+		return err
+	}
+	for i := range lists {
+		if err := next(i); err != nil {
+			return fail(err)
+		}
+	}
+	for {
+		var min Key
+		for _, head := range heads {
+			if head != nil && (min == nil || bytes.Compare(head.key, min) < 0) {
+				min = head.key
+			}
+		}
+		if min == nil {
+			return nil
+		}
+		present := make([]bool, len(lists))
+		for i, head := range heads {
+			present[i] = head != nil && head.key.Equals(min)
+		}
+		if err := found(min, present); err != nil {
+			return fail(err)
+		}
+		for i := range lists {
+			if present[i] {
+				if err := next(i); err != nil {
+					return fail(err)
+				}
+			}
+		}
+	}
+}
+
+// drainKeys consumes the rest of the given key lists in the background, so their producers can finish
+func drainKeys(lists ...<-chan KeyOrError) {
+	for _, list := range lists {
+		go func(list <-chan KeyOrError) {
+			for range list {
+			}
+		}(list)
+	}
+}
+
+// readBlob reads a whole blob from store, failing if it was corrupted
+func readBlob(store BlobStore, key Key) ([]byte, error) {
+	reader, err := store.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
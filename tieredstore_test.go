@@ -0,0 +1,147 @@
+package blobstore
+
+import (
+	"crypto"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// TestTieredReadsNWrites test that a write through tiered store does its reads and writes as expected
+func TestTieredReadsNWrites(t *testing.T) {
+	tiers := []BlobStore{NewMemBlobAdmin(crypto.SHA1), NewMemBlobAdmin(crypto.SHA1)}
+	readsNWrites(t, NewTieredStore(tiers, TieredOptions{}))
+}
+
+// TestTieredList test that a tiered store lists the keys of all its tiers just once
+func TestTieredList(t *testing.T) {
+	// setup
+	tiers := []BlobStore{NewMemBlobAdmin(crypto.SHA1), NewMemBlobAdmin(crypto.SHA1)}
+	_, err := tiers[1].Write(strings.NewReader(testData[0].input))
+	assert(err == nil, t, "Error writing blob: %v", err)
+	ts := NewTieredStore(tiers, TieredOptions{})
+	// exercise
+	listChecks(t, buildExpectedKeys(), ts)
+	// check
+	count := 0
+	for range ts.List() {
+		count++
+	}
+	assert(count == len(testData), t, "Expected %d keys listed but got %d", len(testData), count)
+}
+
+// TestTieredPromotion checks blobs found on lower tiers are promoted to the upper tiers
+func TestTieredPromotion(t *testing.T) {
+	// setup
+	tiers := []BlobStore{NewMemBlobAdmin(crypto.SHA1), NewMemBlobAdmin(crypto.SHA1)}
+	ts := NewTieredStore(tiers, TieredOptions{WriteTiers: []int{1}})
+	key, err := ts.Write(strings.NewReader(testData[0].input))
+	assert(err == nil, t, "Error writing blob: %v", err)
+	_, err = tiers[0].Read(key)
+	assert(err != nil, t, "Blob %v should not be in the first tier yet", key)
+	// exercise
+	_, err = ts.Read(key)
+	assert(err == nil, t, "Error reading %v: %v", key, err)
+	// check
+	_, err = tiers[0].Read(key)
+	assert(err == nil, t, "Blob %v was not promoted: %v", key, err)
+}
+
+// TestTieredWriteBack checks blobs are eventually written back to all write tiers
+func TestTieredWriteBack(t *testing.T) {
+	// setup
+	tiers := []BlobStore{NewMemBlobAdmin(crypto.SHA1), NewMemBlobAdmin(crypto.SHA1)}
+	ts := NewTieredStore(tiers, TieredOptions{WriteBack: true})
+	// exercise
+	keys := []Key{}
+	for _, testCase := range testData {
+		key, err := ts.Write(strings.NewReader(testCase.input))
+		assert(err == nil, t, "Error writing blob %s:%s", testCase.expectedHash, err)
+		keys = append(keys, key)
+	}
+	err := ts.Close()
+	assert(err == nil, t, "Error flushing: %v", err)
+	// check
+	for _, key := range keys {
+		_, err = tiers[1].Read(key)
+		assert(err == nil, t, "Blob %v was not written back: %v", key, err)
+	}
+}
+
+// TestTieredWriteBackCache checks write back survives a cache first tier evicting or rejecting the blobs
+func TestTieredWriteBackCache(t *testing.T) {
+	// setup
+	tiers := []BlobStore{NewCacheBlobServer(crypto.SHA1, 10, 0), NewMemBlobAdmin(crypto.SHA1)}
+	ts := NewTieredStore(tiers, TieredOptions{WriteBack: true})
+	// exercise
+	keys := []Key{}
+	for _, input := range []string{"12345", "abcde", "ABCDE", "too big for the cache"} {
+		key, err := ts.Write(strings.NewReader(input))
+		assert(err == nil, t, "Error writing blob %q: %v", input, err)
+		keys = append(keys, key)
+	}
+	err := ts.Close()
+	assert(err == nil, t, "Error flushing: %v", err)
+	// check
+	for _, key := range keys {
+		_, err = tiers[1].Read(key)
+		assert(err == nil, t, "Blob %v was not written back: %v", key, err)
+		_, err = ts.Read(key)
+		assert(err == nil, t, "Error reading %v despite a failed promotion: %v", key, err)
+	}
+	_, err = ts.Write(strings.NewReader("after close"))
+	assert(err != nil, t, "Expected writes to fail after Close")
+}
+
+// TestTieredWriteBackEviction checks blobs evicted from a cache first tier are read while waiting to be written back
+func TestTieredWriteBackEviction(t *testing.T) {
+	// setup
+	blocked := &blockedStore{NewMemBlobAdmin(crypto.SHA1), make(chan struct{})}
+	ts := NewTieredStore([]BlobStore{NewCacheBlobServer(crypto.SHA1, 10, 0), blocked}, TieredOptions{WriteBack: true})
+	keys := []Key{}
+	for _, input := range []string{"12345", "abcde", "ABCDE"} {
+		key, err := ts.Write(strings.NewReader(input))
+		assert(err == nil, t, "Error writing blob %q: %v", input, err)
+		keys = append(keys, key)
+	}
+	// exercise
+	blob, err := readBlob(ts, keys[0])
+	size, sizeErr := ts.Size(keys[0])
+	// check
+	assert(err == nil && string(blob) == "12345", t, "Expected the evicted blob read back but got '%s': %v", blob, err)
+	assert(sizeErr == nil && size == 5, t, "Expected the evicted blob size 5 but got %d: %v", size, sizeErr)
+	close(blocked.release)
+	err = ts.Close()
+	assert(err == nil, t, "Error flushing: %v", err)
+	blob, err = readBlob(ts, keys[0])
+	assert(err == nil && string(blob) == "12345", t, "Expected the written back blob but got '%s': %v", blob, err)
+}
+
+// blockedStore is a BlobStore whose writes wait to be released
+type blockedStore struct {
+	BlobStore
+	release chan struct{}
+}
+
+func (bs *blockedStore) Write(blob io.Reader) (Key, error) {
+	<-bs.release
+	return bs.BlobStore.Write(blob)
+}
+
+// TestTieredWriteBackErrors checks write back errors are kept for Flush, not taken by Remove
+func TestTieredWriteBackErrors(t *testing.T) {
+	// setup
+	readOnly := NewFSBlobServer(fstest.MapFS{}, crypto.SHA1, FileLayout)
+	ts := NewTieredStore([]BlobStore{NewMemBlobAdmin(crypto.SHA1), readOnly}, TieredOptions{WriteBack: true})
+	key, err := ts.Write(strings.NewReader(testData[0].input))
+	assert(err == nil, t, "Error writing blob: %v", err)
+	// exercise & check
+	err = ts.Remove(key)
+	assert(errors.Is(err, ErrReadOnly), t, "Expected the read only tier to refuse the removal but got %v", err)
+	err = ts.Flush()
+	assert(errors.Is(err, ErrReadOnly), t, "Expected the write back error from Flush but got %v", err)
+	err = ts.Close()
+	assert(err == nil, t, "Expected the write back error to be reported once but got %v", err)
+}
@@ -0,0 +1,304 @@
+package blobstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	treeHeader = "blobstore tree v1\n"
+	treeModes  = fs.ModeDir | fs.ModeSymlink | fs.ModePerm
+)
+
+// TreeEntry is an entry of a directory tree: a file with its contents blob, a symlink with its target blob
+// or a directory with its tree blob. Symlinks have no modification time
+type TreeEntry struct {
+	Name    string
+	Mode    fs.FileMode // permissions & the directory or symlink type bits, if any
+	ModTime time.Time
+	Key     Key
+}
+
+// TreeChange is a difference between two trees, Old is nil for additions and New is nil for removals
+type TreeChange struct {
+	Path string
+	Old  *TreeEntry
+	New  *TreeEntry
+}
+
+// EncodeTree returns the canonical tree blob of the given entries, a header line followed by
+// a line per entry, sorted by name, with its octal mode, modification unix nanoseconds, hex key & quoted name
+func EncodeTree(entries []TreeEntry) ([]byte, error) {
+	sorted := append([]TreeEntry{}, entries...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	tree := bytes.NewBufferString(treeHeader)
+	for i, entry := range sorted {
+		if err := checkTreeEntry(entry); err != nil {
+			return nil, err
+		}
+		if i > 0 && sorted[i-1].Name == entry.Name {
+			return nil, fmt.Errorf("Duplicated tree entry %q", entry.Name)
+		}
+		fmt.Fprintf(tree, "%o %d %s %s\n", uint32(entry.Mode), entry.ModTime.UnixNano(), entry.Key,
+			strconv.Quote(entry.Name))
+	}
+	return tree.Bytes(), nil
+}
+
+// DecodeTree returns the entries of a tree blob, failing if it is not canonical
+func DecodeTree(tree []byte) ([]TreeEntry, error) {
+	if !bytes.HasPrefix(tree, []byte(treeHeader)) {
+		return nil, fmt.Errorf("Not a tree blob")
+	}
+	entries := []TreeEntry{}
+	scanner := bufio.NewScanner(bytes.NewReader(tree[len(treeHeader):]))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 4)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("Wrong tree line %q", scanner.Text())
+		}
+		mode, modeErr := strconv.ParseUint(fields[0], 8, 32)
+		nanos, nanosErr := strconv.ParseInt(fields[1], 10, 64)
+		key, keyErr := hex.DecodeString(fields[2])
+		name, nameErr := strconv.Unquote(fields[3])
+		if modeErr != nil || nanosErr != nil || keyErr != nil || nameErr != nil {
+			return nil, fmt.Errorf("Wrong tree line %q", scanner.Text())
+		}
+		entries = append(entries, TreeEntry{name, fs.FileMode(mode), time.Unix(0, nanos), Key(key)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	canonical, err := EncodeTree(entries)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(canonical, tree) {
+		return nil, fmt.Errorf("Tree blob is not canonical")
+	}
+	return entries, nil
+}
+
+// checkTreeEntry fails entries which could not be checked out safely
+func checkTreeEntry(entry TreeEntry) error {
+	if entry.Name == "" || entry.Name == "." || entry.Name == ".." || strings.ContainsAny(entry.Name, "/\x00") ||
+		(os.PathSeparator != '/' && strings.ContainsRune(entry.Name, os.PathSeparator)) {
+		return fmt.Errorf("Wrong tree entry name %q", entry.Name)
+	}
+	if entry.Mode&^treeModes != 0 || entry.Mode&(fs.ModeDir|fs.ModeSymlink) == fs.ModeDir|fs.ModeSymlink {
+		return fmt.Errorf("Wrong tree entry %q mode %v", entry.Name, entry.Mode)
+	}
+	if len(entry.Key) == 0 {
+		return fmt.Errorf("Tree entry %q has no key", entry.Name)
+	}
+	return nil
+}
+
+// CommitTree writes the directory at dir into blobs, recursively, returning the key of its tree blob.
+// Regular files, symlinks & directories are supported, any other file type fails the commit
+func CommitTree(blobs BlobStore, dir string) (Key, error) {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]TreeEntry, 0, len(fileInfos))
+	for _, fileInfo := range fileInfos {
+		filename := filepath.Join(dir, fileInfo.Name())
+		entry := TreeEntry{Name: fileInfo.Name(), Mode: fileInfo.Mode() & treeModes, ModTime: fileInfo.ModTime()}
+		switch fileInfo.Mode().Type() {
+		case fs.ModeDir:
+			entry.Key, err = CommitTree(blobs, filename)
+		case fs.ModeSymlink:
+			var target string
+			entry.ModTime = time.Unix(0, 0) // symlink times can not be set on checkout, so they are not kept
+			if target, err = os.Readlink(filename); err == nil {
+				entry.Key, err = blobs.Write(strings.NewReader(target))
+			}
+		case 0:
+			entry.Key, err = writeFile(blobs, filename)
+		default:
+			err = fmt.Errorf("Unsupported file type %v of %s", fileInfo.Mode().Type(), filename)
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	tree, err := EncodeTree(entries)
+	if err != nil {
+		return nil, err
+	}
+	return blobs.Write(bytes.NewReader(tree))
+}
+
+// writeFile writes the contents of a file into blobs
+func writeFile(blobs BlobStore, filename string) (Key, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return blobs.Write(file)
+}
+
+// CheckoutTree writes the tree with the given key from blobs at dir, recursively, creating dir if needed.
+// Existing files & symlinks in the way, of files or directories, are replaced, other existing files are left alone
+func CheckoutTree(blobs BlobStore, key Key, dir string) error {
+	entries, err := readTree(blobs, key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, defaultPerms); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		filename := filepath.Join(dir, entry.Name)
+		switch entry.Mode.Type() {
+		case fs.ModeDir:
+			// a symlink in the way would be followed, writing the subtree outside dir
+			if err = removeFile(filename); err == nil {
+				err = CheckoutTree(blobs, entry.Key, filename)
+			}
+			if err == nil {
+				err = os.Chmod(filename, entry.Mode.Perm())
+			}
+		case fs.ModeSymlink:
+			var target []byte
+			if target, err = readBlob(blobs, entry.Key); err == nil {
+				if err = removeFile(filename); err == nil {
+					err = os.Symlink(string(target), filename)
+				}
+			}
+		default:
+			err = checkoutFile(blobs, entry, filename)
+		}
+		if err == nil && entry.Mode.Type() != fs.ModeSymlink {
+			err = os.Chtimes(filename, entry.ModTime, entry.ModTime)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkoutFile writes a file entry contents & permissions
+func checkoutFile(blobs BlobStore, entry TreeEntry, filename string) error {
+	blob, err := blobs.Read(entry.Key)
+	if err != nil {
+		return err
+	}
+	if err := removeFile(filename); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, entry.Mode.Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, blob)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(filename, entry.Mode.Perm())
+	}
+	return err
+}
+
+// removeFile removes a file or symlink in the way of a checkout, if any
+func removeFile(filename string) error {
+	fileInfo, err := os.Lstat(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err == nil && !fileInfo.IsDir() {
+		err = os.Remove(filename)
+	}
+	return err
+}
+
+// DiffTrees returns the changes from the tree with key a to the tree with key b, sorted by path.
+// Subtrees with the same key are skipped, so the cost follows the changes, not the trees size.
+// Directories are only reported when their permissions change or they replace or are replaced by files.
+// A nil key is an empty tree
+func DiffTrees(blobs BlobStore, a, b Key) ([]TreeChange, error) {
+	changes := []TreeChange{}
+	err := diffTrees(blobs, a, b, "", &changes)
+	return changes, err
+}
+
+// diffTrees appends the changes between the trees a & b at dir to changes
+func diffTrees(blobs BlobStore, a, b Key, dir string, changes *[]TreeChange) error {
+	if a.Equals(b) {
+		return nil
+	}
+	oldEntries, err := readTree(blobs, a)
+	if err != nil {
+		return err
+	}
+	newEntries, err := readTree(blobs, b)
+	if err != nil {
+		return err
+	}
+	i, j := 0, 0
+	for i < len(oldEntries) || j < len(newEntries) {
+		var before, after *TreeEntry
+		switch {
+		case j == len(newEntries) || (i < len(oldEntries) && oldEntries[i].Name < newEntries[j].Name):
+			before = &oldEntries[i]
+			i++
+		case i == len(oldEntries) || oldEntries[i].Name > newEntries[j].Name:
+			after = &newEntries[j]
+			j++
+		default:
+			before, after = &oldEntries[i], &newEntries[j]
+			i++
+			j++
+		}
+		if before != nil && after != nil && before.Mode.IsDir() && after.Mode.IsDir() {
+			if before.Mode != after.Mode {
+				*changes = append(*changes, TreeChange{path.Join(dir, after.Name), before, after})
+			}
+			if err := diffTrees(blobs, before.Key, after.Key, path.Join(dir, after.Name), changes); err != nil {
+				return err
+			}
+			continue
+		}
+		if before != nil && after != nil && before.Mode == after.Mode && before.ModTime.Equal(after.ModTime) &&
+			before.Key.Equals(after.Key) {
+			continue
+		}
+		change := TreeChange{Old: before, New: after}
+		if before != nil {
+			change.Path = path.Join(dir, before.Name)
+		} else {
+			change.Path = path.Join(dir, after.Name)
+		}
+		*changes = append(*changes, change)
+	}
+	return nil
+}
+
+// readTree reads & decodes a tree blob, a nil key being an empty tree
+func readTree(blobs BlobStore, key Key) ([]TreeEntry, error) {
+	if key == nil {
+		return nil, nil
+	}
+	tree, err := readBlob(blobs, key)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeTree(tree)
+}
@@ -0,0 +1,97 @@
+package blobstore
+
+import (
+	"crypto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestTrees checks directory trees commit, checkout & diff
+func TestTrees(t *testing.T) {
+	// setup
+	root, err := ioutil.TempDir("", "trees")
+	assert(err == nil, t, "Error creating temp dir: %v", err)
+	source, target := filepath.Join(root, "source"), filepath.Join(root, "target")
+	mtime := time.Unix(1500000000, 123456789)
+	for name, contents := range map[string]string{
+		"a.txt": "file a", "run.sh": "#!/bin/sh", "sub/b.txt": "file b", "sub/deeper/c.txt": "file c",
+	} {
+		filename := filepath.Join(source, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(filename), defaultPerms)
+		assert(err == nil, t, "Error creating dir: %v", err)
+		err = ioutil.WriteFile(filename, []byte(contents), 0640)
+		assert(err == nil, t, "Error writing %s: %v", name, err)
+		err = os.Chtimes(filename, mtime, mtime)
+		assert(err == nil, t, "Error setting %s times: %v", name, err)
+	}
+	err = os.Chmod(filepath.Join(source, "run.sh"), 0750)
+	assert(err == nil, t, "Error changing mode: %v", err)
+	err = os.Mkdir(filepath.Join(source, "empty"), 0700)
+	assert(err == nil, t, "Error creating dir: %v", err)
+	err = os.Symlink("sub/b.txt", filepath.Join(source, "link"))
+	assert(err == nil, t, "Error creating symlink: %v", err)
+	blobs := NewMemBlobAdmin(crypto.SHA256)
+	// exercise commit & checkout
+	key, err := CommitTree(blobs, source)
+	assert(err == nil, t, "Error committing tree: %v", err)
+	again, err := CommitTree(blobs, source)
+	assert(err == nil && again.Equals(key), t, "Expected the same tree key %v again but got %v: %v", key, again, err)
+	err = CheckoutTree(blobs, key, target)
+	assert(err == nil, t, "Error checking out tree: %v", err)
+	contents, err := ioutil.ReadFile(filepath.Join(target, "sub", "deeper", "c.txt"))
+	assert(err == nil && string(contents) == "file c", t, "Unexpected checked out contents '%s': %v", contents, err)
+	info, err := os.Stat(filepath.Join(target, "run.sh"))
+	assert(err == nil && info.Mode().Perm() == 0750 && info.ModTime().Equal(mtime), t,
+		"Unexpected checked out mode & time %v %v: %v", info.Mode(), info.ModTime(), err)
+	link, err := os.Readlink(filepath.Join(target, "link"))
+	assert(err == nil && link == "sub/b.txt", t, "Unexpected checked out symlink %s: %v", link, err)
+	checkedOut, err := CommitTree(blobs, target)
+	assert(err == nil && checkedOut.Equals(key), t, "Expected the checkout to commit as %v but got %v: %v",
+		key, checkedOut, err)
+	// a symlink in the way of a directory is replaced, not followed
+	outside, escaped := filepath.Join(root, "outside"), filepath.Join(root, "escaped")
+	err = os.Mkdir(outside, defaultPerms)
+	assert(err == nil, t, "Error creating dir: %v", err)
+	err = os.MkdirAll(escaped, defaultPerms)
+	assert(err == nil, t, "Error creating dir: %v", err)
+	err = os.Symlink("../outside", filepath.Join(escaped, "sub"))
+	assert(err == nil, t, "Error creating symlink: %v", err)
+	err = CheckoutTree(blobs, key, escaped)
+	assert(err == nil, t, "Error checking out tree over a symlink: %v", err)
+	written, _ := filepath.Glob(filepath.Join(outside, "*"))
+	assert(len(written) == 0, t, "Expected nothing written outside the checkout but got %v", written)
+	info, err = os.Lstat(filepath.Join(escaped, "sub"))
+	assert(err == nil && info.IsDir(), t, "Expected the symlink replaced by a directory but got %v: %v", info, err)
+	// exercise diff
+	err = ioutil.WriteFile(filepath.Join(target, "sub", "b.txt"), []byte("file b changed"), 0640)
+	assert(err == nil, t, "Error changing file: %v", err)
+	err = ioutil.WriteFile(filepath.Join(target, "d.txt"), []byte("file d"), 0640)
+	assert(err == nil, t, "Error adding file: %v", err)
+	err = os.Remove(filepath.Join(target, "link"))
+	assert(err == nil, t, "Error removing symlink: %v", err)
+	changed, err := CommitTree(blobs, target)
+	assert(err == nil, t, "Error committing changed tree: %v", err)
+	changes, err := DiffTrees(blobs, key, changed)
+	assert(err == nil && len(changes) == 3, t, "Expected 3 changes but got %v: %v", changes, err)
+	assert(changes[0].Path == "d.txt" && changes[0].Old == nil && changes[0].New != nil, t, "Expected d.txt added")
+	assert(changes[1].Path == "link" && changes[1].Old != nil && changes[1].New == nil, t, "Expected link removed")
+	assert(changes[2].Path == "sub/b.txt" && changes[2].Old != nil && changes[2].New != nil, t,
+		"Expected sub/b.txt modified")
+	changes, err = DiffTrees(blobs, nil, key)
+	assert(err == nil && len(changes) == 5, t, "Expected 5 entries added from nothing but got %v: %v", changes, err)
+	// exercise canonical encoding checks
+	_, err = EncodeTree([]TreeEntry{{Name: "../escape", Key: key}})
+	assert(err != nil, t, "Expected an escaping name to be rejected")
+	tree, err := EncodeTree([]TreeEntry{{Name: "b", Key: key}, {Name: "a", Key: key}})
+	assert(err == nil, t, "Error encoding tree: %v", err)
+	entries, err := DecodeTree(tree)
+	assert(err == nil && len(entries) == 2 && entries[0].Name == "a", t, "Unexpected entries %v: %v", entries, err)
+	_, err = DecodeTree(append(tree, '\n'))
+	assert(err != nil, t, "Expected a non canonical tree to be rejected")
+	// cleanup
+	err = os.RemoveAll(root)
+	assert(err == nil, t, "Error in cleanup removing %s: %v", root, err)
+}
@@ -1,12 +1,20 @@
 package blobstore
 
 import (
+	"bytes"
 	"crypto"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"io/ioutil"
+	"strings"
 )
 
+// ErrInvalidKey is returned for keys not as long as the store hash
+var ErrInvalidKey = errors.New("Invalid hash key")
+
 // VFSBlobServer implements a generic BlobServer on a Virtual Filesystem (VirtualFS)
 type VFSBlobServer struct {
 	VirtualFS
@@ -33,11 +41,25 @@ type VirtualFS interface {
 	TmpKeyname(size int) string
 }
 
+// sizer is a VirtualFS that knows the size of a keyname contents without reading them
+type sizer interface {
+	Size(keyname string) (int64, error)
+}
+
+// readOnly is a VirtualFS that can tell whether it is read only, so removals are refused even for missing keys
+type readOnly interface {
+	ReadOnly() bool
+}
+
+// afterLister is a VirtualFS that can start its listing after a given key, skipping the keys before it
+type afterLister interface {
+	ListAfterTo(keys chan<- KeyOrError, acceptor func(string) Key, after Key) bool
+}
+
 // Read retrieves a reader for the given blob from the file system
 func (vbs *VFSBlobServer) Read(key Key) (io.Reader, error) {
-	if len(key) < vbs.hash.Size() {
-		return nil, fmt.Errorf("Expected a %d bytes long hash key, but got just %dbytes in %v",
-			vbs.hash.Size(), len(key), key)
+	if err := vbs.checkKey(key); err != nil {
+		return nil, err
 	}
 	file, err := vbs.Open(vbs.Keyname(key))
 	if err != nil {
@@ -48,25 +70,52 @@ func (vbs *VFSBlobServer) Read(key Key) (io.Reader, error) {
 
 // Write stores the bytes from the given reader to the file system and returns the matching hash key
 func (vbs *VFSBlobServer) Write(blob io.Reader) (Key, error) {
+	tmpKeyname, key, err := vbs.spool(blob)
+	if err != nil {
+		return nil, err
+	}
+	return key, vbs.commit(tmpKeyname, key)
+}
+
+// spool writes the blob to a temporary keyname, returning it along with the blob hash key
+func (vbs *VFSBlobServer) spool(blob io.Reader) (string, Key, error) {
 	tmpKeyname := vbs.TmpKeyname(vbs.hash.Size())
 	newblob, err := vbs.Create(tmpKeyname)
-	if err == nil {
-		defer newblob.Close()
-		hasher := vbs.hash.New()
-		_, err := io.Copy(io.MultiWriter(newblob, hasher), blob)
-		if err == nil {
-			key := Key(hasher.Sum(nil))
-			keyname := vbs.Keyname(key)
-			if vbs.Exists(keyname) {
-				// no need to keep to copies of the same bytes
-				err = vbs.Delete(tmpKeyname)
-			} else {
-				err = vbs.Rename(tmpKeyname, keyname)
-			}
-			return key, err
-		}
+	if err != nil {
+		return "", nil, err
+	}
+	hasher := vbs.hash.New()
+	_, err = io.Copy(io.MultiWriter(newblob, hasher), blob)
+	if closeErr := newblob.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		vbs.Delete(tmpKeyname)
+		return "", nil, err
+	}
+	return tmpKeyname, Key(hasher.Sum(nil)), nil
+}
+
+// writeChecked writes a blob only if it hashes as expected, returning the key it hashes as either way
+func (vbs *VFSBlobServer) writeChecked(blob io.Reader, expected Key) (Key, error) {
+	tmpKeyname, key, err := vbs.spool(blob)
+	if err != nil {
+		return nil, err
+	}
+	if !key.Equals(expected) {
+		return key, vbs.Delete(tmpKeyname)
+	}
+	return key, vbs.commit(tmpKeyname, key)
+}
+
+// commit places a spooled blob at its final keyname
+func (vbs *VFSBlobServer) commit(tmpKeyname string, key Key) error {
+	keyname := vbs.Keyname(key)
+	if vbs.Exists(keyname) {
+		// no need to keep to copies of the same bytes
+		return vbs.Delete(tmpKeyname)
 	}
-	return nil, err
+	return vbs.Rename(tmpKeyname, keyname)
 }
 
 // List returns list of stored keys via a channel
@@ -82,8 +131,54 @@ func (vbs *VFSBlobServer) List() <-chan KeyOrError {
 	return keys
 }
 
-// Remove the given key, returns an error is something goes wrong (if the key is not present it does NOT complain)
+// ListAfter returns the stored keys sorting after the given one via a channel,
+// the listing starts right at it when the VirtualFS can, otherwise the keys before it are skipped
+func (vbs *VFSBlobServer) ListAfter(after Key) <-chan KeyOrError {
+	keys := make(chan KeyOrError)
+	go func() {
+		var listed bool
+		if lister, ok := vbs.VirtualFS.(afterLister); ok {
+			listed = lister.ListAfterTo(keys, vbs.acceptor, after)
+		} else {
+			listed = vbs.ListTo(keys, func(name string) Key {
+				if key := vbs.acceptor(name); key != nil && bytes.Compare(key, after) > 0 {
+					return key
+				}
+				return nil
+			})
+		}
+		if listed {
+			close(keys)
+		}
+	}()
+	return keys
+}
+
+// Size returns the size of a blob, as known by the VirtualFS or by reading it through
+func (vbs *VFSBlobServer) Size(key Key) (int64, error) {
+	if err := vbs.checkKey(key); err != nil {
+		return 0, err
+	}
+	if sizer, ok := vbs.VirtualFS.(sizer); ok {
+		return sizer.Size(vbs.Keyname(key))
+	}
+	file, err := vbs.Open(vbs.Keyname(key))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return io.Copy(ioutil.Discard, file)
+}
+
+// Remove the given key, returns an error is something goes wrong (if the key is not present it does NOT complain),
+// read only stores always complain
 func (vbs *VFSBlobServer) Remove(key Key) (err error) {
+	if vfs, ok := vbs.VirtualFS.(readOnly); ok && vfs.ReadOnly() {
+		return ErrReadOnly
+	}
+	if err := vbs.checkKey(key); err != nil {
+		return err
+	}
 	keyname := vbs.Keyname(key)
 	if vbs.Exists(keyname) {
 		err = vbs.Delete(keyname)
@@ -91,6 +186,25 @@ func (vbs *VFSBlobServer) Remove(key Key) (err error) {
 	return err
 }
 
+// has tells whether a key is stored, invalid keys never are
+func (vbs *VFSBlobServer) has(key Key) bool {
+	return vbs.checkKey(key) == nil && vbs.Exists(vbs.Keyname(key))
+}
+
+// checkKey fails keys not as long as the hash
+func (vbs *VFSBlobServer) checkKey(key Key) error {
+	return checkKeySize(vbs.hash, key)
+}
+
+// checkKeySize fails keys not as long as the hash, with an ErrInvalidKey
+func checkKeySize(hash crypto.Hash, key Key) error {
+	if len(key) != hash.Size() {
+		return fmt.Errorf("%w: expected a %d bytes long hash key, but got %d bytes in %v",
+			ErrInvalidKey, hash.Size(), len(key), key)
+	}
+	return nil
+}
+
 // acceptor knows how to accept and transform valid key names to keys
 func (vbs *VFSBlobServer) acceptor(name string) Key {
 	// try to decode to binary from hex string
@@ -108,3 +222,67 @@ func failKeyOrError(keys chan<- KeyOrError, err error) bool {
 	close(keys)
 	return false
 }
+
+// IsCorrupted tells whether err is a corrupted blob error, as opposed to failing to read the blob
+func IsCorrupted(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), corruptedBlobErrorPrefix)
+}
+
+// isNotFound tells whether err is a missing key error, from a VirtualFS or the os
+func isNotFound(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || strings.HasPrefix(err.Error(), "Key not found")
+}
+
+// hasBlob tells whether blobs has a key, directly on its VirtualFS if it has one
+func hasBlob(blobs BlobStore, key Key) bool {
+	if vfs, ok := blobs.(interface{ has(key Key) bool }); ok {
+		return vfs.has(key)
+	}
+	_, err := blobs.Read(key)
+	return err == nil
+}
+
+// writeExpected writes a blob to blobs if it hashes as expected, returning the key it hashes as either way.
+// Stores spooling blobs check it before committing them, others have a mismatched blob removed if they can
+func writeExpected(blobs BlobStore, blob io.Reader, expected Key) (Key, error) {
+	if vfs, ok := blobs.(interface {
+		writeChecked(blob io.Reader, expected Key) (Key, error)
+	}); ok {
+		return vfs.writeChecked(blob, expected)
+	}
+	key, err := blobs.Write(blob)
+	if err == nil && !key.Equals(expected) {
+		if admin, ok := blobs.(BlobAdmin); ok {
+			err = admin.Remove(key)
+		}
+	}
+	return key, err
+}
+
+// checkKey fails keys blobs can not hold, as far as blobs can tell
+func checkKey(blobs BlobStore, key Key) error {
+	if vfs, ok := blobs.(interface{ checkKey(key Key) error }); ok {
+		return vfs.checkKey(key)
+	}
+	return nil
+}
+
+// blobSize returns the size of a blob, from blobs if it knows it, or by reading it
+func blobSize(blobs BlobStore, key Key) (int64, error) {
+	if sizer, ok := blobs.(BlobSizer); ok {
+		return sizer.Size(key)
+	}
+	reader, err := blobs.Read(key)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(ioutil.Discard, reader)
+}
+
+// listAfter lists the keys of blobs after the given one if blobs can, otherwise it lists them all
+func listAfter(blobs BlobStore, after Key) <-chan KeyOrError {
+	if pager, ok := blobs.(BlobPager); ok {
+		return pager.ListAfter(after)
+	}
+	return blobs.List()
+}